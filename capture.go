@@ -0,0 +1,346 @@
+package dicompot
+
+// This file records what goes over each connection into a pcap file of its
+// own, named after the session ID, for the analysis of tooling the logs
+// don't do justice to. Only the TCP payloads are seen, so the packets are
+// made up around them: a handshake, one segment per read or write, and a
+// teardown, with consistent sequence numbers so that Wireshark reassembles
+// the stream.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LINKTYPE_RAW: packets start with the IPv4 or IPv6 header.
+const pcapLinkTypeRaw = 101
+
+// The TCP payload of each segment written, at most.
+const captureSegmentSize = 32768
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// Capture records the connections of a provider into pcap files.
+type Capture struct {
+	// Dir is where the files are written, as "<session ID>.pcap".
+	Dir string
+
+	// MaxFileSize is the size of a file past which the rest of the
+	// connection isn't recorded. If 0, there is no limit.
+	MaxFileSize int64
+
+	// MaxTotalSize is the size of all the files in Dir that are kept. The
+	// oldest ones are deleted beyond that when a connection starts. If 0,
+	// they are all kept.
+	MaxTotalSize int64
+
+	mu sync.Mutex
+}
+
+// enforceRetention deletes the oldest captures of c.Dir until they fit
+// c.MaxTotalSize.
+func (c *Capture) enforceRetention() {
+	if c.MaxTotalSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return
+	}
+	var captures []os.FileInfo
+	var total int64
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), ".pcap") {
+			captures = append(captures, f)
+			total += f.Size()
+		}
+	}
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].ModTime().Before(captures[j].ModTime())
+	})
+	for _, f := range captures {
+		if total <= c.MaxTotalSize {
+			break
+		}
+		if os.Remove(filepath.Join(c.Dir, f.Name())) == nil {
+			total -= f.Size()
+		}
+	}
+}
+
+// wrap returns "conn" recording into a new capture for session "label". A
+// nil *Capture records nothing. If the file can't be created, the error is
+// logged, and "conn" is returned as is.
+func (c *Capture) wrap(conn net.Conn, events *eventEmitter, label string) net.Conn {
+	if c == nil {
+		return conn
+	}
+	c.enforceRetention()
+	path := filepath.Join(c.Dir, label+".pcap")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		events.emit(logrus.ErrorLevel, EventCapture, label, "Capture failed", map[string]interface{}{
+			"Error": err.Error(),
+		})
+		return conn
+	}
+	cc := &captureConn{
+		Conn:    conn,
+		capture: c,
+		events:  events,
+		label:   label,
+		path:    path,
+		file:    f,
+		w:       bufio.NewWriter(f),
+		local:   tcpAddrOf(conn.LocalAddr()),
+		remote:  tcpAddrOf(conn.RemoteAddr()),
+		// The initial sequence numbers.
+		peerSeq:  rand.Uint32(),
+		localSeq: rand.Uint32(),
+	}
+	cc.writeHeader()
+	cc.record(true, tcpSYN, nil)
+	cc.peerSeq++
+	cc.record(false, tcpSYN|tcpACK, nil)
+	cc.localSeq++
+	cc.record(true, tcpACK, nil)
+	return cc
+}
+
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// captureConn is a net.Conn whose payloads are written to a pcap file.
+type captureConn struct {
+	net.Conn
+	capture *Capture
+	events  *eventEmitter
+	label   string
+	path    string
+
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	size      int64
+	packets   int
+	truncated bool
+	closed    bool
+	local     *net.TCPAddr
+	remote    *net.TCPAddr
+	// The next sequence number of each side.
+	peerSeq, localSeq uint32
+	ipID              uint16
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.payload(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.payload(false, b[:n])
+	}
+	return n, err
+}
+
+// Close writes the teardown, closes the file, and logs where it is.
+func (c *captureConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return err
+	}
+	c.closed = true
+	c.record(false, tcpFIN|tcpACK, nil)
+	c.localSeq++
+	c.record(true, tcpFIN|tcpACK, nil)
+	c.peerSeq++
+	c.record(false, tcpACK, nil)
+	fields := map[string]interface{}{
+		"Path":    c.path,
+		"Packets": c.packets,
+		"Size":    c.size,
+	}
+	if c.truncated {
+		fields["Truncated"] = true
+	}
+	if ferr := c.w.Flush(); ferr != nil {
+		fields["Error"] = ferr.Error()
+	}
+	c.file.Close()
+	c.events.emit(logrus.InfoLevel, EventCapture, c.label, "Capture saved", fields)
+	return err
+}
+
+// payload records "data", received if "inbound", else sent.
+func (c *captureConn) payload(inbound bool, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > captureSegmentSize {
+			n = captureSegmentSize
+		}
+		c.record(inbound, tcpPSH|tcpACK, data[:n])
+		if inbound {
+			c.peerSeq += uint32(n)
+		} else {
+			c.localSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+}
+
+func (c *captureConn) writeHeader() {
+	var h [24]byte
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], 65535)
+	binary.LittleEndian.PutUint32(h[20:], pcapLinkTypeRaw)
+	c.w.Write(h[:])
+	c.size += int64(len(h))
+}
+
+// record writes one segment, from the peer if "inbound". Once the file is
+// over its limit, nothing more is written. c.mu must be held, except while
+// the connection is set up.
+func (c *captureConn) record(inbound bool, flags byte, payload []byte) {
+	if c.truncated {
+		return
+	}
+	src, dst := c.local, c.remote
+	seq, ack := c.localSeq, c.peerSeq
+	if inbound {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+	packet := c.packet(src, dst, seq, ack, flags, payload)
+	if max := c.capture.MaxFileSize; max > 0 && c.size+16+int64(len(packet)) > max {
+		c.truncated = true
+		return
+	}
+	now := time.Now()
+	var h [16]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(packet)))
+	c.w.Write(h[:])
+	c.w.Write(packet)
+	c.size += int64(len(h) + len(packet))
+	c.packets++
+}
+
+// packet returns an IP packet holding a TCP segment. It is IPv4 if both
+// addresses are.
+func (c *captureConn) packet(src, dst *net.TCPAddr, seq, ack uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		c.ipID++
+		binary.BigEndian.PutUint16(ip[4:], c.ipID)
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // Don't fragment
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, tcp...)
+	}
+
+	src16, dst16 := src.IP.To16(), dst.IP.To16()
+	if src16 == nil {
+		src16 = net.IPv6zero
+	}
+	if dst16 == nil {
+		dst16 = net.IPv6zero
+	}
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:], src16)
+	copy(pseudo[16:], dst16)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+	pseudo[39] = 6
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6
+	ip[7] = 64
+	copy(ip[8:], src16)
+	copy(ip[24:], dst16)
+	return append(ip, tcp...)
+}
+
+// checksum returns the Internet checksum of the concatenation of "parts",
+// each but the last of even length. RFC 1071.
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range parts {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
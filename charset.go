@@ -0,0 +1,381 @@
+package dicompot
+
+// This file implements Specific Character Set (0008,0005) handling, P3.5
+// chapter 6. Strings are decoded to UTF-8 as they are read, ISO 2022 code
+// extensions included, so that they match and log as text. Since the
+// values are then UTF-8, datasets that carry non-ASCII text are sent out as
+// ISO_IR 192.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+)
+
+// UTF8CharacterSet is the Specific Character Set of decoded datasets.
+const UTF8CharacterSet = "ISO_IR 192"
+
+// codeElement is a character set that ISO 2022 designates to G0, the bytes
+// below 0x80, or G1, the bytes above.
+type codeElement struct {
+	// Whether characters take two bytes.
+	multiByte bool
+	// Decodes a run of bytes of this code element.
+	decode func(b []byte) string
+}
+
+func charmapElement(cm *charmap.Charmap) *codeElement {
+	return &codeElement{decode: func(b []byte) string { return decodeWith(cm.NewDecoder(), b) }}
+}
+
+func decodeWith(d *encoding.Decoder, b []byte) string {
+	s, err := d.Bytes(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(s)
+}
+
+var (
+	asciiElement = &codeElement{decode: func(b []byte) string { return string(b) }}
+	// JIS X 0201 katakana, in G1.
+	katakanaElement = &codeElement{decode: func(b []byte) string { return decodeWith(japanese.ShiftJIS.NewDecoder(), b) }}
+	// JIS X 0208 and 0212 in G0 are EUC-JP with the high bits cleared.
+	jisX0208Element = &codeElement{multiByte: true, decode: func(b []byte) string {
+		euc := make([]byte, len(b))
+		for i, c := range b {
+			euc[i] = c | 0x80
+		}
+		return decodeWith(japanese.EUCJP.NewDecoder(), euc)
+	}}
+	jisX0212Element = &codeElement{multiByte: true, decode: func(b []byte) string {
+		var euc []byte
+		for i := 0; i+1 < len(b); i += 2 {
+			euc = append(euc, 0x8f, b[i]|0x80, b[i+1]|0x80)
+		}
+		return decodeWith(japanese.EUCJP.NewDecoder(), euc)
+	}}
+	ksX1001Element = &codeElement{multiByte: true, decode: func(b []byte) string { return decodeWith(korean.EUCKR.NewDecoder(), b) }}
+	gb2312Element  = &codeElement{multiByte: true, decode: func(b []byte) string { return decodeWith(simplifiedchinese.GBK.NewDecoder(), b) }}
+)
+
+// The escape sequences of P3.5, tables 6.2-1 and 6.2-2, without the leading
+// ESC. "(" designates G0; ")", "-" and "$)" designate G1.
+var iso2022Escapes = map[string]*codeElement{
+	"(B":  asciiElement,
+	"(J":  asciiElement, // JIS X 0201 Romaji differs from ASCII in two places.
+	")I":  katakanaElement,
+	"-A":  charmapElement(charmap.ISO8859_1),
+	"-B":  charmapElement(charmap.ISO8859_2),
+	"-C":  charmapElement(charmap.ISO8859_3),
+	"-D":  charmapElement(charmap.ISO8859_4),
+	"-F":  charmapElement(charmap.ISO8859_7),
+	"-G":  charmapElement(charmap.ISO8859_6),
+	"-H":  charmapElement(charmap.ISO8859_8),
+	"-L":  charmapElement(charmap.ISO8859_5),
+	"-M":  charmapElement(charmap.ISO8859_9),
+	"-T":  charmapElement(charmap.Windows874),
+	"-b":  charmapElement(charmap.ISO8859_15),
+	"$B":  jisX0208Element,
+	"$(D": jisX0212Element,
+	"$)C": ksX1001Element,
+	"$)A": gb2312Element,
+}
+
+// The G1 code element of the single-byte character sets, by defined term.
+// The "ISO 2022 IR" terms are the same with code extensions. P3.3, C.12.1.1.2.
+var singleByteCharsets = map[string]*codeElement{
+	"ISO_IR 13":  katakanaElement,
+	"ISO_IR 100": iso2022Escapes["-A"],
+	"ISO_IR 101": iso2022Escapes["-B"],
+	"ISO_IR 109": iso2022Escapes["-C"],
+	"ISO_IR 110": iso2022Escapes["-D"],
+	"ISO_IR 126": iso2022Escapes["-F"],
+	"ISO_IR 127": iso2022Escapes["-G"],
+	"ISO_IR 138": iso2022Escapes["-H"],
+	"ISO_IR 144": iso2022Escapes["-L"],
+	"ISO_IR 148": iso2022Escapes["-M"],
+	"ISO_IR 166": iso2022Escapes["-T"],
+	"ISO_IR 203": iso2022Escapes["-b"],
+}
+
+// charsetDecoder decodes strings of a dataset with the given Specific
+// Character Set. It only works on whole strings, which is how go-dicom
+// calls it.
+type charsetDecoder struct {
+	// The code elements in effect at the start of the string and after
+	// each delimiter.
+	initialG0, initialG1 *codeElement
+	// Whether escape sequences are honored.
+	iso2022 bool
+	// For the character sets that don't fit the G0/G1 model, e.g.,
+	// "ISO_IR 192". If set, the other fields are ignored.
+	whole func(b []byte) string
+}
+
+func newCharsetDecoder(names []string) *charsetDecoder {
+	d := &charsetDecoder{initialG0: asciiElement}
+	var first string
+	if len(names) > 0 {
+		first = strings.TrimSpace(names[0])
+	}
+	for _, name := range names {
+		if strings.HasPrefix(strings.TrimSpace(name), "ISO 2022") {
+			d.iso2022 = true
+		}
+	}
+	switch first {
+	case "ISO_IR 192":
+		d.whole = func(b []byte) string { return strings.ToValidUTF8(string(b), "�") }
+	case "GB18030":
+		d.whole = func(b []byte) string { return decodeWith(simplifiedchinese.GB18030.NewDecoder(), b) }
+	case "GBK":
+		d.whole = func(b []byte) string { return decodeWith(simplifiedchinese.GBK.NewDecoder(), b) }
+	case "", "ISO_IR 6", "ISO 2022 IR 6":
+		if !d.iso2022 {
+			// No character set, or the default one. Many senders still
+			// use whatever their platform does, which is UTF-8 or Latin-1.
+			d.whole = func(b []byte) string {
+				if utf8.Valid(b) {
+					return string(b)
+				}
+				return iso2022Escapes["-A"].decode(b)
+			}
+		}
+	default:
+		d.initialG1 = singleByteCharsets[strings.Replace(first, "ISO 2022 IR", "ISO_IR", 1)]
+		if d.initialG1 == nil && !d.iso2022 {
+			// Unknown; be as lenient as with no character set.
+			return newCharsetDecoder(nil)
+		}
+	}
+	return d
+}
+
+// isDelimiter reports whether "c" resets the code elements to their
+// initial state. P3.5, 6.1.2.5.3.
+func isDelimiter(c byte) bool {
+	switch c {
+	case '\r', '\n', '\t', '\f', '\\', '^', '=':
+		return true
+	}
+	return false
+}
+
+func (d *charsetDecoder) decode(b []byte) string {
+	if d.whole != nil {
+		return d.whole(b)
+	}
+	var out strings.Builder
+	g0, g1 := d.initialG0, d.initialG1
+	// Bytes of the current run, all decoded by "runElement".
+	var run []byte
+	var runElement *codeElement
+	flush := func() {
+		if len(run) > 0 {
+			if runElement == nil {
+				// No G1 designated: keep the bytes readable.
+				out.WriteString(iso2022Escapes["-A"].decode(run))
+			} else {
+				out.WriteString(runElement.decode(run))
+			}
+		}
+		run = run[:0]
+	}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c == 0x1b && d.iso2022 {
+			flush()
+			var element *codeElement
+			var seq string
+			for _, n := range []int{3, 2} {
+				if i+n < len(b) {
+					if e, ok := iso2022Escapes[string(b[i+1:i+1+n])]; ok {
+						element, seq = e, string(b[i+1:i+1+n])
+						break
+					}
+				}
+			}
+			if element == nil {
+				// Unknown; dropped along with the ESC.
+				continue
+			}
+			if seq[0] == '(' || seq == "$B" || seq == "$(D" {
+				g0 = element
+			} else {
+				g1 = element
+			}
+			i += len(seq)
+			continue
+		}
+		element := g0
+		if c >= 0x80 {
+			element = g1
+		} else if !g0.multiByte && isDelimiter(c) {
+			flush()
+			out.WriteByte(c)
+			g0, g1 = d.initialG0, d.initialG1
+			continue
+		}
+		if element != runElement {
+			flush()
+			runElement = element
+		}
+		run = append(run, c)
+	}
+	flush()
+	return out.String()
+}
+
+// Transform implements transform.Transformer. go-dicom passes the whole
+// string at once.
+func (d *charsetDecoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	if !atEOF {
+		return 0, 0, transform.ErrShortSrc
+	}
+	s := d.decode(src)
+	if len(s) > len(dst) {
+		return 0, 0, transform.ErrShortDst
+	}
+	return copy(dst, s), len(src), nil
+}
+
+// Reset implements transform.Transformer.
+func (d *charsetDecoder) Reset() {}
+
+// codingSystem returns the go-dicom coding system for a Specific Character
+// Set. The same decoder serves the three component groups of person names,
+// since the escape sequences say what each uses.
+func codingSystem(names []string) dicomio.CodingSystem {
+	d := &encoding.Decoder{Transformer: newCharsetDecoder(names)}
+	return dicomio.CodingSystem{Alphabetic: d, Ideographic: d, Phonetic: d}
+}
+
+// readElements reads elements until the end of "d", switching character set
+// when Specific Character Set is seen. go-dicom also switches, but fails on
+// ISO 2022 and on character sets it doesn't know.
+func readElements(d *dicomio.Decoder, options dicom.ReadOptions) []*dicom.Element {
+	// Until told otherwise, guess.
+	d.SetCodingSystem(codingSystem(nil))
+	var elems []*dicom.Element
+	for !d.EOF() {
+		elem := dicom.ReadElement(d, options)
+		if d.Error() != nil || elem == nil {
+			break
+		}
+		if elem.Tag == (dicomtag.Tag{Group: 0x7fff, Element: 0x7fff}) && len(elem.Value) == 0 {
+			// The end-of-data marker for DropPixelData and StopAtTag.
+			break
+		}
+		if elem.Tag == dicomtag.SpecificCharacterSet {
+			names, _ := elem.GetStrings()
+			d.SetCodingSystem(codingSystem(names))
+		}
+		elems = append(elems, elem)
+	}
+	return elems
+}
+
+// ReadDataSet is dicom.ReadDataSet, with strings decoded to UTF-8 whatever
+// their Specific Character Set. If the dataset has non-ASCII text, its
+// Specific Character Set becomes ISO_IR 192, so that it can be sent out as
+// is.
+func ReadDataSet(in io.Reader, options dicom.ReadOptions) (*dicom.DataSet, error) {
+	d := dicomio.NewDecoder(in, binary.LittleEndian, dicomio.ExplicitVR)
+	meta := dicom.ParseFileHeader(d)
+	if d.Error() != nil {
+		return nil, d.Error()
+	}
+	ds := &dicom.DataSet{Elements: meta}
+	elem, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	transferSyntaxUID, err := elem.GetString()
+	if err != nil {
+		return nil, err
+	}
+	endian, implicit, err := dicomio.ParseTransferSyntaxUID(transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	d.PushTransferSyntax(endian, implicit)
+	defer d.PopTransferSyntax()
+	elems := readElements(d, options)
+	ds.Elements = append(ds.Elements, withUTF8CharacterSet(elems)...)
+	return ds, d.Error()
+}
+
+// ReadDataSetFromFile is ReadDataSet on the content of a file.
+func ReadDataSetFromFile(path string, options dicom.ReadOptions) (*dicom.DataSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadDataSet(bufio.NewReader(file), options)
+}
+
+// hasNonASCII reports whether any string of "elems", nested ones included,
+// isn't plain ASCII.
+func hasNonASCII(elems []*dicom.Element) bool {
+	for _, elem := range elems {
+		for _, v := range elem.Value {
+			switch v := v.(type) {
+			case string:
+				for i := 0; i < len(v); i++ {
+					if v[i] >= 0x80 {
+						return true
+					}
+				}
+			case *dicom.Element:
+				if hasNonASCII([]*dicom.Element{v}) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// withUTF8CharacterSet returns "elems" with Specific Character Set set to
+// ISO_IR 192 if they have non-ASCII text, which is UTF-8 once decoded.
+func withUTF8CharacterSet(elems []*dicom.Element) []*dicom.Element {
+	if !hasNonASCII(elems) {
+		return elems
+	}
+	charset := dicom.MustNewElement(dicomtag.SpecificCharacterSet, UTF8CharacterSet)
+	out := make([]*dicom.Element, 0, len(elems)+1)
+	inserted := false
+	for _, elem := range elems {
+		if !inserted && elem.Tag.Group != dicomtag.MetadataGroup {
+			if elem.Tag == dicomtag.SpecificCharacterSet {
+				out = append(out, charset)
+				inserted = true
+				continue
+			}
+			if elem.Tag.Compare(dicomtag.SpecificCharacterSet) > 0 {
+				out = append(out, charset)
+				inserted = true
+			}
+		}
+		out = append(out, elem)
+	}
+	if !inserted {
+		out = append(out, charset)
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package dicompot
+
+import (
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// The examples are those of P3.5, annexes H to K, where there are some.
+func TestCharsetDecoder(t *testing.T) {
+	for _, test := range []struct {
+		charset []string
+		in      string
+		want    string
+	}{
+		{nil, "Smith^John", "Smith^John"},
+		{nil, "Buc^Jérôme", "Buc^Jérôme"},
+		{nil, "Buc^J\xe9r\xf4me", "Buc^Jérôme"},
+		{[]string{"ISO_IR 6"}, "Buc^J\xe9r\xf4me", "Buc^Jérôme"},
+		{[]string{"ISO_IR 100"}, "Buc^J\xe9r\xf4me", "Buc^Jérôme"},
+		{[]string{"ISO_IR 126"}, "\xc4\xe9\xef\xed\xf5\xf3\xe9\xef\xf2", "Διονυσιος"},
+		{[]string{"ISO_IR 144"}, "\xbb\xee\xda\xe1\xd5\xdc\xd1\xe3\xe0\xd3", "Люксембург"},
+		{[]string{"ISO_IR 192"}, "Wang^XiaoDong=王^小東=", "Wang^XiaoDong=王^小東="},
+		{[]string{"ISO_IR 192"}, "bad\xff", "bad�"},
+		{[]string{"GB18030"}, "Wang^XiaoDong=\xcd\xf5^\xd0\xa1\xb6\xab=", "Wang^XiaoDong=王^小东="},
+		{[]string{"ISO_IR 999"}, "Buc^J\xe9r\xf4me", "Buc^Jérôme"},
+		{
+			[]string{"", "ISO 2022 IR 87"},
+			"Yamada^Tarou=\x1b$B;3ED\x1b(B^\x1b$BB@O:\x1b(B=\x1b$B$d$^$@\x1b(B^\x1b$B$?$m$&\x1b(B",
+			"Yamada^Tarou=山田^太郎=やまだ^たろう",
+		},
+		{
+			[]string{"ISO 2022 IR 13", "ISO 2022 IR 87"},
+			"\xd4\xcf\xc0\xde^\xc0\xdb\xb3=\x1b$B;3ED\x1b(J^\x1b$BB@O:\x1b(J=\x1b$B$d$^$@\x1b(J^\x1b$B$?$m$&\x1b(J",
+			"ﾔﾏﾀﾞ^ﾀﾛｳ=山田^太郎=やまだ^たろう",
+		},
+		{
+			[]string{"", "ISO 2022 IR 149"},
+			"Hong^Gildong=\x1b$)C\xfb\xf3^\x1b$)C\xd1\xce\xd4\xd7=\x1b$)C\xc8\xab^\x1b$)C\xb1\xe6\xb5\xbf",
+			"Hong^Gildong=洪^吉洞=홍^길동",
+		},
+		{
+			[]string{"", "ISO 2022 IR 58"},
+			"Zhang^XiaoDong=\x1b$)A\xd5\xc5^\x1b$)A\xd0\xa1\xb6\xab=",
+			"Zhang^XiaoDong=张^小东=",
+		},
+		// A G1 designation ends at a delimiter.
+		{[]string{"", "ISO 2022 IR 100"}, "\x1b-A\xe9^\xe9", "é^é"},
+		// Unknown escape sequences are dropped.
+		{[]string{"ISO 2022 IR 6"}, "A\x1b%GB", "A%GB"},
+	} {
+		if got := newCharsetDecoder(test.charset).decode([]byte(test.in)); got != test.want {
+			t.Errorf("%q: decoded %q as %q, want %q", test.charset, test.in, got, test.want)
+		}
+	}
+}
+
+func TestWithUTF8CharacterSet(t *testing.T) {
+	name := dicom.MustNewElement(dicomtag.PatientName, "Buc^Jérôme")
+	id := dicom.MustNewElement(dicomtag.PatientID, "42")
+	modality := dicom.MustNewElement(dicomtag.Modality, "CT")
+
+	if elems := withUTF8CharacterSet([]*dicom.Element{modality, id}); len(elems) != 2 {
+		t.Errorf("ASCII dataset given a character set: %v", elems)
+	}
+
+	for _, elems := range [][]*dicom.Element{
+		{modality, name, id},
+		{dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 100"), modality, name},
+		{name},
+	} {
+		var charset *dicom.Element
+		out := withUTF8CharacterSet(elems)
+		for i, elem := range out {
+			if elem.Tag == dicomtag.SpecificCharacterSet {
+				if charset != nil {
+					t.Errorf("%v: two character sets", out)
+				}
+				charset = elem
+				if i > 0 && out[i-1].Tag.Compare(elem.Tag) > 0 {
+					t.Errorf("%v: character set out of order", out)
+				}
+			}
+		}
+		if charset == nil || charset.MustGetString() != UTF8CharacterSet {
+			t.Errorf("%v: character set %v, want %s", out, charset, UTF8CharacterSet)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/nsmfoo/dicompot/pdu"
-	"github.com/sirupsen/logrus"
 )
 
 type contextManagerEntry struct {
@@ -33,6 +32,23 @@ type contextManager struct {
 	peerImplementationClassUID string
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
+	// AE titles of the A-ASSOCIATE-RQ, on the provider side.
+	peerCallingAETitle string
+	peerCalledAETitle  string
+	// SOP Class Extended Negotiation proposed by the peer, and the part of it
+	// that was accepted. Keys are SOP class UIDs.
+	peerExtendedNegotiation map[string][]byte
+	extendedNegotiation     map[string][]byte
+	// User Identity Negotiation sent by the peer, or nil.
+	peerUserIdentity *pdu.UserIdentitySubItem
+
+	// Maximum PDU length and asynchronous operations window proposed by the
+	// peer, as is. peerMaxPDUSize is sanitized.
+	peerProposedMaxPDUSize *uint32
+	peerAsyncWindow        *pdu.AsynchronousOperationsWindowSubItem
+
+	// What the provider negotiates. Set by the state machine.
+	negotiation negotiationParams
 
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
@@ -42,6 +58,22 @@ type contextManager struct {
 	tmpRequests map[byte]*pdu.PresentationContextItem
 }
 
+// negotiationParams are the provider settings, from ServiceProviderParams,
+// that determine the response to an A-ASSOCIATE-RQ.
+type negotiationParams struct {
+	// See ServiceProviderParams.TransferSyntaxes. If nil, the first one
+	// proposed is accepted.
+	transferSyntaxes map[string][]string
+	// Advertised maximum PDU length. 0 means DefaultMaxPDUSize.
+	maxPDUSize int
+	// If set, returned when the peer proposes an asynchronous operations
+	// window.
+	asyncWindow *pdu.AsynchronousOperationsWindowSubItem
+	// Sent in the user information. If empty, go-dicom's.
+	implementationClassUID    string
+	implementationVersionName string
+}
+
 // Create an empty contextManager
 func newContextManager(label string) *contextManager {
 	c := &contextManager{
@@ -50,6 +82,8 @@ func newContextManager(label string) *contextManager {
 		abstractSyntaxNameToContextIDMap: make(map[string]*contextManagerEntry),
 		peerMaxPDUSize:                   16384, // The default value used by Osirix & pynetdicom.
 		tmpRequests:                      make(map[byte]*pdu.PresentationContextItem),
+		peerExtendedNegotiation:          make(map[string][]byte),
+		extendedNegotiation:              make(map[string][]byte),
 	}
 	return c
 }
@@ -85,9 +119,9 @@ func (m *contextManager) generateAssociateRequest(
 	items = append(items,
 		&pdu.UserInformationItem{
 			Items: []pdu.SubItem{
-				&pdu.UserInformationMaximumLengthItem{uint32(DefaultMaxPDUSize)},
-				&pdu.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID},
-				&pdu.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName}}})
+				&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)},
+				&pdu.ImplementationClassUIDSubItem{Name: dicom.GoDICOMImplementationClassUID},
+				&pdu.ImplementationVersionNameSubItem{Name: dicom.GoDICOMImplementationVersionName}}})
 
 	return items
 }
@@ -100,6 +134,25 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 			Name: pdu.DICOMApplicationContextItemName,
 		},
 	}
+	maxPDUSize := m.negotiation.maxPDUSize
+	if maxPDUSize == 0 {
+		maxPDUSize = DefaultMaxPDUSize
+	}
+	implementationClassUID := m.negotiation.implementationClassUID
+	implementationVersionName := m.negotiation.implementationVersionName
+	if implementationClassUID == "" {
+		implementationClassUID = dicom.GoDICOMImplementationClassUID
+		if implementationVersionName == "" {
+			implementationVersionName = dicom.GoDICOMImplementationVersionName
+		}
+	}
+	userItems := []pdu.SubItem{
+		&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(maxPDUSize)},
+		&pdu.ImplementationClassUIDSubItem{Name: implementationClassUID},
+	}
+	if implementationVersionName != "" {
+		userItems = append(userItems, &pdu.ImplementationVersionNameSubItem{Name: implementationVersionName})
+	}
 	for _, requestItem := range requestItems {
 		switch ri := requestItem.(type) {
 		case *pdu.ApplicationContextItem:
@@ -107,7 +160,7 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 			}
 		case *pdu.PresentationContextItem:
 			var sopUID string
-			var pickedTransferSyntaxUID string
+			var proposed []string
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu.AbstractSyntaxSubItem:
@@ -117,51 +170,121 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					}
 					sopUID = c.Name
 				case *pdu.TransferSyntaxSubItem:
-					// Just pick the first syntax UID proposed by the client.
-					if pickedTransferSyntaxUID == "" {
-						pickedTransferSyntaxUID = c.Name
-					}
+					proposed = append(proposed, c.Name)
 				default:
 					return nil, fmt.Errorf("dicom.onAssociateRequest: Unknown subitem in PresentationContext: %s",
 						subItem.String())
 				}
 			}
-			if sopUID == "" || pickedTransferSyntaxUID == "" {
+			if sopUID == "" || len(proposed) == 0 {
 				return nil, fmt.Errorf("dicom.onAssociateRequest: SOP or transfersyntax not found in PresentationContext: %v",
 					ri.String())
 			}
+			pickedTransferSyntaxUID, ok := m.pickTransferSyntax(sopUID, proposed)
+			result := pdu.PresentationContextAccepted
+			if !ok {
+				// The transfer syntax of a rejected context isn't looked
+				// at, but it must be there.
+				result = pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported
+				pickedTransferSyntaxUID = proposed[0]
+			}
 			responses = append(responses, &pdu.PresentationContextItem{
 				Type:      pdu.ItemTypePresentationContextResponse,
 				ContextID: ri.ContextID,
-				Result:    0, // accepted
+				Result:    result,
 				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu.PresentationContextAccepted)
+			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, result)
 		case *pdu.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu.UserInformationMaximumLengthItem:
-					m.peerMaxPDUSize = int(c.MaximumLengthReceived)
+					m.peerProposedMaxPDUSize = &c.MaximumLengthReceived
+					// 0 means no limit. Anything too small to carry a PDV
+					// is ignored rather than trusted.
+					if c.MaximumLengthReceived > 8 {
+						m.peerMaxPDUSize = int(c.MaximumLengthReceived)
+					}
 				case *pdu.ImplementationClassUIDSubItem:
 					m.peerImplementationClassUID = c.Name
 				case *pdu.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu.AsynchronousOperationsWindowSubItem:
+					m.peerAsyncWindow = c
+					if w := m.negotiation.asyncWindow; w != nil {
+						userItems = append(userItems, w)
+					}
+				case *pdu.UserIdentitySubItem:
+					m.peerUserIdentity = c
+					// Whatever the credentials, they are good.
+					if c.PositiveResponseRequested {
+						userItems = append(userItems, &pdu.UserIdentityResponseSubItem{})
+					}
+				case *pdu.SOPClassExtendedNegotiationSubItem:
+					m.peerExtendedNegotiation[c.SOPClassUID] = c.ServiceClassApplicationInfo
+					if info := acceptExtendedNegotiation(c.SOPClassUID, c.ServiceClassApplicationInfo); info != nil {
+						m.extendedNegotiation[c.SOPClassUID] = info
+						userItems = append(userItems, &pdu.SOPClassExtendedNegotiationSubItem{
+							SOPClassUID:                 c.SOPClassUID,
+							ServiceClassApplicationInfo: info,
+						})
+					}
 				}
 			}
 		}
 	}
 
-	responses = append(responses,
-		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}})
-
-	logrus.WithFields(logrus.Fields{
-		"Version": m.peerImplementationVersionName,
-		"ID":      m.label,
-	}).Info("Client")
+	responses = append(responses, &pdu.UserInformationItem{Items: userItems})
 	return responses, nil
 }
 
+// pickTransferSyntax chooses among the transfer syntaxes proposed for
+// "sopUID". The provider's order of preference wins over the peer's, as with
+// most real SCPs.
+func (m *contextManager) pickTransferSyntax(sopUID string, proposed []string) (string, bool) {
+	syntaxes := m.negotiation.transferSyntaxes
+	if syntaxes == nil {
+		return proposed[0], true
+	}
+	accepted, ok := syntaxes[sopUID]
+	if !ok {
+		accepted = syntaxes[""]
+	}
+	for _, uid := range accepted {
+		for _, p := range proposed {
+			if p == uid {
+				return uid, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Query/Retrieve SOP classes that accept relational queries and retrievals.
+var relationalSOPClasses = map[string]bool{
+	dicomuid.PatientRootQRFind:    true,
+	dicomuid.PatientRootQRMove:    true,
+	dicomuid.PatientRootQRGet:     true,
+	dicomuid.StudyRootQRFind:      true,
+	dicomuid.StudyRootQRMove:      true,
+	dicomuid.StudyRootQRGet:       true,
+	"1.2.840.10008.5.1.4.1.2.3.1": true,
+	"1.2.840.10008.5.1.4.1.2.3.2": true,
+	"1.2.840.10008.5.1.4.1.2.3.3": true,
+}
+
+// acceptExtendedNegotiation returns the service-class application info to
+// send back for a SOP Class Extended Negotiation proposal, or nil to ignore
+// it. Only relational queries and retrievals (the first byte of the info)
+// are supported; the other options are declined. P3.4, C.5.1.1 and C.5.2.1.
+func acceptExtendedNegotiation(sopClassUID string, info []byte) []byte {
+	if !relationalSOPClasses[sopClassUID] || len(info) == 0 {
+		return nil
+	}
+	accepted := make([]byte, len(info))
+	accepted[0] = info[0] & 1
+	return accepted
+}
+
 // Called by the user (client) to when A_ASSOCIATE_AC PDU arrives from the provider.
 func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 	for _, responseItem := range responses {
@@ -0,0 +1,199 @@
+package dicompot
+
+import (
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+const (
+	ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	jpegLossless   = "1.2.840.10008.1.2.4.70"
+)
+
+// proposedContext returns presentation context "id" proposing "sopUID" in
+// "transferSyntaxes".
+func proposedContext(id byte, sopUID string, transferSyntaxes ...string) *pdu.PresentationContextItem {
+	items := []pdu.SubItem{&pdu.AbstractSyntaxSubItem{Name: sopUID}}
+	for _, ts := range transferSyntaxes {
+		items = append(items, &pdu.TransferSyntaxSubItem{Name: ts})
+	}
+	return &pdu.PresentationContextItem{Type: pdu.ItemTypePresentationContextRequest, ContextID: id, Items: items}
+}
+
+func TestPickTransferSyntax(t *testing.T) {
+	syntaxes := map[string][]string{
+		"":             {dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian},
+		ctImageStorage: {jpegLossless},
+	}
+	for _, test := range []struct {
+		name     string
+		syntaxes map[string][]string
+		sopUID   string
+		proposed []string
+		want     string
+		ok       bool
+	}{
+		{"the peer's first by default", nil, dicomuid.VerificationSOPClass,
+			[]string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian}, dicomuid.ImplicitVRLittleEndian, true},
+		{"the provider's preference", syntaxes, dicomuid.VerificationSOPClass,
+			[]string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian}, dicomuid.ExplicitVRLittleEndian, true},
+		{"the only one accepted", syntaxes, dicomuid.VerificationSOPClass,
+			[]string{jpegLossless, dicomuid.ImplicitVRLittleEndian}, dicomuid.ImplicitVRLittleEndian, true},
+		{"none accepted", syntaxes, dicomuid.VerificationSOPClass,
+			[]string{jpegLossless}, "", false},
+		{"per SOP class", syntaxes, ctImageStorage,
+			[]string{dicomuid.ExplicitVRLittleEndian, jpegLossless}, jpegLossless, true},
+		{"per SOP class, none accepted", syntaxes, ctImageStorage,
+			[]string{dicomuid.ExplicitVRLittleEndian}, "", false},
+	} {
+		m := newContextManager("test")
+		m.negotiation.transferSyntaxes = test.syntaxes
+		got, ok := m.pickTransferSyntax(test.sopUID, test.proposed)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestOnAssociateRequestContexts(t *testing.T) {
+	m := newContextManager("test")
+	m.negotiation.transferSyntaxes = map[string][]string{"": {dicomuid.ExplicitVRLittleEndian}}
+	responses, err := m.onAssociateRequest([]pdu.SubItem{
+		&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+		proposedContext(1, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian),
+		proposedContext(3, ctImageStorage, jpegLossless),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[byte]*pdu.PresentationContextItem{}
+	for _, item := range responses {
+		if c, ok := item.(*pdu.PresentationContextItem); ok {
+			results[c.ContextID] = c
+		}
+	}
+	if c := results[1]; c == nil || c.Result != pdu.PresentationContextAccepted ||
+		c.Items[0].(*pdu.TransferSyntaxSubItem).Name != dicomuid.ExplicitVRLittleEndian {
+		t.Errorf("context 1: %v, want accepted with explicit VR little endian", c)
+	}
+	// A rejected context still carries a transfer syntax.
+	if c := results[3]; c == nil || c.Result != pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported ||
+		len(c.Items) != 1 {
+		t.Errorf("context 3: %v, want rejected for its transfer syntax", c)
+	}
+	if _, err := m.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass); err != nil {
+		t.Errorf("the accepted context isn't mapped: %v", err)
+	}
+}
+
+func TestOnAssociateRequestMalformedContext(t *testing.T) {
+	for _, c := range []*pdu.PresentationContextItem{
+		proposedContext(1, dicomuid.VerificationSOPClass),
+		proposedContext(1, "", dicomuid.ImplicitVRLittleEndian),
+		{Type: pdu.ItemTypePresentationContextRequest, ContextID: 1, Items: []pdu.SubItem{
+			&pdu.AbstractSyntaxSubItem{Name: dicomuid.VerificationSOPClass},
+			&pdu.AbstractSyntaxSubItem{Name: ctImageStorage},
+			&pdu.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian},
+		}},
+	} {
+		if _, err := newContextManager("test").onAssociateRequest([]pdu.SubItem{c}); err == nil {
+			t.Errorf("%v accepted", c)
+		}
+	}
+}
+
+// userInformation returns the sub-items of the user information in
+// "responses".
+func userInformation(t *testing.T, responses []pdu.SubItem) []pdu.SubItem {
+	for _, item := range responses {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			return ui.Items
+		}
+	}
+	t.Fatalf("no user information in %v", responses)
+	return nil
+}
+
+func TestOnAssociateRequestMaxPDULength(t *testing.T) {
+	for _, test := range []struct {
+		advertised int    // negotiationParams.maxPDUSize
+		proposed   uint32 // By the peer.
+		wantSent   uint32
+		wantPeer   int
+	}{
+		{0, 32768, DefaultMaxPDUSize, 32768},
+		{65536, 32768, 65536, 32768},
+		{4096, 0, 4096, 16384},
+		{4096, 8, 4096, 16384},
+	} {
+		m := newContextManager("test")
+		m.negotiation.maxPDUSize = test.advertised
+		responses, err := m.onAssociateRequest([]pdu.SubItem{
+			proposedContext(1, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian),
+			&pdu.UserInformationItem{Items: []pdu.SubItem{
+				&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: test.proposed},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent uint32
+		for _, item := range userInformation(t, responses) {
+			if l, ok := item.(*pdu.UserInformationMaximumLengthItem); ok {
+				sent = l.MaximumLengthReceived
+			}
+		}
+		if sent != test.wantSent {
+			t.Errorf("advertising %d: sent %d, want %d", test.advertised, sent, test.wantSent)
+		}
+		if m.peerMaxPDUSize != test.wantPeer {
+			t.Errorf("peer proposing %d: kept %d, want %d", test.proposed, m.peerMaxPDUSize, test.wantPeer)
+		}
+		if m.peerProposedMaxPDUSize == nil || *m.peerProposedMaxPDUSize != test.proposed {
+			t.Errorf("peer proposing %d: logged %v", test.proposed, m.peerProposedMaxPDUSize)
+		}
+	}
+}
+
+func TestOnAssociateRequestAsyncWindow(t *testing.T) {
+	window := &pdu.AsynchronousOperationsWindowSubItem{MaxOpsInvoked: 0, MaxOpsPerformed: 1}
+	proposed := &pdu.AsynchronousOperationsWindowSubItem{MaxOpsInvoked: 5, MaxOpsPerformed: 5}
+	for _, test := range []struct {
+		name     string
+		window   *pdu.AsynchronousOperationsWindowSubItem
+		proposed *pdu.AsynchronousOperationsWindowSubItem
+		want     *pdu.AsynchronousOperationsWindowSubItem
+	}{
+		{"not configured", nil, proposed, nil},
+		{"not proposed", window, nil, nil},
+		{"answered", window, proposed, window},
+	} {
+		m := newContextManager("test")
+		m.negotiation.asyncWindow = test.window
+		userItems := []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384}}
+		if test.proposed != nil {
+			userItems = append(userItems, test.proposed)
+		}
+		responses, err := m.onAssociateRequest([]pdu.SubItem{
+			proposedContext(1, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian),
+			&pdu.UserInformationItem{Items: userItems},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got *pdu.AsynchronousOperationsWindowSubItem
+		for _, item := range userInformation(t, responses) {
+			if w, ok := item.(*pdu.AsynchronousOperationsWindowSubItem); ok {
+				got = w
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s: answered %v, want %v", test.name, got, test.want)
+		}
+		if m.peerAsyncWindow != test.proposed {
+			t.Errorf("%s: logged %v, want %v", test.name, m.peerAsyncWindow, test.proposed)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package dicompot
+
+// This file counts the traffic of a connection, which its connection-closed
+// event reports, with how long it lasted.
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// countingConn is a net.Conn that counts the bytes read and written.
+type countingConn struct {
+	net.Conn
+	start time.Time
+	// Accessed atomically.
+	read, written int64
+}
+
+func newCountingConn(conn net.Conn) *countingConn {
+	return &countingConn{Conn: conn, start: time.Now()}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// closedFields returns the fields of the connection-closed event.
+func (c *countingConn) closedFields() map[string]interface{} {
+	return map[string]interface{}{
+		"Status":        "Finished",
+		"BytesReceived": atomic.LoadInt64(&c.read),
+		"BytesSent":     atomic.LoadInt64(&c.written),
+		"Duration":      time.Since(c.start).Round(time.Millisecond).String(),
+	}
+}
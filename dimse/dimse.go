@@ -166,6 +166,7 @@ const (
 	StatusSuccess               StatusCode = 0
 	StatusCancel                StatusCode = 0xFE00
 	StatusSOPClassNotSupported  StatusCode = 0x0112
+	StatusDuplicateSOPInstance  StatusCode = 0x0111
 	StatusInvalidArgumentValue  StatusCode = 0x0115
 	StatusInvalidAttributeValue StatusCode = 0x0106
 	StatusInvalidObjectInstance StatusCode = 0x0117
@@ -187,6 +188,9 @@ const (
 	CMoveMoveDestinationUnknown                         StatusCode = 0xa801
 	CMoveDataSetDoesNotMatchSOPClass                    StatusCode = 0xa900
 
+	// MPPS N-SET-specific status codes. P3.4 F.7.2.2
+	MPPSNoLongerUpdatable StatusCode = 0xc310
+
 	// Warning codes.
 	StatusAttributeValueOutOfRange StatusCode = 0x0116
 	StatusAttributeListError       StatusCode = 0x0107
@@ -4,26 +4,28 @@ package dimse
 
 import "fmt"
 
-const _StatusCode_name = "StatusSuccessStatusInvalidAttributeValueStatusAttributeListErrorStatusSOPClassNotSupportedStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCannotUnderstandStatusCancelStatusPending"
+const _StatusCode_name = "StatusSuccessStatusInvalidAttributeValueStatusAttributeListErrorStatusDuplicateSOPInstanceStatusSOPClassNotSupportedStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCannotUnderstandMPPSNoLongerUpdatableStatusCancelStatusPending"
 
 var _StatusCode_map = map[StatusCode]string{
 	0:     _StatusCode_name[0:13],
 	262:   _StatusCode_name[13:40],
 	263:   _StatusCode_name[40:64],
-	274:   _StatusCode_name[64:90],
-	277:   _StatusCode_name[90:116],
-	278:   _StatusCode_name[116:146],
-	279:   _StatusCode_name[146:173],
-	292:   _StatusCode_name[173:192],
-	529:   _StatusCode_name[192:219],
-	42752: _StatusCode_name[219:239],
-	42753: _StatusCode_name[239:290],
-	42754: _StatusCode_name[290:337],
-	43009: _StatusCode_name[337:364],
-	43264: _StatusCode_name[364:397],
-	49152: _StatusCode_name[397:419],
-	65024: _StatusCode_name[419:431],
-	65280: _StatusCode_name[431:444],
+	273:   _StatusCode_name[64:90],
+	274:   _StatusCode_name[90:116],
+	277:   _StatusCode_name[116:142],
+	278:   _StatusCode_name[142:172],
+	279:   _StatusCode_name[172:199],
+	292:   _StatusCode_name[199:218],
+	529:   _StatusCode_name[218:245],
+	42752: _StatusCode_name[245:265],
+	42753: _StatusCode_name[265:316],
+	42754: _StatusCode_name[316:363],
+	43009: _StatusCode_name[363:390],
+	43264: _StatusCode_name[390:423],
+	49152: _StatusCode_name[423:445],
+	49936: _StatusCode_name[445:466],
+	65024: _StatusCode_name[466:478],
+	65280: _StatusCode_name[478:491],
 }
 
 func (i StatusCode) String() string {
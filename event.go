@@ -0,0 +1,289 @@
+package dicompot
+
+// This file defines Event and EventSink. Every observation the provider makes
+// about a peer (connections, association requests, DIMSE commands) is turned
+// into an Event and handed to the configured EventSink, instead of being
+// written to the log directly.
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Types of events emitted by the provider. Listed in the order they typically
+// occur during an association.
+const (
+	EventConnectionOpened    = "connection-opened"
+	EventTarpit              = "tarpit"
+	EventTLSHandshake        = "tls-handshake"
+	EventAssociationRequest  = "association-request"
+	EventAssociationRejected = "association-rejected"
+	EventAssociationClient   = "association-client"
+	EventUserIdentity        = "user-identity"
+	EventExtendedNegotiation = "extended-negotiation"
+	EventContextNegotiation  = "context-negotiation"
+	EventCEcho               = "c-echo"
+	EventCFind               = "c-find"
+	EventCFindQuery          = "c-find-query"
+	EventCFindResult         = "c-find-result"
+	EventCMove               = "c-move"
+	EventCGet                = "c-get"
+	EventCStore              = "c-store"
+	EventCCancel             = "c-cancel"
+	EventNAction             = "n-action"
+	EventStorageCommitment   = "storage-commitment"
+	EventNCreate             = "n-create"
+	EventNSet                = "n-set"
+	EventNGet                = "n-get"
+	EventNDelete             = "n-delete"
+	EventPrint               = "print"
+	EventFakeStatus          = "fake-status"
+	EventUnhandledCommand    = "unhandled-command"
+	EventMalformedPDU        = "malformed-pdu"
+	EventAbort               = "abort"
+	EventCapture             = "capture"
+	EventTranscript          = "transcript"
+	EventConnectionClosed    = "connection-closed"
+)
+
+// Types of events recorded by the services that run next to the provider:
+// DICOMweb and HL7.
+const (
+	EventHTTPRequest   = "http-request"
+	EventQIDO          = "qido-rs"
+	EventWADO          = "wado-rs"
+	EventSTOW          = "stow-rs"
+	EventHL7Connection = "hl7-connection"
+	EventHL7Message    = "hl7-message"
+)
+
+// Types of events recorded about the data served.
+const (
+	EventCanaryUID  = "canary-uid"
+	EventSessionUID = "session-uid"
+	EventWatermark  = "watermark"
+	EventBeacon     = "beacon"
+	EventReveal     = "reveal"
+)
+
+// Types of events recorded by the detectors that watch the other events.
+const (
+	EventExploitAttempt = "exploit-attempt"
+	EventCampaign       = "campaign"
+	EventScanner        = "scanner"
+	EventSessionSummary = "session-summary"
+	EventSuppressed     = "suppressed"
+)
+
+// Event is a single structured observation made by the honeypot. It is
+// marshaled as one line of the NDJSON event log, so the JSON names are part
+// of that schema.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Severity of the event. Sinks that don't have a notion of severity may
+	// ignore it.
+	Level logrus.Level `json:"level"`
+	// Type is one of the Event* constants.
+	Type string `json:"type"`
+	// SessionID identifies the connection that produced the event.
+	SessionID string `json:"sessionID,omitempty"`
+	// The peer of the session, as far as it is known.
+	Session
+	// Command is the DIMSE command the event is about, e.g., "C-FIND".
+	Command string `json:"command,omitempty"`
+	// Query is the identifier of a C-FIND, C-MOVE or C-GET.
+	Query []QueryElement `json:"query,omitempty"`
+	// Message is a short human-readable description, e.g., "Connection from".
+	Message string `json:"message"`
+	// Event-specific attributes, e.g., the peer's IP address.
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// QueryElement is an attribute of a query identifier.
+type QueryElement struct {
+	// E.g., "(0010,0010)".
+	Tag string `json:"tag"`
+	// E.g., "PatientName". Empty for private and unknown tags.
+	Keyword string   `json:"keyword,omitempty"`
+	VR      string   `json:"vr"`
+	Values  []string `json:"values,omitempty"`
+	// The items of a sequence.
+	Items [][]QueryElement `json:"items,omitempty"`
+}
+
+// The commands of the DIMSE event types whose fields don't say.
+var eventCommands = map[string]string{
+	EventCEcho:             "C-ECHO",
+	EventCFind:             "C-FIND",
+	EventCFindQuery:        "C-FIND",
+	EventCFindResult:       "C-FIND",
+	EventCMove:             "C-MOVE",
+	EventCGet:              "C-GET",
+	EventCStore:            "C-STORE",
+	EventCCancel:           "C-CANCEL",
+	EventNAction:           "N-ACTION",
+	EventStorageCommitment: "N-ACTION",
+	EventNCreate:           "N-CREATE",
+	EventNSet:              "N-SET",
+	EventNGet:              "N-GET",
+	EventNDelete:           "N-DELETE",
+}
+
+// NewEvent returns an event recorded now about session "sessionID", with
+// what is known of the session. The command is the "Command" field, if any,
+// else the one of "eventType".
+func NewEvent(level logrus.Level, eventType string, sessionID string, message string, fields map[string]interface{}) Event {
+	command, ok := fields["Command"].(string)
+	if !ok {
+		command = eventCommands[eventType]
+	}
+	return Event{
+		Time:      time.Now(),
+		Level:     level,
+		Type:      eventType,
+		SessionID: sessionID,
+		Session:   LookupSession(sessionID),
+		Command:   command,
+		Message:   message,
+		Fields:    fields,
+	}
+}
+
+// EventSink receives events emitted by the provider. Record is called
+// concurrently from multiple connections, so implementations must be
+// thread safe.
+type EventSink interface {
+	// Record delivers one event to the sink.
+	Record(event Event) error
+	// Close flushes buffered events and releases resources. Record must
+	// not be called after Close.
+	Close() error
+}
+
+// MultiSink is an EventSink that fans every event out to a list of sinks.
+type MultiSink []EventSink
+
+// Record delivers the event to every sink. It returns the first error
+// encountered, but always tries all the sinks.
+func (m MultiSink) Record(event Event) error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Record(event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes every sink, returning the first error encountered.
+func (m MultiSink) Close() error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// LogrusSink writes events through a logrus logger. It is the default sink;
+// events reach the console and the JSON log file through it.
+type LogrusSink struct {
+	logger *logrus.Logger
+}
+
+// NewLogrusSink creates a sink that writes to the given logger. If logger is
+// nil, the logrus standard logger is used.
+func NewLogrusSink(logger *logrus.Logger) *LogrusSink {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &LogrusSink{logger: logger}
+}
+
+// Record logs the event fields, plus the session ID under the "ID" key.
+func (s *LogrusSink) Record(event Event) error {
+	fields := logrus.Fields{}
+	for k, v := range event.Fields {
+		fields[k] = v
+	}
+	if event.SessionID != "" {
+		fields["ID"] = event.SessionID
+	}
+	s.logger.WithTime(event.Time).WithFields(fields).Log(event.Level, event.Message)
+	return nil
+}
+
+// Close is a no-op. The logger outlives the sink.
+func (s *LogrusSink) Close() error {
+	return nil
+}
+
+// NDJSONSink writes every event as one line of JSON, in the schema of Event,
+// for SIEMs to ingest without parsing log messages.
+type NDJSONSink struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewNDJSONSink creates a sink that writes to "w", and closes it with the
+// sink.
+func NewNDJSONSink(w io.WriteCloser) *NDJSONSink {
+	return &NDJSONSink{w: w}
+}
+
+// Record writes the event. A line is written whole, or not at all, so that
+// the lines of concurrent sessions don't interleave.
+func (s *NDJSONSink) Record(event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the writer.
+func (s *NDJSONSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// eventEmitter builds events on behalf of the provider and hands them to the
+// sink. A nil *eventEmitter drops everything, which is what the ServiceUser
+// wants.
+type eventEmitter struct {
+	sink EventSink
+}
+
+func newEventEmitter(sink EventSink) *eventEmitter {
+	if sink == nil {
+		sink = NewLogrusSink(nil)
+	}
+	return &eventEmitter{sink: sink}
+}
+
+func (em *eventEmitter) emit(level logrus.Level, eventType string, sessionID string, message string, fields map[string]interface{}) {
+	if em == nil {
+		return
+	}
+	em.record(NewEvent(level, eventType, sessionID, message, fields))
+}
+
+// record hands "event" to the sink, for events emit can't build.
+func (em *eventEmitter) record(event Event) {
+	if em == nil {
+		return
+	}
+	if err := em.sink.Record(event); err != nil {
+		log.Printf("Failed to record event of session %s: %v", event.SessionID, err)
+	}
+}
@@ -0,0 +1,197 @@
+package dicompot
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+// captureSink is an EventSink that keeps the events it records, for tests
+// to check what a provider observed.
+type captureSink struct {
+	mu     sync.Mutex
+	events []Event
+	closed chan struct{}
+}
+
+func newCaptureSink() *captureSink {
+	return &captureSink{closed: make(chan struct{})}
+}
+
+func (s *captureSink) Record(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	if event.Type == EventConnectionClosed {
+		close(s.closed)
+	}
+	return nil
+}
+
+func (s *captureSink) Close() error {
+	return nil
+}
+
+// types returns the types of the events recorded, in order.
+func (s *captureSink) types() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var types []string
+	for _, event := range s.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+// find returns the first event of type "eventType", or nil.
+func (s *captureSink) find(eventType string) *Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.events {
+		if s.events[i].Type == eventType {
+			return &s.events[i]
+		}
+	}
+	return nil
+}
+
+func TestProviderEmitsEvents(t *testing.T) {
+	sink := newCaptureSink()
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "RADIANT",
+		CEcho: func(ConnectionState) dimse.Status {
+			return dimse.Success
+		},
+		Sink: sink,
+	}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  "RADIANT",
+		CallingAETitle: "PROBE",
+		SOPClasses:     []string{dicomuid.VerificationSOPClass},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err != nil {
+		t.Fatalf("C-ECHO: %v", err)
+	}
+	su.Release()
+
+	select {
+	case <-sink.closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no %s event, got %v", EventConnectionClosed, sink.types())
+	}
+
+	for _, eventType := range []string{EventConnectionOpened, EventAssociationRequest, EventCEcho, EventConnectionClosed} {
+		event := sink.find(eventType)
+		if event == nil {
+			t.Errorf("no %s event, got %v", eventType, sink.types())
+			continue
+		}
+		if event.SessionID == "" {
+			t.Errorf("%s event without a session ID", eventType)
+		}
+	}
+	if types := sink.types(); types[0] != EventConnectionOpened || types[len(types)-1] != EventConnectionClosed {
+		t.Errorf("events out of order: %v", types)
+	}
+	if event := sink.find(EventAssociationRequest); event != nil {
+		if got := event.Fields["CallingAETitle"]; got != "PROBE" {
+			t.Errorf("CallingAETitle = %v, want PROBE", got)
+		}
+	}
+	if event := sink.find(EventCEcho); event != nil && event.Command != "C-ECHO" {
+		t.Errorf("C-ECHO event command = %q", event.Command)
+	}
+}
+
+func TestRejectedAssociationLogsUserIdentity(t *testing.T) {
+	sink := newCaptureSink()
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "RADIANT",
+		Enforce: "yes",
+		Sink:    sink,
+	}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sp.Run()
+
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rq, err := pdu.EncodePDU(&pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "WRONG",
+		CallingAETitle:  "PROBE",
+		Items: []pdu.SubItem{
+			&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+			&pdu.PresentationContextItem{
+				Type:      pdu.ItemTypePresentationContextRequest,
+				ContextID: 1,
+				Items: []pdu.SubItem{
+					&pdu.AbstractSyntaxSubItem{Name: dicomuid.VerificationSOPClass},
+					&pdu.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian},
+				},
+			},
+			&pdu.UserInformationItem{Items: []pdu.SubItem{
+				&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+				&pdu.UserIdentitySubItem{
+					Type:           pdu.UserIdentityUsernamePasscode,
+					PrimaryField:   []byte("admin"),
+					SecondaryField: []byte("s3cret"),
+				},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(rq); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reply, err := pdu.ReadPDU(conn, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reply.(*pdu.AAssociateRj); !ok {
+		t.Fatalf("got %v, want A-ASSOCIATE-RJ", reply)
+	}
+	conn.Close()
+
+	select {
+	case <-sink.closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no %s event, got %v", EventConnectionClosed, sink.types())
+	}
+	id := sink.find(EventUserIdentity)
+	if id == nil {
+		t.Fatalf("no %s event, got %v", EventUserIdentity, sink.types())
+	}
+	if id.Fields["Username"] != "admin" || id.Fields["Passcode"] != "s3cret" {
+		t.Errorf("%s event fields %v, want the username and passcode", EventUserIdentity, id.Fields)
+	}
+	rejected := sink.find(EventAssociationRejected)
+	if rejected == nil {
+		t.Fatalf("no %s event, got %v", EventAssociationRejected, sink.types())
+	}
+	if got := rejected.Fields["UserIdentity"]; got != "username-passcode" {
+		t.Errorf("%s UserIdentity = %v, want username-passcode", EventAssociationRejected, got)
+	}
+}
@@ -0,0 +1,87 @@
+package dicompot
+
+// This file fingerprints the tools that request associations, the way JA3
+// fingerprints TLS clients by their ClientHello: what a tool proposes, and
+// in what order, is set by its code rather than by its user, so the hash of
+// it tells the tool whatever AE titles it is given, on every sensor alike.
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+// subItemType returns the item type of "item", as encoded.
+func subItemType(item pdu.SubItem) byte {
+	e := dicomio.NewBytesEncoder(binary.BigEndian, dicomio.UnknownVR)
+	item.Write(e)
+	if b := e.Bytes(); len(b) > 0 {
+		return b[0]
+	}
+	return 0
+}
+
+// associationFingerprint returns the fingerprint of A-ASSOCIATE-RQ "v", the
+// MD5 hash, in hex, of the string it is made of, and that string. The
+// string has the fields, separated by commas:
+//
+//	protocol version,application context,presentation contexts,max PDU length,implementation class UID,implementation version name,user items
+//
+// where the presentation contexts are "abstract syntax:transfer
+// syntax-transfer syntax..." separated by semicolons, in the order
+// proposed, and the user items the types of the user information
+// sub-items, in hex, separated by dashes in the order sent, with the type
+// of the identity for user identity negotiation, e.g., "58.2". The context
+// IDs and the AE titles are left out.
+func associationFingerprint(v *pdu.AAssociate) (string, string) {
+	var appContext, maxPDU, implUID, implVersion string
+	var contexts, userItems []string
+	for _, item := range v.Items {
+		switch ri := item.(type) {
+		case *pdu.ApplicationContextItem:
+			appContext = ri.Name
+		case *pdu.PresentationContextItem:
+			var abstractSyntax string
+			var transferSyntaxes []string
+			for _, subItem := range ri.Items {
+				switch c := subItem.(type) {
+				case *pdu.AbstractSyntaxSubItem:
+					abstractSyntax = c.Name
+				case *pdu.TransferSyntaxSubItem:
+					transferSyntaxes = append(transferSyntaxes, c.Name)
+				}
+			}
+			contexts = append(contexts, abstractSyntax+":"+strings.Join(transferSyntaxes, "-"))
+		case *pdu.UserInformationItem:
+			for _, subItem := range ri.Items {
+				t := fmt.Sprintf("%02x", subItemType(subItem))
+				switch c := subItem.(type) {
+				case *pdu.UserInformationMaximumLengthItem:
+					maxPDU = strconv.FormatUint(uint64(c.MaximumLengthReceived), 10)
+				case *pdu.ImplementationClassUIDSubItem:
+					implUID = c.Name
+				case *pdu.ImplementationVersionNameSubItem:
+					implVersion = c.Name
+				case *pdu.UserIdentitySubItem:
+					t += fmt.Sprintf(".%d", c.Type)
+				}
+				userItems = append(userItems, t)
+			}
+		}
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(v.ProtocolVersion)),
+		appContext,
+		strings.Join(contexts, ";"),
+		maxPDU,
+		implUID,
+		implVersion,
+		strings.Join(userItems, "-"),
+	}, ",")
+	return fmt.Sprintf("%x", md5.Sum([]byte(s))), s
+}
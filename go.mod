@@ -3,12 +3,20 @@ module github.com/nsmfoo/dicompot
 go 1.14
 
 require (
+	filippo.io/age v1.0.0
 	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/aws/aws-sdk-go v1.35.7
 	github.com/grailbio/go-dicom v0.0.0-20190117035129-c30d9eaca591
+	github.com/lib/pq v1.8.0
 	github.com/mattn/go-colorable v0.1.6
+	github.com/mattn/go-sqlite3 v1.14.3
+	github.com/oschwald/geoip2-golang v1.4.0
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/snowzach/rotatefilehook v0.0.0-20180327172521-2f64f265f58c
-	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/text v0.3.3
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
 
@@ -0,0 +1,208 @@
+package dicompot
+
+// This file computes the JA3 fingerprint of the ClientHello of a TLS
+// client, and the JA3S fingerprint of the ServerHello answering it, from
+// the bytes exchanged: crypto/tls doesn't tell the order of the
+// extensions, which JA3 hashes. See https://github.com/salesforce/ja3.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The bytes of the handshake kept for the fingerprints, at most.
+const helloRecordLimit = 64 << 10
+
+// helloRecorder is a net.Conn that keeps the first bytes read and written,
+// until stopped.
+type helloRecorder struct {
+	net.Conn
+
+	mu      sync.Mutex
+	stopped bool
+	in, out bytes.Buffer
+}
+
+func (r *helloRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.mu.Lock()
+	if !r.stopped && r.in.Len() < helloRecordLimit {
+		r.in.Write(b[:n])
+	}
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *helloRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	if !r.stopped && r.out.Len() < helloRecordLimit {
+		r.out.Write(b)
+	}
+	r.mu.Unlock()
+	return r.Conn.Write(b)
+}
+
+// stop stops recording, and returns what was read and written.
+func (r *helloRecorder) stop() ([]byte, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	in, out := r.in.Bytes(), r.out.Bytes()
+	r.in, r.out = bytes.Buffer{}, bytes.Buffer{}
+	return in, out
+}
+
+// handshakeMessage returns the body of the first handshake message of TLS
+// records "data", if of type "msgType": 1 for ClientHello, 2 for
+// ServerHello.
+func handshakeMessage(data []byte, msgType byte) []byte {
+	// The handshake protocol, out of the records that carry it.
+	var hs []byte
+	for len(data) >= 5 && data[0] == 22 {
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			n = len(data) - 5
+		}
+		hs = append(hs, data[5:5+n]...)
+		data = data[5+n:]
+		if len(hs) >= 4 && len(hs) >= 4+int(hs[1])<<16|int(hs[2])<<8|int(hs[3]) {
+			break
+		}
+	}
+	if len(hs) < 4 || hs[0] != msgType {
+		return nil
+	}
+	n := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+n {
+		return nil
+	}
+	return hs[4 : 4+n]
+}
+
+// isGREASE reports whether "v" is one of the values RFC 8701 reserves to
+// keep servers honest, which JA3 leaves out.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloReader reads the fields of a hello message.
+type helloReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *helloReader) next(n int) []byte {
+	if !r.ok || len(r.b) < n {
+		r.ok = false
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *helloReader) uint8() int {
+	if v := r.next(1); v != nil {
+		return int(v[0])
+	}
+	return 0
+}
+
+func (r *helloReader) uint16() int {
+	if v := r.next(2); v != nil {
+		return int(binary.BigEndian.Uint16(v))
+	}
+	return 0
+}
+
+// uint16s returns the 16-bit values of "b", but GREASE, in decimal.
+func uint16s(b []byte) []string {
+	var values []string
+	for ; len(b) >= 2; b = b[2:] {
+		if v := binary.BigEndian.Uint16(b); !isGREASE(v) {
+			values = append(values, strconv.Itoa(int(v)))
+		}
+	}
+	return values
+}
+
+// extensions returns the types of the extensions that follow in "r",
+// and the data of each.
+func (r *helloReader) extensions() ([]string, map[uint16][]byte) {
+	var types []string
+	data := map[uint16][]byte{}
+	if len(r.b) == 0 {
+		// No extensions at all.
+		return nil, data
+	}
+	ext := &helloReader{b: r.next(r.uint16()), ok: r.ok}
+	for ext.ok && len(ext.b) >= 4 {
+		t := uint16(ext.uint16())
+		d := ext.next(ext.uint16())
+		if !ext.ok {
+			break
+		}
+		if !isGREASE(t) {
+			types = append(types, strconv.Itoa(int(t)))
+		}
+		data[t] = d
+	}
+	return types, data
+}
+
+// ja3 returns the JA3 fingerprint of ClientHello "hello", the MD5 hash of
+// its string, and the string: the version, the cipher suites, the
+// extensions, the elliptic curves and the point formats.
+func ja3(hello []byte) (string, string) {
+	r := &helloReader{b: hello, ok: true}
+	version := r.uint16()
+	r.next(32)        // Random.
+	r.next(r.uint8()) // Session ID.
+	ciphers := r.next(r.uint16())
+	r.next(r.uint8()) // Compression methods.
+	if !r.ok {
+		return "", ""
+	}
+	types, data := r.extensions()
+	var curves, formats []string
+	if d := data[10]; len(d) >= 2 {
+		curves = uint16s(d[2:])
+	}
+	if d := data[11]; len(d) >= 1 {
+		for _, f := range d[1:] {
+			formats = append(formats, strconv.Itoa(int(f)))
+		}
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(version),
+		strings.Join(uint16s(ciphers), "-"),
+		strings.Join(types, "-"),
+		strings.Join(curves, "-"),
+		strings.Join(formats, "-"),
+	}, ",")
+	return fmt.Sprintf("%x", md5.Sum([]byte(s))), s
+}
+
+// ja3s returns the JA3S fingerprint of ServerHello "hello", the MD5 hash of
+// its string, and the string: the version, the cipher suite and the
+// extensions.
+func ja3s(hello []byte) (string, string) {
+	r := &helloReader{b: hello, ok: true}
+	version := r.uint16()
+	r.next(32)        // Random.
+	r.next(r.uint8()) // Session ID.
+	cipher := r.uint16()
+	r.next(1) // Compression method.
+	if !r.ok {
+		return "", ""
+	}
+	types, _ := r.extensions()
+	s := strings.Join([]string{strconv.Itoa(version), strconv.Itoa(cipher), strings.Join(types, "-")}, ",")
+	return fmt.Sprintf("%x", md5.Sum([]byte(s))), s
+}
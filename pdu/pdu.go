@@ -56,6 +56,9 @@ const (
 	ItemTypeAsynchronousOperationsWindow = 0x53
 	ItemTypeRoleSelection                = 0x54
 	ItemTypeImplementationVersionName    = 0x55
+	ItemTypeSOPClassExtendedNegotiation  = 0x56
+	ItemTypeUserIdentityRequest          = 0x58
+	ItemTypeUserIdentityResponse         = 0x59
 )
 
 func decodeSubItem(d *dicomio.Decoder) SubItem {
@@ -85,6 +88,12 @@ func decodeSubItem(d *dicomio.Decoder) SubItem {
 		return decodeRoleSelectionSubItem(d, length)
 	case ItemTypeImplementationVersionName:
 		return decodeImplementationVersionNameSubItem(d, length)
+	case ItemTypeSOPClassExtendedNegotiation:
+		return decodeSOPClassExtendedNegotiationSubItem(d, length)
+	case ItemTypeUserIdentityRequest:
+		return decodeUserIdentitySubItem(d, length)
+	case ItemTypeUserIdentityResponse:
+		return decodeUserIdentityResponseSubItem(d, length)
 	default:
 		d.SetError(fmt.Errorf("Unknown item type: 0x%x", itemType))
 		return nil
@@ -239,6 +248,106 @@ func (v *ImplementationVersionNameSubItem) String() string {
 	return fmt.Sprintf("ImplementationVersionName{name: \"%s\"}", v.Name)
 }
 
+// PS3.7 Annex D.3.3.5
+type SOPClassExtendedNegotiationSubItem struct {
+	SOPClassUID string
+	// Service-class specific. For Query/Retrieve, P3.4 C.5.1.1 and C.5.2.1.
+	ServiceClassApplicationInfo []byte
+}
+
+func decodeSOPClassExtendedNegotiationSubItem(d *dicomio.Decoder, length uint16) *SOPClassExtendedNegotiationSubItem {
+	uidLen := d.ReadUInt16()
+	if int(uidLen)+2 > int(length) {
+		d.SetError(fmt.Errorf("SOPClassExtendedNegotiationSubItem: UID length %d exceeds item length %d", uidLen, length))
+		return nil
+	}
+	return &SOPClassExtendedNegotiationSubItem{
+		SOPClassUID:                 d.ReadString(int(uidLen)),
+		ServiceClassApplicationInfo: d.ReadBytes(int(length) - 2 - int(uidLen)),
+	}
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) Write(e *dicomio.Encoder) {
+	encodeSubItemHeader(e, ItemTypeSOPClassExtendedNegotiation, uint16(2+len(v.SOPClassUID)+len(v.ServiceClassApplicationInfo)))
+	e.WriteUInt16(uint16(len(v.SOPClassUID)))
+	e.WriteString(v.SOPClassUID)
+	e.WriteBytes(v.ServiceClassApplicationInfo)
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("SOPClassExtendedNegotiation{sopclassuid: %v, info: %v}", v.SOPClassUID, v.ServiceClassApplicationInfo)
+}
+
+// Possible values for UserIdentitySubItem.Type.
+const (
+	UserIdentityUsername         = 1
+	UserIdentityUsernamePasscode = 2
+	UserIdentityKerberos         = 3
+	UserIdentitySAML             = 4
+	UserIdentityJWT              = 5
+)
+
+// PS3.7 Annex D.3.3.7.1
+type UserIdentitySubItem struct {
+	Type                      byte
+	PositiveResponseRequested bool
+	PrimaryField              []byte // Username, Kerberos ticket, SAML assertion, or JWT.
+	SecondaryField            []byte // Passcode, for UserIdentityUsernamePasscode only.
+}
+
+func decodeUserIdentitySubItem(d *dicomio.Decoder, length uint16) *UserIdentitySubItem {
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	v := &UserIdentitySubItem{}
+	v.Type = d.ReadByte()
+	v.PositiveResponseRequested = d.ReadByte() == 1
+	v.PrimaryField = d.ReadBytes(int(d.ReadUInt16()))
+	v.SecondaryField = d.ReadBytes(int(d.ReadUInt16()))
+	return v
+}
+
+func (v *UserIdentitySubItem) Write(e *dicomio.Encoder) {
+	encodeSubItemHeader(e, ItemTypeUserIdentityRequest, uint16(6+len(v.PrimaryField)+len(v.SecondaryField)))
+	e.WriteByte(v.Type)
+	if v.PositiveResponseRequested {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+	e.WriteUInt16(uint16(len(v.PrimaryField)))
+	e.WriteBytes(v.PrimaryField)
+	e.WriteUInt16(uint16(len(v.SecondaryField)))
+	e.WriteBytes(v.SecondaryField)
+}
+
+func (v *UserIdentitySubItem) String() string {
+	return fmt.Sprintf("UserIdentity{type: %d, positiveresponserequested: %v, primary: %dbytes, secondary: %dbytes}",
+		v.Type, v.PositiveResponseRequested, len(v.PrimaryField), len(v.SecondaryField))
+}
+
+// PS3.7 Annex D.3.3.7.2
+type UserIdentityResponseSubItem struct {
+	// Kerberos server ticket, SAML response or JWT. Empty for the username
+	// identity types.
+	ServerResponse []byte
+}
+
+func decodeUserIdentityResponseSubItem(d *dicomio.Decoder, length uint16) *UserIdentityResponseSubItem {
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	return &UserIdentityResponseSubItem{ServerResponse: d.ReadBytes(int(d.ReadUInt16()))}
+}
+
+func (v *UserIdentityResponseSubItem) Write(e *dicomio.Encoder) {
+	encodeSubItemHeader(e, ItemTypeUserIdentityResponse, uint16(2+len(v.ServerResponse)))
+	e.WriteUInt16(uint16(len(v.ServerResponse)))
+	e.WriteBytes(v.ServerResponse)
+}
+
+func (v *UserIdentityResponseSubItem) String() string {
+	return fmt.Sprintf("UserIdentityResponse{response: %dbytes}", len(v.ServerResponse))
+}
+
 // Container for subitems that this package doesnt' support
 type SubItemUnsupported struct {
 	Type byte
@@ -377,7 +486,9 @@ func (v *PresentationContextItem) Write(e *dicomio.Encoder) {
 	itemBytes := itemEncoder.Bytes()
 	encodeSubItemHeader(e, v.Type, uint16(4+len(itemBytes)))
 	e.WriteByte(v.ContextID)
-	e.WriteZeros(3)
+	e.WriteZeros(1)
+	e.WriteByte(byte(v.Result))
+	e.WriteZeros(1)
 	e.WriteBytes(itemBytes)
 }
 
@@ -465,30 +576,85 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 	return append(header[:], payload...), nil
 }
 
+// Why a PDU couldn't be read, as ReadError.Reason.
+const (
+	// The PDU is longer than the caller accepts.
+	ReadErrorTooLong     = "too-long"
+	ReadErrorUnknownType = "unknown-type"
+	// An item of the PDU runs past its end, or the connection ended
+	// before it.
+	ReadErrorTruncated = "truncated"
+	// The PDU is longer than its items.
+	ReadErrorJunk = "junk"
+	// The connection ended within the header, e.g., of a probe of
+	// another protocol.
+	ReadErrorShortHeader = "short-header"
+)
+
+// The bytes of a PDU ReadPDU couldn't read kept in ReadError.Data, at most.
+const MaxReadErrorData = 4096
+
+// ReadError is the error of a PDU ReadPDU couldn't read, other than the end
+// of the stream before it.
+type ReadError struct {
+	Type Type
+	// As the header says.
+	Length uint32
+	// One of the ReadError* constants.
+	Reason string
+	Err    error
+	// The bytes read of the PDU, header included, up to MaxReadErrorData.
+	Data []byte
+}
+
+func (e *ReadError) Error() string {
+	return e.Err.Error()
+}
+
+// dataRecorder is a reader that keeps the first MaxReadErrorData bytes read.
+type dataRecorder struct {
+	r    io.Reader
+	data []byte
+}
+
+func (r *dataRecorder) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if room := MaxReadErrorData - len(r.data); room > 0 {
+		if room > n {
+			room = n
+		}
+		r.data = append(r.data, b[:room]...)
+	}
+	return n, err
+}
+
 // EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
-// possible PDU size, in bytes, accepted by the caller.
+// possible PDU size, in bytes, accepted by the caller. The errors of the
+// PDUs that can't be read are *ReadError.
 func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
-	var pduType Type
-	var skip byte
-	var length uint32
-	err := binary.Read(in, binary.BigEndian, &pduType)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(in, binary.BigEndian, &skip)
-	if err != nil {
+	var header [6]byte
+	if n, err := io.ReadFull(in, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &ReadError{Type(header[0]), 0, ReadErrorShortHeader,
+				fmt.Errorf("ReadPDU: header truncated after %d bytes", n), header[:n]}
+		}
 		return nil, err
 	}
-	err = binary.Read(in, binary.BigEndian, &length)
-	if err != nil {
-		return nil, err
+	pduType := Type(header[0])
+	length := binary.BigEndian.Uint32(header[2:6])
+	if pduType < TypeAAssociateRq || pduType > TypeAAbort {
+		// Not DICOM, e.g., "GET / HTTP/1.1", whose length is no more.
+		err := fmt.Errorf("ReadPDU: unknown message type %d", pduType)
+		return nil, &ReadError{pduType, length, ReadErrorUnknownType, err, header[:]}
 	}
 	if length >= uint32(maxPDUSize)*2 {
 		// Avoid using too much memory. *2 is just an arbitrary slack.
-		return nil, fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, maxPDUSize)
+		return nil, &ReadError{pduType, length, ReadErrorTooLong,
+			fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, maxPDUSize), header[:]}
 	}
+	recorder := &dataRecorder{r: in, data: header[:]}
 	d := dicomio.NewDecoder(
-		&io.LimitedReader{R: in, N: int64(length)},
+		&io.LimitedReader{R: recorder, N: int64(length)},
 		binary.BigEndian,  // PDU is always big endian
 		dicomio.UnknownVR) // irrelevant for PDU parsing
 	var pdu PDU
@@ -510,10 +676,14 @@ func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 	}
 	if pdu == nil {
 		err := fmt.Errorf("ReadPDU: unknown message type %d", pduType)
-		return nil, err
+		return nil, &ReadError{pduType, length, ReadErrorUnknownType, err, recorder.data}
 	}
 	if err := d.Finish(); err != nil {
-		return nil, err
+		reason := ReadErrorTruncated
+		if d.Error() == nil {
+			reason = ReadErrorJunk
+		}
+		return nil, &ReadError{pduType, length, reason, err, recorder.data}
 	}
 	return pdu, nil
 }
@@ -688,6 +858,92 @@ const (
 	AbortReasonInvalidPDUParameterValue AbortReasonType = 5
 )
 
+// The explanations of the A-ASSOCIATE-RJ reasons, by source, as PS3.8
+// Table 9-21 has them.
+var rejectExplanations = map[SourceType]map[RejectReasonType]string{
+	SourceULServiceUser: {
+		1: "no reason given",
+		2: "application context name not supported",
+		3: "calling AE title not recognized",
+		7: "called AE title not recognized",
+	},
+	SourceULServiceProviderACSE: {
+		1: "no reason given",
+		2: "protocol version not supported",
+	},
+	SourceULServiceProviderPresentation: {
+		1: "temporary congestion",
+		2: "local limit exceeded",
+	},
+}
+
+// Explanation returns what the result, source and reason of "pdu" mean, e.g.,
+// "rejected permanently by the service user: called AE title not
+// recognized".
+func (pdu *AAssociateRj) Explanation() string {
+	result := fmt.Sprintf("rejected (result %d)", pdu.Result)
+	switch pdu.Result {
+	case ResultRejectedPermanent:
+		result = "rejected permanently"
+	case ResultRejectedTransient:
+		result = "rejected transiently"
+	}
+	source := fmt.Sprintf("unknown source %d", pdu.Source)
+	switch pdu.Source {
+	case SourceULServiceUser:
+		source = "the service user"
+	case SourceULServiceProviderACSE:
+		source = "the service provider (ACSE)"
+	case SourceULServiceProviderPresentation:
+		source = "the service provider (presentation)"
+	}
+	reason, ok := rejectExplanations[pdu.Source][pdu.Reason]
+	if !ok {
+		reason = fmt.Sprintf("reserved reason %d", pdu.Reason)
+	}
+	return result + " by " + source + ": " + reason
+}
+
+// The explanations of the A-ABORT reasons of the service provider, as PS3.8
+// Table 9-26 has them.
+var abortExplanations = map[AbortReasonType]string{
+	0: "reason not specified",
+	1: "unrecognized PDU",
+	2: "unexpected PDU",
+	4: "unrecognized PDU parameter",
+	5: "unexpected PDU parameter",
+	6: "invalid PDU parameter value",
+}
+
+// SourceName returns who aborted: "service-user" or "service-provider".
+// A-ABORT numbers its sources unlike A-ASSOCIATE-RJ.
+func (pdu *AAbort) SourceName() string {
+	switch pdu.Source {
+	case 0:
+		return "service-user"
+	case 2:
+		return "service-provider"
+	}
+	return fmt.Sprintf("reserved(%d)", pdu.Source)
+}
+
+// Explanation returns what the source and reason of "pdu" mean, e.g.,
+// "aborted by the service provider: unexpected PDU". The reason only means
+// something when the service provider aborts.
+func (pdu *AAbort) Explanation() string {
+	switch pdu.Source {
+	case 0:
+		return "aborted by the service user"
+	case 2:
+		reason, ok := abortExplanations[pdu.Reason]
+		if !ok {
+			reason = fmt.Sprintf("reserved reason %d", pdu.Reason)
+		}
+		return "aborted by the service provider: " + reason
+	}
+	return fmt.Sprintf("aborted by reserved source %d", pdu.Source)
+}
+
 type AAbort struct {
 	Source SourceType
 	Reason AbortReasonType
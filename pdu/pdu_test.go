@@ -0,0 +1,93 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+)
+
+// associateRq returns an A-ASSOCIATE-RQ whose user information holds "id".
+func associateRq(id *UserIdentitySubItem) *AAssociate {
+	return &AAssociate{
+		Type:            TypeAAssociateRq,
+		ProtocolVersion: CurrentProtocolVersion,
+		CalledAETitle:   "RADIANT",
+		CallingAETitle:  "PROBE",
+		Items: []SubItem{
+			&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+			&UserInformationItem{Items: []SubItem{
+				&UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+				id,
+			}},
+		},
+	}
+}
+
+func TestUserIdentitySubItem(t *testing.T) {
+	for _, id := range []*UserIdentitySubItem{
+		{Type: UserIdentityUsername, PrimaryField: []byte("admin")},
+		{Type: UserIdentityUsernamePasscode, PositiveResponseRequested: true, PrimaryField: []byte("admin"), SecondaryField: []byte("s3cret")},
+		{Type: UserIdentityKerberos, PrimaryField: []byte{0x6e, 0x82, 0x00, 0x01}},
+		{Type: UserIdentitySAML, PrimaryField: []byte("<saml:Assertion/>")},
+		{Type: UserIdentityJWT, PositiveResponseRequested: true, PrimaryField: []byte("eyJhbGciOiJub25lIn0.e30.")},
+		{Type: 9, PrimaryField: []byte{}, SecondaryField: []byte{}},
+	} {
+		b, err := EncodePDU(associateRq(id))
+		if err != nil {
+			t.Fatalf("EncodePDU(%v): %v", id, err)
+		}
+		decoded, err := ReadPDU(bytes.NewReader(b), 1<<20)
+		if err != nil {
+			t.Fatalf("ReadPDU(%v): %v", id, err)
+		}
+		var got *UserIdentitySubItem
+		for _, item := range decoded.(*AAssociate).Items {
+			if ui, ok := item.(*UserInformationItem); ok {
+				for _, subItem := range ui.Items {
+					if v, ok := subItem.(*UserIdentitySubItem); ok {
+						got = v
+					}
+				}
+			}
+		}
+		switch {
+		case got == nil:
+			t.Errorf("%v: no User Identity sub-item decoded", id)
+		case got.Type != id.Type || got.PositiveResponseRequested != id.PositiveResponseRequested ||
+			!bytes.Equal(got.PrimaryField, id.PrimaryField) || !bytes.Equal(got.SecondaryField, id.SecondaryField):
+			t.Errorf("decoded %v, primary %q, secondary %q, want %v, primary %q, secondary %q",
+				got, got.PrimaryField, got.SecondaryField, id, id.PrimaryField, id.SecondaryField)
+		}
+	}
+}
+
+func TestUserIdentitySubItemEncoding(t *testing.T) {
+	b, err := EncodePDU(associateRq(&UserIdentitySubItem{
+		Type:                      UserIdentityUsernamePasscode,
+		PositiveResponseRequested: true,
+		PrimaryField:              []byte("ab"),
+		SecondaryField:            []byte("c"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PS3.7 Annex D.3.3.7.1: type 0x58, reserved, length, user identity
+	// type, positive response requested, then the fields after their
+	// lengths.
+	want := []byte{0x58, 0, 0, 9, 2, 1, 0, 2, 'a', 'b', 0, 1, 'c'}
+	if !bytes.HasSuffix(b, want) {
+		t.Errorf("encoded % x, want it to end with % x", b, want)
+	}
+}
+
+func TestUserIdentitySubItemTruncated(t *testing.T) {
+	b, err := EncodePDU(associateRq(&UserIdentitySubItem{Type: UserIdentityUsername, PrimaryField: []byte("admin")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim a username longer than the sub-item.
+	i := bytes.Index(b, []byte("admin"))
+	b[i-1] = 0x40
+	if _, err := ReadPDU(bytes.NewReader(b), 1<<20); err == nil {
+		t.Errorf("ReadPDU accepted a username running past its sub-item")
+	}
+}
@@ -0,0 +1,213 @@
+package dicompot
+
+// This file implements the receiving side of the HAProxy PROXY protocol,
+// versions 1 and 2, so that connections forwarded by a load balancer are
+// logged with the address of the real client. Headers are only taken from
+// trusted proxies, lest an attacker connecting directly forge the address
+// it is logged with.
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the proxy has to send the header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// Signature that starts a version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// NewProxyProtocolListener wraps "l" so that the connections it accepts
+// start with a PROXY protocol header. Connections from outside of "trusted",
+// the networks of the proxies, are closed at once. The header is parsed on
+// the first call to Read or RemoteAddr, which returns the address of the
+// client rather than the proxy. Connections without a valid header fail on
+// their first Read.
+func NewProxyProtocolListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: l, trusted: trusted}
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.isTrusted(conn.RemoteAddr()) {
+			return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+		}
+		log.Printf("PROXY protocol: closed the connection from %s, not a trusted proxy", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// isTrusted reports whether "addr" is in the networks of the proxies.
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection accepted by a proxyListener. The header is
+// parsed lazily, so that a slow proxy doesn't hold up the accept loop.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once sync.Once
+	// The client, as reported by the proxy. nil if the proxy didn't say,
+	// e.g., a health check.
+	remote net.Addr
+	// Set if the header is missing or malformed. The connection is then
+	// unusable.
+	err error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxyAddr returns the address of the proxy "conn" came through, or nil
+// if it didn't come through one.
+func proxyAddr(conn net.Conn) net.Addr {
+	if c, ok := conn.(*proxyConn); ok {
+		c.once.Do(c.readHeader)
+		if c.remote != nil {
+			return c.Conn.RemoteAddr()
+		}
+	}
+	return nil
+}
+
+// proxyError returns the error met while parsing the header of "conn".
+func proxyError(conn net.Conn) error {
+	if c, ok := conn.(*proxyConn); ok {
+		c.once.Do(c.readHeader)
+		return c.err
+	}
+	return nil
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	first, err := c.r.Peek(1)
+	if err != nil {
+		// Let the first Read report it.
+		return
+	}
+	c.err = errors.New("no header")
+	switch first[0] {
+	case 'P':
+		if prefix, err := c.r.Peek(6); err == nil && string(prefix) == "PROXY " {
+			c.remote, c.err = readProxyHeaderV1(c.r)
+		}
+	case proxyV2Signature[0]:
+		if prefix, err := c.r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+			c.remote, c.err = readProxyHeaderV2(c.r)
+		}
+	}
+	if c.err != nil {
+		c.err = fmt.Errorf("PROXY protocol: %v", c.err)
+	}
+}
+
+// readProxyHeaderV1 parses a text header, e.g.,
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 104\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		// 107 bytes is the longest header allowed.
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 parses a binary header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	if verCmd&0xf == 0 {
+		// LOCAL: the proxy's own connection.
+		return nil, nil
+	}
+	// The addresses are followed by TLVs, which are ignored.
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// AF_UNIX or AF_UNSPEC.
+	return nil, nil
+}
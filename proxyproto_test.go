@@ -0,0 +1,179 @@
+package dicompot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyHeaderV2 returns a v2 header of command "cmd" and address family
+// "family", with "addrs" for addresses.
+func proxyHeaderV2(cmd, family byte, addrs []byte) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		remote string // "" for no address.
+		ok     bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 104\r\n", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4242 11112\r\n", "[2001:db8::1]:4242", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 104\r\n", "", false},
+		{"PROXY TCP4 192.0.2.x 198.51.100.1 56324 104\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 65536 104\r\n", "", false},
+		{"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1", "", false},
+	} {
+		remote, err := readProxyHeaderV1(bufio.NewReader(strings.NewReader(test.header)))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v", test.header, err)
+			continue
+		}
+		if got := addrString(remote); err == nil && got != test.remote {
+			t.Errorf("%q: remote %q, want %q", test.header, got, test.remote)
+		}
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 104}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 4242)
+	binary.BigEndian.PutUint16(ipv6[34:], 11112)
+	v3 := proxyHeaderV2(1, 0x11, ipv4)
+	v3[12] = 0x31
+	for _, test := range []struct {
+		name   string
+		header []byte
+		remote string
+		ok     bool
+	}{
+		{"IPv4", proxyHeaderV2(1, 0x11, ipv4), "192.0.2.1:56324", true},
+		{"IPv4 with TLVs", proxyHeaderV2(1, 0x11, append(ipv4, 0x04, 0, 1, 'x')), "192.0.2.1:56324", true},
+		{"IPv6", proxyHeaderV2(1, 0x21, ipv6), "[2001:db8::1]:4242", true},
+		{"LOCAL", proxyHeaderV2(0, 0, nil), "", true},
+		{"UNSPEC", proxyHeaderV2(1, 0, nil), "", true},
+		{"short IPv4", proxyHeaderV2(1, 0x11, ipv4[:8]), "", false},
+		{"short IPv6", proxyHeaderV2(1, 0x21, ipv6[:20]), "", false},
+		{"version 3", v3, "", false},
+		{"truncated", proxyHeaderV2(1, 0x11, ipv4)[:20], "", false},
+	} {
+		remote, err := readProxyHeaderV2(bufio.NewReader(bytes.NewReader(test.header)))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if got := addrString(remote); err == nil && got != test.remote {
+			t.Errorf("%s: remote %q, want %q", test.name, got, test.remote)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// proxyListen returns a PROXY protocol listener on the loopback interface,
+// trusting "trusted".
+func proxyListen(t *testing.T, trusted string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, n, err := net.ParseCIDR(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProxyProtocolListener(l, []*net.IPNet{n})
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l := proxyListen(t, "127.0.0.0/8")
+	defer l.Close()
+	for _, test := range []struct {
+		name   string
+		send   string
+		remote string
+		data   string
+		ok     bool
+	}{
+		{"header", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 104\r\nhello", "192.0.2.1:56324", "hello", true},
+		{"no header", "hello", "", "", false},
+		{"malformed header", "PROXY TCP4 nonsense\r\nhello", "", "", false},
+	} {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(test.send))
+		client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(conn)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+		if string(data) != test.data {
+			t.Errorf("%s: read %q, want %q", test.name, data, test.data)
+		}
+		if test.ok && conn.RemoteAddr().String() != test.remote {
+			t.Errorf("%s: remote %s, want %s", test.name, conn.RemoteAddr(), test.remote)
+		}
+		if test.ok && proxyAddr(conn) == nil {
+			t.Errorf("%s: no proxy address", test.name)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolListenerUntrusted(t *testing.T) {
+	l := proxyListen(t, "192.0.2.0/24")
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 104\r\n"))
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF && !isConnReset(err) {
+		t.Errorf("connection from an untrusted proxy not closed: %v", err)
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Errorf("connection from an untrusted proxy accepted")
+	default:
+	}
+}
+
+func isConnReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}
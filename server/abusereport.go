@@ -0,0 +1,205 @@
+package main
+
+// This file reports the sources of the events of some types, e.g., the
+// retrieval of images, to AbuseIPDB. A source is reported once a day at
+// most, as AbuseIPDB doesn't take more, and reports are spaced out like the
+// lookups of -abuseipdbkey.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// How long before a source is reported again.
+	abuseReportInterval = 24 * time.Hour
+	// The longest comment AbuseIPDB takes.
+	abuseMaxComment = 1024
+)
+
+// The AbuseIPDB categories (https://www.abuseipdb.com/categories) of the
+// events: Hacking for DICOM, Web App Attack for HTTP, Port Scan for
+// connections.
+var abuseCategories = map[string]string{
+	dicompot.EventConnectionOpened: "14",
+	dicompot.EventHTTPRequest:      "21",
+	dicompot.EventQIDO:             "15,21",
+	dicompot.EventWADO:             "15,21",
+	dicompot.EventSTOW:             "15,21",
+}
+
+type abuseReport struct {
+	ip, categories, comment string
+	time                    time.Time
+}
+
+// abuseReporter is an EventSink that reports the sources of the events of
+// the types it is given.
+type abuseReporter struct {
+	key      string
+	types    map[string]bool
+	comment  string
+	interval time.Duration
+	client   *http.Client
+	queue    chan abuseReport
+	// Closed by Close. The queue never is, for Record not to panic on
+	// events of sessions still open.
+	closing chan struct{}
+	once    sync.Once
+
+	mu sync.Mutex
+	// When each source was last reported.
+	reported map[string]time.Time
+}
+
+// newAbuseReporter returns the sink for -abuseipdbreport, reporting the
+// sources of the events of the comma-separated "types" with "comment", at
+// most "perDay" times a day, or nil if none are.
+func newAbuseReporter(key, types, comment string, perDay int) *abuseReporter {
+	if types == "" {
+		return nil
+	}
+	if key == "" {
+		log.Fatalf("-abuseipdbreport needs -abuseipdbkey")
+	}
+	if perDay <= 0 {
+		log.Fatalf("Invalid -reputationrate %d, want at least 1", perDay)
+	}
+	r := &abuseReporter{
+		key:      key,
+		types:    map[string]bool{},
+		comment:  comment,
+		interval: 24 * time.Hour / time.Duration(perDay),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		queue:    make(chan abuseReport, reputationQueueSize),
+		closing:  make(chan struct{}),
+		reported: map[string]time.Time{},
+	}
+	for _, t := range strings.Split(types, ",") {
+		r.types[strings.TrimSpace(t)] = true
+	}
+	go r.work()
+	log.Printf("-| Reporting the sources of %s to AbuseIPDB", types)
+	return r
+}
+
+// Record queues a report of the source of "event", if its type is reported
+// and the source wasn't lately.
+func (r *abuseReporter) Record(event dicompot.Event) error {
+	if !r.types[event.Type] {
+		return nil
+	}
+	ip := sourceIP(event)
+	if ip == nil || !isPublicIP(ip) {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if last, ok := r.reported[ip.String()]; ok && time.Since(last) < abuseReportInterval {
+		return nil
+	}
+	categories, ok := abuseCategories[event.Type]
+	if !ok {
+		categories = "15"
+	}
+	report := abuseReport{ip: ip.String(), categories: categories, comment: r.commentOf(event), time: event.Time}
+	select {
+	case <-r.closing:
+		return nil
+	default:
+	}
+	select {
+	case r.queue <- report:
+		r.reported[report.ip] = time.Now()
+	default:
+	}
+	return nil
+}
+
+// commentOf returns the comment of the report of "event": the -abuseipdbcomment,
+// its placeholders replaced.
+func (r *abuseReporter) commentOf(event dicompot.Event) string {
+	comment := strings.NewReplacer(
+		"{type}", event.Type,
+		"{command}", event.Command,
+		"{message}", event.Message,
+		"{aetitle}", event.CallingAETitle,
+		"{port}", strconv.Itoa(event.LocalPort),
+	).Replace(r.comment)
+	if len(comment) > abuseMaxComment {
+		comment = comment[:abuseMaxComment]
+	}
+	return comment
+}
+
+// work sends the queued reports, one every r.interval at most, until the
+// reporter is closed.
+func (r *abuseReporter) work() {
+	var last time.Time
+	for {
+		var report abuseReport
+		select {
+		case report = <-r.queue:
+		case <-r.closing:
+			return
+		}
+		select {
+		case <-time.After(time.Until(last.Add(r.interval))):
+		case <-r.closing:
+			return
+		}
+		last = time.Now()
+		if err := r.send(report); err != nil {
+			log.Printf("AbuseIPDB: failed to report %s: %v", report.ip, err)
+		}
+		r.mu.Lock()
+		for ip, t := range r.reported {
+			if time.Since(t) >= abuseReportInterval {
+				delete(r.reported, ip)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *abuseReporter) send(report abuseReport) error {
+	req, err := http.NewRequest("POST", "https://api.abuseipdb.com/api/v2/report", strings.NewReader(url.Values{
+		"ip":         {report.ip},
+		"categories": {report.categories},
+		"comment":    {report.comment},
+		"timestamp":  {report.time.Format(time.RFC3339)},
+	}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Key", r.key)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Close stops taking reports. The ones queued don't hold up the exit.
+func (r *abuseReporter) Close() error {
+	r.once.Do(func() { close(r.closing) })
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// aePolicy maps calling AE titles to what the server does with their
+// association requests. Patterns are shell globs, e.g., "STORESCU*", and
+// match case-insensitively.
+type aePolicy struct {
+	allow, deny, tarpit []string
+}
+
+func splitAEPatterns(value string) []string {
+	var patterns []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, strings.ToUpper(p))
+		}
+	}
+	return patterns
+}
+
+func newAEPolicy(allow, deny, tarpit string) *aePolicy {
+	return &aePolicy{
+		allow:  splitAEPatterns(allow),
+		deny:   splitAEPatterns(deny),
+		tarpit: splitAEPatterns(tarpit),
+	}
+}
+
+func matchAE(patterns []string, title string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, title); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decide implements dicompot.CallingAECallback. The tarpit list wins over the
+// deny list, which wins over the allow list. If the allow list is nonempty,
+// titles it doesn't list are rejected.
+func (p *aePolicy) decide(callingAETitle string) dicompot.AEDecision {
+	title := strings.ToUpper(callingAETitle)
+	switch {
+	case matchAE(p.tarpit, title):
+		return dicompot.AETarpit
+	case matchAE(p.deny, title):
+		return dicompot.AEReject
+	case len(p.allow) > 0 && !matchAE(p.allow, title):
+		return dicompot.AEReject
+	}
+	return dicompot.AEAccept
+}
@@ -0,0 +1,76 @@
+package main
+
+// This file adds the network the source of every event is in, from a
+// MaxMind GeoLite2 or GeoIP2 ASN database, as the fields ASN,
+// ASOrganization and ASNetwork (the prefix announced), which tell cloud
+// scanners from hospitals and universities.
+
+import (
+	"log"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// asnRecord is the record of a network in an ASN database.
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// asnLookup is an EventSink that adds the autonomous system of the source
+// to the events it hands to "next".
+type asnLookup struct {
+	next dicompot.EventSink
+	db   *maxminddb.Reader
+}
+
+// newASNLookup returns the enricher for -asn, or nil if networks aren't
+// looked up.
+func newASNLookup(path string, next dicompot.EventSink) *asnLookup {
+	if path == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open -asn %s: %v", path, err)
+	}
+	if !strings.Contains(db.Metadata.DatabaseType, "ASN") {
+		log.Fatalf("-asn %s is a %s database, want an ASN one", path, db.Metadata.DatabaseType)
+	}
+	log.Printf("-| Looking up the networks of sources with %s, built %d", db.Metadata.DatabaseType, db.Metadata.BuildEpoch)
+	return &asnLookup{next: next, db: db}
+}
+
+// Record adds the network of the source of "event", if the database has it,
+// and hands the event to "next".
+func (a *asnLookup) Record(event dicompot.Event) error {
+	if ip := sourceIP(event); ip != nil {
+		var rec asnRecord
+		network, ok, err := a.db.LookupNetwork(ip, &rec)
+		if err == nil && ok && rec.Number != 0 {
+			fields := map[string]interface{}{
+				"ASN":       int(rec.Number),
+				"ASNetwork": network.String(),
+			}
+			if rec.Organization != "" {
+				fields["ASOrganization"] = rec.Organization
+			}
+			for name, value := range event.Fields {
+				fields[name] = value
+			}
+			event.Fields = fields
+		}
+	}
+	return a.next.Record(event)
+}
+
+// Close closes "next", then the database.
+func (a *asnLookup) Close() error {
+	err := a.next.Close()
+	if cerr := a.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+// This file sends the events to Azure Monitor Logs, for Microsoft Sentinel
+// to ingest them without an agent. It uses the Logs Ingestion API, through a
+// data collection endpoint and rule, which replaced the HTTP Data Collector
+// API; the application whose credentials are used needs the Monitoring
+// Metrics Publisher role on the rule.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// The largest body the Logs Ingestion API takes, with room to spare.
+const azureMaxBatchBytes = 900 << 10
+
+// azure is a Logs Ingestion API client.
+type azure struct {
+	url                            string
+	tenant, clientID, clientSecret string
+	client                         *http.Client
+
+	// Only used from the goroutine of the queuedSink.
+	token   string
+	expires time.Time
+}
+
+// newAzureSink returns the sink for -azureendpoint and friends, or nil if
+// events aren't sent.
+func newAzureSink(endpoint, rule, stream, tenant, clientID, clientSecret string) dicompot.EventSink {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		log.Fatalf("Invalid -azureendpoint %q, want the https:// URL of a data collection endpoint", endpoint)
+	}
+	if rule == "" || stream == "" || tenant == "" || clientID == "" || clientSecret == "" {
+		log.Fatalf("-azureendpoint needs -azurerule, -azurestream, -azuretenant, -azureclientid and -azureclientsecret")
+	}
+	a := &azure{
+		url: fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=2023-01-01",
+			strings.TrimRight(endpoint, "/"), url.PathEscape(rule), url.PathEscape(stream)),
+		tenant:       tenant,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	log.Printf("-| Sending events to Azure Monitor: %s, rule %s, stream %s", u.Host, rule, stream)
+	return newQueuedSink("Azure Monitor", 500, time.Second, a.send)
+}
+
+// accessToken returns a token of the application for Azure Monitor, from
+// Microsoft Entra ID, until shortly before it expires.
+func (a *azure) accessToken() (string, error) {
+	if a.token != "" && time.Now().Before(a.expires) {
+		return a.token, nil
+	}
+	resp, err := a.client.PostForm("https://login.microsoftonline.com/"+url.PathEscape(a.tenant)+"/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.clientID},
+		"client_secret": {a.clientSecret},
+		"scope":         {"https://monitor.azure.com//.default"},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("token: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("token: %s: %s", resp.Status, token.ErrorDescription)
+	}
+	a.token = token.AccessToken
+	a.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return a.token, nil
+}
+
+// azureRecord returns "event" with the columns of the stream: TimeGenerated,
+// Level, Type, SessionId, RemoteIP, RemotePort, LocalPort, CallingAETitle,
+// CalledAETitle, Command, Message, QueryTerms (strings and integers) and
+// Fields (dynamic).
+func azureRecord(event dicompot.Event) map[string]interface{} {
+	return map[string]interface{}{
+		"TimeGenerated":  event.Time.UTC().Format(time.RFC3339Nano),
+		"Level":          event.Level.String(),
+		"Type":           event.Type,
+		"SessionId":      event.SessionID,
+		"RemoteIP":       event.RemoteIP,
+		"RemotePort":     event.RemotePort,
+		"LocalPort":      event.LocalPort,
+		"CallingAETitle": event.CallingAETitle,
+		"CalledAETitle":  event.CalledAETitle,
+		"Command":        event.Command,
+		"Message":        event.Message,
+		"QueryTerms":     queryTerms(event),
+		"Fields":         event.Fields,
+	}
+}
+
+// send posts the events, as JSON arrays within the size limit of the API.
+func (a *azure) send(events []dicompot.Event) error {
+	token, err := a.accessToken()
+	if err != nil {
+		return err
+	}
+	var records [][]byte
+	for _, event := range events {
+		if b, err := json.Marshal(azureRecord(event)); err == nil {
+			records = append(records, b)
+		}
+	}
+	for len(records) > 0 {
+		body := bytes.NewBufferString("[")
+		n := 0
+		for ; n < len(records); n++ {
+			if n > 0 && body.Len()+len(records[n])+2 > azureMaxBatchBytes {
+				break
+			}
+			if n > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(records[n])
+		}
+		body.WriteByte(']')
+		if err := a.post(token, body.Bytes(), n); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// post makes one call. Records the API rejects as malformed are logged and
+// dropped; other failures are retried.
+func (a *azure) post(token string, body []byte, n int) error {
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		log.Printf("Azure Monitor: rejected %d events: %v", n, err)
+		return nil
+	case http.StatusUnauthorized:
+		a.token = ""
+	}
+	return err
+}
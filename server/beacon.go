@@ -0,0 +1,99 @@
+package main
+
+// This file plants beacons in the instances served: URLs of a canary token
+// service, e.g., canarytokens.org, put where viewers and PACS importers look
+// for links to follow. Whoever opens the stolen copy calls home.
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// Where the beacons go, besides Institution Address and Retrieve URI. The
+// private block reads like a vendor's own, rather than the honeypot's.
+var (
+	retrieveURLTag    = dicomtag.Tag{Group: 0x0008, Element: 0x1190}
+	beaconCreatorTag  = dicomtag.Tag{Group: 0x0009, Element: 0x0010}
+	beaconFirstTag    = dicomtag.Tag{Group: 0x0009, Element: 0x1001}
+	beaconCreatorName = "PACS_LINK_01"
+)
+
+// beacon holds the canary tokens planted in the instances served.
+type beacon struct {
+	// A web token. "{session}" is replaced with the session ID.
+	url string
+	// A DNS token. The session ID is prepended as a subdomain, which DNS
+	// token services report along with the hit.
+	host string
+}
+
+// newBeacon returns the beacon for -beaconurl and -beaconhost, or nil if
+// neither is set.
+func newBeacon(url, host string) *beacon {
+	if url == "" && host == "" {
+		return nil
+	}
+	if url != "" && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		log.Fatalf("Invalid -beaconurl %q, want an http:// or https:// URL", url)
+	}
+	return &beacon{url: url, host: strings.Trim(host, ".")}
+}
+
+// urls returns the URLs planted in session "sessionID", the web token first.
+func (b *beacon) urls(sessionID string) []string {
+	var urls []string
+	if b.url != "" {
+		urls = append(urls, strings.Replace(b.url, "{session}", sessionID, -1))
+	}
+	if b.host != "" {
+		urls = append(urls, "http://"+sessionID+"."+b.host+"/wado")
+	}
+	return urls
+}
+
+// plantBeacon adds the beacons to "ds", read from "path", before it is served
+// in session "sessionID".
+func (ss *server) plantBeacon(ds *dicom.DataSet, path, sessionID string) {
+	if ss.beacon == nil {
+		return
+	}
+	urls := ss.beacon.urls(sessionID)
+	planted := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.InstitutionAddress, urls[0]),
+		// NewElement rejects UT values.
+		{Tag: dicomtag.RetrieveURI, VR: "UT", Value: []interface{}{urls[0]}},
+		{Tag: retrieveURLTag, VR: "UR", Value: []interface{}{urls[0]}},
+		{Tag: beaconCreatorTag, VR: "LO", Value: []interface{}{beaconCreatorName}},
+	}
+	for i, url := range urls {
+		tag := beaconFirstTag
+		tag.Element += uint16(i)
+		planted = append(planted, &dicom.Element{Tag: tag, VR: "UT", Value: []interface{}{url}})
+	}
+	replaced := map[dicomtag.Tag]bool{}
+	for _, elem := range planted {
+		replaced[elem.Tag] = true
+	}
+	elems := planted
+	for _, elem := range ds.Elements {
+		// The whole private group goes, so a block of the same number
+		// can't get mixed up with ours.
+		if !replaced[elem.Tag] && elem.Tag.Group != beaconCreatorTag.Group {
+			elems = append(elems, elem)
+		}
+	}
+	sort.SliceStable(elems, func(i, j int) bool {
+		return elems[i].Tag.Compare(elems[j].Tag) < 0
+	})
+	ds.Elements = elems
+	ss.record(logrus.WarnLevel, dicompot.EventBeacon, sessionID, "Beacon served", map[string]interface{}{
+		"Path": path,
+		"URLs": urls,
+	})
+}
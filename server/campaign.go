@@ -0,0 +1,205 @@
+package main
+
+// This file groups the sessions into campaigns, and adds the ID of its
+// campaign, as the field Campaign, to every event of a session. Sessions
+// are of the same campaign when they share, within -campaignwindow of its
+// last activity, a source IP, a client (the calling AE title with the
+// implementation class UID and version name the tool sends) or a search
+// (the query terms of a C-FIND, C-MOVE or C-GET). A session that turns out
+// to share something with another campaign than the one it started in
+// joins the older of the two: the other one is merged into it, from then
+// on, which an EventCampaign records.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// campaign is a group of sessions.
+type campaign struct {
+	// Derived from what started it and when, e.g., the source IP.
+	id          string
+	first, last time.Time
+	sessions    int
+	// The campaign it was merged into, if it was.
+	mergedInto *campaign
+}
+
+// current returns the campaign "c" is part of now.
+func (c *campaign) current() *campaign {
+	for c.mergedInto != nil {
+		c = c.mergedInto
+	}
+	return c
+}
+
+// campaigns is an EventSink that adds the campaign of their session to the
+// events it hands to "next".
+type campaigns struct {
+	next   dicompot.EventSink
+	window time.Duration
+
+	mu sync.Mutex
+	// The campaign of each source IP, client and search.
+	byKey map[string]*campaign
+	// The campaign of each session in progress.
+	bySession map[string]*campaign
+	pruned    time.Time
+}
+
+// newCampaigns returns the enricher for -campaigns, or nil if sessions
+// aren't grouped.
+func newCampaigns(enabled bool, window time.Duration, next dicompot.EventSink) *campaigns {
+	if !enabled {
+		return nil
+	}
+	if window <= 0 {
+		log.Fatalf("Invalid -campaignwindow %s", window)
+	}
+	log.Printf("-| Grouping the sessions into campaigns, %s apart at most", window)
+	return &campaigns{
+		next:      next,
+		window:    window,
+		byKey:     map[string]*campaign{},
+		bySession: map[string]*campaign{},
+		pruned:    time.Now(),
+	}
+}
+
+// campaignKeys returns what "event" tells of its session that links it to
+// others.
+func campaignKeys(event dicompot.Event) []string {
+	var keys []string
+	if ip := sourceIP(event); ip != nil {
+		keys = append(keys, "ip "+ip.String())
+	}
+	switch event.Type {
+	case dicompot.EventAssociationClient:
+		if uid := stringField(event, "ImplementationClassUID"); uid != "" {
+			keys = append(keys, fmt.Sprintf("client %s/%s/%s", event.CallingAETitle, uid, stringField(event, "Version")))
+		}
+	case dicompot.EventCFindQuery, dicompot.EventCMove, dicompot.EventCGet:
+		if terms := queryTerms(event); terms != "" {
+			keys = append(keys, "search "+terms)
+		}
+	}
+	return keys
+}
+
+// Record adds the campaign of the session of "event", and hands the event,
+// and the merge of two campaigns if it causes one, to "next".
+func (cs *campaigns) Record(event dicompot.Event) error {
+	if event.SessionID == "" {
+		return cs.next.Record(event)
+	}
+	c, merged := cs.assign(event)
+	fields := map[string]interface{}{"Campaign": c.id}
+	for name, value := range event.Fields {
+		fields[name] = value
+	}
+	event.Fields = fields
+	err := cs.next.Record(event)
+	for _, m := range merged {
+		e := dicompot.NewEvent(logrus.InfoLevel, dicompot.EventCampaign, event.SessionID, "Campaigns merged", map[string]interface{}{
+			"Campaign": c.id,
+			"Merged":   m.id,
+			"Sessions": c.sessions,
+			"Since":    logTime(c.first),
+		})
+		if recordErr := cs.next.Record(e); err == nil {
+			err = recordErr
+		}
+	}
+	return err
+}
+
+// assign returns the campaign of the session of "event", and the campaigns
+// merged into it on the way.
+func (cs *campaigns) assign(event dicompot.Event) (*campaign, []*campaign) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	now := event.Time
+	if now.Sub(cs.pruned) > cs.window {
+		cs.prune(now)
+	}
+
+	var c *campaign
+	if s := cs.bySession[event.SessionID]; s != nil {
+		c = s.current()
+	}
+	keys := campaignKeys(event)
+	var merged []*campaign
+	for _, key := range keys {
+		k := cs.byKey[key]
+		if k == nil {
+			continue
+		}
+		k = k.current()
+		if k == c || now.Sub(k.last) > cs.window {
+			continue
+		}
+		if c == nil {
+			c = k
+			c.sessions++
+			continue
+		}
+		// The older campaign takes in the other.
+		older, newer := c, k
+		if k.first.Before(c.first) {
+			older, newer = k, c
+		}
+		newer.mergedInto = older
+		older.sessions += newer.sessions
+		if newer.last.After(older.last) {
+			older.last = newer.last
+		}
+		merged = append(merged, newer)
+		c = older
+	}
+	if c == nil {
+		founder := event.SessionID
+		if len(keys) > 0 {
+			founder = keys[0]
+		}
+		sum := sha256.Sum256([]byte(founder + " " + now.UTC().Format(time.RFC3339Nano)))
+		c = &campaign{id: fmt.Sprintf("%x", sum[:6]), first: now, sessions: 1}
+	}
+	for _, key := range keys {
+		cs.byKey[key] = c
+	}
+	c.last = now
+	if event.Type == dicompot.EventConnectionClosed {
+		delete(cs.bySession, event.SessionID)
+	} else {
+		cs.bySession[event.SessionID] = c
+	}
+	return c, merged
+}
+
+// prune forgets the keys and sessions of the campaigns over, e.g., of
+// DICOMweb requests, which don't end with EventConnectionClosed. cs.mu must
+// be held.
+func (cs *campaigns) prune(now time.Time) {
+	for key, c := range cs.byKey {
+		if now.Sub(c.current().last) > cs.window {
+			delete(cs.byKey, key)
+		}
+	}
+	for id, c := range cs.bySession {
+		if now.Sub(c.current().last) > cs.window {
+			delete(cs.bySession, id)
+		}
+	}
+	cs.pruned = now
+}
+
+// Close closes "next".
+func (cs *campaigns) Close() error {
+	return cs.next.Close()
+}
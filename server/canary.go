@@ -0,0 +1,156 @@
+package main
+
+// This file gives the instances served canary UIDs: UIDs under a root of the
+// operator's, that tell which honeypot and session a copy came from if it
+// ever surfaces again.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// Longest UID allowed. P3.5, 9.1.
+const maxUIDLength = 64
+
+// Longest canary root accepted, leaving room for the session and instance
+// components.
+const maxCanaryRootLength = 30
+
+// The UIDs rewritten, with the log field of each.
+var canaryTags = []struct {
+	tag   dicomtag.Tag
+	field string
+}{
+	{dicomtag.StudyInstanceUID, "StudyInstanceUID"},
+	{dicomtag.SeriesInstanceUID, "SeriesInstanceUID"},
+	{dicomtag.SOPInstanceUID, "SOPInstanceUID"},
+	{dicomtag.MediaStorageSOPInstanceUID, ""},
+}
+
+// canary mints the canary UIDs of one deployment.
+type canary struct {
+	root string
+}
+
+// newCanary returns the canary for -canaryroot, or nil if "root" is empty.
+func newCanary(root string) *canary {
+	if root == "" {
+		return nil
+	}
+	valid := len(root) <= maxCanaryRootLength
+	for _, component := range strings.Split(root, ".") {
+		if component == "" || strings.Trim(component, "0123456789") != "" || (len(component) > 1 && component[0] == '0') {
+			valid = false
+		}
+	}
+	if !valid {
+		log.Fatalf("Invalid -canaryroot %q, want a UID of at most %d characters, e.g., 1.2.826.0.1.3680043.10.99", root, maxCanaryRootLength)
+	}
+	return &canary{root: root}
+}
+
+// uidSession returns the part of a session ID that goes into its canary
+// UIDs: the first 64 bits of the UUID, in decimal. A whole UUID doesn't fit
+// next to most roots.
+func uidSession(sessionID string) string {
+	b, err := hex.DecodeString(strings.Replace(sessionID, "-", "", -1))
+	if err != nil || len(b) < 8 {
+		return ""
+	}
+	n := binary.BigEndian.Uint64(b)
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// uid returns the canary UID that stands for "original" in session
+// "sessionID": <root>.<session>.<digest>. The same original gets the same
+// canary within a session, so a study keeps hanging together. If the session
+// doesn't fit, it is left out, and only the log tells.
+func (c *canary) uid(sessionID, original string) string {
+	sum := sha256.Sum256([]byte(sessionID + "/" + original))
+	digest := fmt.Sprintf("%d", binary.BigEndian.Uint32(sum[:]))
+	session := uidSession(sessionID)
+	uid := c.root + "." + session + "." + digest
+	if session == "" || len(uid) > maxUIDLength {
+		uid = c.root + "." + digest
+	}
+	if len(uid) > maxUIDLength {
+		uid = strings.TrimRight(uid[:maxUIDLength], ".")
+	}
+	return uid
+}
+
+// markCanary rewrites the UIDs of "ds", read from "path", before it is
+// served in session "sessionID", and logs the mapping.
+func (ss *server) markCanary(ds *dicom.DataSet, path, sessionID string) {
+	if ss.canary == nil {
+		return
+	}
+	fields := map[string]interface{}{"Path": path}
+	for _, t := range canaryTags {
+		elem, err := ds.FindElementByTag(t.tag)
+		if err != nil {
+			continue
+		}
+		original, err := elem.GetString()
+		if err != nil {
+			continue
+		}
+		uid := ss.canary.uid(sessionID, strings.TrimSpace(original))
+		elem.Value = []interface{}{uid}
+		if t.field != "" {
+			fields[t.field] = original
+			fields["Canary"+t.field] = uid
+		}
+	}
+	ss.record(logrus.WarnLevel, dicompot.EventCanaryUID, sessionID, "Canary UIDs served", fields)
+}
+
+// readDataSet reads the DICOM file at "path", to be served in session
+// "sessionID": de-identified, with the dates of the rotation, canary or
+// session UIDs, and beacons.
+func (ss *server) readDataSet(path string, options dicom.ReadOptions, sessionID string) (*dicom.DataSet, error) {
+	ds, err := dicompot.ReadDataSetFromFile(path, options)
+	if err != nil {
+		return nil, err
+	}
+	ss.deid.apply(ds)
+	if ss.rotation != nil {
+		shiftDates(ds, ss.rotation.shiftFor(ds))
+	}
+	ss.markCanary(ds, path, sessionID)
+	ss.markSessionUIDs(ds, path, sessionID)
+	ss.plantBeacon(ds, path, sessionID)
+	return ds, nil
+}
+
+// readFile is readDataSet for the whole file, encoded. The file is sent as
+// is if there is nothing to rewrite.
+func (ss *server) readFile(path string, sessionID string) ([]byte, error) {
+	if ss.deid == nil && ss.canary == nil && ss.beacon == nil && ss.rotation == nil && ss.sessionUIDs == nil {
+		return ioutil.ReadFile(path)
+	}
+	ds, err := ss.readDataSet(path, dicom.ReadOptions{}, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := dicom.WriteDataSet(&buf, ds); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// newCapture returns the capture for -pcapdir and friends, or nil if
+// connections aren't recorded. Sizes are in MB.
+func newCapture(dir string, maxFileSize, retention int64) *dicompot.Capture {
+	if dir == "" {
+		return nil
+	}
+	if maxFileSize < 0 || retention < 0 {
+		log.Fatalf("-pcapmaxsize and -pcapretention must not be negative")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatalf("Failed to create -pcapdir %s: %v", dir, err)
+	}
+	log.Printf("-| Capturing connections to: %s", dir)
+	return &dicompot.Capture{
+		Dir:          dir,
+		MaxFileSize:  maxFileSize << 20,
+		MaxTotalSize: retention << 20,
+	}
+}
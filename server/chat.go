@@ -0,0 +1,259 @@
+package main
+
+// This file posts alerts to Slack, Discord and Microsoft Teams channels,
+// through their incoming webhooks, so that a team sees what the honeypot
+// meets as it happens, e.g., "C-MOVE from 192.0.2.7 (RU), AE FINDSCU, 37
+// images requested". Each channel has a least severe level of its own, and
+// the alerts pending when one is sent go in the same message, so that a
+// flood doesn't get the channel throttled.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Alerts of a message, at most.
+	chatMaxAlerts = 20
+	// The longest message; Discord takes no more.
+	chatMaxMessage = 2000
+)
+
+// chatChannel is a channel alerts are posted to.
+type chatChannel struct {
+	kind     string
+	url      string
+	level    logrus.Level
+	template string
+	client   *http.Client
+}
+
+// chatAlerter is an EventSink that hands each channel the events of the
+// types it is given, of its level or more severe.
+type chatAlerter struct {
+	types    map[string]bool
+	channels []*chatChannel
+	sinks    []*queuedSink
+
+	mu sync.Mutex
+	// The last retrieval command of each session, which the matches of
+	// the next c-find-result are of.
+	retrievals map[string]string
+}
+
+// parseChatChannels parses the value of -chat, e.g.,
+// "slack/warning=https://hooks.slack.com/services/...,discord=https://...".
+// Channels without a level take "defaultLevel".
+func parseChatChannels(value string, defaultLevel logrus.Level) []*chatChannel {
+	var channels []*chatChannel
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eq := strings.Index(entry, "=")
+		if eq < 0 {
+			log.Fatalf("Invalid -chat entry %q, want kind[/level]=URL", entry)
+		}
+		parts := strings.SplitN(entry[:eq], "/", 2)
+		c := &chatChannel{kind: strings.ToLower(parts[0]), url: entry[eq+1:], level: defaultLevel}
+		switch c.kind {
+		case "slack", "discord", "teams":
+		default:
+			log.Fatalf("Invalid -chat entry %q, want slack, discord or teams", entry)
+		}
+		if len(parts) == 2 {
+			level, err := logrus.ParseLevel(parts[1])
+			if err != nil {
+				log.Fatalf("Invalid -chat entry %q, want a level of debug, info, warning or error", entry)
+			}
+			c.level = level
+		}
+		if u, err := url.Parse(c.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid -chat entry %q, want the URL of an incoming webhook", entry)
+		}
+		channels = append(channels, c)
+	}
+	return channels
+}
+
+// newChatAlerter returns the sink for -chat and friends, alerting of the
+// events of the comma-separated "types" with "template", or nil if there are
+// no channels.
+func newChatAlerter(channels, types, template string) *chatAlerter {
+	if channels == "" {
+		return nil
+	}
+	a := &chatAlerter{
+		types:      map[string]bool{},
+		channels:   parseChatChannels(channels, logrus.WarnLevel),
+		retrievals: map[string]string{},
+	}
+	for _, t := range strings.Split(types, ",") {
+		a.types[strings.TrimSpace(t)] = true
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, c := range a.channels {
+		c.template, c.client = template, client
+		a.sinks = append(a.sinks, newQueuedSink("Chat "+c.kind, chatMaxAlerts, 2*time.Second, c.post))
+		log.Printf("-| Alerting a %s channel of %s events, %s or more severe", c.kind, types, c.level)
+	}
+	return a
+}
+
+// Record hands the event to the channels of its level, if it is of a type
+// alerted of.
+func (a *chatAlerter) Record(event dicompot.Event) error {
+	a.mu.Lock()
+	switch event.Type {
+	case dicompot.EventCMove, dicompot.EventCGet:
+		a.retrievals[event.SessionID] = event.Command
+	case dicompot.EventCFind:
+		delete(a.retrievals, event.SessionID)
+	case dicompot.EventCFindResult:
+		if command, ok := a.retrievals[event.SessionID]; ok {
+			event.Command = command
+		}
+	case dicompot.EventConnectionClosed:
+		delete(a.retrievals, event.SessionID)
+	}
+	a.mu.Unlock()
+	if !a.types[event.Type] {
+		return nil
+	}
+	for i, c := range a.channels {
+		if event.Level <= c.level {
+			a.sinks[i].Record(event)
+		}
+	}
+	return nil
+}
+
+// Close sends the alerts pending.
+func (a *chatAlerter) Close() error {
+	for _, s := range a.sinks {
+		s.Close()
+	}
+	return nil
+}
+
+// chatDetail returns what "event" is about, for {detail}.
+func chatDetail(event dicompot.Event) string {
+	if event.Type == dicompot.EventCFindResult {
+		n, _ := event.Fields["Matches"].(int)
+		if event.Command == "C-MOVE" || event.Command == "C-GET" {
+			return fmt.Sprintf("%d images requested", n)
+		}
+		return fmt.Sprintf("%d matches", n)
+	}
+	if terms := queryTerms(event); terms != "" {
+		return event.Message + ": " + terms
+	}
+	return event.Message
+}
+
+// chatAlert returns the alert of "event": "template", its placeholders
+// replaced.
+func chatAlert(template string, event dicompot.Event) string {
+	command := event.Command
+	if command == "" {
+		command = strings.ToUpper(event.Type)
+	}
+	source, country := "an unknown source", stringField(event, "GeoCountry")
+	if ip := sourceIP(event); ip != nil {
+		source = ip.String()
+	}
+	if country == "" {
+		country = "unknown"
+	}
+	aeTitle := event.CallingAETitle
+	if aeTitle == "" {
+		aeTitle = "none"
+	}
+	return strings.NewReplacer(
+		"{type}", event.Type,
+		"{command}", command,
+		"{message}", event.Message,
+		"{detail}", chatDetail(event),
+		"{ip}", source,
+		"{country}", country,
+		"{aetitle}", aeTitle,
+		"{port}", strconv.Itoa(event.LocalPort),
+		"{level}", event.Level.String(),
+		"{session}", event.SessionID,
+	).Replace(template)
+}
+
+// post posts the alerts of the events as one message.
+func (c *chatChannel) post(events []dicompot.Event) error {
+	var lines []string
+	for _, event := range events {
+		lines = append(lines, chatAlert(c.template, event))
+	}
+	text := strings.Join(lines, "\n")
+	if len(text) > chatMaxMessage {
+		text = text[:chatMaxMessage-3] + "..."
+	}
+	var message interface{}
+	switch c.kind {
+	case "slack":
+		message = map[string]string{"text": text}
+	case "discord":
+		message = map[string]interface{}{
+			"username":         "dicompot",
+			"content":          text,
+			"allowed_mentions": map[string][]string{"parse": {}},
+		}
+	case "teams":
+		// An Adaptive Card, which the Workflows webhooks want.
+		message = map[string]interface{}{
+			"type": "message",
+			"attachments": []interface{}{map[string]interface{}{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]interface{}{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body": []interface{}{map[string]interface{}{
+						"type": "TextBlock",
+						"text": strings.Replace(text, "\n", "\n\n", -1),
+						"wrap": true,
+					}},
+				},
+			}},
+		}
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		log.Printf("Chat %s: rejected %d alerts: %v", c.kind, len(events), err)
+		return nil
+	}
+	return err
+}
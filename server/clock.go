@@ -0,0 +1,76 @@
+package main
+
+// This file orders the logs and events of a fleet of sensors once merged:
+// their timestamps are in UTC, in RFC 3339 with milliseconds, unless
+// -localtime, and every event gets a sequence number, Seq, from 1 at
+// startup, in the order the events are recorded, for those of one sensor
+// within a millisecond to stay in order.
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// The timestamps of the logs.
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// logLocation is the time zone of the timestamps of the logs and events:
+// UTC, or the local one with -localtime.
+var logLocation = time.UTC
+
+// logTime returns "t" as the logs and events write it.
+func logTime(t time.Time) string {
+	return t.In(logLocation).Format(logTimeFormat)
+}
+
+// timeZoneHook is a logrus.Hook that moves the time of the entries to
+// logLocation, for the formatters and the other hooks, added after it, to
+// write it there.
+type timeZoneHook struct{}
+
+func (timeZoneHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (timeZoneHook) Fire(entry *logrus.Entry) error {
+	entry.Time = entry.Time.In(logLocation)
+	return nil
+}
+
+// sequencer is an EventSink that moves the time of the events to
+// logLocation, numbers them, and hands them to "next".
+type sequencer struct {
+	// First, for 64-bit alignment.
+	seq  uint64
+	next dicompot.EventSink
+}
+
+// newSequencer returns the sequencer of the events handed to "next".
+func newSequencer(next dicompot.EventSink) *sequencer {
+	return &sequencer{next: next}
+}
+
+// Record numbers "event", unless it already is, e.g., if a sensor forwarded
+// it, and hands it to "next". Only the numbering is atomic: a sink that
+// blocks holds up the session of the event, not the others.
+func (s *sequencer) Record(event dicompot.Event) error {
+	event.Time = event.Time.In(logLocation)
+	if _, ok := event.Fields["Seq"]; ok {
+		return s.next.Record(event)
+	}
+	fields := make(map[string]interface{}, len(event.Fields)+1)
+	for name, value := range event.Fields {
+		fields[name] = value
+	}
+	fields["Seq"] = atomic.AddUint64(&s.seq, 1)
+	event.Fields = fields
+	return s.next.Record(event)
+}
+
+// Close closes "next".
+func (s *sequencer) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// recordingSink keeps the events it records.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []dicompot.Event
+}
+
+func (r *recordingSink) Record(event dicompot.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *recordingSink) Close() error { return nil }
+
+func TestSequencer(t *testing.T) {
+	r := &recordingSink{}
+	s := newSequencer(r)
+	s.Record(dicompot.Event{Fields: map[string]interface{}{}})
+	// Forwarded by a sensor, with its own number.
+	s.Record(dicompot.Event{Fields: map[string]interface{}{"Seq": uint64(42)}})
+	s.Record(dicompot.Event{})
+	for i, want := range []uint64{1, 42, 2} {
+		if got := r.events[i].Fields["Seq"]; got != want {
+			t.Errorf("event %d numbered %v, want %d", i, got, want)
+		}
+	}
+}
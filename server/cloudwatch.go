@@ -0,0 +1,174 @@
+package main
+
+// This file ships the events to a CloudWatch Logs group, for honeypots
+// deployed in AWS. Credentials and, unless -cloudwatchregion, the region
+// come from the environment, the shared configuration or the instance role,
+// as for the AWS CLI.
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/nsmfoo/dicompot"
+)
+
+// The limits of PutLogEvents.
+const (
+	cloudWatchMaxBatchBytes = 1048576
+	// Bytes counted for every event, besides its message.
+	cloudWatchEventOverhead = 26
+)
+
+// cloudWatch is a CloudWatch Logs client.
+type cloudWatch struct {
+	client        *cloudwatchlogs.CloudWatchLogs
+	group, stream string
+
+	// Only used from the goroutine of the queuedSink.
+	ready         bool
+	sequenceToken *string
+}
+
+// newCloudWatchSink returns the sink for -cloudwatchgroup and friends, or nil
+// if events aren't shipped. The stream is named after the host by default.
+func newCloudWatchSink(group, stream, region string) dicompot.EventSink {
+	if group == "" {
+		return nil
+	}
+	if stream == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			log.Fatalf("-cloudwatchgroup needs -cloudwatchstream")
+		}
+		stream = hostname
+	}
+	config := aws.NewConfig()
+	if region != "" {
+		config = config.WithRegion(region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{Config: *config, SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		log.Fatalf("Failed to configure AWS: %v", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		log.Fatalf("-cloudwatchgroup needs a region: -cloudwatchregion, or AWS_REGION")
+	}
+	c := &cloudWatch{client: cloudwatchlogs.New(sess), group: group, stream: stream}
+	log.Printf("-| Shipping events to CloudWatch Logs: %s, group %s, stream %s", aws.StringValue(sess.Config.Region), group, stream)
+	return newQueuedSink("CloudWatch", 1000, time.Second, c.put)
+}
+
+// prepare creates the group and the stream, unless they exist, and reads the
+// sequence token of the stream.
+func (c *cloudWatch) prepare() error {
+	_, err := c.client.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: aws.String(c.group)})
+	if err != nil && !isAWSError(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+		return err
+	}
+	_, err = c.client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(c.group),
+		LogStreamName: aws.String(c.stream),
+	})
+	if err != nil && !isAWSError(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+		return err
+	}
+	out, err := c.client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(c.group),
+		LogStreamNamePrefix: aws.String(c.stream),
+	})
+	if err != nil {
+		return err
+	}
+	c.sequenceToken = nil
+	for _, s := range out.LogStreams {
+		if aws.StringValue(s.LogStreamName) == c.stream {
+			c.sequenceToken = s.UploadSequenceToken
+		}
+	}
+	c.ready = true
+	return nil
+}
+
+func isAWSError(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
+
+// put ships the events, in JSON, in as few calls as the limits allow.
+func (c *cloudWatch) put(events []dicompot.Event) error {
+	if !c.ready {
+		if err := c.prepare(); err != nil {
+			return err
+		}
+	}
+	var logEvents []*cloudwatchlogs.InputLogEvent
+	for _, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		logEvents = append(logEvents, &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(string(b)),
+			Timestamp: aws.Int64(event.Time.UnixNano() / 1e6),
+		})
+	}
+	// CloudWatch wants them in order.
+	sort.SliceStable(logEvents, func(i, j int) bool {
+		return *logEvents[i].Timestamp < *logEvents[j].Timestamp
+	})
+	for len(logEvents) > 0 {
+		n, size := 0, 0
+		for ; n < len(logEvents); n++ {
+			size += len(*logEvents[n].Message) + cloudWatchEventOverhead
+			if size > cloudWatchMaxBatchBytes && n > 0 {
+				break
+			}
+		}
+		if err := c.putBatch(logEvents[:n]); err != nil {
+			return err
+		}
+		logEvents = logEvents[n:]
+	}
+	return nil
+}
+
+// putBatch makes one PutLogEvents call. A stale sequence token, e.g., after
+// another writer, is replaced with the one CloudWatch expects, once.
+func (c *cloudWatch) putBatch(logEvents []*cloudwatchlogs.InputLogEvent) error {
+	for attempt := 0; ; attempt++ {
+		out, err := c.client.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(c.group),
+			LogStreamName: aws.String(c.stream),
+			LogEvents:     logEvents,
+			SequenceToken: c.sequenceToken,
+		})
+		switch e := err.(type) {
+		case nil:
+			c.sequenceToken = out.NextSequenceToken
+			if info := out.RejectedLogEventsInfo; info != nil {
+				log.Printf("CloudWatch: rejected events: %s", info)
+			}
+			return nil
+		case *cloudwatchlogs.DataAlreadyAcceptedException:
+			// Sent already, by an attempt that seemed to fail.
+			c.sequenceToken = e.ExpectedSequenceToken
+			return nil
+		case *cloudwatchlogs.InvalidSequenceTokenException:
+			c.sequenceToken = e.ExpectedSequenceToken
+			if attempt == 0 {
+				continue
+			}
+		case *cloudwatchlogs.ResourceNotFoundException:
+			// The group or stream was deleted.
+			c.ready = false
+		}
+		return err
+	}
+}
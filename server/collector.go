@@ -0,0 +1,226 @@
+package main
+
+// This file lets a fleet of sensors forward their events to a central
+// dicompot, the collector, over mutually authenticated TLS, without a
+// pipeline of third parties: the collector enriches, stores and serves the
+// events (log, database, dashboard, API...) as it does its own, with the
+// common name of the certificate of the sensor as the field ForwardedBy.
+// Sensors run with -collector host:port, the collector with -collect :port;
+// each presents -collectorcert and -collectorkey, and verifies the other
+// against -collectorca.
+//
+// The protocol is NDJSON: a batch of events, one per line, in the schema of
+// the event log, then an empty line, which the collector answers with "OK"
+// once it recorded them all, or "ERR" and why. A batch that isn't
+// acknowledged is sent again: delivery is at least once.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// How long a batch, sent and acknowledged, may take.
+	collectorTimeout = 30 * time.Second
+	// How long the collector waits for the next batch of a sensor.
+	collectorIdleTimeout = 10 * time.Minute
+	// The longest line, an event, the collector takes.
+	collectorMaxLine = 16 << 20
+)
+
+// collectorTLSConfig returns the configuration of either end: the
+// certificate it presents, and the CAs it verifies the other against.
+func collectorTLSConfig(certFile, keyFile, caFile string) *tls.Config {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		log.Fatalf("-collector and -collect need -collectorcert, -collectorkey and -collectorca")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load -collectorcert %s: %v", certFile, err)
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log.Fatalf("Failed to read -collectorca %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatalf("No certificate in -collectorca %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// collectorClient forwards the events of a sensor to the collector.
+type collectorClient struct {
+	addr   string
+	config *tls.Config
+
+	// Only used from the goroutine of the queuedSink.
+	conn *tls.Conn
+	r    *bufio.Reader
+}
+
+// newCollectorClient returns the sink for -collector, or nil if events
+// aren't forwarded. "addr" is the host:port of the collector, whose
+// certificate must be for the host.
+func newCollectorClient(addr, certFile, keyFile, caFile string) dicompot.EventSink {
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		log.Fatalf("Invalid -collector %q, want host:port", addr)
+	}
+	config := collectorTLSConfig(certFile, keyFile, caFile)
+	config.ServerName = host
+	log.Printf("-| Forwarding events to the collector: %s", addr)
+	c := &collectorClient{addr: addr, config: config}
+	return newQueuedSink("Collector", 500, time.Second, c.forward)
+}
+
+// forward sends "events" as a batch, connecting first if need be, and waits
+// for the collector to acknowledge it.
+func (c *collectorClient) forward(events []dicompot.Event) error {
+	var batch bytes.Buffer
+	for _, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Collector: dropping an event that can't be marshaled: %v", err)
+			continue
+		}
+		batch.Write(b)
+		batch.WriteByte('\n')
+	}
+	batch.WriteByte('\n')
+	if c.conn == nil {
+		dialer := &net.Dialer{Timeout: collectorTimeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", c.addr, c.config)
+		if err != nil {
+			return err
+		}
+		c.conn, c.r = conn, bufio.NewReader(conn)
+	}
+	c.conn.SetDeadline(time.Now().Add(collectorTimeout))
+	_, err := c.conn.Write(batch.Bytes())
+	var line string
+	if err == nil {
+		line, err = c.r.ReadString('\n')
+	}
+	if err == nil && strings.TrimSpace(line) != "OK" {
+		err = fmt.Errorf("collector answered %q", strings.TrimSpace(line))
+	}
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// collector takes the events of the sensors, and hands them to its sink.
+type collector struct {
+	listener net.Listener
+	sink     dicompot.EventSink
+}
+
+// newCollector returns the collector for -collect, listening on "addr", or
+// nil if this isn't one. The events of the sensors go to "sink".
+func newCollector(addr, certFile, keyFile, caFile string, sink dicompot.EventSink) *collector {
+	if addr == "" {
+		return nil
+	}
+	config := collectorTLSConfig(certFile, keyFile, caFile)
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		log.Fatalf("Failed to listen for -collect on %s: %v", addr, err)
+	}
+	c := &collector{listener: listener, sink: sink}
+	go c.serve()
+	log.Printf("-| Collecting the events of the sensors on: %s", addr)
+	return c
+}
+
+func (c *collector) serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Printf("Collector: stopped accepting: %v", err)
+			return
+		}
+		go c.handle(conn.(*tls.Conn))
+	}
+}
+
+// handle records the batches of a sensor, until it disconnects.
+func (c *collector) handle(conn *tls.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(collectorTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("Collector: TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	sensor := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	log.Printf("Collector: sensor %q connected from %s", sensor, conn.RemoteAddr())
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64<<10), collectorMaxLine)
+	var batch []dicompot.Event
+	for {
+		conn.SetDeadline(time.Now().Add(collectorIdleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Bytes()
+		if len(line) > 0 {
+			var event dicompot.Event
+			if err := json.Unmarshal(line, &event); err != nil {
+				fmt.Fprintf(conn, "ERR invalid event: %v\n", err)
+				log.Printf("Collector: invalid event from sensor %q: %v", sensor, err)
+				return
+			}
+			fields := make(map[string]interface{}, len(event.Fields)+1)
+			for name, value := range event.Fields {
+				fields[name] = value
+			}
+			// The certificate says which sensor it is, not the event.
+			fields["ForwardedBy"] = sensor
+			event.Fields = fields
+			batch = append(batch, event)
+			continue
+		}
+		for _, event := range batch {
+			if err := c.sink.Record(event); err != nil {
+				log.Printf("Collector: failed to record an event of sensor %q: %v", sensor, err)
+			}
+		}
+		batch = nil
+		if _, err := conn.Write([]byte("OK\n")); err != nil {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Collector: sensor %q: %v", sensor, err)
+	}
+	log.Printf("Collector: sensor %q disconnected", sensor)
+}
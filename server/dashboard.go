@@ -0,0 +1,313 @@
+package main
+
+// This file serves a small web dashboard, for operators to see what the
+// honeypot sees without an ELK stack: the sessions in progress, where the
+// sources are, the patient names searched the most, the DIMSE commands
+// received and the objects stored or retrieved. The figures come from the
+// event store of -database, and the page, self-contained, refreshes them
+// every few seconds.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// The rows of the top lists.
+	dashboardTop = 10
+	// The events looked at for the locations of the sources, the latest
+	// first.
+	dashboardLocatedEvents = 20000
+)
+
+// dashboardStats is what the page shows.
+type dashboardStats struct {
+	Sessions int64 `json:"sessions"`
+	Sources  int64 `json:"sources"`
+	Events   int64 `json:"events"`
+	// In progress.
+	Live         []apiSession     `json:"live"`
+	Locations    []dashboardPlace `json:"locations"`
+	PatientNames []dashboardCount `json:"patientNames"`
+	Commands     []dashboardCount `json:"commands"`
+	Objects      []dashboardCount `json:"objects"`
+}
+
+// dashboardCount is a row of a breakdown.
+type dashboardCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// dashboardPlace is where hits came from, to a tenth of a degree.
+type dashboardPlace struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	Country   string  `json:"country,omitempty"`
+	Hits      int64   `json:"hits"`
+}
+
+// dashboard is the http.Handler of -dashboard.
+type dashboard struct {
+	user, password string
+	store          *database
+}
+
+// serveDashboard serves the dashboard on "addr", for -dashboard, if set,
+// from the events stored in "database". Browsers log in with "user" and
+// "password".
+func serveDashboard(addr, user, password, database string) {
+	if addr == "" {
+		return
+	}
+	if database == "" {
+		log.Fatalf("-dashboard requires -database, which it shows")
+	}
+	if password == "" {
+		log.Fatalf("-dashboard requires -dashboardpassword")
+	}
+	d := &dashboard{user: user, password: password, store: openDatabase(database)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.servePage)
+	mux.HandleFunc("/stats", d.serveStats)
+	srv := &http.Server{Addr: addr, Handler: d.authorize(mux), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Fatal(srv.ListenAndServe())
+	}()
+	log.Printf("-| Dashboard served on: http://%s/", addr)
+}
+
+// authorize asks for the user and password, with basic authentication.
+func (d *dashboard) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if subtle.ConstantTimeCompare([]byte(user), []byte(d.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(d.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dicompot", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (d *dashboard) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write([]byte(dashboardPage))
+}
+
+func (d *dashboard) serveStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := d.store.dashboardStats()
+	if err != nil {
+		log.Printf("Failed to read the dashboard figures: %v", err)
+		http.Error(w, "Event store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	for _, s := range dicompot.Sessions() {
+		stats.Live = append(stats.Live, apiSession{ID: s.ID, Session: s.Session, Opened: s.Opened})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// dashboardStats returns the figures of the dashboard, but for the live
+// sessions.
+func (d *database) dashboardStats() (*dashboardStats, error) {
+	if err := d.createSchema(); err != nil {
+		return nil, err
+	}
+	stats := &dashboardStats{Live: []apiSession{}}
+	err := d.db.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT remote_ip) FROM sessions`).Scan(&stats.Sessions, &stats.Sources)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&stats.Events); err != nil {
+		return nil, err
+	}
+	if stats.PatientNames, err = d.counts(`SELECT value, COUNT(*) FROM query_terms
+		WHERE keyword = 'PatientName' GROUP BY value ORDER BY 2 DESC, 1 LIMIT ?`, dashboardTop); err != nil {
+		return nil, err
+	}
+	// The requests, as isDIMSERequest counts them.
+	if stats.Commands, err = d.counts(`SELECT command, COUNT(*) FROM events
+		WHERE command IS NOT NULL AND (message = 'Received' OR message = 'C-STORE received' OR type = 'c-cancel')
+		GROUP BY command ORDER BY 2 DESC, 1`); err != nil {
+		return nil, err
+	}
+	if stats.Objects, err = d.counts(`SELECT direction || ' (' || COALESCE(command, '?') || ')', COUNT(*) FROM objects
+		WHERE error IS NULL GROUP BY direction, command ORDER BY 2 DESC, 1`); err != nil {
+		return nil, err
+	}
+	if stats.Locations, err = d.locations(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// counts returns the name and count of the rows of "query".
+func (d *database) counts(query string, args ...interface{}) ([]dashboardCount, error) {
+	rows, err := d.db.Query(d.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []dashboardCount{}
+	for rows.Next() {
+		var c dashboardCount
+		if err := rows.Scan(&c.Name, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// locations returns where the latest hits came from, as located by -geoip,
+// the most first.
+func (d *database) locations() ([]dashboardPlace, error) {
+	rows, err := d.db.Query(d.dialect.rebind(`SELECT fields FROM events
+		WHERE type IN (?, ?) AND fields LIKE '%"GeoLatitude"%' ORDER BY id DESC LIMIT ?`),
+		dicompot.EventConnectionOpened, dicompot.EventHTTPRequest, dashboardLocatedEvents)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	index := map[[2]float64]int{}
+	places := []dashboardPlace{}
+	for rows.Next() {
+		var fields string
+		if err := rows.Scan(&fields); err != nil {
+			return nil, err
+		}
+		var geo struct {
+			GeoLatitude, GeoLongitude float64
+			GeoCountry                string
+		}
+		if json.Unmarshal([]byte(fields), &geo) != nil {
+			continue
+		}
+		key := [2]float64{math.Round(geo.GeoLatitude*10) / 10, math.Round(geo.GeoLongitude*10) / 10}
+		i, ok := index[key]
+		if !ok {
+			i = len(places)
+			index[key] = i
+			places = append(places, dashboardPlace{Latitude: key[0], Longitude: key[1], Country: geo.GeoCountry})
+		}
+		places[i].Hits++
+	}
+	return places, rows.Err()
+}
+
+// dashboardPage is the dashboard. The map plots the sources on a graticule,
+// in the equirectangular projection, without loading anything from
+// elsewhere.
+const dashboardPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>dicompot</title>
+<style>
+body { font: 14px sans-serif; margin: 1em 2em; background: #111; color: #ddd; }
+h1 { font-size: 20px; }
+h2 { font-size: 15px; margin: 0 0 .5em; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(340px, 1fr)); gap: 1.5em; }
+.wide { grid-column: 1 / -1; }
+section { background: #1c1c1c; padding: 1em; border-radius: 4px; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 2px 6px; border-bottom: 1px solid #333; }
+td.n { text-align: right; }
+.totals span { margin-right: 2em; font-size: 16px; }
+svg { width: 100%; background: #0b1a2a; }
+</style>
+</head>
+<body>
+<h1>dicompot</h1>
+<p class="totals"><span id="sessions"></span><span id="sources"></span><span id="events"></span><span id="updated"></span></p>
+<div class="grid">
+<section class="wide"><h2>Sources</h2><svg id="map" viewBox="0 0 720 360"></svg></section>
+<section class="wide"><h2>Live sessions</h2><table id="live"></table></section>
+<section><h2>Patient names searched</h2><table id="patientNames"></table></section>
+<section><h2>Commands</h2><table id="commands"></table></section>
+<section><h2>Objects</h2><table id="objects"></table></section>
+</div>
+<script>
+function cell(row, text, cls) {
+  var td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+}
+function table(id, head, rows) {
+  var t = document.getElementById(id);
+  t.textContent = "";
+  var h = t.insertRow();
+  head.forEach(function (s) { var th = document.createElement("th"); th.textContent = s; h.appendChild(th); });
+  rows.forEach(function (r) {
+    var row = t.insertRow();
+    r.forEach(function (v) { cell(row, v, typeof v === "number" ? "n" : ""); });
+  });
+}
+function counts(id, head, list) {
+  table(id, [head, "Count"], list.map(function (c) { return [c.name, c.count]; }));
+}
+var ns = "http://www.w3.org/2000/svg";
+function draw(locations) {
+  var svg = document.getElementById("map");
+  svg.textContent = "";
+  for (var lon = -180; lon <= 180; lon += 30) line(svg, (lon + 180) * 2, 0, (lon + 180) * 2, 360);
+  for (var lat = -90; lat <= 90; lat += 30) line(svg, 0, (90 - lat) * 2, 720, (90 - lat) * 2);
+  var max = 1;
+  locations.forEach(function (p) { max = Math.max(max, p.hits); });
+  locations.forEach(function (p) {
+    var c = document.createElementNS(ns, "circle");
+    c.setAttribute("cx", (p.lon + 180) * 2);
+    c.setAttribute("cy", (90 - p.lat) * 2);
+    c.setAttribute("r", 2 + 10 * Math.sqrt(p.hits / max));
+    c.setAttribute("fill", "rgba(255, 80, 60, 0.6)");
+    var title = document.createElementNS(ns, "title");
+    title.textContent = (p.country || "?") + ": " + p.hits;
+    c.appendChild(title);
+    svg.appendChild(c);
+  });
+}
+function line(svg, x1, y1, x2, y2) {
+  var l = document.createElementNS(ns, "line");
+  l.setAttribute("x1", x1); l.setAttribute("y1", y1);
+  l.setAttribute("x2", x2); l.setAttribute("y2", y2);
+  l.setAttribute("stroke", "#234");
+  svg.appendChild(l);
+}
+function refresh() {
+  fetch("stats", {credentials: "same-origin"}).then(function (r) { return r.json(); }).then(function (s) {
+    document.getElementById("sessions").textContent = "Sessions: " + s.sessions;
+    document.getElementById("sources").textContent = "Sources: " + s.sources;
+    document.getElementById("events").textContent = "Events: " + s.events;
+    document.getElementById("updated").textContent = "Updated: " + new Date().toLocaleTimeString();
+    table("live", ["Since", "Source", "Port", "Calling AE", "Called AE"], s.live.map(function (l) {
+      return [new Date(l.opened).toLocaleTimeString(), l.remoteIP || "", l.localPort || "", l.callingAETitle || "", l.calledAETitle || ""];
+    }));
+    counts("patientNames", "Name", s.patientNames);
+    counts("commands", "Command", s.commands);
+    counts("objects", "Direction", s.objects);
+    draw(s.locations);
+  }).catch(function () {
+    document.getElementById("updated").textContent = "Update failed";
+  });
+}
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
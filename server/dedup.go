@@ -0,0 +1,213 @@
+package main
+
+// This file keeps noisy scanners from flooding the logs: of the events of
+// -deduptypes that a source repeats, identically, within -dedup, only the
+// first -dedupafter are logged. The others are counted, and an
+// EventSuppressed reports how many there were when the window ends. Events
+// are identical when their type, message, command, AE title and fields are,
+// but those that differ from one connection to the next, e.g., the source
+// port or the duration. With -dedupsample N, one in N of the events
+// suppressed is logged anyway, marked Sampled, to show what they were.
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// The fields that differ from one connection to the next, left out of the
+// comparison of events.
+var dedupVolatileFields = map[string]bool{
+	"Port":          true,
+	"Duration":      true,
+	"BytesReceived": true,
+	"BytesSent":     true,
+	"MessageID":     true,
+	"Seq":           true,
+}
+
+// dedupEntry is what is known of the events identical to one.
+type dedupEntry struct {
+	start, last time.Time
+	// The events seen, and those suppressed, in the window.
+	seen, suppressed int
+	// The first of the events, which the EventSuppressed describes.
+	event dicompot.Event
+}
+
+// dedup is an EventSink that hands the events on to "next", but those a
+// source repeats.
+type dedup struct {
+	next   dicompot.EventSink
+	window time.Duration
+	after  int
+	sample int
+	types  map[string]bool
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// newDedup returns the sink for -dedup, or nil if repeated events are all
+// logged. Of the events of "types" a source repeats within "window", the
+// first "after" are logged, and one in "sample" of the others if not 0.
+func newDedup(window time.Duration, after int, types string, sample int, next dicompot.EventSink) *dedup {
+	if window == 0 {
+		return nil
+	}
+	if window < 0 {
+		log.Fatalf("Invalid -dedup %s", window)
+	}
+	if after < 1 {
+		log.Fatalf("Invalid -dedupafter %d, want 1 or more", after)
+	}
+	if sample < 0 {
+		log.Fatalf("Invalid -dedupsample %d", sample)
+	}
+	d := &dedup{
+		next:    next,
+		window:  window,
+		after:   after,
+		sample:  sample,
+		types:   map[string]bool{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		entries: map[string]*dedupEntry{},
+	}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			d.types[t] = true
+		}
+	}
+	go d.run()
+	log.Printf("-| Suppressing the events a source repeats more than %d times in %s", after, window)
+	return d
+}
+
+// dedupKey returns what identifies the events identical to "event", or ""
+// if it is never suppressed.
+func dedupKey(event dicompot.Event) string {
+	ip := sourceIP(event)
+	if ip == nil {
+		return ""
+	}
+	fields := map[string]interface{}{}
+	for name, value := range event.Fields {
+		if !dedupVolatileFields[name] {
+			fields[name] = value
+		}
+	}
+	// Map keys are marshaled sorted.
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
+	return strings.Join([]string{ip.String(), event.Type, event.Message, event.Command, event.CallingAETitle, string(b)}, "\x00")
+}
+
+// Record hands "event" to "next", unless it is suppressed.
+func (d *dedup) Record(event dicompot.Event) error {
+	if !d.types[event.Type] {
+		return d.next.Record(event)
+	}
+	key := dedupKey(event)
+	if key == "" {
+		return d.next.Record(event)
+	}
+	d.mu.Lock()
+	e := d.entries[key]
+	if e == nil {
+		e = &dedupEntry{start: event.Time, event: event}
+		d.entries[key] = e
+	}
+	e.seen++
+	e.last = event.Time
+	suppressed := e.seen > d.after
+	sampled := false
+	if suppressed {
+		e.suppressed++
+		sampled = d.sample > 0 && e.suppressed%d.sample == 0
+	}
+	count := e.suppressed
+	d.mu.Unlock()
+
+	if !suppressed {
+		return d.next.Record(event)
+	}
+	if !sampled {
+		return nil
+	}
+	fields := map[string]interface{}{"Sampled": true, "Suppressed": count}
+	for name, value := range event.Fields {
+		fields[name] = value
+	}
+	event.Fields = fields
+	return d.next.Record(event)
+}
+
+// Close reports the events suppressed so far, and closes "next".
+func (d *dedup) Close() error {
+	close(d.stop)
+	<-d.done
+	return d.next.Close()
+}
+
+func (d *dedup) run() {
+	defer close(d.done)
+	// The windows end a tick late, at most.
+	ticker := time.NewTicker(d.window / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.flush(time.Now().Add(-d.window))
+		case <-d.stop:
+			d.flush(time.Now().Add(d.window))
+			return
+		}
+	}
+}
+
+// flush ends the windows started before "before": it forgets them, and
+// reports the events they suppressed.
+func (d *dedup) flush(before time.Time) {
+	var ended []*dedupEntry
+	d.mu.Lock()
+	for key, e := range d.entries {
+		if e.start.Before(before) {
+			delete(d.entries, key)
+			if e.suppressed > 0 {
+				ended = append(ended, e)
+			}
+		}
+	}
+	d.mu.Unlock()
+	for _, e := range ended {
+		fields := map[string]interface{}{
+			"IP":           sourceIP(e.event).String(),
+			"EventType":    e.event.Type,
+			"EventMessage": e.event.Message,
+			"Suppressed":   e.suppressed,
+			"Seen":         e.seen,
+			"First":        logTime(e.start),
+			"Last":         logTime(e.last),
+		}
+		if e.event.CallingAETitle != "" {
+			fields["CallingAETitle"] = e.event.CallingAETitle
+		}
+		if e.event.Command != "" {
+			fields["Command"] = e.event.Command
+		}
+		event := dicompot.NewEvent(logrus.WarnLevel, dicompot.EventSuppressed, "", "Repeated events suppressed", fields)
+		if err := d.next.Record(event); err != nil {
+			log.Printf("Failed to record the events suppressed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+// This file strips patient identity from the served datasets, for operators
+// who only have real clinical images at hand. See P3.15, annex E, for the
+// attributes involved; only the common ones are handled.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// What is done to an identifying attribute.
+type deidAction int
+
+const (
+	deidRemove deidAction = iota
+	deidPatientName
+	deidPatientID
+	deidBirthDate
+	deidStaffName
+	deidInstitution
+	deidAccessionNumber
+)
+
+var deidAttributes = map[dicomtag.Tag]deidAction{
+	dicomtag.PatientName:                        deidPatientName,
+	dicomtag.PatientID:                          deidPatientID,
+	dicomtag.PatientBirthDate:                   deidBirthDate,
+	dicomtag.AccessionNumber:                    deidAccessionNumber,
+	dicomtag.ReferringPhysicianName:             deidStaffName,
+	dicomtag.PerformingPhysicianName:            deidStaffName,
+	dicomtag.NameOfPhysiciansReadingStudy:       deidStaffName,
+	dicomtag.PhysiciansOfRecord:                 deidStaffName,
+	dicomtag.RequestingPhysician:                deidStaffName,
+	dicomtag.OperatorsName:                      deidStaffName,
+	dicomtag.InstitutionName:                    deidInstitution,
+	dicomtag.PatientBirthTime:                   deidRemove,
+	dicomtag.PatientBirthName:                   deidRemove,
+	dicomtag.PatientMotherBirthName:             deidRemove,
+	dicomtag.OtherPatientIDs:                    deidRemove,
+	dicomtag.OtherPatientIDsSequence:            deidRemove,
+	dicomtag.OtherPatientNames:                  deidRemove,
+	dicomtag.IssuerOfPatientID:                  deidRemove,
+	dicomtag.PatientAddress:                     deidRemove,
+	dicomtag.PatientTelephoneNumbers:            deidRemove,
+	dicomtag.CountryOfResidence:                 deidRemove,
+	dicomtag.RegionOfResidence:                  deidRemove,
+	dicomtag.MilitaryRank:                       deidRemove,
+	dicomtag.MedicalRecordLocator:               deidRemove,
+	dicomtag.PatientComments:                    deidRemove,
+	dicomtag.InstitutionAddress:                 deidRemove,
+	dicomtag.InstitutionalDepartmentName:        deidRemove,
+	dicomtag.ReferringPhysicianAddress:          deidRemove,
+	dicomtag.ReferringPhysicianTelephoneNumbers: deidRemove,
+	dicomtag.StationName:                        deidRemove,
+	dicomtag.DeviceSerialNumber:                 deidRemove,
+}
+
+// deidentifier rewrites the identifying attributes of datasets. A nil
+// deidentifier leaves them alone.
+type deidentifier struct {
+	// If set, identifiers are replaced with made up ones, the same for the
+	// same input, so that studies still group by patient. Else they are
+	// emptied.
+	pseudonymize bool
+	key          []byte
+}
+
+// newDeidentifier returns the deidentifier for -deidentify. Pseudonyms are
+// derived from "key", or from a random key if empty, in which case they
+// change when the honeypot restarts.
+func newDeidentifier(mode string, key string) *deidentifier {
+	switch mode {
+	case "":
+		return nil
+	case "scrub":
+		return &deidentifier{}
+	case "pseudonymize":
+		d := &deidentifier{pseudonymize: true, key: []byte(key)}
+		if key == "" {
+			d.key = make([]byte, 32)
+			if _, err := rand.Read(d.key); err != nil {
+				log.Fatalf("Failed to generate a pseudonymization key: %v", err)
+			}
+		}
+		return d
+	}
+	log.Fatalf("Invalid -deidentify %q, want scrub or pseudonymize", mode)
+	return nil
+}
+
+// apply rewrites the identifying attributes of "ds", sequences included.
+func (d *deidentifier) apply(ds *dicom.DataSet) {
+	if d != nil {
+		ds.Elements = d.elements(ds.Elements)
+	}
+}
+
+func (d *deidentifier) elements(elems []*dicom.Element) []*dicom.Element {
+	out := elems[:0]
+	for _, elem := range elems {
+		action, ok := deidAttributes[elem.Tag]
+		switch {
+		case !ok:
+			if elem.VR == "SQ" {
+				for _, v := range elem.Value {
+					if item, ok := v.(*dicom.Element); ok {
+						item.Value = d.items(item.Value)
+					}
+				}
+			}
+		case action == deidRemove:
+			continue
+		case !d.pseudonymize:
+			elem.Value = nil
+		default:
+			for i, v := range elem.Value {
+				if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
+					elem.Value[i] = d.pseudonym(action, elem.Tag, strings.TrimSpace(s))
+				}
+			}
+		}
+		out = append(out, elem)
+	}
+	return out
+}
+
+// items is elements for the values of an Item.
+func (d *deidentifier) items(values []interface{}) []interface{} {
+	var elems []*dicom.Element
+	for _, v := range values {
+		if elem, ok := v.(*dicom.Element); ok {
+			elems = append(elems, elem)
+		}
+	}
+	var out []interface{}
+	for _, elem := range d.elements(elems) {
+		out = append(out, elem)
+	}
+	return out
+}
+
+// pseudonym returns the replacement for "value" of attribute "tag".
+func (d *deidentifier) pseudonym(action deidAction, tag dicomtag.Tag, value string) string {
+	mac := hmac.New(sha256.New, d.key)
+	fmt.Fprintf(mac, "%v=%s", tag, value)
+	sum := mac.Sum(nil)
+	g := &generator{rand: mathrand.New(mathrand.NewSource(int64(binary.BigEndian.Uint64(sum))))}
+	switch action {
+	case deidPatientName:
+		given := g.pick(generatedMaleNames)
+		if g.rand.Intn(2) == 0 {
+			given = g.pick(generatedFemaleNames)
+		}
+		return strings.ToUpper(g.pick(generatedFamilyNames) + "^" + given)
+	case deidPatientID:
+		return fmt.Sprintf("MRN%07d", g.rand.Intn(10000000))
+	case deidBirthDate:
+		// The year stays, so that ages remain plausible.
+		if len(value) >= 4 {
+			return fmt.Sprintf("%s%02d%02d", value[:4], 1+g.rand.Intn(12), 1+g.rand.Intn(28))
+		}
+		return ""
+	case deidStaffName:
+		return strings.ToUpper(g.pick(generatedPhysicians))
+	case deidInstitution:
+		return g.pick(generatedInstitutions)
+	case deidAccessionNumber:
+		return fmt.Sprintf("A%08d", g.rand.Intn(100000000))
+	}
+	return ""
+}
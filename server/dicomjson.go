@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// dicomJSON converts elements to the DICOM JSON model used by DICOMweb.
+// P3.18, F.2. Group 0002 and pixel data are left out.
+func dicomJSON(elems []*dicom.Element) map[string]interface{} {
+	obj := map[string]interface{}{}
+	for _, elem := range elems {
+		if elem.Tag.Group == dicomtag.MetadataGroup || elem.Tag == dicomtag.PixelData || elem.Tag == dicomtag.Item {
+			continue
+		}
+		attr := map[string]interface{}{"vr": elem.VR}
+		if values := dicomJSONValues(elem); len(values) > 0 {
+			if _, ok := values[0].(inlineBinary); ok {
+				attr["InlineBinary"] = string(values[0].(inlineBinary))
+			} else {
+				attr["Value"] = values
+			}
+		}
+		obj[fmt.Sprintf("%04X%04X", elem.Tag.Group, elem.Tag.Element)] = attr
+	}
+	return obj
+}
+
+// inlineBinary is a base64-encoded bulk value.
+type inlineBinary string
+
+func dicomJSONValues(elem *dicom.Element) []interface{} {
+	var values []interface{}
+	for _, v := range elem.Value {
+		switch elem.VR {
+		case "SQ":
+			if item, ok := v.(*dicom.Element); ok && item.Tag == dicomtag.Item {
+				var sub []*dicom.Element
+				for _, iv := range item.Value {
+					if e, ok := iv.(*dicom.Element); ok {
+						sub = append(sub, e)
+					}
+				}
+				values = append(values, dicomJSON(sub))
+			}
+			continue
+		case "PN":
+			values = append(values, map[string]interface{}{"Alphabetic": strings.TrimSpace(fmt.Sprint(v))})
+			continue
+		case "IS", "DS":
+			s := strings.TrimSpace(fmt.Sprint(v))
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				values = append(values, f)
+			} else {
+				values = append(values, s)
+			}
+			continue
+		case "AT":
+			if tag, ok := v.(dicomtag.Tag); ok {
+				values = append(values, fmt.Sprintf("%04X%04X", tag.Group, tag.Element))
+				continue
+			}
+		}
+		switch b := v.(type) {
+		case []byte:
+			return []interface{}{inlineBinary(base64.StdEncoding.EncodeToString(b))}
+		case string:
+			values = append(values, strings.TrimSpace(b))
+		default:
+			values = append(values, b)
+		}
+	}
+	return values
+}
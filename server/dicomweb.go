@@ -0,0 +1,548 @@
+package main
+
+// This file emulates the DICOMweb services, P3.18: QIDO-RS searches,
+// WADO-RS retrievals and STOW-RS uploads, plus WADO-URI (wadouri.go). They
+// are backed by the same datasets as the DIMSE services.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// Largest STOW-RS request body accepted.
+const maxSTOWSize = 256 << 20
+
+// Path prefixes under which DICOMweb servers commonly live. The services are
+// also answered at the root.
+var dicomwebPrefixes = []string{"/dicom-web", "/dicomweb", "/wado-rs", "/rs"}
+
+// httpRequestFields describes an HTTP request for the log, including any
+// credentials it carries.
+func httpRequestFields(r *http.Request) map[string]interface{} {
+	fields := map[string]interface{}{
+		"Method":    r.Method,
+		"URI":       r.RequestURI,
+		"Host":      r.Host,
+		"UserAgent": r.UserAgent(),
+	}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		fields["IP"] = host
+		fields["Port"] = port
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fields["Authorization"] = auth
+		if user, password, ok := r.BasicAuth(); ok {
+			fields["Username"] = user
+			fields["Password"] = password
+		}
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		fields["ContentType"] = ct
+	}
+	return fields
+}
+
+// dicomweb is the http.Handler of the DICOMweb services.
+type dicomweb struct {
+	ss *server
+}
+
+func (ss *server) serveDICOMweb(addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           &dicomweb{ss: ss},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	health.listening(addr)
+	if *proxyFlag {
+		l = dicompot.NewProxyProtocolListener(l, ss.proxies)
+	}
+	return srv.Serve(l)
+}
+
+// webResource is a parsed DICOMweb path, e.g.,
+// /studies/{study}/series/{series}/metadata.
+type webResource struct {
+	study, series, instance string
+	// Set for a search: "studies", "series" or "instances".
+	search   string
+	metadata bool
+	frames   string
+}
+
+func parseWebPath(path string) (webResource, bool) {
+	var res webResource
+	for _, prefix := range dicomwebPrefixes {
+		if strings.HasPrefix(path, prefix+"/") {
+			path = path[len(prefix):]
+			break
+		}
+	}
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	for _, level := range []struct {
+		name string
+		uid  *string
+	}{{"studies", &res.study}, {"series", &res.series}, {"instances", &res.instance}} {
+		if len(segs) == 0 || segs[0] != level.name {
+			continue
+		}
+		if len(segs) == 1 {
+			res.search = level.name
+			return res, true
+		}
+		*level.uid = segs[1]
+		segs = segs[2:]
+	}
+	switch {
+	case res.study == "" && res.series == "" && res.instance == "":
+		return res, false
+	case len(segs) == 0:
+	case len(segs) == 1 && segs[0] == "metadata":
+		res.metadata = true
+	case len(segs) == 2 && segs[0] == "frames" && res.instance != "":
+		res.frames = segs[1]
+	default:
+		return res, false
+	}
+	return res, true
+}
+
+func (w *dicomweb) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	sessionID := dicompot.NewSessionID()
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	dicompot.OpenSession(sessionID, remote, local)
+	defer dicompot.CloseSession(sessionID)
+	fields := httpRequestFields(r)
+	refused := w.ss.refused(remoteIP(r.RemoteAddr), "dicomweb", fields)
+	w.ss.record(logrus.WarnLevel, dicompot.EventHTTPRequest, sessionID, "DICOMweb request", fields)
+	if refused {
+		if fields["Banned"] == true {
+			// Close the connection without an answer, as on DIMSE.
+			panic(http.ErrAbortHandler)
+		}
+		http.Error(rw, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	res, ok := parseWebPath(r.URL.Path)
+	switch {
+	case isWADOURI(r):
+		w.wadoURI(rw, r, sessionID)
+	case !ok:
+		http.NotFound(rw, r)
+	case r.Method == http.MethodPost && (res.search == "studies" ||
+		res.search == "" && res.study != "" && res.series == "" && !res.metadata):
+		w.stow(rw, r, sessionID)
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	case res.search != "":
+		w.qido(rw, r, res, sessionID)
+	default:
+		w.wado(rw, r, res, sessionID)
+	}
+}
+
+func writeDICOMJSON(rw http.ResponseWriter, status int, objs []map[string]interface{}) {
+	rw.Header().Set("Content-Type", "application/dicom+json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(objs)
+}
+
+// webAttributeTag parses an attribute in a QIDO-RS query: a keyword, e.g.,
+// "PatientName", or a tag, e.g., "00100010".
+func webAttributeTag(key string) (dicomtag.Tag, error) {
+	if len(key) == 8 {
+		if n, err := strconv.ParseUint(key, 16, 32); err == nil {
+			return dicomtag.Tag{Group: uint16(n >> 16), Element: uint16(n)}, nil
+		}
+	}
+	info, err := dicomtag.FindByName(key)
+	if err != nil {
+		return dicomtag.Tag{}, fmt.Errorf("Unknown attribute %q", key)
+	}
+	return info.Tag, nil
+}
+
+var qidoLevels = map[string]string{"studies": "STUDY", "series": "SERIES", "instances": "IMAGE"}
+
+// qidoIdentifier converts a QIDO-RS search into a C-FIND identifier in the
+// Study Root model. Unless "includefield" says otherwise, every attribute of
+// the searched level and the levels above is returned.
+func qidoIdentifier(res webResource, query url.Values) ([]*dicom.Element, error) {
+	levelName := qidoLevels[res.search]
+	var order []dicomtag.Tag
+	byTag := map[dicomtag.Tag]*dicom.Element{}
+	set := func(elem *dicom.Element, override bool) {
+		if _, ok := byTag[elem.Tag]; !ok {
+			order = append(order, elem.Tag)
+		} else if !override {
+			return
+		}
+		byTag[elem.Tag] = elem
+	}
+	set(dicom.MustNewElement(dicomtag.QueryRetrieveLevel, levelName), true)
+	for _, level := range qrModels[dicomuid.StudyRootQRFind] {
+		set(dicom.MustNewElement(level.uniqueKey), false)
+		for _, tag := range level.keys {
+			set(dicom.MustNewElement(tag), false)
+		}
+		if level.name == levelName {
+			break
+		}
+	}
+	for key, values := range query {
+		switch strings.ToLower(key) {
+		case "limit", "offset", "fuzzymatching":
+			continue
+		case "includefield":
+			for _, v := range values {
+				for _, field := range strings.Split(v, ",") {
+					if field == "all" {
+						continue
+					}
+					tag, err := webAttributeTag(field)
+					if err != nil {
+						return nil, err
+					}
+					elem, err := dicom.NewElement(tag)
+					if err != nil {
+						return nil, err
+					}
+					set(elem, false)
+				}
+			}
+			continue
+		}
+		tag, err := webAttributeTag(key)
+		if err != nil {
+			return nil, err
+		}
+		var elemValues []interface{}
+		for _, v := range strings.Split(values[0], ",") {
+			elemValues = append(elemValues, v)
+		}
+		elem, err := dicom.NewElement(tag, elemValues...)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s: %v", key, err)
+		}
+		set(elem, true)
+	}
+	for tag, uid := range map[dicomtag.Tag]string{
+		dicomtag.StudyInstanceUID:  res.study,
+		dicomtag.SeriesInstanceUID: res.series,
+	} {
+		if uid != "" {
+			set(dicom.MustNewElement(tag, uid), true)
+		}
+	}
+	identifier := make([]*dicom.Element, len(order))
+	for i, tag := range order {
+		identifier[i] = byTag[tag]
+	}
+	return identifier, nil
+}
+
+func (w *dicomweb) qido(rw http.ResponseWriter, r *http.Request, res webResource, sessionID string) {
+	query := r.URL.Query()
+	fields := map[string]interface{}{"Level": qidoLevels[res.search]}
+	for key, values := range query {
+		fields["Query."+key] = strings.Join(values, ",")
+	}
+	identifier, err := qidoIdentifier(res, query)
+	var matches []filterMatch
+	if err == nil {
+		var q qrQuery
+		if q, err = parseQRQuery(dicomuid.StudyRootQRFind, w.ss.sessionUIDs.resolve(identifier), true); err == nil {
+			if matches, err = w.ss.findMatchingFiles(q.filters, w.ss.visibleStudies(remoteIP(r.RemoteAddr), "")); err == nil {
+				matches = q.group(matches)
+			}
+		}
+	}
+	fields["Matches"] = len(matches)
+	if err != nil {
+		fields["Error"] = err.Error()
+	}
+	w.ss.record(logrus.WarnLevel, dicompot.EventQIDO, sessionID, "QIDO-RS search", fields)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > 0 && offset < len(matches) {
+		matches = matches[offset:]
+	} else if offset >= len(matches) {
+		matches = nil
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit >= 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+	if len(matches) == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	objs := make([]map[string]interface{}, len(matches))
+	for i, m := range matches {
+		// QueryRetrieveLevel is a DIMSE artifact.
+		objs[i] = dicomJSON(w.ss.sessionUIDs.rewrite(m.elems[1:], sessionID))
+	}
+	writeDICOMJSON(rw, http.StatusOK, objs)
+}
+
+// wado implements WADO-RS: the instances, their metadata, or frames.
+func (w *dicomweb) wado(rw http.ResponseWriter, r *http.Request, res webResource, sessionID string) {
+	var keys []*dicom.Element
+	for tag, uid := range map[dicomtag.Tag]string{
+		dicomtag.StudyInstanceUID:  res.study,
+		dicomtag.SeriesInstanceUID: res.series,
+		dicomtag.SOPInstanceUID:    res.instance,
+	} {
+		if uid != "" {
+			keys = append(keys, dicom.MustNewElement(tag, uid))
+		}
+	}
+	matches, err := w.ss.findMatchingFiles(w.ss.sessionUIDs.resolve(keys), w.ss.visibleStudies(remoteIP(r.RemoteAddr), ""))
+	fields := map[string]interface{}{
+		"StudyInstanceUID":  res.study,
+		"SeriesInstanceUID": res.series,
+		"SOPInstanceUID":    res.instance,
+		"Matches":           len(matches),
+	}
+	switch {
+	case res.metadata:
+		fields["Type"] = "metadata"
+	case res.frames != "":
+		fields["Type"] = "frames"
+		fields["Frames"] = res.frames
+	default:
+		fields["Type"] = "instances"
+	}
+	if err != nil {
+		fields["Error"] = err.Error()
+	}
+	w.ss.record(logrus.WarnLevel, dicompot.EventWADO, sessionID, "WADO-RS retrieve", fields)
+	if err != nil || len(matches) == 0 {
+		http.NotFound(rw, r)
+		return
+	}
+
+	if res.metadata {
+		var objs []map[string]interface{}
+		for _, m := range matches {
+			ds, err := w.ss.readDataSet(m.path, dicom.ReadOptions{DropPixelData: true}, sessionID)
+			if err != nil {
+				log.Printf("%s: %v", m.path, err)
+				continue
+			}
+			objs = append(objs, dicomJSON(ds.Elements))
+		}
+		writeDICOMJSON(rw, http.StatusOK, objs)
+		return
+	}
+
+	var parts [][]byte
+	partType := "application/dicom"
+	if res.frames != "" {
+		partType = "application/octet-stream"
+		if parts, err = readFrames(matches[0].path, res.frames); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		for _, m := range matches {
+			data, err := w.ss.readFile(m.path, sessionID)
+			if err != nil {
+				log.Printf("%s: %v", m.path, err)
+				continue
+			}
+			parts = append(parts, data)
+		}
+	}
+	mw := multipart.NewWriter(rw)
+	rw.Header().Set("Content-Type", fmt.Sprintf("multipart/related; type=%q; boundary=%s", partType, mw.Boundary()))
+	for _, data := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {partType}})
+		if err != nil {
+			return
+		}
+		pw.Write(data)
+	}
+	mw.Close()
+}
+
+// readFrames returns the frames listed in "list", e.g., "1,3", of the pixel
+// data of "path". Frame numbers start at 1.
+func readFrames(path, list string) ([][]byte, error) {
+	ds, err := dicompot.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		return nil, err
+	}
+	elem, err := ds.FindElementByTag(dicomtag.PixelData)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := elem.Value[0].(dicom.PixelDataInfo)
+	if !ok {
+		return nil, fmt.Errorf("No pixel data")
+	}
+	frames := info.Frames
+	// Native pixel data is read as one blob; split it into frames.
+	if n, err := ds.FindElementByTag(dicomtag.NumberOfFrames); err == nil && len(frames) == 1 {
+		if s, err := n.GetString(); err == nil {
+			if count, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && count > 1 {
+				size := len(frames[0]) / count
+				var split [][]byte
+				for i := 0; i < count; i++ {
+					split = append(split, frames[0][i*size:(i+1)*size])
+				}
+				frames = split
+			}
+		}
+	}
+	var out [][]byte
+	for _, s := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 1 || i > len(frames) {
+			return nil, fmt.Errorf("Invalid frame number %q", s)
+		}
+		out = append(out, frames[i-1])
+	}
+	return out, nil
+}
+
+// stow implements STOW-RS. Every part of the upload is logged, and the DICOM
+// instances are quarantined if -quarantine is set. Without a quarantine, the
+// upload is refused, like C-STORE. Every request of a peer is a new session,
+// so the quarantine accounts for the uploads by the IP of the peer.
+func (w *dicomweb) stow(rw http.ResponseWriter, r *http.Request, sessionID string) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		w.ss.record(logrus.WarnLevel, dicompot.EventSTOW, sessionID, "STOW-RS upload", map[string]interface{}{
+			"Error": "Not a multipart request",
+		})
+		http.Error(rw, "Unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+	mr := multipart.NewReader(http.MaxBytesReader(rw, r.Body, maxSTOWSize), params["boundary"])
+	limit := int64(maxSTOWSize)
+	if q := w.ss.quarantine; q != nil && q.maxFile > 0 {
+		limit = q.maxFile
+	}
+	var stored, failed []interface{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.ss.record(logrus.WarnLevel, dicompot.EventSTOW, sessionID, "STOW-RS upload", map[string]interface{}{
+				"Error": err.Error(),
+			})
+			break
+		}
+		// A part past the cap of the quarantine isn't read whole.
+		data, err := ioutil.ReadAll(io.LimitReader(part, limit+1))
+		if int64(len(data)) > limit {
+			w.ss.record(logrus.WarnLevel, dicompot.EventSTOW, sessionID, "STOW-RS part", map[string]interface{}{
+				"ContentType":    part.Header.Get("Content-Type"),
+				"Error":          fmt.Sprintf("Part larger than %d bytes", limit),
+				"QuarantineFull": true,
+			})
+			failed = append(failed, dicom.MustNewElement(dicomtag.Item,
+				dicom.MustNewElement(dicomtag.FailureReason, uint16(0xa700)))) // Out of resources
+			continue
+		}
+		ds, dsErr := dicompot.ReadDataSet(bytes.NewReader(data), dicom.ReadOptions{DropPixelData: true})
+		fields := payloadFields(data, ds)
+		fields["ContentType"] = part.Header.Get("Content-Type")
+		if err != nil {
+			fields["Error"] = err.Error()
+		}
+		if dsErr != nil {
+			if ct := part.Header.Get("Content-Type"); strings.Contains(ct, "json") || strings.Contains(ct, "xml") {
+				preview := data
+				if len(preview) > 1024 {
+					preview = preview[:1024]
+				}
+				fields["Preview"] = string(preview)
+			}
+			w.ss.record(logrus.WarnLevel, dicompot.EventSTOW, sessionID, "STOW-RS part", fields)
+			continue
+		}
+		for name, tag := range map[string]dicomtag.Tag{
+			"SOPInstanceUID":   dicomtag.SOPInstanceUID,
+			"StudyInstanceUID": dicomtag.StudyInstanceUID,
+			"PatientID":        dicomtag.PatientID,
+			"PatientName":      dicomtag.PatientName,
+		} {
+			if elem, err := ds.FindElementByTag(tag); err == nil {
+				fields[name], _ = elem.GetString()
+			}
+		}
+		item := []interface{}{}
+		for refTag, tag := range map[dicomtag.Tag]dicomtag.Tag{
+			dicomtag.ReferencedSOPClassUID:    dicomtag.SOPClassUID,
+			dicomtag.ReferencedSOPInstanceUID: dicomtag.SOPInstanceUID,
+		} {
+			if elem, err := ds.FindElementByTag(tag); err == nil {
+				item = append(item, dicom.MustNewElement(refTag, elem.Value...))
+			}
+		}
+		if w.ss.quarantine == nil {
+			failed = append(failed, dicom.MustNewElement(dicomtag.Item,
+				append(item, dicom.MustNewElement(dicomtag.FailureReason, uint16(0x0124)))...)) // Refused: not authorized
+		} else if path, err := w.ss.quarantine.writeFile(sessionID, remoteIP(r.RemoteAddr), data); err != nil {
+			if err == errQuarantineFull {
+				fields["QuarantineFull"] = true
+			} else {
+				log.Printf("Failed to quarantine STOW-RS payload: %v", err)
+			}
+			failed = append(failed, dicom.MustNewElement(dicomtag.Item,
+				append(item, dicom.MustNewElement(dicomtag.FailureReason, uint16(0xa700)))...)) // Out of resources
+		} else {
+			fields["Path"] = path
+			stored = append(stored, dicom.MustNewElement(dicomtag.Item, item...))
+		}
+		w.ss.record(logrus.WarnLevel, dicompot.EventSTOW, sessionID, "STOW-RS instance", fields)
+	}
+
+	var resp []*dicom.Element
+	if len(stored) > 0 {
+		resp = append(resp, dicom.MustNewElement(dicomtag.ReferencedSOPSequence, stored...))
+	}
+	if len(failed) > 0 {
+		resp = append(resp, dicom.MustNewElement(dicomtag.FailedSOPSequence, failed...))
+	}
+	status := http.StatusOK
+	switch {
+	case len(failed) > 0 && len(stored) > 0:
+		status = http.StatusAccepted
+	case len(failed) > 0:
+		status = http.StatusConflict
+	}
+	writeDICOMJSON(rw, status, []map[string]interface{}{dicomJSON(resp)})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSTOWOversizedPart(t *testing.T) {
+	q, err := newQuarantine(t.TempDir(), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recordingSink{}
+	w := &dicomweb{ss: &server{quarantine: q, sink: r}}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(map[string][]string{"Content-Type": {"application/dicom"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(make([]byte, 1<<20+1))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/studies", &body)
+	req.Header.Set("Content-Type", "multipart/related; type=\"application/dicom\"; boundary="+mw.Boundary())
+	rec := httptest.NewRecorder()
+	w.stow(rec, req, "session")
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if len(r.events) != 1 || r.events[0].Fields["QuarantineFull"] != true {
+		t.Errorf("recorded %v, want the part refused", r.events)
+	}
+	if files, _ := ioutil.ReadDir(q.dir); len(files) != 0 {
+		t.Errorf("quarantined %d files", len(files))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+// This file contributes the connections to the honeypot to SANS DShield
+// (https://isc.sans.edu), as firewall logs, for the statistics of the
+// Internet Storm Center: one record per connection from a public address,
+// to the DICOM, HL7 and DICOMweb ports.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const dshieldURL = "https://www.dshield.org/submitapi/"
+
+// dshieldRecord is a record of a firewall log.
+type dshieldRecord struct {
+	Time  int64  `json:"time"`
+	SIP   string `json:"sip"`
+	DIP   string `json:"dip"`
+	Proto int    `json:"proto"`
+	SPort int    `json:"sport"`
+	DPort int    `json:"dport"`
+	Flags string `json:"flags"`
+}
+
+// dshield is a DShield submitter.
+type dshield struct {
+	userID, key string
+	// The address of the honeypot in the records.
+	targetIP string
+	client   *http.Client
+}
+
+// newDShieldSink returns the sink for -dshielduserid and -dshieldkey, or nil
+// if nothing is submitted. "listenIP" is the address listened to, if one.
+func newDShieldSink(userID, key, listenIP string) dicompot.EventSink {
+	if userID == "" {
+		return nil
+	}
+	if _, err := strconv.Atoi(userID); err != nil {
+		log.Fatalf("Invalid -dshielduserid %q, want the number of the DShield account", userID)
+	}
+	if key == "" {
+		log.Fatalf("-dshielduserid needs -dshieldkey")
+	}
+	d := &dshield{userID: userID, key: key, targetIP: "0.0.0.0", client: &http.Client{Timeout: 30 * time.Second}}
+	if ip := net.ParseIP(listenIP); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		d.targetIP = ip.String()
+	}
+	log.Printf("-| Submitting connections to DShield, as user %s", userID)
+	return newQueuedSink("DShield", 1000, time.Minute, d.submit)
+}
+
+// authorization returns the X-ISC-Authorization of a request: the API key,
+// signed with a nonce and the user ID.
+func (d *dshield) authorization() string {
+	var b [8]byte
+	rand.Read(b[:])
+	nonce := base64.StdEncoding.EncodeToString(b[:])
+	mac := hmac.New(sha256.New, []byte(nonce+d.userID))
+	mac.Write([]byte(d.key))
+	return fmt.Sprintf("ISC-HMAC-SHA256 Credentials=%s Userid=%s Nonce=%s",
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)), d.userID, nonce)
+}
+
+// dshieldRecordOf returns the record of the connection "event" opens, if it
+// does, from a public address. Every DICOMweb request counts as one.
+func dshieldRecordOf(event dicompot.Event, targetIP string) (dshieldRecord, bool) {
+	switch event.Type {
+	case dicompot.EventConnectionOpened, dicompot.EventHL7Connection, dicompot.EventHTTPRequest:
+	default:
+		return dshieldRecord{}, false
+	}
+	ip := sourceIP(event)
+	if ip == nil || !isPublicIP(ip) {
+		return dshieldRecord{}, false
+	}
+	r := dshieldRecord{
+		Time:  event.Time.Unix(),
+		SIP:   ip.String(),
+		DIP:   targetIP,
+		Proto: 6,
+		SPort: event.RemotePort,
+		DPort: event.LocalPort,
+		Flags: "S",
+	}
+	return r, true
+}
+
+// submit submits the connections the events open.
+func (d *dshield) submit(events []dicompot.Event) error {
+	var logs []dshieldRecord
+	for _, event := range events {
+		if r, ok := dshieldRecordOf(event, d.targetIP); ok {
+			logs = append(logs, r)
+		}
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	auth := d.authorization()
+	body, err := json.Marshal(map[string]interface{}{"type": "firewall", "logs": logs, "authheader": auth})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", dshieldURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-ISC-Authorization", auth)
+	req.Header.Set("X-ISC-LogType", "firewall")
+	req.Header.Set("User-Agent", "dicompot/"+siemVersion)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			log.Printf("DShield: rejected %d records: %v", len(logs), err)
+			return nil
+		}
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+// This file formats events in the Elastic Common Schema, so that Filebeat
+// and Elastic Agent index them without a custom mapping. What ECS has no
+// field for goes under "dicom", the DICOM specifics first.
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// The version of ECS the events follow.
+const ecsVersion = "8.11.0"
+
+var ecsHostname, _ = os.Hostname()
+
+// ecsCategory returns the event.kind, event.category and event.type of an
+// event of type "eventType".
+func ecsCategory(eventType string) (kind string, category, types []string) {
+	switch eventType {
+	case dicompot.EventExploitAttempt:
+		return "alert", []string{"intrusion_detection", "network"}, []string{"info"}
+	case dicompot.EventConnectionOpened, dicompot.EventHL7Connection:
+		return "event", []string{"network"}, []string{"connection", "start"}
+	case dicompot.EventConnectionClosed:
+		return "event", []string{"network"}, []string{"connection", "end"}
+	case dicompot.EventAssociationRejected:
+		return "event", []string{"network"}, []string{"connection", "denied"}
+	case dicompot.EventUserIdentity:
+		return "event", []string{"authentication"}, []string{"info"}
+	case dicompot.EventCStore, dicompot.EventSTOW:
+		return "event", []string{"file", "network"}, []string{"creation"}
+	case dicompot.EventHTTPRequest, dicompot.EventQIDO, dicompot.EventWADO:
+		return "event", []string{"web", "network"}, []string{"access"}
+	}
+	return "event", []string{"network"}, []string{"protocol"}
+}
+
+// ecsProtocol returns the network.protocol of an event of type "eventType".
+func ecsProtocol(eventType string) string {
+	switch eventType {
+	case dicompot.EventHTTPRequest, dicompot.EventQIDO, dicompot.EventWADO, dicompot.EventSTOW:
+		return "http"
+	case dicompot.EventHL7Connection, dicompot.EventHL7Message:
+		return "hl7"
+	}
+	return "dicom"
+}
+
+// setECS sets "value" at dotted "path" of "doc", unless it is empty.
+func setECS(doc map[string]interface{}, path string, value interface{}) {
+	if value == nil || value == "" || value == 0 {
+		return
+	}
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		sub, ok := doc[key].(map[string]interface{})
+		if !ok {
+			sub = map[string]interface{}{}
+			doc[key] = sub
+		}
+		doc = sub
+	}
+	doc[keys[len(keys)-1]] = value
+}
+
+// The event fields that have an ECS field, and the ones they go to.
+var ecsFields = map[string]string{
+	"Path":           "file.path",
+	"SHA256":         "file.hash.sha256",
+	"MD5":            "file.hash.md5",
+	"Method":         "http.request.method",
+	"URI":            "url.original",
+	"UserAgent":      "user_agent.original",
+	"Username":       "user.name",
+	"Signature":      "rule.id",
+	"Description":    "rule.description",
+	"SOPClassUID":    "dicom.sop_class_uid",
+	"SOPInstanceUID": "dicom.sop_instance_uid",
+	"GeoCountry":     "source.geo.country_iso_code",
+	"GeoCountryName": "source.geo.country_name",
+	"GeoCity":        "source.geo.city_name",
+	"RemoteHostname": "source.domain",
+	"ASN":            "source.as.number",
+	"ASOrganization": "source.as.organization.name",
+	"Sensor":         "observer.name",
+	"NodeID":         "agent.id",
+	"SensorTags":     "tags",
+	"Seq":            "event.sequence",
+}
+
+// ecsEvent formats "event" as an ECS document.
+func ecsEvent(event dicompot.Event) ([]byte, error) {
+	kind, category, types := ecsCategory(event.Type)
+	doc := map[string]interface{}{
+		"@timestamp": event.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"message":    event.Message,
+		"ecs":        map[string]interface{}{"version": ecsVersion},
+		"event": map[string]interface{}{
+			"kind":     kind,
+			"category": category,
+			"type":     types,
+			"action":   event.Type,
+			"module":   "dicompot",
+			"dataset":  "dicompot.events",
+			"severity": syslogSeverity(event.Level),
+		},
+		"log": map[string]interface{}{"level": event.Level.String()},
+		"network": map[string]interface{}{
+			"protocol":  ecsProtocol(event.Type),
+			"transport": "tcp",
+		},
+		"observer": map[string]interface{}{
+			"type":    "honeypot",
+			"vendor":  siemVendor,
+			"product": siemProduct,
+			"version": siemVersion,
+		},
+	}
+	setECS(doc, "observer.hostname", ecsHostname)
+	setECS(doc, "source.ip", event.RemoteIP)
+	setECS(doc, "source.port", event.RemotePort)
+	setECS(doc, "destination.port", event.LocalPort)
+	setECS(doc, "dicom.session_id", event.SessionID)
+	setECS(doc, "dicom.calling_ae_title", event.CallingAETitle)
+	setECS(doc, "dicom.called_ae_title", event.CalledAETitle)
+	setECS(doc, "dicom.command", event.Command)
+	if len(event.Query) > 0 {
+		setECS(doc, "dicom.query", event.Query)
+	}
+	if id, ok := event.Fields["Signature"].(string); ok && strings.HasPrefix(id, "CVE-") {
+		setECS(doc, "vulnerability.id", id)
+	}
+	if size, ok := event.Fields["Size"].(int); ok && event.Fields["SHA256"] != nil {
+		setECS(doc, "file.size", size)
+	}
+	lat, hasLat := event.Fields["GeoLatitude"].(float64)
+	lon, hasLon := event.Fields["GeoLongitude"].(float64)
+	if hasLat && hasLon {
+		setECS(doc, "source.geo.location", map[string]float64{"lat": lat, "lon": lon})
+	}
+	other := map[string]interface{}{}
+	for name, value := range event.Fields {
+		if name == "GeoLatitude" || name == "GeoLongitude" {
+			continue
+		}
+		if path, ok := ecsFields[name]; ok {
+			setECS(doc, path, value)
+			continue
+		}
+		other[name] = value
+	}
+	if len(other) > 0 {
+		setECS(doc, "dicom.fields", other)
+	}
+	return json.Marshal(doc)
+}
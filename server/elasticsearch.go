@@ -0,0 +1,226 @@
+package main
+
+// This file bulk-indexes the events, as ECS documents, into Elasticsearch or
+// OpenSearch, so that small deployments do without Logstash. Events go to
+// daily indices, "dicompot-2006.01.02", for index lifecycle policies to roll
+// over and delete, and an index template maps them.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// elasticsearch is a bulk indexer.
+type elasticsearch struct {
+	url            string
+	index          string
+	policy         string
+	user, password string
+	client         *http.Client
+
+	// Only used from the goroutine of the queuedSink.
+	templated bool
+}
+
+// newElasticsearchSink returns the sink for -elasticsearch and friends, or
+// nil if events aren't indexed.
+func newElasticsearchSink(rawURL, index, policy, user, password, caFile string) dicompot.EventSink {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid -elasticsearch %q, want http(s)://host:port", rawURL)
+	}
+	if index == "" || index != strings.ToLower(index) || strings.ContainsAny(index, `\/*?"<>| ,#:`) {
+		log.Fatalf("Invalid -elasticsearchindex %q, want a lowercase name", index)
+	}
+	if (user == "") != (password == "") {
+		log.Fatalf("-elasticsearchuser and -elasticsearchpassword go together")
+	}
+	e := &elasticsearch{
+		url:      strings.TrimRight(rawURL, "/"),
+		index:    index,
+		policy:   policy,
+		user:     user,
+		password: password,
+		client:   newHTTPClient("elasticsearchcafile", caFile),
+	}
+	log.Printf("-| Indexing events into Elasticsearch: %s, indices %s-*", e.url, index)
+	return newQueuedSink("Elasticsearch", 500, time.Second, e.bulk)
+}
+
+// newHTTPClient returns the client of an HTTP service, trusting the CAs in
+// "caFile", if any, which flag "flagName" names.
+func newHTTPClient(flagName, caFile string) *http.Client {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if caFile == "" {
+		return client
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log.Fatalf("Failed to read -%s %s: %v", flagName, caFile, err)
+	}
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		log.Fatalf("No certificate in -%s %s", flagName, caFile)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: config}
+	return client
+}
+
+// request sends a request with a JSON or NDJSON body, and decodes the JSON
+// response into "out", if not nil.
+func (e *elasticsearch) request(method, path, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, e.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.user != "" {
+		req.SetBasicAuth(e.user, e.password)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// template returns the index template of the indices. Strings are keywords,
+// but for the message, and the event-specific fields are kept in the source
+// without being indexed, as they differ in type from one event to another.
+func (e *elasticsearch) template() []byte {
+	settings := map[string]interface{}{}
+	if e.policy != "" {
+		settings["index.lifecycle.name"] = e.policy
+	}
+	keyword := map[string]interface{}{"type": "keyword", "ignore_above": 1024}
+	long := map[string]interface{}{"type": "long"}
+	notIndexed := map[string]interface{}{"type": "object", "enabled": false}
+	b, _ := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{e.index + "-*"},
+		"priority":       200,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{"strings": map[string]interface{}{
+						"match_mapping_type": "string",
+						"mapping":            keyword,
+					}},
+				},
+				"properties": map[string]interface{}{
+					"@timestamp": map[string]interface{}{"type": "date"},
+					"message":    map[string]interface{}{"type": "text"},
+					"source": map[string]interface{}{"properties": map[string]interface{}{
+						"ip":   map[string]interface{}{"type": "ip"},
+						"port": long,
+						"geo":  map[string]interface{}{"properties": map[string]interface{}{"location": map[string]interface{}{"type": "geo_point"}}},
+					}},
+					"destination": map[string]interface{}{"properties": map[string]interface{}{"port": long}},
+					"file":        map[string]interface{}{"properties": map[string]interface{}{"size": long}},
+					"dicom": map[string]interface{}{"properties": map[string]interface{}{
+						"fields": notIndexed,
+						"query":  map[string]interface{}{"properties": map[string]interface{}{"items": notIndexed}},
+					}},
+				},
+			},
+		},
+	})
+	return b
+}
+
+// documentID returns the ID of "doc", the same every time the batch is sent
+// again, for the copies to be rejected as conflicts.
+func documentID(doc []byte) string {
+	sum := sha1.Sum(doc)
+	return hex.EncodeToString(sum[:])
+}
+
+// bulkResponse is the part of the response to _bulk that matters.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk indexes the events, after installing the template the first time.
+// Documents the cluster has no room for yet fail the batch, to be sent
+// again; the ones it rejects are logged and dropped.
+func (e *elasticsearch) bulk(events []dicompot.Event) error {
+	if !e.templated {
+		if err := e.request("PUT", "/_index_template/"+e.index, "application/json", e.template(), nil); err != nil {
+			return err
+		}
+		e.templated = true
+	}
+	var body bytes.Buffer
+	for _, event := range events {
+		doc, err := ecsEvent(event)
+		if err != nil {
+			continue
+		}
+		action, _ := json.Marshal(map[string]interface{}{"create": map[string]string{
+			"_index": e.index + "-" + event.Time.UTC().Format("2006.01.02"),
+			"_id":    documentID(doc),
+		}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+	var resp bulkResponse
+	if err := e.request("POST", "/_bulk", "application/x-ndjson", body.Bytes(), &resp); err != nil {
+		return err
+	}
+	if !resp.Errors {
+		return nil
+	}
+	var retry, rejected int
+	var reason json.RawMessage
+	for _, item := range resp.Items {
+		for _, result := range item {
+			switch {
+			case result.Status == http.StatusConflict, result.Status/100 == 2:
+				// Indexed, maybe by an earlier attempt.
+			case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+				retry++
+			default:
+				rejected++
+				reason = result.Error
+			}
+		}
+	}
+	if rejected > 0 {
+		log.Printf("Elasticsearch: rejected %d events: %s", rejected, reason)
+	}
+	if retry > 0 {
+		return fmt.Errorf("%d events not indexed yet", retry)
+	}
+	return nil
+}
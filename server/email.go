@@ -0,0 +1,373 @@
+package main
+
+// This file emails alerts of the events of some types, a few at a time as
+// they happen, and, optionally, a daily digest of what the sources did: the
+// sessions and events of each, the commands and the query terms, e.g., the
+// patient names looked for.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// The line of an alert, before the time.
+	emailAlertLine = "{command} from {ip} ({country}), AE {aetitle}, {detail}"
+	// Lines of each table of the digest, at most.
+	emailDigestTop = 20
+	smtpTimeout    = 30 * time.Second
+)
+
+// mailer sends emails through an SMTP server.
+type mailer struct {
+	addr     string
+	host     string
+	tlsMode  string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+// emailStats is what the digest sums up.
+type emailStats struct {
+	since    time.Time
+	events   int
+	sessions map[string]bool
+	sources  map[string]*emailSource
+	// The sessions of each command.
+	commands map[string]map[string]bool
+	terms    map[string]int
+}
+
+type emailSource struct {
+	country  string
+	sessions map[string]bool
+	events   int
+	aeTitles map[string]bool
+}
+
+// emailAlerter is an EventSink that emails alerts of the events of the
+// types it is given, and the daily digest.
+type emailAlerter struct {
+	mailer *mailer
+	types  map[string]bool
+	alerts *queuedSink
+	stop   chan struct{}
+
+	mu sync.Mutex
+	// nil without a digest.
+	stats *emailStats
+}
+
+// newEmailAlerter returns the sink for -smtp and friends, or nil if no
+// emails are sent. "types" are the comma-separated event types alerted of,
+// "digest" the local time of the day the digest is sent at, as HH:MM, if
+// one is.
+func newEmailAlerter(addr, tlsMode, username, password, from, to, types, digest string) *emailAlerter {
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("Invalid -smtp %q, want host:port, e.g., smtp.example.org:587", addr)
+	}
+	switch tlsMode {
+	case "starttls", "tls", "none":
+	default:
+		log.Fatalf("Invalid -smtptls %q, want starttls, tls or none", tlsMode)
+	}
+	if from == "" || to == "" {
+		log.Fatalf("-smtp needs -emailfrom and -emailto")
+	}
+	m := &mailer{addr: addr, host: host, tlsMode: tlsMode, username: username, password: password, from: from}
+	for _, addr := range strings.Split(to, ",") {
+		m.to = append(m.to, strings.TrimSpace(addr))
+	}
+	a := &emailAlerter{mailer: m, types: map[string]bool{}, stop: make(chan struct{})}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			a.types[t] = true
+		}
+	}
+	if len(a.types) > 0 {
+		a.alerts = newQueuedSink("Email", 100, 30*time.Second, a.sendAlerts)
+		log.Printf("-| Emailing alerts of %s to %s", types, to)
+	}
+	if digest != "" {
+		at, err := time.Parse("15:04", digest)
+		if err != nil {
+			log.Fatalf("Invalid -emaildigest %q, want the time of the day, as HH:MM", digest)
+		}
+		a.stats = newEmailStats()
+		go a.digestDaily(at.Hour(), at.Minute())
+		log.Printf("-| Emailing a digest to %s every day at %s", to, digest)
+	}
+	return a
+}
+
+func newEmailStats() *emailStats {
+	return &emailStats{
+		since:    time.Now(),
+		sessions: map[string]bool{},
+		sources:  map[string]*emailSource{},
+		commands: map[string]map[string]bool{},
+		terms:    map[string]int{},
+	}
+}
+
+// Record queues an alert of the event, if of a type alerted of, and adds
+// it to the digest.
+func (a *emailAlerter) Record(event dicompot.Event) error {
+	if a.alerts != nil && a.types[event.Type] {
+		a.alerts.Record(event)
+	}
+	if a.stats == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.stats
+	s.events++
+	if event.SessionID != "" {
+		s.sessions[event.SessionID] = true
+	}
+	if ip := sourceIP(event); ip != nil {
+		src := s.sources[ip.String()]
+		if src == nil {
+			src = &emailSource{sessions: map[string]bool{}, aeTitles: map[string]bool{}}
+			s.sources[ip.String()] = src
+		}
+		src.events++
+		if event.SessionID != "" {
+			src.sessions[event.SessionID] = true
+		}
+		if country := stringField(event, "GeoCountry"); country != "" {
+			src.country = country
+		}
+		if event.CallingAETitle != "" {
+			src.aeTitles[event.CallingAETitle] = true
+		}
+	}
+	// The search results of C-MOVE and C-GET are said to be of C-FIND.
+	if event.Command != "" && event.SessionID != "" && event.Type != dicompot.EventCFindResult {
+		if s.commands[event.Command] == nil {
+			s.commands[event.Command] = map[string]bool{}
+		}
+		s.commands[event.Command][event.SessionID] = true
+	}
+	if event.Type == dicompot.EventCFindQuery {
+		if term := queryTerms(event); term != "" {
+			s.terms[event.Command+" "+term]++
+		}
+	}
+	return nil
+}
+
+// Close sends the alerts queued. The digest under way is not sent.
+func (a *emailAlerter) Close() error {
+	close(a.stop)
+	if a.alerts != nil {
+		a.alerts.Close()
+	}
+	return nil
+}
+
+// sendAlerts emails the alerts of the events.
+func (a *emailAlerter) sendAlerts(events []dicompot.Event) error {
+	var body strings.Builder
+	for _, event := range events {
+		fmt.Fprintf(&body, "%s  %s\n", event.Time.Format("2006-01-02 15:04:05"), chatAlert(emailAlertLine, event))
+		if event.SessionID != "" {
+			fmt.Fprintf(&body, "    session %s\n", event.SessionID)
+		}
+	}
+	subject := "dicompot: " + chatAlert("{command} from {ip}", events[0])
+	if len(events) > 1 {
+		subject += fmt.Sprintf(" and %d more", len(events)-1)
+	}
+	return a.mailer.send(subject, body.String())
+}
+
+// digestDaily sends the digest every day at "hour":"minute", until Close.
+func (a *emailAlerter) digestDaily(hour, minute int) {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		select {
+		case <-time.After(time.Until(next)):
+		case <-a.stop:
+			return
+		}
+		a.mu.Lock()
+		stats := a.stats
+		a.stats = newEmailStats()
+		a.mu.Unlock()
+		subject := fmt.Sprintf("dicompot digest: %d sources, %d sessions", len(stats.sources), len(stats.sessions))
+		if err := a.mailer.send(subject, stats.digest(time.Now())); err != nil {
+			log.Printf("Email: failed to send the digest: %v", err)
+		}
+	}
+}
+
+// topKeys returns the keys of "counts", the highest first, at most
+// emailDigestTop of them.
+func topKeys(counts map[string]int) []string {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > emailDigestTop {
+		keys = keys[:emailDigestTop]
+	}
+	return keys
+}
+
+// digest returns the text of the digest, up to "until".
+func (s *emailStats) digest(until time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From %s to %s: %d events, %d sessions, %d sources.\n",
+		s.since.Format("2006-01-02 15:04"), until.Format("2006-01-02 15:04"), s.events, len(s.sessions), len(s.sources))
+
+	events := map[string]int{}
+	for ip, src := range s.sources {
+		events[ip] = src.events
+	}
+	if len(events) > 0 {
+		fmt.Fprintf(&b, "\nSources\n")
+		for _, ip := range topKeys(events) {
+			src := s.sources[ip]
+			country := src.country
+			if country == "" {
+				country = "--"
+			}
+			var aeTitles []string
+			for t := range src.aeTitles {
+				aeTitles = append(aeTitles, t)
+			}
+			sort.Strings(aeTitles)
+			fmt.Fprintf(&b, "  %-39s %-2s %5d sessions %6d events  %s\n", ip, country, len(src.sessions), src.events, strings.Join(aeTitles, ", "))
+		}
+		if len(events) > emailDigestTop {
+			fmt.Fprintf(&b, "  and %d more\n", len(events)-emailDigestTop)
+		}
+	}
+	commands := map[string]int{}
+	for c, sessions := range s.commands {
+		commands[c] = len(sessions)
+	}
+	if len(commands) > 0 {
+		fmt.Fprintf(&b, "\nCommands\n")
+		for _, c := range topKeys(commands) {
+			fmt.Fprintf(&b, "  %-12s %5d sessions\n", c, commands[c])
+		}
+	}
+	if len(s.terms) > 0 {
+		fmt.Fprintf(&b, "\nQuery terms\n")
+		for _, t := range topKeys(s.terms) {
+			fmt.Fprintf(&b, "  %6d  %s\n", s.terms[t], t)
+		}
+		if len(s.terms) > emailDigestTop {
+			fmt.Fprintf(&b, "  and %d more\n", len(s.terms)-emailDigestTop)
+		}
+	}
+	return b.String()
+}
+
+// send sends an email, in plain text.
+func (m *mailer) send(subject, body string) error {
+	return m.sendAs(subject, "text/plain", body)
+}
+
+// sendAs sends an email of type "contentType", e.g., text/html.
+func (m *mailer) sendAs(subject, contentType, body string) error {
+	var msg bytes.Buffer
+	var id [12]byte
+	rand.Read(id[:])
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "dicompot"
+	}
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%x@%s>\r\n", id, hostname)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	qp.Close()
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	if m.tlsMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, &tls.Config{ServerName: m.host})
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if m.tlsMode == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	for _, to := range m.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
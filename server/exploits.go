@@ -0,0 +1,320 @@
+package main
+
+// This file watches for the exploits of the products the vulnerable
+// personalities pass for. A personality's signatures apply to the
+// associations on the ports it answers, and to every DICOMweb request while
+// it answers any, since the DICOMweb port is shared. With -payloadchecks,
+// the signatures of exploit payloads apply to every session.
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/pdu"
+	"github.com/sirupsen/logrus"
+)
+
+// exploitSignature recognizes the exploitation of a known vulnerability in
+// the events of a session.
+type exploitSignature struct {
+	// The CVE ID, or a short name if the vulnerability has none.
+	id          string
+	description string
+	match       func(event dicompot.Event) bool
+}
+
+// isUID reports whether "s" has only the characters UIDs are made of.
+func isUID(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isPrintable reports whether "s" is printable ASCII.
+func isPrintable(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func stringField(event dicompot.Event, name string) string {
+	s, _ := event.Fields[name].(string)
+	return s
+}
+
+// storescp names the files it receives after the SOP class and instance
+// UIDs, which DCMTK before 3.6.7 didn't check. ICSMA-22-174-01.
+var uidPathTraversal = exploitSignature{
+	id:          "CVE-2022-2119",
+	description: "Path traversal through the UIDs of a C-STORE",
+	match: func(event dicompot.Event) bool {
+		if event.Type != dicompot.EventCStore {
+			return false
+		}
+		return !isUID(stringField(event, "SOPInstanceUID")) || !isUID(stringField(event, "SOPClassUID"))
+	},
+}
+
+// Orthanc before 1.12.0 lets API users write arbitrary files, e.g., through
+// the export of an instance or a Lua script.
+var orthancFileOverwrite = exploitSignature{
+	id:          "CVE-2023-33466",
+	description: "Arbitrary file write through the Orthanc REST API",
+	match: func(event dicompot.Event) bool {
+		if event.Type != dicompot.EventHTTPRequest {
+			return false
+		}
+		uri := stringField(event, "URI")
+		if i := strings.IndexByte(uri, '?'); i >= 0 {
+			uri = uri[:i]
+		}
+		return strings.HasPrefix(uri, "/tools/execute-script") ||
+			(strings.HasPrefix(uri, "/instances/") && strings.HasSuffix(uri, "/export"))
+	},
+}
+
+// Old Conquest releases copy the AE titles and UIDs of an association into
+// fixed-size buffers. Payloads show up as binary AE titles or oversized UIDs.
+var associationOverflow = exploitSignature{
+	id:          "conquest-association-overflow",
+	description: "Buffer overflow through the fields of an association request",
+	match: func(event dicompot.Event) bool {
+		switch event.Type {
+		case dicompot.EventAssociationRequest:
+			return !isPrintable(stringField(event, "CallingAETitle")) || !isPrintable(stringField(event, "CalledAETitle"))
+		case dicompot.EventAssociationClient:
+			version := stringField(event, "Version")
+			return len(version) > 16 || !isPrintable(version)
+		case dicompot.EventContextNegotiation:
+			return oversizedContextUID(event)
+		}
+		return false
+	},
+}
+
+// oversizedContextUID reports whether a presentation context of context
+// negotiation "event" has a UID longer than 64 characters.
+func oversizedContextUID(event dicompot.Event) bool {
+	contexts, _ := event.Fields["Contexts"].([]string)
+	for _, c := range contexts {
+		// "id:abstract syntax[transfer syntaxes]"
+		c = strings.TrimRight(c, "]")
+		for _, uid := range strings.FieldsFunc(c, func(r rune) bool { return r == ':' || r == '[' || r == ',' }) {
+			if len(uid) > 64 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oversizedQuery reports whether an attribute of query "q" has a value
+// longer than its VR allows.
+func oversizedQuery(q []dicompot.QueryElement) bool {
+	for _, qe := range q {
+		for _, item := range qe.Items {
+			if oversizedQuery(item) {
+				return true
+			}
+		}
+		limit, ok := vrMaxLengths[qe.VR]
+		if !ok {
+			continue
+		}
+		for _, v := range qe.Values {
+			parts := []string{v}
+			if qe.VR == "PN" {
+				parts = strings.Split(v, "=")
+			}
+			for _, part := range parts {
+				if len(part) > limit {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// The signatures of exploit payloads, which apply to every session, whatever
+// the product passed for: the tricks that overflow or confuse parsers, and
+// the executables smuggled in stored objects.
+var payloadSignatures = []exploitSignature{
+	{
+		id:          "pdu-length-trick",
+		description: "PDU whose lengths don't add up: longer than allowed, an item running past its end, or bytes past its items",
+		match: func(event dicompot.Event) bool {
+			reason := stringField(event, "Reason")
+			return event.Type == dicompot.EventMalformedPDU && reason != pdu.ReadErrorUnknownType && reason != pdu.ReadErrorShortHeader
+		},
+	},
+	{
+		id:          "oversized-field",
+		description: "Value longer than the standard allows, in an association request, a query or a stored object",
+		match: func(event dicompot.Event) bool {
+			switch event.Type {
+			case dicompot.EventAssociationClient:
+				return len(stringField(event, "Version")) > 16 || len(stringField(event, "ImplementationClassUID")) > 64
+			case dicompot.EventContextNegotiation:
+				return oversizedContextUID(event)
+			case dicompot.EventCFindQuery, dicompot.EventCMove, dicompot.EventCGet:
+				return oversizedQuery(event.Query)
+			case dicompot.EventCStore, dicompot.EventSTOW:
+				return event.Fields["OversizedElements"] != nil
+			}
+			return false
+		},
+	},
+	{
+		id:          "CVE-2019-11687",
+		description: "Executable in the preamble of a Part 10 file, a DICOM and PE or ELF polyglot",
+		match: func(event dicompot.Event) bool {
+			return (event.Type == dicompot.EventCStore || event.Type == dicompot.EventSTOW) && stringField(event, "PreambleExecutable") != ""
+		},
+	},
+	{
+		id:          "embedded-executable",
+		description: "Executable hidden in a stored object, e.g., in its pixel data or a private element",
+		match: func(event dicompot.Event) bool {
+			return (event.Type == dicompot.EventCStore || event.Type == dicompot.EventSTOW) && stringField(event, "EmbeddedExecutable") != ""
+		},
+	},
+}
+
+// exploitSession is what the detector knows of a connection.
+type exploitSession struct {
+	personality string
+	signatures  []exploitSignature
+	// The signatures that matched already. Each is logged once per
+	// session.
+	matched map[string]bool
+}
+
+// exploitDetector is an EventSink that forwards every event to "next", and
+// records an EventExploitAttempt next to the events that match the signatures
+// of the personality of their session.
+type exploitDetector struct {
+	next dicompot.EventSink
+	// Whether payloadSignatures apply.
+	payloads bool
+
+	mu sync.Mutex
+	// The personality of each port that answers as a vulnerable product.
+	ports map[string]*personality
+	// The sessions of those ports, by ID.
+	sessions map[string]*exploitSession
+}
+
+func newExploitDetector(next dicompot.EventSink, payloads bool) *exploitDetector {
+	return &exploitDetector{
+		next:     next,
+		payloads: payloads,
+		ports:    map[string]*personality{},
+		sessions: map[string]*exploitSession{},
+	}
+}
+
+// watch applies the signatures of "p" to the connections on "port". It must
+// be called before the port is listened on.
+func (d *exploitDetector) watch(port string, p *personality) {
+	if p == nil || len(p.exploits) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ports[port] = p
+}
+
+// Record forwards "event", then checks it.
+func (d *exploitDetector) Record(event dicompot.Event) error {
+	err := d.next.Record(event)
+	for _, attempt := range d.check(event) {
+		if recordErr := d.next.Record(attempt); err == nil {
+			err = recordErr
+		}
+	}
+	return err
+}
+
+// check returns the EventExploitAttempts "event" gives away.
+func (d *exploitDetector) check(event dicompot.Event) []dicompot.Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.ports) == 0 && !d.payloads {
+		return nil
+	}
+	switch event.Type {
+	case dicompot.EventConnectionOpened:
+		s := &exploitSession{matched: map[string]bool{}}
+		if p := d.ports[stringField(event, "LocalPort")]; p != nil {
+			s.personality, s.signatures = p.name, p.exploits
+		}
+		if d.payloads {
+			s.signatures = append(append([]exploitSignature{}, s.signatures...), payloadSignatures...)
+		}
+		if len(s.signatures) > 0 {
+			d.sessions[event.SessionID] = s
+		}
+		return nil
+	case dicompot.EventConnectionClosed:
+		delete(d.sessions, event.SessionID)
+		return nil
+	case dicompot.EventHTTPRequest:
+		// DICOMweb requests are sessions of their own, that end with
+		// the event.
+		var attempts []dicompot.Event
+		for _, p := range d.ports {
+			s := &exploitSession{personality: p.name, signatures: p.exploits, matched: map[string]bool{}}
+			attempts = append(attempts, s.check(event)...)
+		}
+		return attempts
+	}
+	if s := d.sessions[event.SessionID]; s != nil {
+		return s.check(event)
+	}
+	if d.payloads && event.Type == dicompot.EventSTOW {
+		// Each part of a STOW-RS request is checked on its own.
+		s := &exploitSession{signatures: payloadSignatures, matched: map[string]bool{}}
+		return s.check(event)
+	}
+	return nil
+}
+
+func (s *exploitSession) check(event dicompot.Event) []dicompot.Event {
+	var attempts []dicompot.Event
+	for _, sig := range s.signatures {
+		if s.matched[sig.id] || !sig.match(event) {
+			continue
+		}
+		s.matched[sig.id] = true
+		fields := map[string]interface{}{
+			"Signature":   sig.id,
+			"Description": sig.description,
+			"Trigger":     event.Type,
+		}
+		if s.personality != "" {
+			fields["Personality"] = s.personality
+		}
+		for _, name := range []string{"IP", "URI", "SOPInstanceUID", "CallingAETitle", "Reason", "PreambleExecutable", "EmbeddedExecutable", "OversizedElements", "Path"} {
+			if v, ok := event.Fields[name]; ok {
+				fields[name] = v
+			}
+		}
+		attempt := dicompot.NewEvent(logrus.ErrorLevel, dicompot.EventExploitAttempt, event.SessionID, "Exploit attempt", fields)
+		attempt.Command = event.Command
+		attempts = append(attempts, attempt)
+	}
+	return attempts
+}
+
+// Close closes "next".
+func (d *exploitDetector) Close() error {
+	return d.next.Close()
+}
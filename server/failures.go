@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// The failures -failures can name, rather than give the code of. Some codes
+// depend on the service. P3.4, annex C.4, GG.4, and P3.7, annex C.
+var failureStatuses = map[string]func(command int) dimse.StatusCode{
+	"out-of-resources": func(command int) dimse.StatusCode {
+		switch command {
+		case dimse.CommandFieldCMoveRq, dimse.CommandFieldCGetRq:
+			return dimse.CMoveOutOfResourcesUnableToPerformSubOperations
+		case dimse.CommandFieldNActionRq, dimse.CommandFieldNCreateRq, dimse.CommandFieldNSetRq,
+			dimse.CommandFieldNGetRq, dimse.CommandFieldNDeleteRq:
+			return 0x0213 // Resource limitation
+		}
+		return dimse.CStoreOutOfResources
+	},
+	"sop-class-not-supported": func(command int) dimse.StatusCode {
+		switch command {
+		case dimse.CommandFieldNActionRq, dimse.CommandFieldNCreateRq, dimse.CommandFieldNSetRq,
+			dimse.CommandFieldNGetRq, dimse.CommandFieldNDeleteRq:
+			return dimse.StatusSOPClassNotSupported
+		}
+		return 0x0122 // Refused: SOP Class not supported
+	},
+	"unable-to-process":   func(int) dimse.StatusCode { return dimse.CFindUnableToProcess },
+	"processing-failure":  func(int) dimse.StatusCode { return 0x0110 },
+	"not-authorized":      func(int) dimse.StatusCode { return dimse.StatusNotAuthorized },
+	"duplicate":           func(int) dimse.StatusCode { return dimse.StatusDuplicateSOPInstance },
+	"destination-unknown": func(int) dimse.StatusCode { return dimse.CMoveMoveDestinationUnknown },
+}
+
+// parseFailures parses the value of -failures, e.g.,
+// "store=0.1:out-of-resources,find=0.02:0xC000". A request may be given
+// several failures, each with its own probability.
+func parseFailures(value string) map[int][]dicompot.FakeStatus {
+	failures := map[int][]dicompot.FakeStatus{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid -failures entry %q, want name=probability:status", entry)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		command, ok := requestNames[name]
+		if !ok {
+			log.Fatalf("Invalid -failures entry %q, unknown name %q", entry, name)
+		}
+		fields := strings.SplitN(parts[1], ":", 2)
+		if len(fields) != 2 {
+			log.Fatalf("Invalid -failures entry %q, want name=probability:status", entry)
+		}
+		p, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil || p < 0 || p > 1 {
+			log.Fatalf("Invalid -failures entry %q, want a probability between 0 and 1", entry)
+		}
+		code, ok := parseFailureStatus(fields[1], command)
+		if !ok {
+			log.Fatalf("Invalid -failures entry %q, want a status code, e.g., 0xC000, or one of out-of-resources, sop-class-not-supported, unable-to-process, processing-failure, not-authorized, duplicate, destination-unknown", entry)
+		}
+		failures[command] = append(failures[command], dicompot.FakeStatus{
+			Status:      dimse.Status{Status: code},
+			Probability: p,
+		})
+	}
+	return failures
+}
+
+// parseFailureStatus parses a status code in hex, e.g., "0xA700" or "a700",
+// or the name of a failure.
+func parseFailureStatus(s string, command int) (dimse.StatusCode, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if status, ok := failureStatuses[s]; ok {
+		return status(command), true
+	}
+	code, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 16)
+	if err != nil || code == uint64(dimse.StatusSuccess) || code == uint64(dimse.StatusPending) {
+		return 0, false
+	}
+	return dimse.StatusCode(code), true
+}
@@ -0,0 +1,352 @@
+package main
+
+// This file streams the events, as they happen, over WebSocket, for
+// dashboards to show the live activity without polling the logs: each
+// message is an event, in JSON, as the other sinks post them. Clients can
+// filter by type and level, and ask for the last events first, so that
+// they don't start empty.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// The events kept for the clients that ask for the last ones.
+	feedHistory = 200
+	// Events waiting to be written to a client, at most. Further ones are
+	// dropped, for that client, rather than hold up the others.
+	feedClientQueue = 256
+	// How often idle clients are pinged, for proxies not to close them.
+	feedPingInterval = 30 * time.Second
+	feedWriteTimeout = 10 * time.Second
+
+	// The GUID of the handshake of RFC 6455.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// The longest frame taken from a client, which has nothing to send but
+	// control frames.
+	websocketMaxFrame = 4096
+)
+
+// The opcodes of the frames of RFC 6455.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// feedEvent is an event, as sent to the clients.
+type feedEvent struct {
+	typ   string
+	level logrus.Level
+	json  []byte
+}
+
+// feedClient is a client of the feed.
+type feedClient struct {
+	types map[string]bool
+	level logrus.Level
+	send  chan []byte
+}
+
+// wants returns whether the client takes "e".
+func (c *feedClient) wants(e feedEvent) bool {
+	return e.level <= c.level && (len(c.types) == 0 || c.types[e.typ])
+}
+
+// feed is an EventSink that hands the events to the WebSocket clients, and
+// the http.Handler they connect to.
+type feed struct {
+	token string
+
+	mu      sync.Mutex
+	clients map[*feedClient]bool
+	// The last events, the oldest first.
+	history []feedEvent
+}
+
+// newFeed returns the sink for -feed, serving the WebSocket on "addr" at
+// /events, or nil if there is none. Clients must send "token", if set.
+func newFeed(addr, token string) *feed {
+	if addr == "" {
+		return nil
+	}
+	f := &feed{token: token, clients: map[*feedClient]bool{}}
+	mux := http.NewServeMux()
+	mux.Handle("/events", f)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Fatal(srv.ListenAndServe())
+	}()
+	if token == "" {
+		log.Printf("-| Live feed served on: ws://%s/events, without -feedtoken: keep the address from attackers", addr)
+	} else {
+		log.Printf("-| Live feed served on: ws://%s/events", addr)
+	}
+	return f
+}
+
+// Record hands the event to the clients that take it.
+func (f *feed) Record(event dicompot.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	e := feedEvent{typ: event.Type, level: event.Level, json: b}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.history) == feedHistory {
+		copy(f.history, f.history[1:])
+		f.history = f.history[:feedHistory-1]
+	}
+	f.history = append(f.history, e)
+	for c := range f.clients {
+		if !c.wants(e) {
+			continue
+		}
+		select {
+		case c.send <- e.json:
+		default:
+		}
+	}
+	return nil
+}
+
+func (f *feed) Close() error {
+	return nil
+}
+
+// authorized returns whether "r" carries the token, as a bearer token or,
+// as browsers can't set headers on WebSockets, the "token" parameter.
+func (f *feed) authorized(r *http.Request) bool {
+	if f.token == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(f.token)) == 1
+}
+
+// ServeHTTP takes a client. The parameters are "types", the
+// comma-separated event types sent (default: all), "level", the least
+// severe level sent (default: debug), and "last", how many of the last
+// events to send first.
+func (f *feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	c := &feedClient{types: map[string]bool{}, level: logrus.DebugLevel, send: make(chan []byte, feedClientQueue)}
+	query := r.URL.Query()
+	if types := query.Get("types"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			c.types[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+	}
+	if level := query.Get("level"); level != "" {
+		var err error
+		if c.level, err = logrus.ParseLevel(level); err != nil {
+			http.Error(w, "Invalid level", http.StatusBadRequest)
+			return
+		}
+	}
+	last, _ := strconv.Atoi(query.Get("last"))
+	conn, rw, err := acceptWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	var backlog [][]byte
+	for i := len(f.history) - 1; i >= 0 && len(backlog) < last; i-- {
+		if c.wants(f.history[i]) {
+			backlog = append(backlog, f.history[i].json)
+		}
+	}
+	for i := len(backlog) - 1; i >= 0; i-- {
+		c.send <- backlog[i]
+	}
+	f.clients[c] = true
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.clients, c)
+		f.mu.Unlock()
+	}()
+
+	// The reader answers the pings and the close of the client. Writes
+	// are made under "mu", as the reader writes too.
+	var mu sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+		return writeWebSocketFrame(rw.Writer, opcode, payload)
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := readWebSocketFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsPing:
+				write(wsPong, payload)
+			case wsClose:
+				if len(payload) >= 2 {
+					payload = payload[:2]
+				}
+				write(wsClose, payload)
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(feedPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case b := <-c.send:
+			err = write(wsText, b)
+		case <-ping.C:
+			err = write(wsPing, nil)
+		case <-closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// acceptWebSocket completes the handshake of RFC 6455 and returns the
+// connection, hijacked from "w".
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerHasToken(r.Header.Get("Connection"), "upgrade") || key == "" {
+		http.Error(w, "WebSocket expected", http.StatusBadRequest)
+		return nil, nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, nil, errors.New("unsupported WebSocket version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket unsupported", http.StatusInternalServerError)
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, rw, nil
+}
+
+// headerHasToken returns whether the comma-separated "header" has "token".
+func headerHasToken(header, token string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeWebSocketFrame writes an unfragmented, unmasked frame, as servers
+// send them.
+func writeWebSocketFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+	w.WriteByte(0x80 | opcode)
+	switch n := len(payload); {
+	case n < 126:
+		w.WriteByte(byte(n))
+	case n <= 0xFFFF:
+		w.WriteByte(126)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(127)
+		binary.Write(w, binary.BigEndian, uint64(n))
+	}
+	w.Write(payload)
+	return w.Flush()
+}
+
+// readWebSocketFrame reads a frame of a client, and returns its opcode and
+// unmasked payload. Frames too long are an error.
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var n16 uint16
+		if err := binary.Read(r, binary.BigEndian, &n16); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(n16)
+	case 127:
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return 0, nil, err
+		}
+	}
+	if !masked {
+		return 0, nil, errors.New("unmasked frame from a client")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	if n > websocketMaxFrame {
+		// Data frames are of no use: skip them, up to a point.
+		if opcode&0x8 != 0 || n > 1<<20 {
+			return 0, nil, errors.New("frame too long")
+		}
+		_, err := io.CopyN(ioutil.Discard, r, int64(n))
+		return opcode, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
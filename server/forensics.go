@@ -0,0 +1,171 @@
+package main
+
+// This file describes the payloads received, C-STORE datasets and STOW-RS
+// parts, for the log: their hashes, to match them against malware
+// intelligence, and what they claim to be.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// The attributes of a dataset that tell where it comes from.
+var payloadAttributes = map[string]dicomtag.Tag{
+	"SOPClassUID":                  dicomtag.SOPClassUID,
+	"TransferSyntax":               dicomtag.TransferSyntaxUID,
+	"Modality":                     dicomtag.Modality,
+	"Manufacturer":                 dicomtag.Manufacturer,
+	"ManufacturerModelName":        dicomtag.ManufacturerModelName,
+	"SoftwareVersions":             dicomtag.SoftwareVersions,
+	"SourceApplicationEntityTitle": dicomtag.SourceApplicationEntityTitle,
+	"ImplementationVersionName":    dicomtag.ImplementationVersionName,
+}
+
+// preambleFormat returns the executable format the 128-byte preamble of a
+// Part 10 file starts with, if any. A preamble is free for all, which makes
+// files that are valid DICOM and a valid executable at once (CVE-2019-11687).
+func preambleFormat(file []byte) string {
+	switch {
+	case bytes.HasPrefix(file, []byte("MZ")):
+		return "PE"
+	case bytes.HasPrefix(file, []byte("\x7fELF")):
+		return "ELF"
+	case bytes.HasPrefix(file, []byte("\xcf\xfa\xed\xfe")), bytes.HasPrefix(file, []byte("\xce\xfa\xed\xfe")):
+		return "Mach-O"
+	}
+	return ""
+}
+
+// The maximum length of the values of the string VRs that have one, PS3.5
+// 6.2. PN's is that of each component group.
+var vrMaxLengths = map[string]int{
+	"AE": 16, "AS": 4, "CS": 16, "DA": 8, "DS": 16, "DT": 26, "IS": 12,
+	"LO": 64, "LT": 10240, "PN": 64, "SH": 16, "ST": 1024, "TM": 16, "UI": 64,
+}
+
+// The oversized elements listed, at most.
+const maxOversizedElements = 10
+
+// oversizedElements returns the elements of "elems", and of their
+// sequences, with a value longer than its VR allows, which is how the
+// buffers of careless parsers are overflowed, as "Keyword (VR, length)".
+func oversizedElements(elems []*dicom.Element) []string {
+	var found []string
+	var walk func(elems []*dicom.Element)
+	walk = func(elems []*dicom.Element) {
+		for _, elem := range elems {
+			if len(found) == maxOversizedElements {
+				return
+			}
+			if elem.VR == "SQ" || elem.Tag == dicomtag.Item {
+				var items []*dicom.Element
+				for _, v := range elem.Value {
+					if item, ok := v.(*dicom.Element); ok {
+						items = append(items, item)
+					}
+				}
+				walk(items)
+				continue
+			}
+			limit, ok := vrMaxLengths[elem.VR]
+			if !ok {
+				continue
+			}
+			for _, v := range elem.Value {
+				value, _ := v.(string)
+				parts := []string{value}
+				if elem.VR == "PN" {
+					parts = strings.Split(value, "=")
+				}
+				for _, part := range parts {
+					if len(part) > limit {
+						name := elem.Tag.String()
+						if info, err := dicomtag.Find(elem.Tag); err == nil {
+							name = info.Name
+						}
+						found = append(found, fmt.Sprintf("%s (%s, %d)", name, elem.VR, len(part)))
+						break
+					}
+				}
+			}
+		}
+	}
+	walk(elems)
+	return found
+}
+
+// embeddedExecutable returns the format and offset of the first executable
+// found in "data" past its start, e.g., in the pixel data or a private
+// element, if any.
+func embeddedExecutable(data []byte) (string, int) {
+	for i := 1; i < len(data); {
+		pe := bytes.Index(data[i:], []byte("MZ"))
+		elf := bytes.Index(data[i:], []byte("\x7fELF"))
+		if pe < 0 && elf < 0 {
+			break
+		}
+		if pe >= 0 && (elf < 0 || pe < elf) {
+			at := i + pe
+			// The DOS header points to the PE header at 0x3c.
+			if at+0x40 <= len(data) {
+				off := int(binary.LittleEndian.Uint32(data[at+0x3c:]))
+				if off >= 0x40 && at+off+4 <= len(data) && bytes.Equal(data[at+off:at+off+4], []byte("PE\x00\x00")) {
+					return "PE", at
+				}
+			}
+			i = at + 2
+			continue
+		}
+		at := i + elf
+		// The class and the byte order.
+		if at+6 <= len(data) && (data[at+4] == 1 || data[at+4] == 2) && (data[at+5] == 1 || data[at+5] == 2) {
+			return "ELF", at
+		}
+		i = at + 4
+	}
+	return "", 0
+}
+
+// payloadFields returns the size and hashes of Part 10 file "file", the
+// executable it hides, if any, and the attributes of "ds", its dataset, if
+// it parsed, with those oversized.
+func payloadFields(file []byte, ds *dicom.DataSet) map[string]interface{} {
+	fields := map[string]interface{}{
+		"Size":   len(file),
+		"SHA256": fmt.Sprintf("%x", sha256.Sum256(file)),
+		"MD5":    fmt.Sprintf("%x", md5.Sum(file)),
+	}
+	if format, at := embeddedExecutable(file); format != "" {
+		fields["EmbeddedExecutable"] = fmt.Sprintf("%s at %d", format, at)
+	}
+	if ds == nil {
+		return fields
+	}
+	for name, tag := range payloadAttributes {
+		if elem, err := ds.FindElementByTag(tag); err == nil {
+			if values, err := elem.GetStrings(); err == nil && len(values) > 0 {
+				fields[name] = strings.Join(values, "\\")
+			}
+		}
+	}
+	if uid, ok := fields["SOPClassUID"].(string); ok {
+		if info, err := dicomuid.Lookup(uid); err == nil {
+			fields["SOPClass"] = info.Name
+		}
+	}
+	if format := preambleFormat(file); format != "" {
+		fields["PreambleExecutable"] = format
+	}
+	if found := oversizedElements(ds.Elements); len(found) > 0 {
+		fields["OversizedElements"] = found
+	}
+	return fields
+}
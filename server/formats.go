@@ -0,0 +1,214 @@
+package main
+
+// This file formats events for the SIEMs that don't take JSON well: CEF for
+// ArcSight and LEEF for QRadar. Both get the peer, the command, and the
+// DICOM specifics (AE titles, SOP class, query terms) in keys of their own.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// The product that CEF and LEEF name as the source of the events.
+const (
+	siemVendor  = "dicompot"
+	siemProduct = "dicompot"
+	siemVersion = "1.0"
+)
+
+// eventFormats are the formats of -syslogformat and -eventlogformat, by
+// name.
+var eventFormats = map[string]func(event dicompot.Event) ([]byte, error){
+	"json": func(event dicompot.Event) ([]byte, error) { return json.Marshal(event) },
+	"ecs":  ecsEvent,
+	"cef":  cefEvent,
+	"leef": leefEvent,
+}
+
+// lookupEventFormat returns the format named "name", for flag "flagName".
+func lookupEventFormat(flagName, name string) func(event dicompot.Event) ([]byte, error) {
+	format, ok := eventFormats[strings.ToLower(name)]
+	if !ok {
+		log.Fatalf("Invalid -%s %q, want json, ecs, cef or leef", flagName, name)
+	}
+	return format
+}
+
+// lineSink is an EventSink that writes every event as a line, in one of the
+// eventFormats.
+type lineSink struct {
+	format func(event dicompot.Event) ([]byte, error)
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// newEventLog returns the sink for -eventlog and -eventlogformat, or nil if
+// events aren't written to a file. In JSON, the lines are those of
+// dicompot.NDJSONSink.
+func newEventLog(path, format string) dicompot.EventSink {
+	if path == "" {
+		return nil
+	}
+	formatter := lookupEventFormat("eventlogformat", format)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatalf("Failed to open -eventlog %s: %v", path, err)
+	}
+	if strings.ToLower(format) == "json" {
+		return dicompot.NewNDJSONSink(f)
+	}
+	return &lineSink{format: formatter, w: f}
+}
+
+func (s *lineSink) Record(event dicompot.Event) error {
+	b, err := s.format(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *lineSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// queryTerms returns the non-empty elements of the query of "event", as
+// "PatientName=DOE*;StudyDate=2020".
+func queryTerms(event dicompot.Event) string {
+	var terms []string
+	for _, qe := range event.Query {
+		if strings.Join(qe.Values, "") == "" {
+			continue
+		}
+		name := qe.Keyword
+		if name == "" {
+			name = qe.Tag
+		}
+		terms = append(terms, name+"="+strings.Join(qe.Values, "\\"))
+	}
+	return strings.Join(terms, ";")
+}
+
+// The event fields siemAttributes takes care of.
+var siemFields = map[string]bool{"SOPClassUID": true, "Path": true, "SHA256": true, "URI": true, "Username": true}
+
+// siemAttributes returns what CEF and LEEF have keys for, as the CEF key, the
+// LEEF key and the value. Empty values are left out.
+func siemAttributes(event dicompot.Event) [][3]string {
+	attrs := [][3]string{
+		{"externalId", "sessionID", event.SessionID},
+		{"src", "src", event.RemoteIP},
+		{"act", "command", event.Command},
+		{"msg", "msg", event.Message},
+		{"cs1", "callingAETitle", event.CallingAETitle},
+		{"cs2", "calledAETitle", event.CalledAETitle},
+		{"cs3", "sopClassUID", stringField(event, "SOPClassUID")},
+		{"cs4", "queryTerms", queryTerms(event)},
+		{"fname", "filePath", stringField(event, "Path")},
+		{"fileHash", "fileHash", stringField(event, "SHA256")},
+		{"request", "url", stringField(event, "URI")},
+		{"suser", "usrName", stringField(event, "Username")},
+	}
+	if event.RemotePort != 0 {
+		attrs = append(attrs, [3]string{"spt", "srcPort", fmt.Sprint(event.RemotePort)})
+	}
+	if event.LocalPort != 0 {
+		attrs = append(attrs, [3]string{"dpt", "dstPort", fmt.Sprint(event.LocalPort)})
+	}
+	var out [][3]string
+	for _, a := range attrs {
+		if a[2] != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// The labels of the custom strings of CEF.
+var cefLabels = map[string]string{
+	"cs1": "CallingAETitle",
+	"cs2": "CalledAETitle",
+	"cs3": "SOPClassUID",
+	"cs4": "QueryTerms",
+}
+
+// cefSeverity maps the level of an event to the 0-10 scale of CEF.
+func cefSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 10
+	case logrus.ErrorLevel:
+		return 8
+	case logrus.WarnLevel:
+		return 5
+	case logrus.InfoLevel:
+		return 3
+	}
+	return 1
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// cefEvent formats "event" as ArcSight CEF.
+func cefEvent(event dicompot.Event) ([]byte, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		siemVendor, siemProduct, siemVersion,
+		cefHeaderEscaper.Replace(event.Type),
+		cefHeaderEscaper.Replace(event.Message),
+		cefSeverity(event.Level))
+	fmt.Fprintf(&sb, "rt=%d app=DICOM proto=TCP", event.Time.UnixNano()/1e6)
+	for _, a := range siemAttributes(event) {
+		fmt.Fprintf(&sb, " %s=%s", a[0], cefExtensionEscaper.Replace(a[2]))
+		if label, ok := cefLabels[a[0]]; ok {
+			fmt.Fprintf(&sb, " %sLabel=%s", a[0], label)
+		}
+	}
+	return []byte(sb.String()), nil
+}
+
+var leefEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// leefEvent formats "event" as QRadar LEEF 1.0, attributes separated by
+// tabs. The event-specific fields follow the common ones, under their own
+// names.
+func leefEvent(event dicompot.Event) ([]byte, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "LEEF:1.0|%s|%s|%s|%s|",
+		siemVendor, siemProduct, siemVersion, strings.Replace(event.Type, "|", " ", -1))
+	fmt.Fprintf(&sb, "devTime=%s\tdevTimeFormat=yyyy-MM-dd'T'HH:mm:ss.SSSZ\tsev=%d\tproto=TCP",
+		event.Time.Format("2006-01-02T15:04:05.000-0700"), cefSeverity(event.Level))
+	for _, a := range siemAttributes(event) {
+		fmt.Fprintf(&sb, "\t%s=%s", a[1], leefEscaper.Replace(a[2]))
+	}
+	var names []string
+	for name := range event.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if siemFields[name] {
+			continue
+		}
+		fmt.Fprintf(&sb, "\t%s=%s", name, leefEscaper.Replace(fmt.Sprint(event.Fields[name])))
+	}
+	return []byte(sb.String()), nil
+}
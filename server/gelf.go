@@ -0,0 +1,180 @@
+package main
+
+// This file sends the events to Graylog, as GELF 1.1 messages
+// (https://go2docs.graylog.org/current/getting_in_log_data/gelf.html), every
+// structured field of an event an additional field of its own.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// Bytes of a UDP chunk, headers included, as Graylog suggests for
+	// WAN links.
+	gelfChunkSize = 1420
+	// Chunks of a UDP message, at most.
+	gelfMaxChunks = 128
+	// How long a connection to Graylog or a write may take.
+	gelfTimeout = 10 * time.Second
+)
+
+// What GELF allows in the name of an additional field.
+var gelfFieldName = regexp.MustCompile(`[^\w.\-]`)
+
+// gelfSink sends the events, through a queuedSink, as GELF messages.
+type gelfSink struct {
+	network, addr string
+	host          string
+
+	conn net.Conn
+}
+
+// newGELFSink returns the sink for -gelf, or nil if events aren't sent to
+// Graylog. "target" is udp://host:port or tcp://host:port.
+func newGELFSink(target string) dicompot.EventSink {
+	if target == "" {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Hostname() == "" {
+		log.Fatalf("Invalid -gelf %q, want udp://host:port or tcp://host:port", target)
+	}
+	s := &gelfSink{network: u.Scheme, addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "12201")
+	}
+	if s.host, err = os.Hostname(); err != nil || s.host == "" {
+		s.host = "dicompot"
+	}
+	if s.conn, err = net.DialTimeout(s.network, s.addr, gelfTimeout); err != nil {
+		log.Fatalf("Failed to connect to -gelf %s: %v", target, err)
+	}
+	log.Printf("-| Sending events to Graylog: %s", target)
+	return newQueuedSink("GELF", 100, 0, s.send)
+}
+
+// gelfMessage returns "event" as a GELF message. Fields that aren't strings
+// or numbers are in JSON.
+func gelfMessage(host string, event dicompot.Event) ([]byte, error) {
+	msg := map[string]interface{}{
+		"version":       "1.1",
+		"host":          host,
+		"short_message": event.Message,
+		"timestamp":     float64(event.Time.UnixNano()/1e3) / 1e6,
+		"level":         syslogSeverity(event.Level),
+		"_event_type":   event.Type,
+	}
+	set := func(name string, value interface{}) {
+		if value == nil || value == "" || value == 0 {
+			return
+		}
+		switch v := value.(type) {
+		case string, int, int64, uint16, uint32, float64:
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			b, err := json.Marshal(value)
+			if err != nil || string(b) == "null" {
+				return
+			}
+			value = string(b)
+		}
+		msg["_"+gelfFieldName.ReplaceAllString(name, "_")] = value
+	}
+	set("session_id", event.SessionID)
+	set("remote_ip", event.RemoteIP)
+	set("remote_port", event.RemotePort)
+	set("local_port", event.LocalPort)
+	set("calling_ae_title", event.CallingAETitle)
+	set("called_ae_title", event.CalledAETitle)
+	set("command", event.Command)
+	set("query_terms", queryTerms(event))
+	for name, value := range event.Fields {
+		if _, ok := msg["_"+name]; ok {
+			name = "field_" + name
+		}
+		set(name, value)
+	}
+	return json.Marshal(msg)
+}
+
+// gelfChunks returns "msg" as UDP datagrams: one, or chunks of a gzipped
+// "msg" if it doesn't fit.
+func gelfChunks(msg []byte) ([][]byte, error) {
+	if len(msg) <= gelfChunkSize {
+		return [][]byte{msg}, nil
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(msg)
+	w.Close()
+	if gz.Len() <= gelfChunkSize {
+		return [][]byte{gz.Bytes()}, nil
+	}
+	// The header of a chunk: magic bytes, message ID, sequence number and
+	// count.
+	const payloadSize = gelfChunkSize - 12
+	n := (gz.Len() + payloadSize - 1) / payloadSize
+	if n > gelfMaxChunks {
+		return nil, fmt.Errorf("message of %d bytes too big for GELF over UDP", len(msg))
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	data := gz.Bytes()
+	chunks := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		end := (i + 1) * payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := append([]byte{0x1e, 0x0f}, id[:]...)
+		chunk = append(chunk, byte(i), byte(n))
+		chunks = append(chunks, append(chunk, data[i*payloadSize:end]...))
+	}
+	return chunks, nil
+}
+
+// send sends the events. Over TCP, messages end with a null byte, and a
+// connection that broke is made again on the next batch.
+func (s *gelfSink) send(events []dicompot.Event) error {
+	if s.conn == nil {
+		var err error
+		if s.conn, err = net.DialTimeout(s.network, s.addr, gelfTimeout); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		msg, err := gelfMessage(s.host, event)
+		if err != nil {
+			continue
+		}
+		packets := [][]byte{append(msg, 0)}
+		if s.network == "udp" {
+			if packets, err = gelfChunks(msg); err != nil {
+				continue
+			}
+		}
+		for _, p := range packets {
+			s.conn.SetWriteDeadline(time.Now().Add(gelfTimeout))
+			if _, err := s.conn.Write(p); err != nil {
+				s.conn.Close()
+				s.conn = nil
+				return err
+			}
+		}
+	}
+	return nil
+}
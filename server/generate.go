@@ -0,0 +1,242 @@
+package main
+
+// This file implements "server generate", which fills a directory with a
+// fake archive, so that the honeypot can be deployed without real images.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+var (
+	generatedFamilyNames = []string{
+		"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis",
+		"Rodriguez", "Martinez", "Hernandez", "Lopez", "Wilson", "Anderson", "Thomas",
+		"Taylor", "Moore", "Jackson", "Martin", "Lee", "Thompson", "White", "Harris",
+		"Clark", "Lewis", "Robinson", "Walker", "Young", "Allen", "King", "Wright",
+		"Scott", "Green", "Baker", "Adams", "Nelson", "Hill", "Campbell", "Mitchell",
+		"Andersson", "Johansson", "Karlsson", "Nilsson", "Eriksson", "Larsson",
+	}
+	generatedMaleNames = []string{
+		"James", "John", "Robert", "Michael", "William", "David", "Richard", "Joseph",
+		"Thomas", "Charles", "Daniel", "Matthew", "Anthony", "Mark", "Paul", "Steven",
+		"Erik", "Lars", "Karl", "Anders", "Johan", "Per", "Nils", "Mikael",
+	}
+	generatedFemaleNames = []string{
+		"Mary", "Patricia", "Jennifer", "Linda", "Elizabeth", "Barbara", "Susan",
+		"Jessica", "Sarah", "Karen", "Nancy", "Lisa", "Margaret", "Sandra", "Ashley",
+		"Anna", "Eva", "Maria", "Karin", "Sara", "Kristina", "Lena", "Emma", "Ingrid",
+	}
+	generatedPhysicians = []string{
+		"House^Gregory", "Grey^Meredith", "Carter^John", "Ross^Douglas", "Weaver^Kerry",
+		"Benton^Peter", "Lewis^Susan", "Greene^Mark", "Quinn^Michaela", "Kildare^James",
+	}
+	generatedInstitutions = []string{
+		"General Hospital", "St. Mary's Medical Center", "University Hospital",
+		"County Regional Medical Center", "Memorial Hospital",
+	}
+)
+
+// generatedModality is the part of a study that depends on its modality.
+type generatedModality struct {
+	modality     string
+	sopClassUID  string
+	descriptions []string
+	// Series descriptions.
+	series []string
+	// Instances per series.
+	instances int
+}
+
+var generatedModalities = []generatedModality{
+	{"CT", "1.2.840.10008.5.1.4.1.1.2",
+		[]string{"CT HEAD W/O CONTRAST", "CT CHEST W CONTRAST", "CT ABDOMEN PELVIS", "CT ANGIO CHEST"},
+		[]string{"Scout", "Axial 5mm", "Axial 1mm", "Coronal MPR"}, 8},
+	{"MR", "1.2.840.10008.5.1.4.1.1.4",
+		[]string{"MRI BRAIN W/WO CONTRAST", "MRI KNEE LEFT", "MRI LUMBAR SPINE", "MRI SHOULDER RIGHT"},
+		[]string{"Localizer", "T1 SAG", "T2 AX", "FLAIR AX", "DWI"}, 6},
+	{"CR", "1.2.840.10008.5.1.4.1.1.1",
+		[]string{"XR CHEST 2 VIEWS", "XR HAND LEFT", "XR ANKLE RIGHT"},
+		[]string{"PA", "LAT"}, 1},
+	{"DX", "1.2.840.10008.5.1.4.1.1.1.1",
+		[]string{"XR CHEST PA", "XR PELVIS AP", "XR KNEE 3 VIEWS"},
+		[]string{"AP", "LAT", "OBL"}, 1},
+	{"US", "1.2.840.10008.5.1.4.1.1.6.1",
+		[]string{"US ABDOMEN COMPLETE", "US THYROID", "US RENAL"},
+		[]string{"B-mode"}, 4},
+	{"MG", "1.2.840.10008.5.1.4.1.1.1.2",
+		[]string{"MAMMO SCREENING BILATERAL", "MAMMO DIAGNOSTIC LEFT"},
+		[]string{"L CC", "L MLO", "R CC", "R MLO"}, 1},
+}
+
+// Side of the generated images, in pixels. Small, as nobody is meant to
+// read them.
+const generatedImageSize = 64
+
+// runGenerate implements the "generate" subcommand. "args" are the
+// arguments that follow it.
+func runGenerate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	dir := fs.String("dir", "images", "Directory to write the archive to")
+	patients := fs.Int("patients", 25, "Number of patients")
+	seed := fs.Int64("seed", 0, "Random seed, for a reproducible archive (default: random)")
+	fs.Parse(args)
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	g := &generator{rand: rand.New(rand.NewSource(*seed)), dir: *dir}
+	for i := 0; i < *patients; i++ {
+		if err := g.patient(); err != nil {
+			log.Fatalf("Failed to generate archive: %v", err)
+		}
+	}
+	log.Printf("-| Generated %d patients, %d studies, %d images in %s", *patients, g.studies, g.images, *dir)
+}
+
+type generator struct {
+	rand *rand.Rand
+	dir  string
+
+	// Counters, for the summary.
+	studies, images int
+}
+
+func (g *generator) pick(values []string) string {
+	return values[g.rand.Intn(len(values))]
+}
+
+// uid returns a UID under the 2.25 root, which needs no registration.
+func (g *generator) uid() string {
+	var b [16]byte
+	g.rand.Read(b[:])
+	return "2.25." + new(big.Int).SetBytes(b[:]).String()
+}
+
+func (g *generator) patient() error {
+	sex, given := "M", g.pick(generatedMaleNames)
+	if g.rand.Intn(2) == 0 {
+		sex, given = "F", g.pick(generatedFemaleNames)
+	}
+	birth := time.Now().AddDate(-18-g.rand.Intn(70), 0, -g.rand.Intn(365))
+	patient := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, g.pick(generatedFamilyNames)+"^"+given),
+		dicom.MustNewElement(dicomtag.PatientID, fmt.Sprintf("MRN%07d", g.rand.Intn(10000000))),
+		dicom.MustNewElement(dicomtag.PatientBirthDate, birth.Format("20060102")),
+		dicom.MustNewElement(dicomtag.PatientSex, sex),
+	}
+	institution := g.pick(generatedInstitutions)
+	for n := 1 + g.rand.Intn(3); n > 0; n-- {
+		if err := g.study(patient, birth, institution); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *generator) study(patient []*dicom.Element, birth time.Time, institution string) error {
+	m := generatedModalities[g.rand.Intn(len(generatedModalities))]
+	// Sometime in the last five years, during working hours.
+	date := time.Now().AddDate(0, 0, -g.rand.Intn(5*365))
+	date = time.Date(date.Year(), date.Month(), date.Day(), 8+g.rand.Intn(9), g.rand.Intn(60), g.rand.Intn(60), 0, time.Local)
+	age := date.Year() - birth.Year()
+	if date.YearDay() < birth.YearDay() {
+		age--
+	}
+	studyUID := g.uid()
+	study := append(append([]*dicom.Element{}, patient...),
+		dicom.MustNewElement(dicomtag.PatientAge, fmt.Sprintf("%03dY", age)),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, studyUID),
+		dicom.MustNewElement(dicomtag.StudyDate, date.Format("20060102")),
+		dicom.MustNewElement(dicomtag.StudyTime, date.Format("150405")),
+		dicom.MustNewElement(dicomtag.StudyID, fmt.Sprintf("%d", 1+g.rand.Intn(9999))),
+		dicom.MustNewElement(dicomtag.AccessionNumber, fmt.Sprintf("A%08d", g.rand.Intn(100000000))),
+		dicom.MustNewElement(dicomtag.StudyDescription, g.pick(m.descriptions)),
+		dicom.MustNewElement(dicomtag.ReferringPhysicianName, g.pick(generatedPhysicians)),
+		dicom.MustNewElement(dicomtag.InstitutionName, institution),
+		dicom.MustNewElement(dicomtag.Modality, m.modality),
+	)
+	g.studies++
+	for i, description := range m.series {
+		seriesUID := g.uid()
+		series := append(append([]*dicom.Element{}, study...),
+			dicom.MustNewElement(dicomtag.SeriesInstanceUID, seriesUID),
+			dicom.MustNewElement(dicomtag.SeriesNumber, fmt.Sprintf("%d", i+1)),
+			dicom.MustNewElement(dicomtag.SeriesDescription, description),
+			dicom.MustNewElement(dicomtag.SeriesDate, date.Format("20060102")),
+		)
+		dir := filepath.Join(g.dir, studyUID, seriesUID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for n := 1; n <= m.instances; n++ {
+			instanceUID := g.uid()
+			elems := append(append([]*dicom.Element{}, series...),
+				dicom.MustNewElement(dicomtag.TransferSyntaxUID, dicomuid.ExplicitVRLittleEndian),
+				dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, m.sopClassUID),
+				dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, instanceUID),
+				dicom.MustNewElement(dicomtag.ImplementationClassUID, toolkitProfiles["dcmtk"].implementationClassUID),
+				dicom.MustNewElement(dicomtag.ImplementationVersionName, toolkitProfiles["dcmtk"].implementationVersionName),
+				dicom.MustNewElement(dicomtag.SOPClassUID, m.sopClassUID),
+				dicom.MustNewElement(dicomtag.SOPInstanceUID, instanceUID),
+				dicom.MustNewElement(dicomtag.InstanceNumber, fmt.Sprintf("%d", n)),
+				dicom.MustNewElement(dicomtag.ContentDate, date.Format("20060102")),
+				dicom.MustNewElement(dicomtag.ContentTime, date.Format("150405")),
+			)
+			elems = append(elems, g.image()...)
+			sort.Slice(elems, func(i, j int) bool {
+				return elems[i].Tag.Compare(elems[j].Tag) < 0
+			})
+			path := filepath.Join(dir, fmt.Sprintf("%d.dcm", n))
+			if err := dicom.WriteDataSetToFile(path, &dicom.DataSet{Elements: elems}); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			g.images++
+		}
+	}
+	return nil
+}
+
+// image returns the pixel data elements of a noisy blob, 16 bit grayscale.
+func (g *generator) image() []*dicom.Element {
+	const size = generatedImageSize
+	cx, cy := size/2+g.rand.Intn(size/4)-size/8, size/2+g.rand.Intn(size/4)-size/8
+	r := size/4 + g.rand.Intn(size/8)
+	frame := make([]byte, 2*size*size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := 100 + g.rand.Intn(200)
+			if (x-cx)*(x-cx)+(y-cy)*(y-cy) < r*r {
+				v += 1500
+			}
+			i := 2 * (y*size + x)
+			frame[i], frame[i+1] = byte(v), byte(v>>8)
+		}
+	}
+	return []*dicom.Element{
+		dicom.MustNewElement(dicomtag.SamplesPerPixel, uint16(1)),
+		dicom.MustNewElement(dicomtag.PhotometricInterpretation, "MONOCHROME2"),
+		dicom.MustNewElement(dicomtag.Rows, uint16(size)),
+		dicom.MustNewElement(dicomtag.Columns, uint16(size)),
+		dicom.MustNewElement(dicomtag.BitsAllocated, uint16(16)),
+		dicom.MustNewElement(dicomtag.BitsStored, uint16(12)),
+		dicom.MustNewElement(dicomtag.HighBit, uint16(11)),
+		dicom.MustNewElement(dicomtag.PixelRepresentation, uint16(0)),
+		{
+			Tag:   dicomtag.PixelData,
+			VR:    "OW",
+			Value: []interface{}{dicom.PixelDataInfo{Frames: [][]byte{frame}}},
+		},
+	}
+}
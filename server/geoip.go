@@ -0,0 +1,106 @@
+package main
+
+// This file adds the location of the source of every event, from a MaxMind
+// GeoLite2 or GeoIP2 database, as the fields GeoCountry (ISO code),
+// GeoCountryName, GeoCity, GeoLatitude and GeoLongitude. A City database
+// gives them all, a Country one the first two.
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoIP is an EventSink that adds the location of the source IP to the
+// events it hands to "next". Sources the database doesn't know, e.g.,
+// private addresses, have none.
+type geoIP struct {
+	next dicompot.EventSink
+	db   *geoip2.Reader
+	// Whether "db" has cities, rather than only countries.
+	cities bool
+}
+
+// newGeoIP returns the enricher for -geoip, or nil if events aren't located.
+func newGeoIP(path string, next dicompot.EventSink) *geoIP {
+	if path == "" {
+		return nil
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open -geoip %s: %v", path, err)
+	}
+	dbType := db.Metadata().DatabaseType
+	if !strings.Contains(dbType, "City") && !strings.Contains(dbType, "Country") {
+		log.Fatalf("-geoip %s is a %s database, want a City or Country one", path, dbType)
+	}
+	log.Printf("-| Locating sources with %s, built %d", dbType, db.Metadata().BuildEpoch)
+	return &geoIP{next: next, db: db, cities: strings.Contains(dbType, "City")}
+}
+
+// sourceIP returns the address the event came from: that of its session, or
+// of the request for the services without sessions.
+func sourceIP(event dicompot.Event) net.IP {
+	ip := event.RemoteIP
+	if ip == "" {
+		ip = stringField(event, "IP")
+	}
+	return net.ParseIP(ip)
+}
+
+// Record locates the source of "event", and hands it to "next".
+func (g *geoIP) Record(event dicompot.Event) error {
+	if ip := sourceIP(event); ip != nil {
+		if fields := g.locate(ip); len(fields) > 0 {
+			for name, value := range event.Fields {
+				fields[name] = value
+			}
+			event.Fields = fields
+		}
+	}
+	return g.next.Record(event)
+}
+
+// locate returns the fields of the location of "ip", if any.
+func (g *geoIP) locate(ip net.IP) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if g.cities {
+		city, err := g.db.City(ip)
+		if err != nil {
+			return nil
+		}
+		setGeoField(fields, "GeoCountry", city.Country.IsoCode)
+		setGeoField(fields, "GeoCountryName", city.Country.Names["en"])
+		setGeoField(fields, "GeoCity", city.City.Names["en"])
+		if city.Location.Latitude != 0 || city.Location.Longitude != 0 {
+			fields["GeoLatitude"] = city.Location.Latitude
+			fields["GeoLongitude"] = city.Location.Longitude
+		}
+		return fields
+	}
+	country, err := g.db.Country(ip)
+	if err != nil {
+		return nil
+	}
+	setGeoField(fields, "GeoCountry", country.Country.IsoCode)
+	setGeoField(fields, "GeoCountryName", country.Country.Names["en"])
+	return fields
+}
+
+func setGeoField(fields map[string]interface{}, name, value string) {
+	if value != "" {
+		fields[name] = value
+	}
+}
+
+// Close closes "next", then the database.
+func (g *geoIP) Close() error {
+	err := g.next.Close()
+	if cerr := g.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,447 @@
+package main
+
+// This file serves the events over gRPC, for automation to consume them
+// typed rather than parse JSON: Subscribe streams them as they happen, and
+// Query returns those stored by -database. The service and messages are
+// those of events.proto, encoded here by hand, over HTTP/2 without TLS
+// (h2c), as gRPC clients speak it with -plaintext or insecure credentials.
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// The longest request message taken.
+	grpcMaxRequest = 1 << 20
+	// The events a Query returns by default, and at most.
+	grpcDefaultLimit = 1000
+	grpcMaxLimit     = 10000
+	// Events waiting to be streamed to a subscriber, at most. Further ones
+	// are dropped, for that subscriber.
+	grpcSubscriberQueue = 1024
+)
+
+// The status codes of gRPC.
+const (
+	grpcInvalidArgument    = 3
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is the status an RPC ends with.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// grpcSubscriber is a client of Subscribe.
+type grpcSubscriber struct {
+	types  map[string]bool
+	level  logrus.Level
+	events chan dicompot.Event
+}
+
+// grpcServer is an EventSink that streams the events to the subscribers,
+// and the http.Handler of the service.
+type grpcServer struct {
+	token string
+	// nil without -database.
+	store *database
+
+	mu          sync.Mutex
+	subscribers map[*grpcSubscriber]bool
+}
+
+// newGRPCServer returns the sink for -grpc, serving on "addr", or nil if
+// there is none. Clients must send "token", if set, as a bearer token.
+// "database" is -database, for Query.
+func newGRPCServer(addr, token, database string) *grpcServer {
+	if addr == "" {
+		return nil
+	}
+	g := &grpcServer{token: token, subscribers: map[*grpcSubscriber]bool{}}
+	if database != "" {
+		g.store = openDatabase(database)
+	}
+	srv := &http.Server{Addr: addr, Handler: h2c.NewHandler(g, &http2.Server{}), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Fatal(srv.ListenAndServe())
+	}()
+	if token == "" {
+		log.Printf("-| gRPC served on: %s, without -grpctoken: keep the address from attackers", addr)
+	} else {
+		log.Printf("-| gRPC served on: %s", addr)
+	}
+	return g
+}
+
+// Record hands the event to the subscribers that take it.
+func (g *grpcServer) Record(event dicompot.Event) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for s := range g.subscribers {
+		if event.Level > s.level || (len(s.types) > 0 && !s.types[event.Type]) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+func (g *grpcServer) Close() error {
+	return nil
+}
+
+// ServeHTTP serves an RPC.
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC expected", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	err := g.serve(w, r)
+	code, message := 0, ""
+	if err != nil {
+		var e *grpcError
+		if !errors.As(err, &e) {
+			e = &grpcError{grpcInternal, err.Error()}
+		}
+		code, message = e.code, e.message
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", fmt.Sprint(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(message))
+	}
+}
+
+// grpcEscape percent-encodes "s", as grpc-message is.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7F || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (g *grpcServer) serve(w http.ResponseWriter, r *http.Request) error {
+	if g.token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			return &grpcError{grpcUnauthenticated, "invalid token"}
+		}
+	}
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	switch r.URL.Path {
+	case "/dicompot.v1.Events/Subscribe":
+		return g.subscribe(w, r, req)
+	case "/dicompot.v1.Events/Query":
+		return g.query(w, req)
+	}
+	return &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+}
+
+// subscribe streams the events until the client goes.
+func (g *grpcServer) subscribe(w http.ResponseWriter, r *http.Request, req []byte) error {
+	s := &grpcSubscriber{types: map[string]bool{}, level: logrus.DebugLevel, events: make(chan dicompot.Event, grpcSubscriberQueue)}
+	err := parseProto(req, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			s.types[strings.ToLower(string(b))] = true
+		case 2:
+			level, err := logrus.ParseLevel(string(b))
+			if err != nil {
+				return &grpcError{grpcInvalidArgument, "invalid level " + string(b)}
+			}
+			s.level = level
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.subscribers[s] = true
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.subscribers, s)
+		g.mu.Unlock()
+	}()
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case event := <-s.events:
+			if err := writeGRPCMessage(w, protoEvent(nil, event)); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+// query returns the stored events.
+func (g *grpcServer) query(w http.ResponseWriter, req []byte) error {
+	if g.store == nil {
+		return &grpcError{grpcFailedPrecondition, "events aren't stored, without -database"}
+	}
+	q := eventQuery{limit: grpcDefaultLimit}
+	err := parseProto(req, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1, 2:
+			t, err := parseProtoTimestamp(b)
+			if err != nil {
+				return err
+			}
+			if field == 1 {
+				q.since = t
+			} else {
+				q.until = t
+			}
+		case 3:
+			q.types = append(q.types, strings.ToLower(string(b)))
+		case 4:
+			q.sessionID = string(b)
+		case 5:
+			q.remoteIP = string(b)
+		case 6:
+			if v > 0 {
+				q.limit = int(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if q.limit > grpcMaxLimit {
+		q.limit = grpcMaxLimit
+	}
+	events, err := g.store.events(q)
+	if err != nil {
+		return &grpcError{grpcUnavailable, err.Error()}
+	}
+	var resp []byte
+	for _, event := range events {
+		resp = appendProtoBytes(resp, 1, protoEvent(nil, event))
+	}
+	return writeGRPCMessage(w, resp)
+}
+
+// readGRPCMessage reads the message of a unary request.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > grpcMaxRequest {
+		return nil, &grpcError{grpcInvalidArgument, "request message too long"}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	return b, nil
+}
+
+// writeGRPCMessage writes a message, uncompressed.
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// protoEvent appends the Event message of "event" to "b".
+func protoEvent(b []byte, event dicompot.Event) []byte {
+	if !event.Time.IsZero() {
+		b = appendProtoBytes(b, 1, protoTimestamp(event.Time))
+	}
+	b = appendProtoString(b, 2, event.Level.String())
+	b = appendProtoString(b, 3, event.Type)
+	b = appendProtoString(b, 4, event.SessionID)
+	b = appendProtoString(b, 5, event.RemoteIP)
+	b = appendProtoVarint(b, 6, uint64(event.RemotePort))
+	b = appendProtoVarint(b, 7, uint64(event.LocalPort))
+	b = appendProtoString(b, 8, event.CallingAETitle)
+	b = appendProtoString(b, 9, event.CalledAETitle)
+	b = appendProtoString(b, 10, event.Command)
+	for _, qe := range event.Query {
+		b = appendProtoBytes(b, 11, protoQueryElement(nil, qe))
+	}
+	b = appendProtoString(b, 12, event.Message)
+	if len(event.Fields) > 0 {
+		if fields, err := json.Marshal(event.Fields); err == nil {
+			b = appendProtoString(b, 13, string(fields))
+		}
+	}
+	return b
+}
+
+// protoQueryElement appends the QueryElement message of "qe" to "b".
+func protoQueryElement(b []byte, qe dicompot.QueryElement) []byte {
+	b = appendProtoString(b, 1, qe.Tag)
+	b = appendProtoString(b, 2, qe.Keyword)
+	b = appendProtoString(b, 3, qe.VR)
+	for _, v := range qe.Values {
+		// Repeated, so empty values are kept.
+		b = appendProtoBytes(b, 4, []byte(v))
+	}
+	for _, item := range qe.Items {
+		var itemMsg []byte
+		for _, e := range item {
+			itemMsg = appendProtoBytes(itemMsg, 1, protoQueryElement(nil, e))
+		}
+		b = appendProtoBytes(b, 5, itemMsg)
+	}
+	return b
+}
+
+// protoTimestamp returns the google.protobuf.Timestamp of "t".
+func protoTimestamp(t time.Time) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(t.Unix()))
+	b = appendProtoVarint(b, 2, uint64(t.Nanosecond()))
+	return b
+}
+
+// parseProtoTimestamp parses a google.protobuf.Timestamp.
+func parseProtoTimestamp(msg []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := parseProto(msg, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			seconds = int64(v)
+		case 2:
+			nanos = int64(int32(v))
+		}
+		return nil
+	})
+	return time.Unix(seconds, nanos), err
+}
+
+func appendProtoTag(b []byte, field int, wireType uint64) []byte {
+	return appendUvarint(b, uint64(field)<<3|wireType)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendProtoVarint appends a varint field, unless 0, as proto3 omits it.
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendUvarint(appendProtoTag(b, field, 0), v)
+}
+
+// appendProtoString appends a string field, unless empty.
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(s))
+}
+
+// appendProtoBytes appends a length-delimited field: bytes, a string or a
+// message.
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(appendProtoTag(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
+
+// parseProto calls "f" with each field of "msg": the value of the varints,
+// the bytes of the length-delimited fields. The other types are skipped.
+func parseProto(msg []byte, f func(field int, v uint64, b []byte) error) error {
+	malformed := &grpcError{grpcInvalidArgument, "malformed message"}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 || key>>3 > math.MaxInt32 {
+			return malformed
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return malformed
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return malformed
+			}
+			msg = msg[8:]
+			continue
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return malformed
+			}
+			b, msg = msg[n:n+int(l)], msg[n+int(l):]
+		case 5:
+			if len(msg) < 4 {
+				return malformed
+			}
+			msg = msg[4:]
+			continue
+		default:
+			return malformed
+		}
+		if err := f(field, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+// This file serves /healthz and /readyz, for container orchestration and
+// uptime monitoring: the listeners and whether they are up, the number of
+// images served, and the state of the queues of the services events are
+// shipped to. /healthz answers as long as the process does; /readyz only
+// once every listener is up and the images are loaded. A service that
+// fails to take the events doesn't make the honeypot unready, as it still
+// records them in the log, but is reported by both.
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a queue may fail to send before the honeypot is degraded.
+const healthFailingFor = 5 * time.Minute
+
+// listenerHealth is the state of a listener.
+type listenerHealth struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Up      bool   `json:"up"`
+}
+
+// sinkHealth is the state of the queue of a service.
+type sinkHealth struct {
+	Name         string     `json:"name"`
+	Queued       int        `json:"queued"`
+	Dropped      int64      `json:"dropped"`
+	Failing      bool       `json:"failing"`
+	FailingSince *time.Time `json:"failingSince,omitempty"`
+}
+
+// healthReport is what the endpoints answer.
+type healthReport struct {
+	// "ok", "degraded" if a service has failed for healthFailingFor, or
+	// "starting" until ready.
+	Status    string           `json:"status"`
+	Started   time.Time        `json:"started"`
+	Listeners []listenerHealth `json:"listeners"`
+	// The images served, -1 until they are loaded.
+	Datasets int          `json:"datasets"`
+	Sinks    []sinkHealth `json:"sinks"`
+}
+
+// healthState is what the endpoints report on.
+type healthState struct {
+	mu        sync.Mutex
+	started   time.Time
+	listeners []*listenerHealth
+	// Returns the number of images served, once they are loaded.
+	datasets func() int
+}
+
+var health = &healthState{started: time.Now()}
+
+// expect adds a listener, down until listening is called for "addr".
+func (h *healthState) expect(name, addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, &listenerHealth{Name: name, Address: addr})
+}
+
+// listening marks the listener on "addr" as up.
+func (h *healthState) listening(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, l := range h.listeners {
+		if l.Address == addr {
+			l.Up = true
+		}
+	}
+}
+
+// loaded sets the function returning the number of images served.
+func (h *healthState) loaded(datasets func() int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.datasets = datasets
+}
+
+// report returns the state of the honeypot, and whether it is ready.
+func (h *healthState) report() (healthReport, bool) {
+	r := healthReport{Status: "ok", Datasets: -1, Listeners: []listenerHealth{}, Sinks: []sinkHealth{}}
+	h.mu.Lock()
+	r.Started = h.started
+	ready := h.datasets != nil
+	for _, l := range h.listeners {
+		r.Listeners = append(r.Listeners, *l)
+		ready = ready && l.Up
+	}
+	datasets := h.datasets
+	h.mu.Unlock()
+	// Outside of h.mu, as it takes the lock of the server.
+	if datasets != nil {
+		r.Datasets = datasets()
+	}
+
+	queuedSinks.mu.Lock()
+	for _, q := range queuedSinks.sinks {
+		s := sinkHealth{Name: q.name, Queued: len(q.queue), Dropped: atomic.LoadInt64(&q.dropped)}
+		if since := atomic.LoadInt64(&q.failingSince); since != 0 {
+			t := time.Unix(0, since)
+			s.Failing = true
+			s.FailingSince = &t
+			if time.Since(t) >= healthFailingFor {
+				r.Status = "degraded"
+			}
+		}
+		r.Sinks = append(r.Sinks, s)
+	}
+	queuedSinks.mu.Unlock()
+	if !ready {
+		r.Status = "starting"
+	}
+	return r, ready
+}
+
+// serveHealthz answers 200 while the process is alive.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	report, _ := health.report()
+	writeHealth(w, http.StatusOK, report)
+}
+
+// serveReadyz answers 200 once the honeypot takes connections, 503 until
+// then.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	report, ready := health.report()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, report)
+}
+
+func writeHealth(w http.ResponseWriter, status int, report healthReport) {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+// handleHealth adds the endpoints to "mux".
+func handleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", serveReadyz)
+}
+
+// serveHealth serves the endpoints on "addr", for -health, if set.
+func serveHealth(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	handleHealth(mux)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Fatal(srv.ListenAndServe())
+	}()
+	log.Printf("-| Health served on: http://%s/healthz and /readyz", addr)
+}
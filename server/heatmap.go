@@ -0,0 +1,239 @@
+package main
+
+// This file writes where the hits come from, as located by -geoip, to a
+// file for map tools, e.g., QGIS, kepler.gl or Grafana's geomap: a GeoJSON
+// FeatureCollection with a point per place, or CSV. The places are rounded
+// to a tenth of a degree, about 10 km, and counted since the start; the
+// file is rewritten every so often, whole, so that it can be read at any
+// time. Sources located only to their country, e.g., with a Country
+// database, have no place and are left out.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// heatmapPlace is what came from a place.
+type heatmapPlace struct {
+	latitude, longitude float64
+	country, city       string
+	hits, exploits      int
+	sources             map[string]bool
+	first, last         time.Time
+	// len(sources), as written.
+	sourceCount int
+}
+
+// heatmap is an EventSink that writes the places of the hits.
+type heatmap struct {
+	path   string
+	format string
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	places  map[[2]float64]*heatmapPlace
+	changed bool
+}
+
+// newHeatmap returns the sink for -heatmap, or nil if the places aren't
+// written. They are written to "path" as "format", geojson or csv, every
+// "interval".
+func newHeatmap(path, format string, interval time.Duration) *heatmap {
+	if path == "" {
+		return nil
+	}
+	if format != "geojson" && format != "csv" {
+		log.Fatalf("Invalid -heatmapformat %q, want geojson or csv", format)
+	}
+	if interval <= 0 {
+		log.Fatalf("Invalid -heatmapinterval %s", interval)
+	}
+	h := &heatmap{
+		path:    path,
+		format:  format,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		places:  map[[2]float64]*heatmapPlace{},
+		changed: true,
+	}
+	go h.run(interval)
+	log.Printf("-| Writing the places of the hits to %s every %s", path, interval)
+	return h
+}
+
+// Record counts the hits and the exploit attempts by place.
+func (h *heatmap) Record(event dicompot.Event) error {
+	switch event.Type {
+	case dicompot.EventConnectionOpened, dicompot.EventHL7Connection:
+		if stringField(event, "Status") != "" {
+			return nil
+		}
+	case dicompot.EventHTTPRequest, dicompot.EventExploitAttempt:
+	default:
+		return nil
+	}
+	latitude, ok := event.Fields["GeoLatitude"].(float64)
+	longitude, ok2 := event.Fields["GeoLongitude"].(float64)
+	if !ok || !ok2 {
+		return nil
+	}
+	key := [2]float64{math.Round(latitude*10) / 10, math.Round(longitude*10) / 10}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := h.places[key]
+	if p == nil {
+		p = &heatmapPlace{latitude: key[0], longitude: key[1], sources: map[string]bool{}, first: event.Time}
+		h.places[key] = p
+	}
+	p.country = stringField(event, "GeoCountry")
+	p.city = stringField(event, "GeoCity")
+	if event.Type == dicompot.EventExploitAttempt {
+		p.exploits++
+	} else {
+		p.hits++
+	}
+	if ip := sourceIP(event); ip != nil {
+		p.sources[ip.String()] = true
+	}
+	p.last = event.Time
+	h.changed = true
+	return nil
+}
+
+// Close writes the places a last time.
+func (h *heatmap) Close() error {
+	close(h.stop)
+	<-h.done
+	return nil
+}
+
+func (h *heatmap) run(interval time.Duration) {
+	defer close(h.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.save()
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			h.save()
+			return
+		}
+	}
+}
+
+// save writes the places to h.path, if they changed.
+func (h *heatmap) save() {
+	h.mu.Lock()
+	if !h.changed {
+		h.mu.Unlock()
+		return
+	}
+	h.changed = false
+	places := make([]heatmapPlace, 0, len(h.places))
+	for _, p := range h.places {
+		c := *p
+		c.sources, c.sourceCount = nil, len(p.sources)
+		places = append(places, c)
+	}
+	h.mu.Unlock()
+	// The most hits first.
+	sort.Slice(places, func(i, j int) bool {
+		if places[i].hits != places[j].hits {
+			return places[i].hits > places[j].hits
+		}
+		if places[i].latitude != places[j].latitude {
+			return places[i].latitude < places[j].latitude
+		}
+		return places[i].longitude < places[j].longitude
+	})
+
+	var data []byte
+	var err error
+	if h.format == "csv" {
+		data, err = heatmapCSV(places)
+	} else {
+		data, err = heatmapGeoJSON(places)
+	}
+	if err == nil {
+		tmp := h.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, h.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write -heatmap %s: %v", h.path, err)
+	}
+}
+
+// heatmapGeoJSON returns the places as a GeoJSON FeatureCollection.
+func heatmapGeoJSON(places []heatmapPlace) ([]byte, error) {
+	type properties struct {
+		Country  string    `json:"country,omitempty"`
+		City     string    `json:"city,omitempty"`
+		Hits     int       `json:"hits"`
+		Sources  int       `json:"sources"`
+		Exploits int       `json:"exploits"`
+		First    time.Time `json:"first"`
+		Last     time.Time `json:"last"`
+	}
+	type geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	}
+	type feature struct {
+		Type       string     `json:"type"`
+		Geometry   geometry   `json:"geometry"`
+		Properties properties `json:"properties"`
+	}
+	collection := struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}{Type: "FeatureCollection", Features: []feature{}}
+	for _, p := range places {
+		collection.Features = append(collection.Features, feature{
+			Type: "Feature",
+			// GeoJSON has the longitude first.
+			Geometry: geometry{Type: "Point", Coordinates: [2]float64{p.longitude, p.latitude}},
+			Properties: properties{
+				Country:  p.country,
+				City:     p.city,
+				Hits:     p.hits,
+				Sources:  p.sourceCount,
+				Exploits: p.exploits,
+				First:    p.first,
+				Last:     p.last,
+			},
+		})
+	}
+	return json.Marshal(collection)
+}
+
+// heatmapCSV returns the places as CSV, with a header.
+func heatmapCSV(places []heatmapPlace) ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"latitude", "longitude", "country", "city", "hits", "sources", "exploits", "first", "last"})
+	for _, p := range places {
+		w.Write([]string{
+			fmt.Sprint(p.latitude), fmt.Sprint(p.longitude), p.country, p.city,
+			fmt.Sprint(p.hits), fmt.Sprint(p.sourceCount), fmt.Sprint(p.exploits),
+			p.first.Format(time.RFC3339), p.last.Format(time.RFC3339),
+		})
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
@@ -0,0 +1,230 @@
+package main
+
+// This file implements an HL7 v2 listener, using the Minimal Lower Layer
+// Protocol (MLLP) framing. Every message is logged in full and acknowledged
+// with AA, whatever its content.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// MLLP block delimiters.
+const (
+	mllpStart = 0x0b
+	mllpEnd   = 0x1c
+	mllpCR    = 0x0d
+)
+
+const (
+	// Largest HL7 message accepted. Larger ones close the connection.
+	maxHL7MessageSize = 1 << 20
+	// How long an idle connection is kept open.
+	hl7IdleTimeout = 5 * time.Minute
+)
+
+func (ss *server) serveHL7(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	health.listening(addr)
+	if *proxyFlag {
+		l = dicompot.NewProxyProtocolListener(l, ss.proxies)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			continue
+		}
+		go ss.handleHL7Conn(conn)
+	}
+}
+
+func (ss *server) handleHL7Conn(conn net.Conn) {
+	defer conn.Close()
+	sessionID := dicompot.NewSessionID()
+	dicompot.OpenSession(sessionID, conn.RemoteAddr(), conn.LocalAddr())
+	defer dicompot.CloseSession(sessionID)
+	fields := map[string]interface{}{}
+	if host, port, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		fields["IP"] = host
+		fields["Port"] = port
+	}
+	refused := ss.refused(remoteIP(conn.RemoteAddr().String()), "hl7", fields)
+	ss.record(logrus.WarnLevel, dicompot.EventHL7Connection, sessionID, "HL7 connection from", fields)
+	if refused {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	var messages int
+	for {
+		conn.SetReadDeadline(time.Now().Add(hl7IdleTimeout))
+		msg, junk, err := readMLLP(r)
+		if len(junk) > 0 {
+			// Bytes outside of an MLLP block, e.g., a scanner's banner
+			// grab or HTTP probe.
+			ss.record(logrus.WarnLevel, dicompot.EventHL7Message, sessionID, "HL7 unframed data", map[string]interface{}{
+				"Data": string(junk),
+			})
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("HL7 %s: %v", sessionID, err)
+			}
+			break
+		}
+		messages++
+		fields, ack := parseHL7(msg)
+		ss.record(logrus.WarnLevel, dicompot.EventHL7Message, sessionID, "HL7 message", fields)
+		if ack != nil {
+			conn.SetWriteDeadline(time.Now().Add(hl7IdleTimeout))
+			if _, err := conn.Write(frameMLLP(ack)); err != nil {
+				break
+			}
+		}
+	}
+	ss.record(logrus.WarnLevel, dicompot.EventHL7Connection, sessionID, "HL7 connection", map[string]interface{}{
+		"Status":   "Finished",
+		"Messages": messages,
+	})
+}
+
+// readMLLP reads the next MLLP block. "junk" holds whatever came before the
+// start of the block.
+func readMLLP(r *bufio.Reader) (msg []byte, junk []byte, err error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, junk, err
+		}
+		if b == mllpStart {
+			break
+		}
+		if len(junk) < maxHL7MessageSize {
+			junk = append(junk, b)
+		}
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, junk, err
+		}
+		if b == mllpEnd {
+			// The trailing CR is optional in practice.
+			if next, err := r.Peek(1); err == nil && next[0] == mllpCR {
+				r.ReadByte()
+			}
+			return msg, junk, nil
+		}
+		if len(msg) >= maxHL7MessageSize {
+			return nil, junk, fmt.Errorf("HL7 message exceeds %d bytes", maxHL7MessageSize)
+		}
+		msg = append(msg, b)
+	}
+}
+
+func frameMLLP(msg []byte) []byte {
+	framed := make([]byte, 0, len(msg)+3)
+	framed = append(framed, mllpStart)
+	framed = append(framed, msg...)
+	return append(framed, mllpEnd, mllpCR)
+}
+
+// hl7Field returns field "n" of "segment", numbered as in the standard.
+func hl7Field(segment []string, n int) string {
+	if n < 0 || n >= len(segment) {
+		return ""
+	}
+	return segment[n]
+}
+
+// parseHL7 extracts the interesting fields of an HL7 v2 message for the log,
+// and builds its acknowledgement. The ACK is nil if the message has no MSH
+// segment.
+func parseHL7(msg []byte) (map[string]interface{}, []byte) {
+	text := strings.Replace(string(msg), "\r\n", "\r", -1)
+	text = strings.Replace(text, "\n", "\r", -1)
+	fields := map[string]interface{}{
+		"Message": text,
+		"Size":    len(msg),
+	}
+	var segments []string
+	var msh, pid []string
+	sep := "|"
+	for _, line := range strings.Split(text, "\r") {
+		if len(line) < 3 {
+			continue
+		}
+		name := line[:3]
+		segments = append(segments, name)
+		switch {
+		case name == "MSH" && msh == nil && len(line) > 3:
+			sep = line[3:4]
+			// MSH-1 is the separator itself, so splitting "MSH|^~\&|..."
+			// is off by one.
+			msh = append([]string{"MSH", sep}, strings.Split(line, sep)[1:]...)
+		case name == "PID" && pid == nil:
+			pid = strings.Split(line, sep)
+		}
+	}
+	fields["Segments"] = strings.Join(segments, ",")
+	if msh == nil {
+		return fields, nil
+	}
+	for name, n := range map[string]int{
+		"SendingApplication":   3,
+		"SendingFacility":      4,
+		"ReceivingApplication": 5,
+		"ReceivingFacility":    6,
+		"MessageType":          9,
+		"MessageControlID":     10,
+		"ProcessingID":         11,
+		"Version":              12,
+	} {
+		if v := hl7Field(msh, n); v != "" {
+			fields[name] = v
+		}
+	}
+	if pid != nil {
+		fields["PatientID"] = hl7Field(pid, 3)
+		fields["PatientName"] = hl7Field(pid, 5)
+	}
+
+	encoding := hl7Field(msh, 2)
+	component := "^"
+	if encoding != "" {
+		component = encoding[:1]
+	}
+	messageType := "ACK"
+	if parts := strings.Split(hl7Field(msh, 9), component); len(parts) > 1 {
+		messageType += component + parts[1]
+	}
+	var ack bytes.Buffer
+	ack.WriteString(strings.Join([]string{
+		"MSH", encoding,
+		hl7Field(msh, 5), hl7Field(msh, 6), // The receiver answers.
+		hl7Field(msh, 3), hl7Field(msh, 4),
+		time.Now().Format("20060102150405"), "",
+		messageType,
+		fmt.Sprintf("ACK%d", time.Now().UnixNano()),
+		hl7Field(msh, 11), hl7Field(msh, 12),
+	}, sep))
+	ack.WriteString("\r")
+	ack.WriteString(strings.Join([]string{"MSA", "AA", hl7Field(msh, 10)}, sep))
+	ack.WriteString("\r")
+	return fields, ack.Bytes()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadMLLP(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		in    string
+		msgs  []string
+		junk  string
+		final error
+	}{
+		{"one block", "\x0bMSH|^~\\&|A\r\x1c\r", []string{"MSH|^~\\&|A\r"}, "", io.EOF},
+		{"two blocks", "\x0bone\x1c\r\x0btwo\x1c\r", []string{"one", "two"}, "", io.EOF},
+		{"no trailing CR", "\x0bone\x1c\x0btwo\x1c", []string{"one", "two"}, "", io.EOF},
+		{"junk first", "GET / HTTP/1.0\r\n\r\n\x0bone\x1c\r", []string{"one"}, "GET / HTTP/1.0\r\n\r\n", io.EOF},
+		{"unframed", "SSH-2.0-probe\r\n", nil, "SSH-2.0-probe\r\n", io.EOF},
+		{"truncated", "\x0bMSH|^~\\&|A", nil, "", io.ErrUnexpectedEOF},
+	} {
+		r := bufio.NewReader(strings.NewReader(test.in))
+		var msgs []string
+		var junk string
+		var err error
+		for {
+			var msg, j []byte
+			msg, j, err = readMLLP(r)
+			junk += string(j)
+			if err != nil {
+				break
+			}
+			msgs = append(msgs, string(msg))
+		}
+		if err != test.final {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.final)
+		}
+		if strings.Join(msgs, "\n") != strings.Join(test.msgs, "\n") || len(msgs) != len(test.msgs) {
+			t.Errorf("%s: messages %q, want %q", test.name, msgs, test.msgs)
+		}
+		if junk != test.junk {
+			t.Errorf("%s: junk %q, want %q", test.name, junk, test.junk)
+		}
+	}
+}
+
+func TestReadMLLPTooLarge(t *testing.T) {
+	in := append([]byte{mllpStart}, bytes.Repeat([]byte("x"), maxHL7MessageSize+1)...)
+	if _, _, err := readMLLP(bufio.NewReader(bytes.NewReader(append(in, mllpEnd)))); err == nil || err == io.EOF {
+		t.Errorf("readMLLP accepted a message of %d bytes: %v", maxHL7MessageSize+1, err)
+	}
+}
+
+func TestFrameMLLP(t *testing.T) {
+	msg := []byte("MSH|^~\\&|A|B\rMSA|AA|1\r")
+	got, _, err := readMLLP(bufio.NewReader(bytes.NewReader(frameMLLP(msg))))
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("readMLLP(frameMLLP(%q)) = %q, %v", msg, got, err)
+	}
+}
+
+func TestParseHL7(t *testing.T) {
+	msg := "MSH|^~\\&|RIS|HOSP|PACS|RAD|20200101120000||ORM^O01|MSG00001|P|2.3\r" +
+		"PID|1||123456^^^HOSP||DOE^JOHN||19700101|M\n" +
+		"ORC|NW|1000\r\n"
+	fields, ack := parseHL7([]byte(msg))
+	for name, want := range map[string]interface{}{
+		"Segments":             "MSH,PID,ORC",
+		"SendingApplication":   "RIS",
+		"SendingFacility":      "HOSP",
+		"ReceivingApplication": "PACS",
+		"ReceivingFacility":    "RAD",
+		"MessageType":          "ORM^O01",
+		"MessageControlID":     "MSG00001",
+		"ProcessingID":         "P",
+		"Version":              "2.3",
+		"PatientID":            "123456^^^HOSP",
+		"PatientName":          "DOE^JOHN",
+		"Size":                 len(msg),
+	} {
+		if fields[name] != want {
+			t.Errorf("%s = %v, want %v", name, fields[name], want)
+		}
+	}
+	if strings.Contains(fields["Message"].(string), "\n") {
+		t.Errorf("Message %q keeps LF segment separators", fields["Message"])
+	}
+
+	segments := strings.Split(strings.TrimSuffix(string(ack), "\r"), "\r")
+	if len(segments) != 2 {
+		t.Fatalf("ACK %q, want MSH and MSA", ack)
+	}
+	msh := strings.Split(segments[0], "|")
+	for n, want := range map[int]string{1: "^~\\&", 2: "PACS", 3: "RAD", 4: "RIS", 5: "HOSP", 8: "ACK^O01", 10: "P", 11: "2.3"} {
+		if n >= len(msh) || msh[n] != want {
+			t.Errorf("ACK %q: MSH-%d isn't %q", segments[0], n+1, want)
+		}
+	}
+	if segments[1] != "MSA|AA|MSG00001" {
+		t.Errorf("ACK MSA %q, want MSA|AA|MSG00001", segments[1])
+	}
+}
+
+func TestParseHL7Separators(t *testing.T) {
+	fields, ack := parseHL7([]byte("MSH#$~\\&#APP#FAC#####ADT$A01#42#P#2.5\rPID#1##99##ROE$JANE"))
+	if fields["MessageType"] != "ADT$A01" || fields["PatientName"] != "ROE$JANE" {
+		t.Errorf("fields %v, want those split on # and $", fields)
+	}
+	if !bytes.Contains(ack, []byte("#ACK$A01#")) || !bytes.HasSuffix(ack, []byte("MSA#AA#42\r")) {
+		t.Errorf("ACK %q, not with the separators of the message", ack)
+	}
+}
+
+func TestParseHL7WithoutMSH(t *testing.T) {
+	fields, ack := parseHL7([]byte("PID|1||123"))
+	if ack != nil {
+		t.Errorf("ACK %q of a message without MSH", ack)
+	}
+	if fields["Segments"] != "PID" {
+		t.Errorf("Segments = %v, want PID", fields["Segments"])
+	}
+	if _, ok := fields["PatientID"]; ok {
+		t.Errorf("PatientID logged without MSH")
+	}
+}
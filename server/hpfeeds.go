@@ -0,0 +1,179 @@
+package main
+
+// This file publishes the events to an HPFeeds broker, as Cowrie and Dionaea
+// do, for community honeynets to share. The protocol is that of
+// https://hpfeeds.org/wire-protocol: length-prefixed messages, and an
+// authentication by SHA-1 of the broker's nonce and the secret.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// HPFeeds opcodes.
+const (
+	hpfeedsOpError   = 0
+	hpfeedsOpInfo    = 1
+	hpfeedsOpAuth    = 2
+	hpfeedsOpPublish = 3
+)
+
+// The largest message a broker sends, as far as the client is concerned.
+const hpfeedsMaxMessageSize = 1 << 20
+
+// hpfeeds is an HPFeeds publisher.
+type hpfeeds struct {
+	addr, ident, secret, channel string
+
+	// Only used from the goroutine of the queuedSink.
+	conn net.Conn
+	// The errors the broker reports on "conn".
+	errs chan error
+}
+
+// newHPFeedsSink returns the sink for -hpfeeds and friends, or nil if events
+// aren't published.
+func newHPFeedsSink(addr, ident, secret, channel string) dicompot.EventSink {
+	if addr == "" {
+		return nil
+	}
+	if ident == "" || secret == "" || channel == "" {
+		log.Fatalf("-hpfeeds needs -hpfeedsident, -hpfeedssecret and -hpfeedschannel")
+	}
+	if len(ident) > 255 || len(channel) > 255 {
+		log.Fatalf("-hpfeedsident and -hpfeedschannel must be at most 255 bytes")
+	}
+	h := &hpfeeds{addr: addr, ident: ident, secret: secret, channel: channel}
+	log.Printf("-| Publishing events to HPFeeds: %s, channel %s", addr, channel)
+	return newQueuedSink("HPFeeds", 100, 0, h.publish)
+}
+
+// hpfeedsMessage returns a message: its length, opcode, and "parts", which
+// are strings prefixed with their length, but for the last one.
+func hpfeedsMessage(op byte, parts ...[]byte) []byte {
+	var body bytes.Buffer
+	for i, part := range parts {
+		if i < len(parts)-1 {
+			body.WriteByte(byte(len(part)))
+		}
+		body.Write(part)
+	}
+	msg := make([]byte, 5, 5+body.Len())
+	binary.BigEndian.PutUint32(msg, uint32(5+body.Len()))
+	msg[4] = op
+	return append(msg, body.Bytes()...)
+}
+
+// readHPFeedsMessage returns the next message from the broker.
+func readHPFeedsMessage(conn net.Conn) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n < 5 || n > hpfeedsMaxMessageSize {
+		return 0, nil, fmt.Errorf("invalid message length %d", n)
+	}
+	body := make([]byte, n-5)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+	return header[4], body, nil
+}
+
+// connect connects and authenticates to the broker.
+func (h *hpfeeds) connect() error {
+	conn, err := net.DialTimeout("tcp", h.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	op, body, err := readHPFeedsMessage(conn)
+	if err == nil && op != hpfeedsOpInfo {
+		err = fmt.Errorf("expected the broker's info, got opcode %d", op)
+	}
+	// The broker's name, then the nonce.
+	if err == nil && (len(body) < 1 || len(body) < 1+int(body[0])) {
+		err = fmt.Errorf("invalid info message")
+	}
+	if err != nil {
+		h.close()
+		return err
+	}
+	nonce := body[1+int(body[0]):]
+	mac := sha1.Sum(append(append([]byte{}, nonce...), h.secret...))
+	if _, err := conn.Write(hpfeedsMessage(hpfeedsOpAuth, []byte(h.ident), mac[:])); err != nil {
+		h.close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	h.errs = make(chan error, 1)
+	go readHPFeedsErrors(conn, h.errs)
+	return nil
+}
+
+// readHPFeedsErrors reports the first error the broker sends on "conn", or
+// the one reading it fails with.
+func readHPFeedsErrors(conn net.Conn, errs chan<- error) {
+	for {
+		op, body, err := readHPFeedsMessage(conn)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if op == hpfeedsOpError {
+			errs <- fmt.Errorf("broker: %s", body)
+			return
+		}
+	}
+}
+
+func (h *hpfeeds) close() {
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// publish publishes every event, in JSON, to the channel. A broker that
+// rejects the credentials says so, and closes the connection, which fails
+// the next batch.
+func (h *hpfeeds) publish(events []dicompot.Event) error {
+	if h.conn == nil {
+		if err := h.connect(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		buf.Write(hpfeedsMessage(hpfeedsOpPublish, []byte(h.ident), []byte(h.channel), payload))
+	}
+	// Errors, e.g., about the credentials or the channel, come back
+	// asynchronously.
+	select {
+	case err := <-h.errs:
+		h.close()
+		return err
+	default:
+	}
+	h.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := h.conn.Write(buf.Bytes()); err != nil {
+		h.close()
+		return err
+	}
+	return nil
+}
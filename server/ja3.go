@@ -0,0 +1,169 @@
+package main
+
+// This file names the TLS clients by the JA3 fingerprint of their
+// ClientHello, and adds the name, as the field JA3Tool, to the events of
+// their sessions from the handshake on. The tools known are those below,
+// and those of -ja3db, a CSV file of "hash,tool" lines, which may also be
+// abuse.ch's SSLBL ja3_fingerprints.csv as downloaded: the last column is
+// the name. The file is read again when it changes, so that it can be
+// updated, e.g., by cron, without restarting.
+
+import (
+	"encoding/csv"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// How often -ja3db is checked for changes, at most.
+const ja3DBCheckInterval = time.Minute
+
+// The JA3 fingerprints of common TLS clients. They depend on the version of
+// the TLS library, those of OpenSSL being of 3.0.
+var knownJA3 = map[string]string{
+	"78f0dc5ac5b19daf131a133cfdee9691": "curl (OpenSSL 3.0)",
+	"8a9d5d0f12f7d43ee3af1c51d2998d99": "python ssl (OpenSSL 3.0), e.g., pynetdicom or requests",
+	"c216e752cae6f8755fd27f561d031636": "openssl s_client (OpenSSL 3.0)",
+	"fbe7e189e37a07ee33706f86bc746344": "openssl s_client -tls1_2 (OpenSSL 3.0)",
+	"725543c78edf669194c11dc7a039b56e": "Go crypto/tls (Go 1.27), e.g., zgrab2 or nuclei",
+}
+
+// ja3Tools is an EventSink that adds the TLS client of their session to the
+// events it hands to "next".
+type ja3Tools struct {
+	next dicompot.EventSink
+	path string
+
+	mu       sync.Mutex
+	db       map[string]string
+	modTime  time.Time
+	checked  time.Time
+	sessions map[string]string
+}
+
+// newJA3Tools returns the enricher that names the TLS clients, or nil if
+// there is no TLS listener. "path" is -ja3db, or "".
+func newJA3Tools(tlsPort, path string, next dicompot.EventSink) *ja3Tools {
+	if tlsPort == "" {
+		if path != "" {
+			log.Fatalf("-ja3db requires -tlsport")
+		}
+		return nil
+	}
+	j := &ja3Tools{next: next, path: path, sessions: map[string]string{}}
+	j.db = knownJA3
+	if path != "" {
+		if err := j.load(); err != nil {
+			log.Fatalf("Failed to read -ja3db %s: %v", path, err)
+		}
+		log.Printf("-| Naming the TLS clients with the JA3 fingerprints of %s too", path)
+	}
+	return j
+}
+
+// load reads j.path into j.db, with the fingerprints known. j.mu must be
+// held once "j" is in use.
+func (j *ja3Tools) load() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	db := map[string]string{}
+	for hash, tool := range knownJA3 {
+		db[hash] = tool
+	}
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		hash := strings.ToLower(strings.TrimSpace(record[0]))
+		// Headers, e.g., ja3_md5, are left out with the rest that isn't a
+		// hash.
+		if len(record) < 2 || !isMD5Hex(hash) {
+			continue
+		}
+		db[hash] = strings.TrimSpace(record[len(record)-1])
+	}
+	j.db, j.modTime = db, info.ModTime()
+	return nil
+}
+
+func isMD5Hex(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the tool of JA3 fingerprint "hash", reading -ja3db again
+// if it changed. j.mu must be held.
+func (j *ja3Tools) lookup(hash string) string {
+	if j.path != "" && time.Since(j.checked) > ja3DBCheckInterval {
+		j.checked = time.Now()
+		if info, err := os.Stat(j.path); err == nil && !info.ModTime().Equal(j.modTime) {
+			if err := j.load(); err != nil {
+				log.Printf("Failed to read -ja3db %s again: %v", j.path, err)
+			}
+		}
+	}
+	return j.db[hash]
+}
+
+// Record adds the TLS client of the session of "event", if known, and hands
+// the event to "next".
+func (j *ja3Tools) Record(event dicompot.Event) error {
+	if event.SessionID == "" {
+		return j.next.Record(event)
+	}
+	j.mu.Lock()
+	tool, ok := j.sessions[event.SessionID]
+	if event.Type == dicompot.EventTLSHandshake {
+		if hash := stringField(event, "JA3"); hash != "" {
+			tool = j.lookup(hash)
+			if tool != "" {
+				j.sessions[event.SessionID] = tool
+				ok = true
+			}
+		}
+	}
+	if event.Type == dicompot.EventConnectionClosed {
+		delete(j.sessions, event.SessionID)
+	}
+	j.mu.Unlock()
+	if ok {
+		fields := map[string]interface{}{"JA3Tool": tool}
+		for name, value := range event.Fields {
+			fields[name] = value
+		}
+		event.Fields = fields
+	}
+	return j.next.Record(event)
+}
+
+// Close closes "next".
+func (j *ja3Tools) Close() error {
+	return j.next.Close()
+}
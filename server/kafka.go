@@ -0,0 +1,455 @@
+package main
+
+// This file produces the events to a Kafka topic, for fleets of sensors to
+// stream into central processing. It speaks just enough of the protocol
+// (https://kafka.apache.org/protocol) to do so: Metadata to find the leaders
+// of the partitions, Produce v3 with v2 record batches, and SASL PLAIN, over
+// TLS or not. Brokers from 0.11 on take it.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// Kafka API keys.
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+)
+
+// The biggest response read from a broker.
+const kafkaMaxResponseSize = 16 << 20
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// kafka is a Kafka producer.
+type kafka struct {
+	bootstrap      []string
+	topic          string
+	tls            *tls.Config
+	user, password string
+
+	// Only used from the goroutine of the queuedSink. The metadata is
+	// fetched again after any failure.
+	conns   map[int32]*kafkaConn
+	addrs   map[int32]string
+	leaders []int32 // By partition.
+	next    int     // The partition of the next event without a session.
+}
+
+// newKafkaSink returns the sink for -kafka and friends, or nil if events
+// aren't produced. "brokers" is a comma-separated list of host:port.
+func newKafkaSink(brokers, topic string, useTLS bool, caFile, user, password string) dicompot.EventSink {
+	if brokers == "" {
+		return nil
+	}
+	if topic == "" {
+		log.Fatalf("-kafka needs -kafkatopic")
+	}
+	k := &kafka{topic: topic, user: user, password: password}
+	for _, addr := range strings.Split(brokers, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			k.bootstrap = append(k.bootstrap, addr)
+		}
+	}
+	if useTLS || caFile != "" {
+		k.tls = &tls.Config{}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				log.Fatalf("Failed to read -kafkacafile %s: %v", caFile, err)
+			}
+			k.tls.RootCAs = x509.NewCertPool()
+			if !k.tls.RootCAs.AppendCertsFromPEM(pem) {
+				log.Fatalf("No certificate in -kafkacafile %s", caFile)
+			}
+		}
+	}
+	if (user == "") != (password == "") {
+		log.Fatalf("-kafkauser and -kafkapassword go together")
+	}
+	log.Printf("-| Producing events to Kafka: %s, topic %s", strings.Join(k.bootstrap, ","), topic)
+	return newQueuedSink("Kafka", 500, 100*time.Millisecond, k.produce)
+}
+
+// kafkaEncoder builds a request in the encoding of the protocol.
+type kafkaEncoder struct{ bytes.Buffer }
+
+func (e *kafkaEncoder) int8(v int8)   { e.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) int32(v int32) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) int64(v int64) { binary.Write(e, binary.BigEndian, v) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// varint writes a zigzag varint, as records use.
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// kafkaDecoder reads a response. The first error sticks, and the values read
+// after it are zero.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, null ones as "".
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// kafkaConn is a connection to a broker.
+type kafkaConn struct {
+	net.Conn
+	correlationID int32
+}
+
+// roundTrip sends a request and returns the body of the response.
+func (c *kafkaConn) roundTrip(apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	c.correlationID++
+	var req kafkaEncoder
+	req.int32(0) // Size, set below.
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(c.correlationID)
+	req.string("dicompot")
+	req.Write(body)
+	b := req.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != c.correlationID {
+		return nil, fmt.Errorf("response %d to request %d", id, c.correlationID)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return &kafkaDecoder{b: resp}, nil
+}
+
+// dial connects to the broker at "addr", and authenticates.
+func (k *kafka) dial(addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if k.tls != nil {
+		config := k.tls.Clone()
+		if config.ServerName, _, err = net.SplitHostPort(addr); err != nil {
+			config.ServerName = addr
+		}
+		conn = tls.Client(conn, config)
+	}
+	c := &kafkaConn{Conn: conn}
+	if k.user != "" {
+		if err := k.authenticate(c); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %v", addr, err)
+		}
+	}
+	return c, nil
+}
+
+// authenticate goes through SASL PLAIN on "c".
+func (k *kafka) authenticate(c *kafkaConn) error {
+	var req kafkaEncoder
+	req.string("PLAIN")
+	resp, err := c.roundTrip(kafkaSaslHandshake, 1, req.Bytes())
+	if err != nil {
+		return err
+	}
+	if code := resp.int16(); resp.err == nil && code != 0 {
+		return fmt.Errorf("SASL PLAIN not enabled (error %d)", code)
+	}
+	req.Reset()
+	req.bytes([]byte("\x00" + k.user + "\x00" + k.password))
+	if resp, err = c.roundTrip(kafkaSaslAuthenticate, 0, req.Bytes()); err != nil {
+		return err
+	}
+	if code := resp.int16(); code != 0 {
+		return fmt.Errorf("authentication failed (error %d): %s", code, resp.string())
+	}
+	return resp.err
+}
+
+// metadata finds the leaders of the partitions of the topic, through the
+// first bootstrap broker that answers.
+func (k *kafka) metadata() error {
+	var err error
+	for _, addr := range k.bootstrap {
+		var c *kafkaConn
+		if c, err = k.dial(addr); err != nil {
+			continue
+		}
+		err = k.readMetadata(c)
+		c.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (k *kafka) readMetadata(c *kafkaConn) error {
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(k.topic)
+	resp, err := c.roundTrip(kafkaMetadata, 1, req.Bytes())
+	if err != nil {
+		return err
+	}
+	addrs := map[int32]string{}
+	for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+		id := resp.int32()
+		host := resp.string()
+		port := resp.int32()
+		resp.string() // Rack
+		addrs[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	resp.int32() // Controller
+	var leaders []int32
+	for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+		code := resp.int16()
+		name := resp.string()
+		resp.take(1) // Internal
+		partitions := resp.int32()
+		if name == k.topic && code != 0 {
+			return fmt.Errorf("topic %s: error %d", k.topic, code)
+		}
+		for ; partitions > 0 && resp.err == nil; partitions-- {
+			resp.int16() // Error
+			id := resp.int32()
+			leader := resp.int32()
+			resp.take(4 * int(resp.int32())) // Replicas
+			resp.take(4 * int(resp.int32())) // In-sync replicas
+			if name != k.topic {
+				continue
+			}
+			for int(id) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[id] = leader
+		}
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("topic %s has no partitions", k.topic)
+	}
+	for i, leader := range leaders {
+		if _, ok := addrs[leader]; !ok {
+			return fmt.Errorf("partition %d of %s has no leader", i, k.topic)
+		}
+	}
+	k.addrs, k.leaders, k.conns = addrs, leaders, map[int32]*kafkaConn{}
+	return nil
+}
+
+func (k *kafka) reset() {
+	for _, c := range k.conns {
+		c.Close()
+	}
+	k.conns, k.addrs, k.leaders = nil, nil, nil
+}
+
+// partition returns the partition of "event": the events of a session go to
+// the same one, to stay in order.
+func (k *kafka) partition(event dicompot.Event) int32 {
+	if event.SessionID == "" {
+		k.next = (k.next + 1) % len(k.leaders)
+		return int32(k.next)
+	}
+	return int32(crc32.ChecksumIEEE([]byte(event.SessionID)) % uint32(len(k.leaders)))
+}
+
+// kafkaRecords returns "events" as a v2 record batch, keyed by session.
+func kafkaRecords(events []dicompot.Event) []byte {
+	first := events[0].Time.UnixNano() / 1e6
+	max := first
+	var records kafkaEncoder
+	for i, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			value = []byte("{}")
+		}
+		ts := event.Time.UnixNano() / 1e6
+		if ts > max {
+			max = ts
+		}
+		var r kafkaEncoder
+		r.int8(0) // Attributes
+		r.varint(ts - first)
+		r.varint(int64(i))
+		if event.SessionID == "" {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(event.SessionID)))
+			r.WriteString(event.SessionID)
+		}
+		r.varint(int64(len(value)))
+		r.Write(value)
+		r.varint(0) // Headers
+		records.varint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+	// What the CRC covers: from the attributes on.
+	var tail kafkaEncoder
+	tail.int16(0) // Attributes: no compression, no transaction.
+	tail.int32(int32(len(events) - 1))
+	tail.int64(first)
+	tail.int64(max)
+	tail.int64(-1) // Producer ID
+	tail.int16(-1) // Producer epoch
+	tail.int32(-1) // Base sequence
+	tail.int32(int32(len(events)))
+	tail.Write(records.Bytes())
+	var batch kafkaEncoder
+	batch.int64(0)                             // Base offset
+	batch.int32(int32(4 + 1 + 4 + tail.Len())) // Length, past this field
+	batch.int32(-1)                            // Partition leader epoch
+	batch.int8(2)                              // Magic
+	batch.int32(int32(crc32.Checksum(tail.Bytes(), kafkaCRCTable)))
+	batch.Write(tail.Bytes())
+	return batch.Bytes()
+}
+
+// produce sends the events to the leaders of their partitions, waiting for
+// all the in-sync replicas to have them. On failure, the whole batch is sent
+// again, so a consumer may see an event twice.
+func (k *kafka) produce(events []dicompot.Event) error {
+	if k.leaders == nil {
+		if err := k.metadata(); err != nil {
+			return err
+		}
+	}
+	byLeader := map[int32]map[int32][]dicompot.Event{}
+	for _, event := range events {
+		p := k.partition(event)
+		leader := k.leaders[p]
+		if byLeader[leader] == nil {
+			byLeader[leader] = map[int32][]dicompot.Event{}
+		}
+		byLeader[leader][p] = append(byLeader[leader][p], event)
+	}
+	for leader, partitions := range byLeader {
+		if err := k.produceTo(leader, partitions); err != nil {
+			k.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *kafka) produceTo(leader int32, partitions map[int32][]dicompot.Event) error {
+	c := k.conns[leader]
+	if c == nil {
+		var err error
+		if c, err = k.dial(k.addrs[leader]); err != nil {
+			return err
+		}
+		k.conns[leader] = c
+	}
+	var req kafkaEncoder
+	req.int16(-1)    // Transactional ID
+	req.int16(-1)    // Acks: all
+	req.int32(10000) // Timeout
+	req.int32(1)
+	req.string(k.topic)
+	req.int32(int32(len(partitions)))
+	for p, events := range partitions {
+		req.int32(p)
+		req.bytes(kafkaRecords(events))
+	}
+	resp, err := c.roundTrip(kafkaProduce, 3, req.Bytes())
+	if err != nil {
+		return err
+	}
+	for n := resp.int32(); n > 0 && resp.err == nil; n-- {
+		resp.string() // Topic
+		for m := resp.int32(); m > 0 && resp.err == nil; m-- {
+			p := resp.int32()
+			code := resp.int16()
+			resp.int64() // Base offset
+			resp.int64() // Log append time
+			if code != 0 && resp.err == nil {
+				return fmt.Errorf("partition %d of %s: error %d", p, k.topic, code)
+			}
+		}
+	}
+	return resp.err
+}
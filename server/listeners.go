@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// listener is one additional DICOM port, with the AE title it answers to.
+type listener struct {
+	port    string
+	aeTitle string
+	// nil: the same as the main port.
+	personality *personality
+}
+
+// parseListeners parses the value of -listen, e.g.,
+// "104,4242/ORTHANC,11112//dcm4chee". Listeners without an AE title use the
+// personality's, if given, else "defaultAETitle".
+func parseListeners(value string, defaultAETitle string) []listener {
+	var listeners []listener
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "/", 3)
+		l := listener{port: parts[0], aeTitle: defaultAETitle}
+		if len(parts) == 3 && parts[2] != "" {
+			l.personality = lookupPersonality(parts[2])
+			l.aeTitle = l.personality.aeTitle
+		}
+		if len(parts) >= 2 && parts[1] != "" {
+			l.aeTitle = parts[1]
+		}
+		if l.port == "" || (len(parts) == 2 && parts[1] == "") {
+			log.Fatalf("Invalid -listen entry %q, want port[/AE[/personality]]", entry)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
@@ -0,0 +1,232 @@
+package main
+
+// This file encrypts the rotated attacker logs at rest, for what attackers
+// submit, real-looking patient names included, not to leak from the disk of
+// the honeypot or its backups: with -logpubkey, the logs -log is rotated to
+// are encrypted to the age (https://age-encryption.org) X25519 recipients of
+// the operator, as .age files, and the plaintext removed. Only the holder of
+// an identity, kept off the honeypot, reads them back, with age itself or
+// "dicompot decryptlog":
+//
+//	age-keygen -o dicompot-identity.txt
+//	dicompot -logpubkey age1... (the public key age-keygen printed)
+//	age -d -i dicompot-identity.txt dicompot-2026-01-02T03-04-05.000.log.age > dicompot-2026-01-02T03-04-05.000.log
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+const (
+	// The extension of the encrypted logs.
+	logEncryptExt = ".age"
+	// How often the rotated logs are looked for.
+	logEncryptInterval = time.Minute
+	// The timestamp lumberjack names the rotated logs with.
+	logBackupTimeFormat = "2006-01-02T15-04-05.000"
+)
+
+// logEncrypter encrypts the logs "path" is rotated to.
+type logEncrypter struct {
+	path       string
+	recipients []age.Recipient
+	backups    int
+	age        int
+}
+
+// newLogEncrypter returns the encrypter of the rotated logs of "logPath"
+// for -logpubkey, or nil if they are kept in plaintext. It encrypts those
+// already there, then every logEncryptInterval, and keeps "backups" of
+// them, for "age" days, as -logbackups and -logage do.
+func newLogEncrypter(keyPath, logPath string, backups, age int) *logEncrypter {
+	if keyPath == "" {
+		return nil
+	}
+	recipients, err := parseLogRecipients(keyPath)
+	if err != nil {
+		log.Fatalf("Invalid -logpubkey %s: %v", keyPath, err)
+	}
+	e := &logEncrypter{path: logPath, recipients: recipients, backups: backups, age: age}
+	log.Printf("-| Encrypting the rotated attacker logs to the age recipients of -logpubkey")
+	e.sweep()
+	go func() {
+		for range time.Tick(logEncryptInterval) {
+			e.sweep()
+		}
+	}()
+	return e
+}
+
+// sweep encrypts the rotated logs, and removes the encrypted logs that
+// lumberjack would have: beyond "backups", or older than "age" days, unless
+// 0.
+func (e *logEncrypter) sweep() {
+	dir := filepath.Dir(e.path)
+	ext := filepath.Ext(e.path)
+	prefix := strings.TrimSuffix(filepath.Base(e.path), ext) + "-"
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to list the rotated logs in %s: %v", dir, err)
+		return
+	}
+	type backup struct {
+		path string
+		t    time.Time
+	}
+	var encrypted []backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		isEncrypted := strings.HasSuffix(name, ext+logEncryptExt)
+		t, err := time.Parse(logBackupTimeFormat, strings.TrimSuffix(strings.TrimSuffix(name[len(prefix):], logEncryptExt), ext))
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if !isEncrypted {
+			if !strings.HasSuffix(name, ext) {
+				continue
+			}
+			if err := encryptLogFile(path, e.recipients); err != nil {
+				log.Printf("Failed to encrypt the rotated log %s: %v", path, err)
+				continue
+			}
+			path += logEncryptExt
+		}
+		encrypted = append(encrypted, backup{path, t})
+	}
+	sort.Slice(encrypted, func(i, j int) bool { return encrypted[i].t.After(encrypted[j].t) })
+	cutoff := time.Now().Add(-time.Duration(e.age) * 24 * time.Hour)
+	for i, b := range encrypted {
+		if (e.backups > 0 && i >= e.backups) || (e.age > 0 && b.t.Before(cutoff)) {
+			if err := os.Remove(b.path); err != nil {
+				log.Printf("Failed to remove the old log %s: %v", b.path, err)
+			}
+		}
+	}
+}
+
+// parseLogRecipients returns the recipients of -logpubkey "value": one,
+// age1..., or a file of them.
+func parseLogRecipients(value string) ([]age.Recipient, error) {
+	if strings.HasPrefix(value, "age1") {
+		r, err := age.ParseX25519Recipient(value)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	}
+	f, err := os.Open(value)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseRecipients(f)
+}
+
+// encryptLogFile encrypts the log at "path" to "recipients", as
+// "path".age, and removes it.
+func encryptLogFile(path string, recipients []age.Recipient) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + logEncryptExt + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = encryptLog(out, in, recipients)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+logEncryptExt)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// encryptLog writes "r", encrypted to "recipients", to "w", as an age file.
+func encryptLog(w io.Writer, r io.Reader, recipients []age.Recipient) error {
+	bw := bufio.NewWriter(w)
+	aw, err := age.Encrypt(bw, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(aw, r); err != nil {
+		return err
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// decryptLog writes "r", an age file, decrypted with one of "identities",
+// to "w". age tells altered and truncated files.
+func decryptLog(w io.Writer, r io.Reader, identities []age.Identity) error {
+	ar, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, ar); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errors.New("truncated")
+		}
+		return err
+	}
+	return nil
+}
+
+// runDecryptLog writes the logs given, decrypted, to the standard output.
+func runDecryptLog(args []string) {
+	fs := flag.NewFlagSet("decryptlog", flag.ExitOnError)
+	keyPath := fs.String("logprivkey", "", "age identity file, from age-keygen, of a recipient the logs were encrypted to")
+	fs.Parse(args)
+	if *keyPath == "" || fs.NArg() == 0 {
+		log.Fatalf("Usage: dicompot decryptlog -logprivkey FILE LOG.age...")
+	}
+	f, err := os.Open(*keyPath)
+	if err != nil {
+		log.Fatalf("Failed to read -logprivkey %s: %v", *keyPath, err)
+	}
+	identities, err := age.ParseIdentities(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Invalid -logprivkey %s: %v", *keyPath, err)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		err = decryptLog(out, f, identities)
+		f.Close()
+		if err != nil {
+			out.Flush()
+			log.Fatalf("Failed to decrypt %s: %v", path, err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatalf("Failed to write the logs: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+func TestEncryptLog(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []age.Recipient{identity.Recipient()}
+	identities := []age.Identity{identity}
+	const chunk = 64 << 10 // Of age's payload.
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3*chunk + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		var encrypted bytes.Buffer
+		if err := encryptLog(&encrypted, bytes.NewReader(plain), recipients); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.HasPrefix(encrypted.Bytes(), []byte("age-encryption.org/v1\n")) {
+			t.Errorf("%d bytes: not an age file", size)
+		}
+		if size > 16 && bytes.Contains(encrypted.Bytes(), plain[:16]) {
+			t.Errorf("%d bytes: the plaintext shows", size)
+		}
+		var decrypted bytes.Buffer
+		if err := decryptLog(&decrypted, bytes.NewReader(encrypted.Bytes()), identities); err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+		} else if !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Errorf("%d bytes: decrypted %d different bytes", size, decrypted.Len())
+		}
+
+		if err := decryptLog(ioutil.Discard, bytes.NewReader(encrypted.Bytes()), []age.Identity{other}); err == nil {
+			t.Errorf("%d bytes: decrypted with another identity", size)
+		}
+		b := encrypted.Bytes()
+		// Truncated within the last chunk, or at a chunk boundary.
+		for _, n := range []int{len(b) - 1, len(b) - size%chunk - 16} {
+			if n < len(b) && n > len(b)-size-16 {
+				if err := decryptLog(ioutil.Discard, bytes.NewReader(b[:n]), identities); err == nil {
+					t.Errorf("%d bytes: truncated to %d decrypts", size, n)
+				}
+			}
+		}
+		altered := append([]byte{}, b...)
+		altered[len(altered)-1] ^= 1
+		if err := decryptLog(ioutil.Discard, bytes.NewReader(altered), identities); err == nil {
+			t.Errorf("%d bytes: altered decrypts", size)
+		}
+	}
+	if err := decryptLog(ioutil.Discard, strings.NewReader("{\"msg\":\"plaintext\"}\n"), identities); err == nil {
+		t.Errorf("a plaintext log decrypts")
+	}
+}
+
+func TestParseLogRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := identity.Recipient().String()
+	if r, err := parseLogRecipients(key); err != nil || len(r) != 1 {
+		t.Errorf("parseLogRecipients(%q) = %v, %v", key, r, err)
+	}
+	path := filepath.Join(t.TempDir(), "recipients.txt")
+	if err := ioutil.WriteFile(path, []byte("# The operator.\n"+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := parseLogRecipients(path); err != nil || len(r) != 1 {
+		t.Errorf("parseLogRecipients of a file = %v, %v", r, err)
+	}
+	if _, err := parseLogRecipients("age1invalid"); err == nil {
+		t.Errorf("an invalid recipient parsed")
+	}
+}
+
+func TestLogEncrypterSweep(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	e := &logEncrypter{path: filepath.Join(dir, "dicompot.log"), recipients: []age.Recipient{identity.Recipient()}, backups: 2}
+	now := time.Now().UTC()
+	var backups []string
+	for i := 3; i > 0; i-- {
+		name := "dicompot-" + now.Add(-time.Duration(i)*time.Hour).Format(logBackupTimeFormat) + ".log"
+		backups = append(backups, name)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"dicompot.log", "other.log"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.sweep()
+
+	for _, name := range []string{"dicompot.log", "other.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	// The oldest is beyond -logbackups.
+	for i, name := range backups {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left in plaintext", name)
+		}
+		f, err := os.Open(filepath.Join(dir, name+logEncryptExt))
+		if i == 0 {
+			if err == nil {
+				f.Close()
+				t.Errorf("%s.age kept beyond -logbackups", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var decrypted bytes.Buffer
+		err = decryptLog(&decrypted, f, []age.Identity{identity})
+		f.Close()
+		if err != nil || decrypted.String() != name {
+			t.Errorf("%s.age decrypts to %q, %v", name, decrypted.String(), err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+// This file makes the attacker log tamper-evident, for its entries to stand
+// as evidence in incident response or in court: with -logkey, every line
+// ends with an "hmac" field, the HMAC-SHA256, under the key, of the
+// previous line's HMAC and the line. Whoever doesn't hold the key can't
+// alter, insert, remove or reorder lines without breaking the chain, which
+// "dicompot verifylog" checks:
+//
+//	dicompot verifylog -logkey dicompot.key dicompot-2026-01-02T03-04-05.000.log dicompot.log
+//
+// The chain resumes from the last line of the log on startup, and restarts
+// when that has none, e.g., when the log was rotated away; verifylog says
+// where it restarted. Lines removed from the end of the log only show
+// against a later HMAC kept elsewhere.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// What the signed lines end with, before the HMAC and `"}`.
+const logMACMarker = `,"hmac":"`
+
+// The length of an HMAC, in hex.
+const logMACLength = sha256.Size * 2
+
+// signingFormatter is a logrus.Formatter that ends the JSON lines of the
+// formatter it wraps with the HMAC of the chain. Lines must be written in
+// the order they are formatted, as logrus does under the lock of the logger.
+type signingFormatter struct {
+	logrus.Formatter
+	key []byte
+
+	mu   sync.Mutex
+	prev string
+}
+
+// readLogKey reads the key of -logkey from "path".
+func readLogKey(path string) []byte {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read -logkey %s: %v", path, err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < 16 {
+		log.Fatalf("-logkey %s holds %d bytes, want 16 or more", path, len(key))
+	}
+	return key
+}
+
+// newSigningFormatter returns the formatter of the attacker log for
+// -logkey: "formatter", or the signing formatter wrapping it if "keyPath"
+// is set. The chain resumes from the last line of "logPath".
+func newSigningFormatter(keyPath, logPath string, formatter logrus.Formatter) logrus.Formatter {
+	if keyPath == "" {
+		return formatter
+	}
+	return &signingFormatter{Formatter: formatter, key: readLogKey(keyPath), prev: lastLogMAC(logPath)}
+}
+
+// Format formats "entry", and signs it.
+func (f *signingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	line := bytes.TrimSuffix(b, []byte("\n"))
+	if len(line) < 2 || line[len(line)-1] != '}' {
+		return nil, fmt.Errorf("can't sign a log line that isn't a JSON object: %q", line)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prev = logMAC(f.key, f.prev, line)
+	signed := make([]byte, 0, len(line)+len(logMACMarker)+logMACLength+3)
+	signed = append(signed, line[:len(line)-1]...)
+	signed = append(signed, logMACMarker...)
+	signed = append(signed, f.prev...)
+	return append(signed, "\"}\n"...), nil
+}
+
+// logMAC returns the HMAC, in hex, of "line", following "prev".
+func logMAC(key []byte, prev string, line []byte) string {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, prev)
+	mac.Write([]byte{'\n'})
+	mac.Write(line)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// splitSignedLine returns the line "signed" was signed as, and its HMAC, or
+// nil if it isn't signed.
+func splitSignedLine(signed []byte) ([]byte, string) {
+	n := len(signed) - len(logMACMarker) - logMACLength - 2
+	if n < 1 || !bytes.HasPrefix(signed[n:], []byte(logMACMarker)) || !bytes.HasSuffix(signed, []byte(`"}`)) {
+		return nil, ""
+	}
+	line := append(signed[:n:n], '}')
+	return line, string(signed[n+len(logMACMarker) : len(signed)-2])
+}
+
+// lastLogMAC returns the HMAC of the last line of the log at "path", or ""
+// if it has none.
+func lastLogMAC(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	// The last line is in the last 64 KiB, unless it is longer.
+	if info, err := f.Stat(); err == nil && info.Size() > 64<<10 {
+		f.Seek(info.Size()-64<<10, io.SeekStart)
+	}
+	tail, err := ioutil.ReadAll(f)
+	if err != nil {
+		return ""
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	_, mac := splitSignedLine(tail)
+	return mac
+}
+
+// runVerifyLog checks the chain of the logs given, in order, and exits with
+// 1 if it is broken.
+func runVerifyLog(args []string) {
+	fs := flag.NewFlagSet("verifylog", flag.ExitOnError)
+	keyPath := fs.String("logkey", "", "File of the key the logs were signed with")
+	fs.Parse(args)
+	if *keyPath == "" || fs.NArg() == 0 {
+		log.Fatalf("Usage: dicompot verifylog -logkey FILE LOG...")
+	}
+	key := readLogKey(*keyPath)
+	prev, broken := "", false
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 16<<20)
+		n, signed := 0, 0
+		for scanner.Scan() {
+			n++
+			line, mac := splitSignedLine(scanner.Bytes())
+			switch {
+			case line == nil:
+				if prev != "" {
+					fmt.Printf("%s:%d: not signed\n", path, n)
+					broken = true
+				}
+				prev = ""
+				continue
+			case hmac.Equal([]byte(mac), []byte(logMAC(key, prev, line))):
+			case prev != "" && hmac.Equal([]byte(mac), []byte(logMAC(key, "", line))):
+				fmt.Printf("%s:%d: the chain restarts\n", path, n)
+			default:
+				fmt.Printf("%s:%d: altered, or lines before it were removed\n", path, n)
+				broken = true
+			}
+			prev = mac
+			signed++
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("Failed to read %s: %v", path, err)
+		}
+		f.Close()
+		fmt.Printf("%s: %d of %d lines signed\n", path, signed, n)
+	}
+	if broken {
+		os.Exit(1)
+	}
+	fmt.Printf("The chain is intact\n")
+}
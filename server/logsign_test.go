@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// signedLines formats "n" entries with a signing formatter following "prev".
+func signedLines(t *testing.T, key []byte, prev string, n int) [][]byte {
+	f := &signingFormatter{Formatter: &logrus.JSONFormatter{}, key: key, prev: prev}
+	var lines [][]byte
+	for i := 0; i < n; i++ {
+		entry := logrus.NewEntry(logrus.StandardLogger()).WithField("n", i)
+		entry.Message = "event"
+		b, err := f.Format(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, bytes.TrimSuffix(b, []byte("\n")))
+	}
+	return lines
+}
+
+// verifyChain reports whether "lines" chain from "prev" under "key".
+func verifyChain(key []byte, prev string, lines [][]byte) bool {
+	for _, signed := range lines {
+		line, mac := splitSignedLine(signed)
+		if line == nil || mac != logMAC(key, prev, line) {
+			return false
+		}
+		prev = mac
+	}
+	return true
+}
+
+func TestSigningFormatter(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	lines := signedLines(t, key, "", 3)
+	if !verifyChain(key, "", lines) {
+		t.Fatalf("the chain of %q doesn't verify", lines)
+	}
+	if verifyChain([]byte("fedcba9876543210"), "", lines) {
+		t.Errorf("the chain verifies under another key")
+	}
+
+	altered := append([][]byte{}, lines...)
+	altered[1] = bytes.Replace(lines[1], []byte(`"n":1`), []byte(`"n":7`), 1)
+	if verifyChain(key, "", altered) {
+		t.Errorf("an altered line verifies")
+	}
+	if verifyChain(key, "", [][]byte{lines[0], lines[2]}) {
+		t.Errorf("the chain verifies without a line")
+	}
+	if verifyChain(key, "", [][]byte{lines[1], lines[0], lines[2]}) {
+		t.Errorf("reordered lines verify")
+	}
+
+	// The chain resumes from the last line of the log.
+	_, last := splitSignedLine(lines[2])
+	more := signedLines(t, key, last, 2)
+	if !verifyChain(key, "", append(lines, more...)) {
+		t.Errorf("the resumed chain doesn't verify")
+	}
+}
+
+func TestSplitSignedLine(t *testing.T) {
+	mac := strings.Repeat("ab", logMACLength/2)
+	for _, test := range []struct {
+		signed string
+		line   string
+		mac    string
+	}{
+		{`{"msg":"x","hmac":"` + mac + `"}`, `{"msg":"x"}`, mac},
+		{`{"msg":"x"}`, "", ""},
+		{`{"hmac":"` + mac + `"}`, "", ""},
+		{`{"msg":"x","hmac":"` + mac[2:] + `"}`, "", ""},
+		{"", "", ""},
+	} {
+		line, got := splitSignedLine([]byte(test.signed))
+		if string(line) != test.line || got != test.mac {
+			t.Errorf("splitSignedLine(%q) = %q, %q, want %q, %q", test.signed, line, got, test.line, test.mac)
+		}
+	}
+}
+
+func TestLastLogMAC(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	lines := signedLines(t, key, "", 2)
+	path := filepath.Join(t.TempDir(), "dicompot.log")
+	if mac := lastLogMAC(path); mac != "" {
+		t.Errorf("lastLogMAC of no log = %q", mac)
+	}
+	if err := ioutil.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, want := splitSignedLine(lines[1]); lastLogMAC(path) != want {
+		t.Errorf("lastLogMAC = %q, want %q", lastLogMAC(path), want)
+	}
+	if err := ioutil.WriteFile(path, []byte("{\"msg\":\"unsigned\"}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mac := lastLogMAC(path); mac != "" {
+		t.Errorf("lastLogMAC of an unsigned log = %q", mac)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+// This file serves the management API, for operators to look after the
+// honeypot remotely without restarting it: the sessions in progress, the
+// sources banned, the services on and off, the recent events, and a reload
+// of the images served. It speaks JSON, and takes a bearer token.
+//
+//   GET    /api/sessions          the sessions in progress
+//   GET    /api/events            the recent events: ?last=, ?types=, ?level=
+//   GET    /api/bans              the sources banned
+//   POST   /api/bans              bans {"ip": "192.0.2.7", "reason": "..."}
+//   DELETE /api/bans?ip=          lifts a ban
+//   GET    /api/services          the services, on or off
+//   PUT    /api/services/{name}   turns a service {"enabled": false}
+//   POST   /api/reload            reads -dir again
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// The events kept for /api/events.
+	manageHistory = 1000
+	// The longest request body taken.
+	manageMaxBody = 1 << 16
+)
+
+// The services that can be turned off, in the order they are listed.
+var serviceNames = []string{"echo", "find", "worklist", "move", "get", "store", "commitment", "mpps", "print", "hl7", "dicomweb"}
+
+// The status of the DIMSE requests to a service turned off, as if it
+// weren't implemented.
+var serviceOffStatus = dimse.Status{Status: dimse.StatusUnrecognizedOperation}
+
+var errServiceOff = errors.New("service unavailable")
+
+// services are the services on and off. All are on at start.
+type services struct {
+	mu  sync.Mutex
+	off map[string]bool
+}
+
+func newServices() *services {
+	return &services{off: map[string]bool{}}
+}
+
+// on returns whether service "name" is on.
+func (s *services) on(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.off[name]
+}
+
+// set turns service "name" on or off, and returns false if there is no such
+// service.
+func (s *services) set(name string, on bool) bool {
+	for _, n := range serviceNames {
+		if n == name {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.off[name] = !on
+			return true
+		}
+	}
+	return false
+}
+
+// ban is a source banned.
+type ban struct {
+	// An IP or a CIDR block.
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+
+	net *net.IPNet
+}
+
+// bans are the sources whose connections are closed at once, until the
+// process restarts.
+type bans struct {
+	mu   sync.Mutex
+	list []*ban
+}
+
+// add bans "entry", an IP or a CIDR block, or replaces the reason if it is
+// banned already.
+func (b *bans) add(entry, reason string) (*ban, error) {
+	var n *net.IPNet
+	if strings.Contains(entry, "/") {
+		var err error
+		if _, n, err = net.ParseCIDR(entry); err != nil {
+			return nil, errors.New("invalid CIDR block")
+		}
+	} else {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, errors.New("invalid IP")
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range b.list {
+		if e.net.String() == n.String() {
+			e.Reason = reason
+			return e, nil
+		}
+	}
+	e := &ban{IP: entry, Reason: reason, Since: time.Now(), net: n}
+	b.list = append(b.list, e)
+	return e, nil
+}
+
+// remove lifts the ban of "entry", and returns whether there was one.
+func (b *bans) remove(entry string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, e := range b.list {
+		if e.IP == entry || e.net.String() == entry {
+			b.list = append(b.list[:i], b.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// banned returns whether "ip" is banned.
+func (b *bans) banned(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range b.list {
+		if e.net.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bans) all() []ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := []ban{}
+	for _, e := range b.list {
+		list = append(list, *e)
+	}
+	return list
+}
+
+// refused returns whether a connection from "ip" to "service" is to be
+// closed at once, as the source is banned or the service off, and says why
+// in "fields".
+func (ss *server) refused(ip, service string, fields map[string]interface{}) bool {
+	switch {
+	case ss.bans.banned(ip):
+		fields["Banned"] = true
+	case !ss.services.on(service):
+		fields["ServiceOff"] = true
+	default:
+		return false
+	}
+	return true
+}
+
+// reload reads -dir again, and serves what it finds from now on.
+func (ss *server) reload() (int, error) {
+	var skipDir string
+	if ss.quarantine != nil {
+		skipDir = ss.quarantine.dir
+	}
+	datasets, err := listDicomFiles(*dirFlag, skipDir, ss.deid)
+	if err != nil {
+		return 0, err
+	}
+	if ss.reveal != nil {
+		ss.reveal.load(datasets)
+	}
+	if ss.rotation != nil {
+		ss.rotation.load(datasets)
+		ss.rotate()
+	} else {
+		ss.mu.Lock()
+		ss.datasets = datasets
+		ss.mu.Unlock()
+	}
+	log.Printf("-| Reloaded %d images", len(datasets))
+	return len(datasets), nil
+}
+
+// manager is an EventSink that keeps the recent events, and the
+// http.Handler of the management API.
+type manager struct {
+	addr  string
+	token string
+	ss    *server
+
+	mu sync.Mutex
+	// The last events, the oldest first.
+	history []dicompot.Event
+}
+
+// newManager returns the sink for -manage, or nil if there is none. The API
+// is only served once start is called.
+func newManager(addr, token string) *manager {
+	if addr == "" {
+		return nil
+	}
+	if token == "" {
+		log.Fatalf("-manage requires -managetoken")
+	}
+	return &manager{addr: addr, token: token}
+}
+
+// start serves the API for "ss".
+func (m *manager) start(ss *server) {
+	if m == nil {
+		return
+	}
+	m.ss = ss
+	srv := &http.Server{Addr: m.addr, Handler: m, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Fatal(srv.ListenAndServe())
+	}()
+	log.Printf("-| Management API served on: http://%s/api/", m.addr)
+}
+
+// Record keeps the event for /api/events.
+func (m *manager) Record(event dicompot.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.history) == manageHistory {
+		copy(m.history, m.history[1:])
+		m.history = m.history[:manageHistory-1]
+	}
+	m.history = append(m.history, event)
+	return nil
+}
+
+func (m *manager) Close() error {
+	return nil
+}
+
+func (m *manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(m.token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, manageMaxBody)
+	switch path := r.URL.Path; {
+	case path == "/api/sessions" && r.Method == http.MethodGet:
+		m.serveSessions(w)
+	case path == "/api/events" && r.Method == http.MethodGet:
+		m.serveEvents(w, r)
+	case path == "/api/bans":
+		m.serveBans(w, r)
+	case path == "/api/services" && r.Method == http.MethodGet:
+		m.serveServices(w)
+	case strings.HasPrefix(path, "/api/services/") && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		m.serveSetService(w, r, strings.TrimPrefix(path, "/api/services/"))
+	case path == "/api/reload" && r.Method == http.MethodPost:
+		n, err := m.ss.reload()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAPI(w, http.StatusOK, map[string]int{"datasets": n})
+	default:
+		writeAPIError(w, http.StatusNotFound, "no such endpoint or method")
+	}
+}
+
+// apiSession is a session in progress, as /api/sessions lists it.
+type apiSession struct {
+	ID string `json:"id"`
+	dicompot.Session
+	Opened time.Time `json:"opened"`
+}
+
+func (m *manager) serveSessions(w http.ResponseWriter) {
+	list := []apiSession{}
+	for _, s := range dicompot.Sessions() {
+		list = append(list, apiSession{ID: s.ID, Session: s.Session, Opened: s.Opened})
+	}
+	writeAPI(w, http.StatusOK, list)
+}
+
+// serveEvents returns the recent events, the oldest first. The parameters are
+// "last", how many (default: 100), "types", the comma-separated event types
+// (default: all), and "level", the least severe level (default: debug).
+func (m *manager) serveEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	last := 100
+	if s := query.Get("last"); s != "" {
+		var err error
+		if last, err = strconv.Atoi(s); err != nil || last < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid last")
+			return
+		}
+	}
+	types := map[string]bool{}
+	if s := query.Get("types"); s != "" {
+		for _, t := range strings.Split(s, ",") {
+			types[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+	}
+	level := logrus.DebugLevel
+	if s := query.Get("level"); s != "" {
+		var err error
+		if level, err = logrus.ParseLevel(s); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid level")
+			return
+		}
+	}
+	events := []dicompot.Event{}
+	m.mu.Lock()
+	for i := len(m.history) - 1; i >= 0 && len(events) < last; i-- {
+		e := m.history[i]
+		if e.Level <= level && (len(types) == 0 || types[e.Type]) {
+			events = append(events, e)
+		}
+	}
+	m.mu.Unlock()
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	writeAPI(w, http.StatusOK, events)
+}
+
+func (m *manager) serveBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAPI(w, http.StatusOK, m.ss.bans.all())
+	case http.MethodPost:
+		var req struct {
+			IP     string `json:"ip"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		b, err := m.ss.bans.add(strings.TrimSpace(req.IP), req.Reason)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("-| Banned %s", b.IP)
+		writeAPI(w, http.StatusOK, b)
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if !m.ss.bans.remove(ip) {
+			writeAPIError(w, http.StatusNotFound, "not banned")
+			return
+		}
+		log.Printf("-| Lifted the ban of %s", ip)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiService is a service, as /api/services lists it.
+type apiService struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (m *manager) serveServices(w http.ResponseWriter) {
+	var list []apiService
+	for _, name := range serviceNames {
+		list = append(list, apiService{Name: name, Enabled: m.ss.services.on(name)})
+	}
+	writeAPI(w, http.StatusOK, list)
+}
+
+func (m *manager) serveSetService(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		writeAPIError(w, http.StatusBadRequest, `want {"enabled": true|false}`)
+		return
+	}
+	if !m.ss.services.set(name, *req.Enabled) {
+		writeAPIError(w, http.StatusNotFound, "no such service, want one of "+strings.Join(serviceNames, ", "))
+		return
+	}
+	if *req.Enabled {
+		log.Printf("-| Turned %s on", name)
+	} else {
+		log.Printf("-| Turned %s off", name)
+	}
+	writeAPI(w, http.StatusOK, apiService{Name: name, Enabled: *req.Enabled})
+}
+
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPI(w, status, map[string]string{"error": message})
+}
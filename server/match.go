@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// matchKeys checks if "ds" satisfies all the keys. If so, it returns the
+// elements of "ds" that correspond to the keys, with empty elements standing
+// in for the attributes "ds" lacks.
+func matchKeys(ds *dicom.DataSet, keys []*dicom.Element) ([]*dicom.Element, bool, error) {
+	var elems []*dicom.Element
+	for _, key := range keys {
+		ok, elem, err := matchElement(ds, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		if elem == nil {
+			if elem, err = dicom.NewElement(key.Tag); err != nil {
+				log.Println(err)
+				return nil, false, err
+			}
+		}
+		elems = append(elems, elem)
+	}
+	return elems, true, nil
+}
+
+// matchElement applies one C-FIND matching key to "ds". It returns the
+// element of "ds" to be returned to the requester, or nil if "ds" lacks
+// the attribute but the key is a universal match. The matching types are
+// defined in P3.4, C.2.2.2.
+func matchElement(ds *dicom.DataSet, f *dicom.Element) (bool, *dicom.Element, error) {
+	if f.Tag == dicomtag.QueryRetrieveLevel || f.Tag == dicomtag.SpecificCharacterSet {
+		return true, nil, nil
+	}
+	elem, err := ds.FindElementByTag(f.Tag)
+	if err != nil {
+		elem = nil
+	}
+	if f.VR == "SQ" {
+		return matchSequence(elem, f)
+	}
+	if isUniversalKey(f) {
+		return true, elem, nil
+	}
+	if elem == nil {
+		return false, nil, nil
+	}
+
+	var match func(value string) bool
+	switch {
+	case f.VR == "UI":
+		// List of UID matching. The values are OR'ed. P3.4, C.2.2.2.5.
+		uids := map[string]bool{}
+		for _, v := range f.Value {
+			uids[strings.TrimSpace(fmt.Sprint(v))] = true
+		}
+		match = func(value string) bool { return uids[value] }
+	case len(f.Value) > 1:
+		// Only UIDs may be listed. P3.4, C.2.2.2.1.
+		return false, nil, fmt.Errorf("Multiple values found in filter '%v'", f)
+	case f.VR == "DA" || f.VR == "TM" || f.VR == "DT":
+		key := strings.TrimSpace(fmt.Sprint(f.Value[0]))
+		if from, to, ok := splitRange(f.VR, key); ok {
+			match = rangeMatcher(f.VR, from, to)
+		} else {
+			key = normalizeDateTime(f.VR, key)
+			match = func(value string) bool { return normalizeDateTime(f.VR, value) == key }
+		}
+	default:
+		key := strings.TrimRight(fmt.Sprint(f.Value[0]), " ")
+		if isWildcardVR(f.VR) && strings.ContainsAny(key, "*?") {
+			re, err := wildcardRegexp(key, f.VR == "PN")
+			if err != nil {
+				return false, nil, err
+			}
+			match = re.MatchString
+		} else if f.VR == "PN" {
+			match = func(value string) bool { return strings.EqualFold(value, key) }
+		} else {
+			match = func(value string) bool { return value == key }
+		}
+	}
+	for _, v := range elem.Value {
+		if match(strings.TrimRight(fmt.Sprint(v), " ")) {
+			return true, elem, nil
+		}
+	}
+	return false, nil, nil
+}
+
+// sequenceItems returns the datasets nested in the items of an SQ element.
+func sequenceItems(elem *dicom.Element) []*dicom.DataSet {
+	var items []*dicom.DataSet
+	for _, v := range elem.Value {
+		item, ok := v.(*dicom.Element)
+		if !ok || item.Tag != dicomtag.Item {
+			continue
+		}
+		ds := &dicom.DataSet{}
+		for _, iv := range item.Value {
+			if sub, ok := iv.(*dicom.Element); ok {
+				ds.Elements = append(ds.Elements, sub)
+			}
+		}
+		items = append(items, ds)
+	}
+	return items
+}
+
+// matchSequence implements sequence matching. The single item of the key
+// holds the keys to match, and an item of "elem" matches if it satisfies all
+// of them, recursively. Only the matching items are returned, each reduced
+// to the requested attributes. P3.4, C.2.2.2.6.
+func matchSequence(elem *dicom.Element, f *dicom.Element) (bool, *dicom.Element, error) {
+	keyItems := sequenceItems(f)
+	if len(keyItems) == 0 || len(keyItems[0].Elements) == 0 {
+		// Universal match; the whole sequence is returned.
+		return true, elem, nil
+	}
+	if len(keyItems) > 1 {
+		return false, nil, fmt.Errorf("Multiple items found in sequence filter '%v'", f)
+	}
+	keys := keyItems[0].Elements
+	if elem == nil {
+		// No items to match against; only universal keys match.
+		for _, key := range keys {
+			if key.VR == "SQ" || !isUniversalKey(key) {
+				return false, nil, nil
+			}
+		}
+		return true, nil, nil
+	}
+	var matched []interface{}
+	for _, item := range sequenceItems(elem) {
+		elems, ok, err := matchKeys(item, keys)
+		if err != nil {
+			return false, nil, err
+		}
+		if !ok {
+			continue
+		}
+		values := make([]interface{}, len(elems))
+		for i, e := range elems {
+			values[i] = e
+		}
+		matched = append(matched, dicom.MustNewElement(dicomtag.Item, values...))
+	}
+	if len(matched) == 0 {
+		return false, nil, nil
+	}
+	return true, dicom.MustNewElement(f.Tag, matched...), nil
+}
+
+// isUniversalKey reports whether every dataset matches "f": the key is
+// empty, or consists of '*'s only. P3.4, C.2.2.2.3.
+func isUniversalKey(f *dicom.Element) bool {
+	if len(f.Value) == 0 {
+		return true
+	}
+	if len(f.Value) > 1 {
+		return false
+	}
+	switch v := f.Value[0].(type) {
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return true
+		}
+		return isWildcardVR(f.VR) && strings.Trim(s, "*") == ""
+	case []byte:
+		return len(v) == 0
+	}
+	return false
+}
+
+// isWildcardVR reports whether '*' and '?' are wildcards for the VR.
+// P3.4, C.2.2.2.4.
+func isWildcardVR(vr string) bool {
+	switch vr {
+	case "AE", "CS", "LO", "LT", "PN", "SH", "ST", "UC", "UR", "UT":
+		return true
+	}
+	return false
+}
+
+func wildcardRegexp(pattern string, caseInsensitive bool) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	if caseInsensitive {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// normalizeDateTime strips the separators that old ACR-NEMA style values
+// carry ("1993.08.22", "08:30"), so values can be compared as strings.
+func normalizeDateTime(vr, s string) string {
+	s = strings.TrimSpace(s)
+	switch vr {
+	case "DA":
+		return strings.Replace(s, ".", "", -1)
+	case "TM":
+		return strings.Replace(s, ":", "", -1)
+	}
+	return s
+}
+
+// splitRange splits a range key of the form "from-to", "-to" or "from-"
+// into its ends, or returns false if "key" isn't a range. In DT, a "-" may
+// also start the UTC offset of either end, "&ZZXX" (P3.5, 6.2), so the range
+// separator is the "-" that doesn't.
+func splitRange(vr, key string) (string, string, bool) {
+	if vr != "DT" {
+		i := strings.IndexByte(key, '-')
+		if i < 0 {
+			return "", "", false
+		}
+		return key[:i], key[i+1:], true
+	}
+	offset := false
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '+':
+			offset = true
+		case key[i] != '-':
+		case !offset && isDTOffset(key, i):
+			offset = true
+		default:
+			return key[:i], key[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// isDTOffset reports whether the "-" at "i" in the DT key may start a UTC
+// offset: it follows a digit, and is followed by the four digits of a valid
+// offset, then the end of the key or the range separator.
+func isDTOffset(key string, i int) bool {
+	if i == 0 || !isDigits(key[i-1:i]) {
+		return false
+	}
+	if i+5 > len(key) || !isDigits(key[i+1:i+5]) || (i+5 < len(key) && key[i+5] != '-') {
+		return false
+	}
+	return key[i+1:i+3] <= "14" && key[i+3:i+5] <= "59"
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// dtWithoutOffset strips the UTC offset of a DT value, if any.
+func dtWithoutOffset(s string) string {
+	if n := len(s) - 5; n > 0 && (s[n] == '+' || s[n] == '-') && isDigits(s[n+1:]) {
+		return s[:n]
+	}
+	return s
+}
+
+// rangeMatcher implements range matching between "from" and "to", either of
+// which may be empty for an open-ended range. Both ends are inclusive.
+// P3.4, C.2.2.2.5.
+//
+// DA, TM and DT values are fixed-order digit strings, so they compare as
+// strings once the shorter side is padded: a lower bound "0800" becomes
+// "080000..." and an upper bound "1200" becomes "120099...". DT values are
+// compared without their UTC offsets, in the time of their own zones.
+func rangeMatcher(vr, from, to string) func(string) bool {
+	from = normalizeDateTime(vr, from)
+	to = normalizeDateTime(vr, to)
+	if vr == "DT" {
+		from, to = dtWithoutOffset(from), dtWithoutOffset(to)
+	}
+	return func(value string) bool {
+		value = normalizeDateTime(vr, value)
+		if vr == "DT" {
+			value = dtWithoutOffset(value)
+		}
+		if from != "" && value < padRight(from, len(value), '0') {
+			return false
+		}
+		if to != "" && value > padRight(to, len(value), '9') {
+			return false
+		}
+		return true
+	}
+}
+
+func padRight(s string, n int, c byte) string {
+	if len(s) >= n {
+		return s
+	}
+	return s + strings.Repeat(string(c), n-len(s))
+}
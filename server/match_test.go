@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+func TestSplitRange(t *testing.T) {
+	for _, test := range []struct {
+		vr, key  string
+		from, to string
+		ok       bool
+	}{
+		{"DA", "20200101-20201231", "20200101", "20201231", true},
+		{"DA", "20200101-", "20200101", "", true},
+		{"DA", "-20201231", "", "20201231", true},
+		{"DA", "20200101", "", "", false},
+		{"TM", "0800-1200", "0800", "1200", true},
+		{"TM", "0800-", "0800", "", true},
+		{"TM", "-1200", "", "1200", true},
+		{"DT", "20200101120000-20200102", "20200101120000", "20200102", true},
+		{"DT", "20200101120000-0500-20200102", "20200101120000-0500", "20200102", true},
+		{"DT", "20200101120000+0100-20200102120000-0500", "20200101120000+0100", "20200102120000-0500", true},
+		{"DT", "20200101120000-0500-20200102120000-0500", "20200101120000-0500", "20200102120000-0500", true},
+		{"DT", "20200101120000-0500-", "20200101120000-0500", "", true},
+		{"DT", "-20200102120000-0500", "", "20200102120000-0500", true},
+		{"DT", "2019-2020", "2019", "2020", true},
+		{"DT", "20200101120000-0500", "", "", false},
+		{"DT", "20200101", "", "", false},
+	} {
+		from, to, ok := splitRange(test.vr, test.key)
+		if from != test.from || to != test.to || ok != test.ok {
+			t.Errorf("splitRange(%s, %q) = %q, %q, %v, want %q, %q, %v",
+				test.vr, test.key, from, to, ok, test.from, test.to, test.ok)
+		}
+	}
+}
+
+func TestMatchDateTime(t *testing.T) {
+	for _, test := range []struct {
+		tag   dicomtag.Tag
+		key   string
+		value string
+		want  bool
+	}{
+		{dicomtag.StudyDate, "20200101", "20200101", true},
+		{dicomtag.StudyDate, "20200101", "2020.01.01", true},
+		{dicomtag.StudyDate, "20200101", "20200102", false},
+		{dicomtag.StudyDate, "20200101-20200131", "20200115", true},
+		{dicomtag.StudyDate, "20200101-20200131", "20200131", true},
+		{dicomtag.StudyDate, "20200101-20200131", "20200201", false},
+		{dicomtag.StudyDate, "20200101-", "20991231", true},
+		{dicomtag.StudyDate, "20200101-", "20191231", false},
+		{dicomtag.StudyDate, "-20200101", "19700101", true},
+		{dicomtag.StudyDate, "-20200101", "20200102", false},
+		{dicomtag.StudyTime, "0800-1200", "083015", true},
+		{dicomtag.StudyTime, "0800-1200", "120059", true},
+		{dicomtag.StudyTime, "0800-1200", "1201", false},
+		{dicomtag.StudyTime, "0800-", "2359", true},
+		{dicomtag.StudyTime, "-0800", "0800", true},
+		{dicomtag.StudyTime, "-0800", "0801", false},
+		{dicomtag.StudyTime, "08:00-12:00", "10:30", true},
+		{dicomtag.AcquisitionDateTime, "20200101120000-0500-20200102", "20200101150000", true},
+		{dicomtag.AcquisitionDateTime, "20200101120000-0500-20200102", "20200102235959-0500", true},
+		{dicomtag.AcquisitionDateTime, "20200101120000-0500-20200102", "20200101115959", false},
+		{dicomtag.AcquisitionDateTime, "20200101120000-0500-20200102", "20200103", false},
+		{dicomtag.AcquisitionDateTime, "20200101-", "20210101000000+0100", true},
+		{dicomtag.AcquisitionDateTime, "-20200101", "20200102", false},
+		{dicomtag.AcquisitionDateTime, "20200101120000-0500", "20200101120000-0500", true},
+	} {
+		key := dicom.MustNewElement(test.tag, test.key)
+		ds := &dicom.DataSet{Elements: []*dicom.Element{dicom.MustNewElement(test.tag, test.value)}}
+		got, _, err := matchElement(ds, key)
+		if err != nil {
+			t.Errorf("matchElement(%s %q, %q): %v", key.VR, test.key, test.value, err)
+		} else if got != test.want {
+			t.Errorf("matchElement(%s %q, %q) = %v, want %v", key.VR, test.key, test.value, got, test.want)
+		}
+	}
+}
+
+// item returns an Item of a sequence holding "elems".
+func item(elems ...*dicom.Element) *dicom.Element {
+	values := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		values[i] = elem
+	}
+	return dicom.MustNewElement(dicomtag.Item, values...)
+}
+
+func TestMatchSequence(t *testing.T) {
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence,
+			item(
+				dicom.MustNewElement(dicomtag.Modality, "CT"),
+				dicom.MustNewElement(dicomtag.ScheduledStationAETitle, "CT01"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, "20200101"),
+			),
+			item(
+				dicom.MustNewElement(dicomtag.Modality, "MR"),
+				dicom.MustNewElement(dicomtag.ScheduledStationAETitle, "MR01"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, "20200201"),
+			),
+		),
+	}}
+	for _, test := range []struct {
+		name string
+		keys []*dicom.Element
+		want []string // Modality of the items returned.
+		ok   bool
+	}{
+		{"universal", nil, []string{"CT", "MR"}, true},
+		{"one item", []*dicom.Element{dicom.MustNewElement(dicomtag.Modality, "MR")}, []string{"MR"}, true},
+		{"wildcard", []*dicom.Element{
+			dicom.MustNewElement(dicomtag.Modality, ""),
+			dicom.MustNewElement(dicomtag.ScheduledStationAETitle, "*01"),
+		}, []string{"CT", "MR"}, true},
+		{"range", []*dicom.Element{
+			dicom.MustNewElement(dicomtag.Modality, ""),
+			dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, "20200115-"),
+		}, []string{"MR"}, true},
+		{"all keys of an item", []*dicom.Element{
+			dicom.MustNewElement(dicomtag.Modality, "CT"),
+			dicom.MustNewElement(dicomtag.ScheduledStationAETitle, "MR01"),
+		}, nil, false},
+		{"no item", []*dicom.Element{dicom.MustNewElement(dicomtag.Modality, "US")}, nil, false},
+	} {
+		var key *dicom.Element
+		if test.keys == nil {
+			key = dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence)
+		} else {
+			key = dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, item(test.keys...))
+		}
+		ok, elem, err := matchElement(ds, key)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%s: matched %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var got []string
+		for _, itemDS := range sequenceItems(elem) {
+			modality, err := itemDS.FindElementByTag(dicomtag.Modality)
+			if err != nil {
+				t.Errorf("%s: item without Modality", test.name)
+				continue
+			}
+			got = append(got, modality.MustGetString())
+			if test.keys != nil && len(itemDS.Elements) != len(test.keys) {
+				t.Errorf("%s: item of %d elements, want the %d requested", test.name, len(itemDS.Elements), len(test.keys))
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got items %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got items %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+
+	// Only universal keys match a dataset without the sequence.
+	empty := &dicom.DataSet{}
+	key := dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, item(dicom.MustNewElement(dicomtag.Modality, "")))
+	if ok, _, _ := matchElement(empty, key); !ok {
+		t.Errorf("universal keys don't match a dataset without the sequence")
+	}
+	key = dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, item(dicom.MustNewElement(dicomtag.Modality, "CT")))
+	if ok, _, _ := matchElement(empty, key); ok {
+		t.Errorf("a key matches a dataset without the sequence")
+	}
+
+	// A key of several items is refused.
+	key = dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence,
+		item(dicom.MustNewElement(dicomtag.Modality, "CT")),
+		item(dicom.MustNewElement(dicomtag.Modality, "MR")))
+	if _, _, err := matchElement(ds, key); err == nil {
+		t.Errorf("a key of several items is accepted")
+	}
+}
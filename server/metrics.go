@@ -0,0 +1,214 @@
+package main
+
+// This file counts what the honeypot sees, for monitoring systems: the
+// connections and associations, the DIMSE requests by command, the
+// associations rejected, the bytes exchanged, the hits by country and how
+// long the connections last. -metrics serves them at /metrics, in the
+// Prometheus text format, along with the health endpoints.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// metricDef describes a metric.
+type metricDef struct {
+	name string
+	help string
+	// The name of its label, if it has one.
+	label     string
+	histogram bool
+}
+
+// The metrics, in the order they are served.
+var metricDefs = []metricDef{
+	{name: "events_total", help: "Events recorded, by type.", label: "type"},
+	{name: "connections_total", help: "Connections accepted, by port.", label: "port"},
+	{name: "associations_total", help: "A-ASSOCIATE requests received, by port.", label: "port"},
+	{name: "association_rejects_total", help: "Associations rejected, by port.", label: "port"},
+	{name: "commands_total", help: "DIMSE requests received, by command.", label: "command"},
+	{name: "objects_stored_total", help: "Objects quarantined, from C-STORE and STOW-RS."},
+	{name: "http_requests_total", help: "DICOMweb and WADO-URI requests, by method.", label: "method"},
+	{name: "hits_total", help: "Connections and HTTP requests, by country of the source (with -geoip).", label: "country"},
+	{name: "bytes_received_total", help: "Bytes received on the DICOM connections closed."},
+	{name: "bytes_sent_total", help: "Bytes sent on the DICOM connections closed."},
+	{name: "session_duration_seconds", help: "How long the DICOM connections lasted.", histogram: true},
+}
+
+// The upper bounds of the buckets of the histograms, in seconds.
+var metricBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// metricSample is what an event adds to a metric: "n" to a counter, or an
+// observation of a histogram.
+type metricSample struct {
+	name       string
+	labelValue string
+	n          float64
+}
+
+// isDIMSERequest returns whether "event" reports the receipt of a DIMSE
+// request, once per request.
+func isDIMSERequest(event dicompot.Event) bool {
+	switch {
+	case event.Message == "Received":
+		return true
+	case event.Type == dicompot.EventCStore:
+		return event.Message == "C-STORE received"
+	case event.Type == dicompot.EventCCancel:
+		return true
+	}
+	return false
+}
+
+// metricSamples returns what "event" adds to the metrics.
+func metricSamples(event dicompot.Event) []metricSample {
+	samples := []metricSample{{"events_total", event.Type, 1}}
+	port := strconv.Itoa(event.LocalPort)
+	country := stringField(event, "GeoCountry")
+	if country == "" {
+		country = "unknown"
+	}
+	switch event.Type {
+	case dicompot.EventConnectionOpened:
+		samples = append(samples, metricSample{"connections_total", port, 1}, metricSample{"hits_total", country, 1})
+	case dicompot.EventAssociationRequest:
+		samples = append(samples, metricSample{"associations_total", port, 1})
+	case dicompot.EventAssociationRejected:
+		samples = append(samples, metricSample{"association_rejects_total", port, 1})
+	case dicompot.EventHTTPRequest:
+		samples = append(samples, metricSample{"http_requests_total", stringField(event, "Method"), 1}, metricSample{"hits_total", country, 1})
+	case dicompot.EventCStore, dicompot.EventSTOW:
+		if stringField(event, "SHA256") != "" {
+			samples = append(samples, metricSample{"objects_stored_total", "", 1})
+		}
+	case dicompot.EventConnectionClosed:
+		if n, ok := event.Fields["BytesReceived"].(int64); ok {
+			samples = append(samples, metricSample{"bytes_received_total", "", float64(n)})
+		}
+		if n, ok := event.Fields["BytesSent"].(int64); ok {
+			samples = append(samples, metricSample{"bytes_sent_total", "", float64(n)})
+		}
+		if d, err := time.ParseDuration(stringField(event, "Duration")); err == nil {
+			samples = append(samples, metricSample{"session_duration_seconds", "", d.Seconds()})
+		}
+	}
+	if event.Command != "" && isDIMSERequest(event) {
+		samples = append(samples, metricSample{"commands_total", event.Command, 1})
+	}
+	return samples
+}
+
+// histogram is the state of a histogram.
+type histogram struct {
+	// The observations in each bucket, the last one being +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metrics is an EventSink that keeps the metrics, and the http.Handler
+// that serves them.
+type metrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]*histogram
+}
+
+// newMetrics returns the sink for -metrics, serving the metrics on "addr",
+// or nil if they aren't.
+func newMetrics(addr string) *metrics {
+	if addr == "" {
+		return nil
+	}
+	m := &metrics{counters: map[string]map[string]float64{}, histograms: map[string]*histogram{}}
+	for _, def := range metricDefs {
+		if def.histogram {
+			m.histograms[def.name] = &histogram{counts: make([]uint64, len(metricBuckets)+1)}
+		} else {
+			m.counters[def.name] = map[string]float64{}
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	handleHealth(mux)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Fatal(srv.ListenAndServe())
+	}()
+	log.Printf("-| Metrics served on: http://%s/metrics", addr)
+	return m
+}
+
+// Record adds the event to the metrics.
+func (m *metrics) Record(event dicompot.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range metricSamples(event) {
+		if h, ok := m.histograms[s.name]; ok {
+			i := sort.SearchFloat64s(metricBuckets, s.n)
+			h.counts[i]++
+			h.sum += s.n
+			h.count++
+			continue
+		}
+		m.counters[s.name][s.labelValue] += s.n
+	}
+	return nil
+}
+
+func (m *metrics) Close() error {
+	return nil
+}
+
+// escapeLabel escapes a label value of the text format.
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ServeHTTP serves the metrics in the text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	m.mu.Lock()
+	for _, def := range metricDefs {
+		name := "dicompot_" + def.name
+		if def.histogram {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", name, def.help, name)
+			h := m.histograms[def.name]
+			var cumulative uint64
+			for i, le := range metricBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+			fmt.Fprintf(&b, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, def.help, name)
+		values := m.counters[def.name]
+		if def.label == "" {
+			fmt.Fprintf(&b, "%s %s\n", name, formatFloat(values[""]))
+			continue
+		}
+		var keys []string
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s{%s=\"%s\"} %s\n", name, def.label, escapeLabel.Replace(k), formatFloat(values[k]))
+		}
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,243 @@
+package main
+
+// This file shares what the sources do with a MISP instance. Each source
+// gets a MISP event a day, created once it does more than connect, with the
+// attributes seen since: its IP address, the calling AE titles it used, the
+// patient names it queried and the hashes of the objects it stored. The
+// events are found again by their info after a restart, and MISP rejects
+// the attributes it has already.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// mispAttribute is an attribute of a MISP event.
+type mispAttribute struct {
+	Type     string `json:"type"`
+	Category string `json:"category"`
+	Value    string `json:"value"`
+	ToIDS    bool   `json:"to_ids"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// misp is a MISP client.
+type misp struct {
+	url          string
+	key          string
+	distribution int
+	tag          string
+	client       *http.Client
+
+	// Only used from the goroutine of the queuedSink.
+	// The MISP events by their info.
+	events map[string]string
+	// The attributes added, by info then type and value.
+	added map[string]map[string]bool
+}
+
+// newMISPSink returns the sink for -misp and friends, or nil if nothing is
+// shared.
+func newMISPSink(rawURL, key string, distribution int, tag, caFile string) dicompot.EventSink {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid -misp %q, want https://host", rawURL)
+	}
+	if key == "" {
+		log.Fatalf("-misp needs -mispkey")
+	}
+	if distribution < 0 || distribution > 3 {
+		log.Fatalf("Invalid -mispdistribution %d, want 0 (organization) to 3 (all communities)", distribution)
+	}
+	m := &misp{
+		url:          strings.TrimRight(rawURL, "/"),
+		key:          key,
+		distribution: distribution,
+		tag:          tag,
+		client:       newHTTPClient("mispcafile", caFile),
+		events:       map[string]string{},
+		added:        map[string]map[string]bool{},
+	}
+	log.Printf("-| Sharing sources with MISP: %s, distribution %d", m.url, distribution)
+	return newQueuedSink("MISP", 100, 5*time.Second, m.share)
+}
+
+// mispAttributes returns the attributes "event" shows, besides the IP
+// address of its source.
+func mispAttributes(event dicompot.Event) []mispAttribute {
+	var attrs []mispAttribute
+	if event.Type == dicompot.EventAssociationRequest && event.CallingAETitle != "" {
+		attrs = append(attrs, mispAttribute{Type: "text", Category: "Network activity", Value: event.CallingAETitle, Comment: "Calling AE title"})
+	}
+	for _, qe := range event.Query {
+		if qe.Keyword != "PatientName" {
+			continue
+		}
+		for _, v := range qe.Values {
+			if strings.Trim(v, "*?^ ") != "" {
+				attrs = append(attrs, mispAttribute{Type: "text", Category: "Other", Value: v, Comment: "Patient name queried"})
+			}
+		}
+	}
+	if sha256 := stringField(event, "SHA256"); sha256 != "" {
+		attrs = append(attrs, mispAttribute{Type: "sha256", Category: "Payload delivery", Value: sha256, ToIDS: true,
+			Comment: "Object stored, SOP Class " + stringField(event, "SOPClassUID")})
+	}
+	if md5 := stringField(event, "MD5"); md5 != "" {
+		attrs = append(attrs, mispAttribute{Type: "md5", Category: "Payload delivery", Value: md5, ToIDS: true})
+	}
+	return attrs
+}
+
+// request sends a request to the API, and decodes the JSON response into
+// "out", if not nil.
+func (m *misp) request(method, path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, m.url+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", m.key)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &mispError{status: resp.StatusCode, msg: fmt.Sprintf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))}
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type mispError struct {
+	status int
+	msg    string
+}
+
+func (e *mispError) Error() string {
+	return e.msg
+}
+
+// mispEvent is the part of a MISP event that matters.
+type mispEvent struct {
+	Event struct {
+		ID string `json:"id"`
+	} `json:"Event"`
+}
+
+// eventID returns the ID of the MISP event "info", which it creates unless
+// it exists.
+func (m *misp) eventID(info string) (string, error) {
+	if id, ok := m.events[info]; ok {
+		return id, nil
+	}
+	var found struct {
+		Response []mispEvent `json:"response"`
+	}
+	err := m.request("POST", "/events/restSearch", map[string]interface{}{
+		"returnFormat": "json",
+		"eventinfo":    info,
+		"metadata":     true,
+	}, &found)
+	if err != nil {
+		return "", err
+	}
+	if len(found.Response) > 0 && found.Response[0].Event.ID != "" {
+		m.events[info] = found.Response[0].Event.ID
+		return m.events[info], nil
+	}
+	event := map[string]interface{}{
+		"info":            info,
+		"distribution":    m.distribution,
+		"threat_level_id": 2,
+		"analysis":        1,
+		"date":            time.Now().UTC().Format("2006-01-02"),
+	}
+	if m.tag != "" {
+		event["Tag"] = []map[string]string{{"name": m.tag}}
+	}
+	var created mispEvent
+	if err := m.request("POST", "/events/add", map[string]interface{}{"Event": event}, &created); err != nil {
+		return "", err
+	}
+	if created.Event.ID == "" {
+		return "", fmt.Errorf("no ID in the event created")
+	}
+	m.events[info] = created.Event.ID
+	return created.Event.ID, nil
+}
+
+// add adds "attr" to the MISP event "info", unless it was already.
+func (m *misp) add(info string, attr mispAttribute) error {
+	key := attr.Type + "|" + attr.Value
+	if m.added[info][key] {
+		return nil
+	}
+	id, err := m.eventID(info)
+	if err != nil {
+		return err
+	}
+	err = m.request("POST", "/attributes/add/"+url.PathEscape(id), attr, nil)
+	if e, ok := err.(*mispError); ok && e.status == http.StatusForbidden && strings.Contains(e.msg, "already exists") {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if m.added[info] == nil {
+		m.added[info] = map[string]bool{}
+	}
+	m.added[info][key] = true
+	return nil
+}
+
+// share adds the attributes of the events to the MISP events of their
+// sources.
+func (m *misp) share(events []dicompot.Event) error {
+	for _, event := range events {
+		attrs := mispAttributes(event)
+		ip := sourceIP(event)
+		if len(attrs) == 0 || ip == nil {
+			continue
+		}
+		info := fmt.Sprintf("dicompot: DICOM honeypot activity from %s on %s", ip, event.Time.UTC().Format("2006-01-02"))
+		attrs = append([]mispAttribute{{Type: "ip-src", Category: "Network activity", Value: ip.String(), ToIDS: true}}, attrs...)
+		for _, attr := range attrs {
+			if err := m.add(info, attr); err != nil {
+				return err
+			}
+		}
+	}
+	// Only today's events are added to.
+	today := "on " + time.Now().UTC().Format("2006-01-02")
+	for info := range m.events {
+		if !strings.HasSuffix(info, today) {
+			delete(m.events, info)
+			delete(m.added, info)
+		}
+	}
+	return nil
+}
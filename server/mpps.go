@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// Modality Performed Procedure Step SOP Class. P3.4, F.7.
+const mppsSOPClassUID = "1.2.840.10008.3.1.2.3.3"
+
+// The most steps mpps keeps; the oldest are forgotten beyond that, so peers
+// can't exhaust the memory with UIDs of their choosing.
+const mppsMaxSteps = 10000
+
+// mpps keeps just enough state about the performed procedure steps created
+// by peers to answer N-CREATE and N-SET like a real MPPS SCP would. Steps
+// are kept in memory only, mppsMaxSteps of them at most.
+type mpps struct {
+	mu    sync.Mutex
+	steps map[string]string // SOP instance UID -> PerformedProcedureStepStatus
+	order []string          // The UIDs of steps, oldest first.
+	seq   int64             // Used to assign UIDs. Accessed atomically.
+}
+
+func newMPPS() *mpps {
+	return &mpps{steps: map[string]string{}}
+}
+
+func stepStatus(attrs []*dicom.Element) string {
+	for _, elem := range attrs {
+		if elem.Tag == dicomtag.PerformedProcedureStepStatus {
+			s, _ := elem.GetString()
+			return strings.TrimSpace(s)
+		}
+	}
+	return ""
+}
+
+func (m *mpps) onNCreate(sopClassUID, sopInstanceUID string, attrs []*dicom.Element) (string, dimse.Status) {
+	if sopClassUID != mppsSOPClassUID {
+		return sopInstanceUID, dimse.Status{Status: dimse.StatusSOPClassNotSupported}
+	}
+	if sopInstanceUID == "" {
+		sopInstanceUID = fmt.Sprintf("1.2.826.0.1.3680043.9.7133.4.%d.%d", time.Now().Unix(), atomic.AddInt64(&m.seq, 1))
+	}
+	status := stepStatus(attrs)
+	if status == "" {
+		status = "IN PROGRESS"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.steps[sopInstanceUID]; ok {
+		return sopInstanceUID, dimse.Status{Status: dimse.StatusDuplicateSOPInstance}
+	}
+	if len(m.order) >= mppsMaxSteps {
+		delete(m.steps, m.order[0])
+		m.order = m.order[1:]
+	}
+	m.steps[sopInstanceUID] = status
+	m.order = append(m.order, sopInstanceUID)
+	return sopInstanceUID, dimse.Success
+}
+
+func (m *mpps) onNSet(sopClassUID, sopInstanceUID string, attrs []*dicom.Element) dimse.Status {
+	if sopClassUID != mppsSOPClassUID {
+		return dimse.Status{Status: dimse.StatusSOPClassNotSupported}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.steps[sopInstanceUID]
+	if !ok {
+		return dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+	}
+	// Once completed or discontinued, a step is final. P3.4, F.7.2.2.
+	if current == "COMPLETED" || current == "DISCONTINUED" {
+		return dimse.Status{Status: dimse.MPPSNoLongerUpdatable}
+	}
+	if status := stepStatus(attrs); status != "" {
+		m.steps[sopInstanceUID] = status
+	}
+	return dimse.Success
+}
@@ -0,0 +1,248 @@
+package main
+
+// This file publishes the events to an MQTT broker, for deployments where
+// sensors report over lightweight brokers, as IoT devices do. Events go to
+// a topic per event type, e.g., dicompot/c-store. The protocol is MQTT
+// 3.1.1 (https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html).
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// MQTT packet types, in the high nibble of the first byte.
+const (
+	mqttConnect = 1
+	mqttConnack = 2
+	mqttPublish = 3
+	mqttPuback  = 4
+	mqttPubrec  = 5
+	mqttPubrel  = 6
+	mqttPubcomp = 7
+)
+
+// mqtt is an MQTT publisher.
+type mqtt struct {
+	addr           string
+	tls            *tls.Config
+	user, password string
+	clientID       string
+	prefix         string
+	qos            byte
+
+	// Only used from the goroutine of the queuedSink.
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+// newMQTTSink returns the sink for -mqtt and friends, or nil if events aren't
+// published. "rawURL" is mqtt://[user:password@]host:port, or mqtts:// for
+// TLS.
+func newMQTTSink(rawURL, prefix string, qos int, clientID string) dicompot.EventSink {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Host == "" {
+		log.Fatalf("Invalid -mqtt %q, want mqtt://[user:password@]host:port", rawURL)
+	}
+	if qos < 0 || qos > 2 {
+		log.Fatalf("Invalid -mqttqos %d, want 0, 1 or 2", qos)
+	}
+	if prefix == "" || strings.ContainsAny(prefix, "#+") {
+		log.Fatalf("Invalid -mqtttopic %q, want, e.g., dicompot", prefix)
+	}
+	m := &mqtt{addr: u.Host, prefix: strings.TrimRight(prefix, "/"), qos: byte(qos), clientID: clientID}
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		m.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "mqtts" {
+		m.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		m.user = u.User.Username()
+		m.password, _ = u.User.Password()
+	}
+	if m.clientID == "" {
+		hostname, _ := os.Hostname()
+		m.clientID = fmt.Sprintf("dicompot-%s-%d", hostname, os.Getpid())
+	}
+	log.Printf("-| Publishing events to MQTT: %s, topics %s/<event type>, QoS %d", m.addr, m.prefix, qos)
+	return newQueuedSink("MQTT", 100, 0, m.publish)
+}
+
+// mqttString returns "s" prefixed with its length.
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket returns a packet of type "kind" and flags "flags".
+func mqttPacket(kind, flags byte, body []byte) []byte {
+	packet := []byte{kind<<4 | flags}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// readPacket returns the type and body of the next packet from the broker.
+func (m *mqtt) readPacket() (byte, []byte, error) {
+	header, err := m.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, uint(0)
+	for {
+		b, err := m.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, fmt.Errorf("invalid packet length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(m.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// The reasons a broker refuses a connection, by CONNACK return code.
+var mqttRefusals = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// connect connects to the broker, with a clean session and no keep alive.
+func (m *mqtt) connect() error {
+	conn, err := net.DialTimeout("tcp", m.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if m.tls != nil {
+		conn = tls.Client(conn, m.tls)
+	}
+	m.conn, m.r = conn, bufio.NewReader(conn)
+	flags := byte(0x02) // Clean session
+	payload := mqttString(m.clientID)
+	if m.user != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(m.user)...)
+		if m.password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(m.password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(mqttPacket(mqttConnect, 0, append(body, payload...)))
+	var kind byte
+	if err == nil {
+		kind, body, err = m.readPacket()
+	}
+	if err == nil && (kind != mqttConnack || len(body) != 2) {
+		err = fmt.Errorf("expected CONNACK, got packet type %d", kind)
+	}
+	if err == nil && body[1] != 0 {
+		err = fmt.Errorf("connection refused: %s", mqttRefusals[body[1]])
+	}
+	if err != nil {
+		m.close()
+	}
+	return err
+}
+
+func (m *mqtt) close() {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn, m.r = nil, nil
+	}
+}
+
+// publish publishes every event, in JSON, to the topic of its type. With QoS
+// 1 and 2, it waits for the broker to have them all.
+func (m *mqtt) publish(events []dicompot.Event) error {
+	if m.conn == nil {
+		if err := m.connect(); err != nil {
+			return err
+		}
+	}
+	var buf []byte
+	pending := map[uint16]bool{}
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		body := mqttString(m.prefix + "/" + event.Type)
+		if m.qos > 0 {
+			if m.packetID++; m.packetID == 0 {
+				m.packetID = 1
+			}
+			pending[m.packetID] = true
+			body = append(body, byte(m.packetID>>8), byte(m.packetID))
+		}
+		buf = append(buf, mqttPacket(mqttPublish, m.qos<<1, append(body, payload...))...)
+	}
+	m.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := m.conn.Write(buf); err != nil {
+		m.close()
+		return err
+	}
+	for len(pending) > 0 {
+		kind, body, err := m.readPacket()
+		if err == nil && len(body) < 2 {
+			err = fmt.Errorf("invalid packet type %d", kind)
+		}
+		if err != nil {
+			m.close()
+			return err
+		}
+		id := binary.BigEndian.Uint16(body)
+		switch kind {
+		case mqttPuback, mqttPubcomp:
+			delete(pending, id)
+		case mqttPubrec:
+			if _, err := m.conn.Write(mqttPacket(mqttPubrel, 0x02, body[:2])); err != nil {
+				m.close()
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+// This file publishes the events to NATS, for cloud-native pipelines. Events
+// go to a subject per event type, e.g., dicompot.events.c-store. With
+// JetStream, every event is acknowledged by the stream that captures the
+// subject, and sent again otherwise: delivery is at least once. The protocol
+// is that of https://docs.nats.io/reference/reference-protocols/nats-protocol.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// nats is a NATS publisher.
+type nats struct {
+	addr                  string
+	useTLS                bool
+	serverName            string
+	user, password, token string
+	prefix                string
+	jetStream             bool
+
+	// Only used from the goroutine of the queuedSink.
+	conn  net.Conn
+	r     *bufio.Reader
+	inbox string
+	// The number of the last reply subject, for late acknowledgements
+	// not to be taken for those of the batch.
+	replies int
+}
+
+// newNATSSink returns the sink for -nats and friends, or nil if events aren't
+// published. "rawURL" is nats://[user:password@]host:port, nats://token@...,
+// or tls:// for TLS.
+func newNATSSink(rawURL, prefix string, jetStream bool) dicompot.EventSink {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		log.Fatalf("Invalid -nats %q, want nats://[user:password@]host:port", rawURL)
+	}
+	if prefix == "" || strings.ContainsAny(prefix, "*> \t") {
+		log.Fatalf("Invalid -natssubject %q, want, e.g., dicompot.events", prefix)
+	}
+	n := &nats{addr: u.Host, useTLS: u.Scheme == "tls", serverName: u.Hostname(), prefix: strings.TrimRight(prefix, "."), jetStream: jetStream}
+	if u.Port() == "" {
+		n.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			n.user, n.password = u.User.Username(), password
+		} else {
+			n.token = u.User.Username()
+		}
+	}
+	mode := "core NATS"
+	if jetStream {
+		mode = "JetStream"
+	}
+	log.Printf("-| Publishing events to NATS: %s, subjects %s.<event type>, %s", n.addr, n.prefix, mode)
+	return newQueuedSink("NATS", 500, 0, n.publish)
+}
+
+// natsInfo is the part of the INFO of the server that matters.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+// connect connects, upgrading to TLS if either side wants it, and
+// subscribes to the inbox of the acknowledgements of JetStream.
+func (n *nats) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	n.conn, n.r = conn, bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := n.r.ReadString('\n')
+	var info natsInfo
+	if err == nil && !strings.HasPrefix(line, "INFO ") {
+		err = fmt.Errorf("expected INFO, got %q", strings.TrimSpace(line))
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(line[5:]), &info)
+	}
+	if err != nil {
+		n.close()
+		return err
+	}
+	if n.useTLS || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: n.serverName})
+		if err := tlsConn.Handshake(); err != nil {
+			n.close()
+			return err
+		}
+		n.conn, n.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": n.useTLS || info.TLSRequired,
+		"name":         "dicompot",
+		"lang":         "go",
+		"version":      siemVersion,
+		"protocol":     1,
+		"user":         n.user,
+		"pass":         n.password,
+		"auth_token":   n.token,
+		// For a status to come back at once if no stream captures
+		// the subject.
+		"headers":       info.Headers,
+		"no_responders": info.Headers,
+	})
+	cmd := "CONNECT " + string(connect) + "\r\n"
+	if n.jetStream {
+		var id [8]byte
+		rand.Read(id[:])
+		n.inbox = "_INBOX." + hex.EncodeToString(id[:])
+		cmd += "SUB " + n.inbox + ".* 1\r\n"
+	}
+	if _, err := io.WriteString(n.conn, cmd); err != nil {
+		n.close()
+		return err
+	}
+	// The server answers the PING once it took the CONNECT, or says why it
+	// didn't.
+	if err := n.flush(); err != nil {
+		n.close()
+		return err
+	}
+	return nil
+}
+
+func (n *nats) close() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn, n.r = nil, nil
+	}
+}
+
+// flush sends a PING and waits for the PONG, failing on any error the
+// server reports first.
+func (n *nats) flush() error {
+	if _, err := io.WriteString(n.conn, "PING\r\n"); err != nil {
+		return err
+	}
+	for {
+		line, _, err := n.read()
+		if err != nil {
+			return err
+		}
+		if line == "PONG" {
+			return nil
+		}
+	}
+}
+
+// read returns the next protocol line, and its payload for a MSG or HMSG,
+// after answering a PING of the server. -ERR is an error.
+func (n *nats) read() (string, []byte, error) {
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			if _, err := io.WriteString(n.conn, "PONG\r\n"); err != nil {
+				return "", nil, err
+			}
+			continue
+		case line == "+OK", strings.HasPrefix(line, "INFO "):
+			continue
+		case strings.HasPrefix(line, "-ERR"):
+			return "", nil, fmt.Errorf("%s", strings.Trim(strings.TrimPrefix(line, "-ERR"), " '"))
+		case strings.HasPrefix(line, "MSG "), strings.HasPrefix(line, "HMSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>, HMSG with the
+			// headers in the bytes.
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return "", nil, fmt.Errorf("invalid %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(n.r, payload); err != nil {
+				return "", nil, err
+			}
+			return line, payload[:size], nil
+		}
+		return line, nil, nil
+	}
+}
+
+// natsAck is the acknowledgement of JetStream.
+type natsAck struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// publish publishes every event, in JSON, to the subject of its type. With
+// JetStream, each one waits for its acknowledgement; otherwise, the server
+// only confirms it took the batch.
+func (n *nats) publish(events []dicompot.Event) error {
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	var buf strings.Builder
+	pending := map[string]bool{}
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		subject := n.prefix + "." + event.Type
+		if n.jetStream {
+			n.replies++
+			reply := n.inbox + "." + strconv.Itoa(n.replies)
+			pending[reply] = true
+			fmt.Fprintf(&buf, "PUB %s %s %d\r\n%s\r\n", subject, reply, len(payload), payload)
+		} else {
+			fmt.Fprintf(&buf, "PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+		}
+	}
+	n.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.WriteString(n.conn, buf.String()); err != nil {
+		n.close()
+		return err
+	}
+	if !n.jetStream {
+		if err := n.flush(); err != nil {
+			n.close()
+			return err
+		}
+		return nil
+	}
+	for len(pending) > 0 {
+		line, payload, err := n.read()
+		if err != nil {
+			n.close()
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !pending[fields[1]] {
+			continue
+		}
+		delete(pending, fields[1])
+		var ack natsAck
+		if fields[0] == "HMSG" || json.Unmarshal(payload, &ack) != nil {
+			// The status of "no responders", when no stream captures
+			// the subject.
+			n.close()
+			return fmt.Errorf("no acknowledgement from JetStream for %s.*: %q", n.prefix, strings.TrimSpace(string(payload)))
+		}
+		if ack.Error != nil {
+			n.close()
+			return fmt.Errorf("JetStream: %s (%d)", ack.Error.Description, ack.Error.Code)
+		}
+	}
+	return nil
+}
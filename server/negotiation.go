@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+// Short names accepted by -transfersyntaxes, in addition to UIDs.
+var transferSyntaxNames = map[string]string{
+	"implicit":          dicomuid.ImplicitVRLittleEndian,
+	"explicit":          dicomuid.ExplicitVRLittleEndian,
+	"big-endian":        dicomuid.ExplicitVRBigEndian,
+	"deflate":           dicomuid.DeflatedExplicitVRLittleEndian,
+	"jpeg-baseline":     "1.2.840.10008.1.2.4.50",
+	"jpeg-extended":     "1.2.840.10008.1.2.4.51",
+	"jpeg-lossless":     "1.2.840.10008.1.2.4.70",
+	"jpeg-ls":           "1.2.840.10008.1.2.4.80",
+	"jpeg-ls-near":      "1.2.840.10008.1.2.4.81",
+	"jpeg2000-lossless": "1.2.840.10008.1.2.4.90",
+	"jpeg2000":          "1.2.840.10008.1.2.4.91",
+	"rle":               "1.2.840.10008.1.2.5",
+}
+
+// parseTransferSyntaxes parses the value of -transfersyntaxes: ";"-separated
+// entries, each a comma-separated list of transfer syntaxes, most preferred
+// first, optionally prefixed by a SOP class UID and "=". An entry without
+// a SOP class applies to all the others. E.g.,
+// "explicit,implicit;1.2.840.10008.5.1.4.1.1.2=jpeg-lossless,explicit".
+// It returns nil for an empty value.
+func parseTransferSyntaxes(value string) map[string][]string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	syntaxes := map[string][]string{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var sopClassUID string
+		if i := strings.Index(entry, "="); i >= 0 {
+			sopClassUID, entry = strings.TrimSpace(entry[:i]), entry[i+1:]
+		}
+		var uids []string
+		for _, ts := range strings.Split(entry, ",") {
+			ts = strings.TrimSpace(ts)
+			if uid, ok := transferSyntaxNames[strings.ToLower(ts)]; ok {
+				ts = uid
+			}
+			if ts == "" || strings.Trim(ts, "0123456789.") != "" {
+				log.Fatalf("Invalid transfer syntax %q in -transfersyntaxes", ts)
+			}
+			uids = append(uids, ts)
+		}
+		syntaxes[sopClassUID] = uids
+	}
+	if _, ok := syntaxes[""]; !ok {
+		// Only some SOP classes are restricted; the others keep accepting
+		// the uncompressed syntaxes.
+		syntaxes[""] = []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian}
+	}
+	return syntaxes
+}
+
+// parseAsyncWindow parses the value of -asyncwindow, e.g., "0,1". It returns
+// nil for an empty value.
+func parseAsyncWindow(value string) *pdu.AsynchronousOperationsWindowSubItem {
+	if value == "" {
+		return nil
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		log.Fatalf("Invalid -asyncwindow %q, want invoked,performed", value)
+	}
+	var ops [2]uint16
+	for i, p := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil {
+			log.Fatalf("Invalid -asyncwindow %q: %v", value, err)
+		}
+		ops[i] = uint16(n)
+	}
+	return &pdu.AsynchronousOperationsWindowSubItem{MaxOpsInvoked: ops[0], MaxOpsPerformed: ops[1]}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+func TestParseTransferSyntaxes(t *testing.T) {
+	uncompressed := []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian}
+	for _, test := range []struct {
+		value string
+		want  map[string][]string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"implicit", map[string][]string{"": {dicomuid.ImplicitVRLittleEndian}}},
+		{"Explicit, IMPLICIT", map[string][]string{"": uncompressed}},
+		{"1.2.840.10008.1.2.4.70,explicit", map[string][]string{"": {"1.2.840.10008.1.2.4.70", dicomuid.ExplicitVRLittleEndian}}},
+		{"1.2.840.10008.5.1.4.1.1.2=jpeg-lossless,explicit", map[string][]string{
+			"1.2.840.10008.5.1.4.1.1.2": {"1.2.840.10008.1.2.4.70", dicomuid.ExplicitVRLittleEndian},
+			"":                          uncompressed,
+		}},
+		{"big-endian;1.2.840.10008.5.1.4.1.1.2 = rle;", map[string][]string{
+			"1.2.840.10008.5.1.4.1.1.2": {"1.2.840.10008.1.2.5"},
+			"":                          {dicomuid.ExplicitVRBigEndian},
+		}},
+	} {
+		if got := parseTransferSyntaxes(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseTransferSyntaxes(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseAsyncWindow(t *testing.T) {
+	if w := parseAsyncWindow(""); w != nil {
+		t.Errorf("parseAsyncWindow(\"\") = %v, want nil", w)
+	}
+	for value, want := range map[string][2]uint16{
+		"0,1":         {0, 1},
+		"1, 1":        {1, 1},
+		"65535,65535": {65535, 65535},
+	} {
+		w := parseAsyncWindow(value)
+		if w == nil || w.MaxOpsInvoked != want[0] || w.MaxOpsPerformed != want[1] {
+			t.Errorf("parseAsyncWindow(%q) = %v, want %v", value, w, want)
+		}
+	}
+}
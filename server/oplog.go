@@ -0,0 +1,100 @@
+package main
+
+// This file keeps the operational log, the startup messages and the
+// failures of the server, apart from the attack log, the events of the
+// attackers: what the server writes with the log package goes to
+// opLogger, on the standard error or to -oplog, with its own level and
+// format, while the events go to the console and to -log, as JSON, at
+// -loglevel. The startup messages, those starting with "-| ", are logged at
+// info, those of log.Fatal at fatal, of log.Panic at error, the others at
+// warning.
+
+import (
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// opLogger writes the operational log.
+var opLogger = logrus.New()
+
+// opLog is the file of -oplog, nil if the operational log goes to the
+// standard error.
+var opLog io.Writer
+
+// opLogWriter hands what the log package writes, a line at a time, to
+// opLogger.
+type opLogWriter struct{}
+
+func (opLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	level := logCallerLevel()
+	if level == logrus.WarnLevel && strings.HasPrefix(message, "-| ") {
+		level = logrus.InfoLevel
+	}
+	opLogger.Log(level, message)
+	return len(p), nil
+}
+
+// logCallerLevel returns the level of the function of the log package that
+// is writing: fatal for log.Fatal, which exits next, error for log.Panic,
+// which panics next, and warning for the others.
+func logCallerLevel() logrus.Level {
+	pc := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		switch {
+		case strings.HasPrefix(frame.Function, "log.Fatal"), strings.HasPrefix(frame.Function, "log.(*Logger).Fatal"):
+			return logrus.FatalLevel
+		case strings.HasPrefix(frame.Function, "log.Panic"), strings.HasPrefix(frame.Function, "log.(*Logger).Panic"):
+			return logrus.ErrorLevel
+		}
+		if !more {
+			return logrus.WarnLevel
+		}
+	}
+}
+
+// initOpLog sends the log package to opLogger, which writes to "path",
+// rotated as -log, or to the standard error if "", at "level" in "format".
+func initOpLog(path, level, format string) {
+	switch strings.ToLower(format) {
+	case "text":
+		opLogger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: logTimeFormat,
+		})
+	case "json":
+		opLogger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: logTimeFormat})
+	default:
+		log.Fatalf("Invalid -oplogformat %q, want text or json", format)
+	}
+	switch strings.ToLower(level) {
+	case "info":
+		opLogger.SetLevel(logrus.InfoLevel)
+	case "warning", "warn":
+		opLogger.SetLevel(logrus.WarnLevel)
+	default:
+		log.Fatalf("Invalid -oploglevel %q, want info or warning", level)
+	}
+	opLogger.SetOutput(os.Stderr)
+	if path != "" {
+		opLog = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    *logSizeFlag,
+			MaxBackups: *logBackupsFlag,
+			MaxAge:     *logAgeFlag,
+		}
+		opLogger.SetOutput(opLog)
+	}
+	opLogger.AddHook(timeZoneHook{})
+	// opLogger has the time.
+	log.SetFlags(0)
+	log.SetOutput(opLogWriter{})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestOpLogWriterLevels(t *testing.T) {
+	hook := test.NewLocal(opLogger)
+	defer opLogger.ReplaceHooks(make(logrus.LevelHooks))
+	l := log.New(opLogWriter{}, "", 0)
+
+	l.Printf("-| Listening on: %s", ":11112")
+	l.Printf("Failed to write: %s", "disk full")
+	func() {
+		defer func() { recover() }()
+		l.Panicf("Invalid state: %d", 42)
+	}()
+	for i, want := range []logrus.Level{logrus.InfoLevel, logrus.WarnLevel, logrus.ErrorLevel} {
+		if i >= len(hook.Entries) {
+			t.Fatalf("%d entries, want 3", len(hook.Entries))
+		}
+		if got := hook.Entries[i].Level; got != want {
+			t.Errorf("%q logged at %v, want %v", hook.Entries[i].Message, got, want)
+		}
+	}
+}
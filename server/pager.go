@@ -0,0 +1,259 @@
+package main
+
+// This file pages through PagerDuty or Opsgenie when the honeypot sees
+// something serious: images retrieved by a source that searched for them
+// first, which is how data theft goes, or the other event types of
+// -pagetypes, e.g., exploit attempts. The incidents of a source share a
+// deduplication key, so that the service groups them, and a source pages
+// again only after -pageinterval.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// The -pagetypes entry for retrievals after a search.
+	pageRetrievalAfterRecon = "retrieval-after-recon"
+	// How long a search counts as the reconnaissance of a retrieval.
+	reconWindow = 24 * time.Hour
+
+	pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+// pager is an EventSink that raises incidents.
+type pager struct {
+	types    map[string]bool
+	interval time.Duration
+	sink     *queuedSink
+
+	pagerDutyKey string
+	opsgenieKey  string
+	opsgenieURL  string
+	source       string
+	client       *http.Client
+
+	mu sync.Mutex
+	// When each source last searched.
+	recon map[string]time.Time
+	// When each source last paged.
+	paged map[string]time.Time
+}
+
+// newPager returns the sink for -pagerdutykey, -opsgeniekey and friends,
+// raising incidents for the comma-separated "types", or nil if none are.
+func newPager(pagerDutyKey, opsgenieKey, opsgenieURL, types string, interval time.Duration) *pager {
+	if pagerDutyKey == "" && opsgenieKey == "" {
+		return nil
+	}
+	p := &pager{
+		types:        map[string]bool{},
+		interval:     interval,
+		pagerDutyKey: pagerDutyKey,
+		opsgenieKey:  opsgenieKey,
+		opsgenieURL:  strings.TrimRight(opsgenieURL, "/") + "/v2/alerts",
+		source:       "dicompot",
+		client:       &http.Client{Timeout: 30 * time.Second},
+		recon:        map[string]time.Time{},
+		paged:        map[string]time.Time{},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		p.source = hostname
+	}
+	for _, t := range strings.Split(types, ",") {
+		p.types[strings.TrimSpace(t)] = true
+	}
+	p.sink = newQueuedSink("Pager", 10, time.Second, p.trigger)
+	log.Printf("-| Paging for %s", types)
+	return p
+}
+
+// isRecon returns whether "event" is a search. The terms of a C-MOVE or
+// C-GET are reported as c-find-query too.
+func isRecon(event dicompot.Event) bool {
+	return (event.Type == dicompot.EventCFindQuery && event.Command == "C-FIND") || event.Type == dicompot.EventQIDO
+}
+
+// isRetrieval returns whether "event" is about the retrieval of images.
+func isRetrieval(event dicompot.Event) bool {
+	switch event.Type {
+	case dicompot.EventCMove, dicompot.EventCGet:
+		return true
+	case dicompot.EventWADO:
+		n, _ := event.Fields["Matches"].(int)
+		return n > 0
+	}
+	return false
+}
+
+// Record queues an incident for the event if it pages, and its source
+// didn't lately.
+func (p *pager) Record(event dicompot.Event) error {
+	ip := sourceIP(event)
+	if ip == nil {
+		return nil
+	}
+	source := ip.String()
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isRecon(event) {
+		p.recon[source] = now
+		return nil
+	}
+	pages := p.types[event.Type] && event.Type != pageRetrievalAfterRecon
+	if !pages && p.types[pageRetrievalAfterRecon] && isRetrieval(event) {
+		last, ok := p.recon[source]
+		pages = ok && now.Sub(last) < reconWindow
+	}
+	if !pages {
+		return nil
+	}
+	if last, ok := p.paged[source]; ok && now.Sub(last) < p.interval {
+		return nil
+	}
+	p.paged[source] = now
+	for ip, t := range p.paged {
+		if now.Sub(t) >= p.interval {
+			delete(p.paged, ip)
+		}
+	}
+	for ip, t := range p.recon {
+		if now.Sub(t) >= reconWindow {
+			delete(p.recon, ip)
+		}
+	}
+	return p.sink.Record(event)
+}
+
+func (p *pager) Close() error {
+	return p.sink.Close()
+}
+
+// pageSummary returns the title of the incident "event" raises.
+func pageSummary(event dicompot.Event) string {
+	if isRetrieval(event) {
+		return chatAlert("DICOM honeypot: {command} from {ip} ({country}) after a search, AE {aetitle}", event)
+	}
+	return chatAlert("DICOM honeypot: {message} from {ip} ({country}), AE {aetitle}", event)
+}
+
+// pageDetails returns the details of the incident "event" raises.
+func pageDetails(event dicompot.Event) map[string]interface{} {
+	details := map[string]interface{}{
+		"type":    event.Type,
+		"session": event.SessionID,
+		"message": event.Message,
+	}
+	if event.CallingAETitle != "" {
+		details["calling_ae_title"] = event.CallingAETitle
+		details["called_ae_title"] = event.CalledAETitle
+	}
+	if event.LocalPort != 0 {
+		details["port"] = event.LocalPort
+	}
+	if terms := queryTerms(event); terms != "" {
+		details["query"] = terms
+	}
+	for k, v := range event.Fields {
+		details[k] = v
+	}
+	return details
+}
+
+// trigger raises the incidents of the events with every service. Those a
+// retry raises again are deduplicated.
+func (p *pager) trigger(events []dicompot.Event) error {
+	for _, event := range events {
+		dedupKey := "dicompot-" + sourceIP(event).String()
+		severity, priority := "error", "P2"
+		if event.Type == dicompot.EventExploitAttempt || isRetrieval(event) {
+			severity, priority = "critical", "P1"
+		}
+		if p.pagerDutyKey != "" {
+			err := p.post(pagerDutyURL, "", map[string]interface{}{
+				"routing_key":  p.pagerDutyKey,
+				"event_action": "trigger",
+				"dedup_key":    dedupKey,
+				"payload": map[string]interface{}{
+					"summary":        pageSummary(event),
+					"source":         p.source,
+					"severity":       severity,
+					"timestamp":      event.Time.UTC().Format(time.RFC3339),
+					"component":      "dicompot",
+					"class":          event.Type,
+					"custom_details": pageDetails(event),
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("PagerDuty: %v", err)
+			}
+		}
+		if p.opsgenieKey != "" {
+			message := pageSummary(event)
+			if len(message) > 130 {
+				message = message[:130]
+			}
+			details := map[string]string{}
+			for k, v := range pageDetails(event) {
+				details[k] = fmt.Sprint(v)
+			}
+			err := p.post(p.opsgenieURL, "GenieKey "+p.opsgenieKey, map[string]interface{}{
+				"message":  message,
+				"alias":    dedupKey,
+				"source":   p.source,
+				"priority": priority,
+				"tags":     []string{"dicompot", event.Type},
+				"details":  details,
+			})
+			if err != nil {
+				return fmt.Errorf("Opsgenie: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// post posts "body" in JSON to "url". A request rejected as malformed is
+// logged and dropped.
+func (p *pager) post(url, authorization string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity {
+		log.Printf("Pager: rejected an incident: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// personality bundles what gives a DICOM product away to a scanner: its
+// default AE title and port, its toolkit identity, and how it answers.
+type personality struct {
+	name    string
+	aeTitle string
+	port    string
+	toolkit toolkitProfile
+	// 0: the default.
+	maxPDUSize int
+	// Status of a C-STORE when the quarantine is off.
+	refusedCStoreStatus dimse.StatusCode
+	// Time taken to answer each request.
+	responseDelay time.Duration
+	// The exploits of the product that are watched for. Only the releases
+	// known to be vulnerable have any.
+	exploits []exploitSignature
+}
+
+// The products -personality can pass for, with their out of the box
+// settings.
+var personalities = map[string]personality{
+	// Orthanc is built on DCMTK, and accepts any called AE title unless
+	// DicomCheckCalledAet is set.
+	"orthanc": {
+		aeTitle:             "ORTHANC",
+		port:                "4242",
+		toolkit:             toolkitProfiles["dcmtk"],
+		maxPDUSize:          16384,
+		refusedCStoreStatus: dimse.CStoreOutOfResources,
+		responseDelay:       2 * time.Millisecond,
+	},
+	"dcm4chee": {
+		aeTitle:             "DCM4CHEE",
+		port:                "11112",
+		toolkit:             toolkitProfiles["dcm4che"],
+		maxPDUSize:          16378,
+		refusedCStoreStatus: dimse.StatusNotAuthorized,
+		responseDelay:       15 * time.Millisecond,
+	},
+	"conquest": {
+		aeTitle: "CONQUESTSRV1",
+		port:    "5678",
+		toolkit: toolkitProfile{
+			implementationClassUID:    "1.2.826.0.1.3680043.2.135.1066.101",
+			implementationVersionName: "1.5.0/WIN32",
+		},
+		maxPDUSize:          16384,
+		refusedCStoreStatus: dimse.StatusSOPClassNotSupported,
+		responseDelay:       5 * time.Millisecond,
+	},
+	// storescp of the last DCMTK release before the path traversal fixes.
+	// It answers as STORESCP, and reports a failed write as out of
+	// resources, which is what a traversal to an unwritable path gets.
+	"dcmtk-3.6.6": {
+		aeTitle: "STORESCP",
+		port:    "104",
+		toolkit: toolkitProfile{
+			implementationClassUID:    "1.2.276.0.7230010.3.0.3.6.6",
+			implementationVersionName: "OFFIS_DCMTK_366",
+		},
+		maxPDUSize:          16384,
+		refusedCStoreStatus: dimse.CStoreOutOfResources,
+		responseDelay:       2 * time.Millisecond,
+		exploits:            []exploitSignature{uidPathTraversal},
+	},
+	// Orthanc 1.11, whose REST API allows file writes. Its DICOM side is
+	// that of any recent Orthanc.
+	"orthanc-1.11": {
+		aeTitle:             "ORTHANC",
+		port:                "4242",
+		toolkit:             toolkitProfiles["dcmtk"],
+		maxPDUSize:          16384,
+		refusedCStoreStatus: dimse.CStoreOutOfResources,
+		responseDelay:       2 * time.Millisecond,
+		exploits:            []exploitSignature{orthancFileOverwrite, uidPathTraversal},
+	},
+	"conquest-1.4.17": {
+		aeTitle: "CONQUESTSRV1",
+		port:    "5678",
+		toolkit: toolkitProfile{
+			implementationClassUID:    "1.2.826.0.1.3680043.2.135.1066.101",
+			implementationVersionName: "1.4.17d/WIN32",
+		},
+		maxPDUSize:          16384,
+		refusedCStoreStatus: dimse.StatusSOPClassNotSupported,
+		responseDelay:       5 * time.Millisecond,
+		exploits:            []exploitSignature{associationOverflow},
+	},
+	"ge-pacs": {
+		aeTitle: "GEPACS",
+		port:    "104",
+		toolkit: toolkitProfile{
+			implementationClassUID:    "1.2.840.113619.6.94",
+			implementationVersionName: "GEHC_CPACS_40",
+			enforceCalledAE:           true,
+			calledAEReject:            calledAENotRecognized,
+		},
+		maxPDUSize:          32768,
+		refusedCStoreStatus: dimse.CStoreCannotUnderstand,
+		responseDelay:       40 * time.Millisecond,
+	},
+}
+
+// lookupPersonality returns the personality called "name", or nil if
+// "name" is empty.
+func lookupPersonality(name string) *personality {
+	if name == "" {
+		return nil
+	}
+	p, ok := personalities[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for n := range personalities {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		log.Fatalf("Unknown personality %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	p.name = strings.ToLower(name)
+	return &p
+}
+
+// applyPersonality makes the provider pass for "p". If "keepFlags" is set,
+// the settings given explicitly on the command line win over the
+// personality's.
+func applyPersonality(params *dicompot.ServiceProviderParams, p *personality, keepFlags bool) {
+	if p == nil {
+		return
+	}
+	explicit := func(name string) bool {
+		return keepFlags && isFlagSet(name)
+	}
+	if !explicit("ae") {
+		params.AETitle = p.aeTitle
+	}
+	if !explicit("toolkit") {
+		applyToolkitProfile(params, p.toolkit)
+	}
+	if !explicit("maxpdu") {
+		params.MaxPDUSize = p.maxPDUSize
+	}
+	params.RefusedCStoreStatus = p.refusedCStoreStatus
+	params.ResponseDelay = p.responseDelay
+}
@@ -0,0 +1,422 @@
+package main
+
+// This file emulates a Basic Grayscale Print SCP (P3.4, annex H), so that
+// print attempts get far enough to be logged: film sessions and film boxes
+// are created, image boxes are filled in, and print requests are accepted,
+// yet nothing is ever printed. Like MPPS steps, the objects are kept in
+// memory only.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+// Print Management SOP classes. P3.4, H.
+const (
+	grayscalePrintMetaSOPClassUID = "1.2.840.10008.5.1.1.9"
+	filmSessionSOPClassUID        = "1.2.840.10008.5.1.1.1"
+	filmBoxSOPClassUID            = "1.2.840.10008.5.1.1.2"
+	grayscaleImageBoxSOPClassUID  = "1.2.840.10008.5.1.1.4"
+	printerSOPClassUID            = "1.2.840.10008.5.1.1.16"
+	// The well-known instance of the Printer SOP class.
+	printerSOPInstanceUID = "1.2.840.10008.5.1.1.17"
+)
+
+// The SOP classes negotiated when -print is set.
+var printSOPClasses = []string{
+	grayscalePrintMetaSOPClassUID,
+	filmSessionSOPClassUID,
+	filmBoxSOPClassUID,
+	grayscaleImageBoxSOPClassUID,
+	printerSOPClassUID,
+}
+
+// Most film sessions remembered. Older ones are forgotten beyond that.
+const maxFilmSessions = 1024
+
+// filmBox is a film box of a film session, with the image boxes it was
+// created with.
+type filmBox struct {
+	session    string
+	format     string
+	imageBoxes []string
+}
+
+// filmSession is a film session, with the film boxes created in it.
+type filmSession struct {
+	created time.Time
+	label   string
+	copies  string
+	boxes   []string
+	// Images set in the image boxes of the session so far.
+	images int
+}
+
+// printer keeps the state of the print jobs of peers.
+type printer struct {
+	name string
+
+	mu       sync.Mutex
+	sessions map[string]*filmSession
+	boxes    map[string]*filmBox
+	// The film box of each image box.
+	imageBoxes map[string]string
+	seq        int64 // Used to assign UIDs. Accessed atomically.
+}
+
+// newPrinter returns the printer for -print, or nil if print requests are
+// refused. "name" is the PrinterName reported on N-GET.
+func newPrinter(enabled bool, name string) *printer {
+	if !enabled {
+		return nil
+	}
+	return &printer{
+		name:       name,
+		sessions:   map[string]*filmSession{},
+		boxes:      map[string]*filmBox{},
+		imageBoxes: map[string]string{},
+	}
+}
+
+// handles reports whether "sopClassUID" is one of the Print Management SOP
+// classes. A nil printer handles none.
+func (p *printer) handles(sopClassUID string) bool {
+	if p == nil {
+		return false
+	}
+	for _, uid := range printSOPClasses {
+		if uid == sopClassUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *printer) newUID() string {
+	return fmt.Sprintf("1.2.826.0.1.3680043.9.7133.6.%d.%d", time.Now().Unix(), atomic.AddInt64(&p.seq, 1))
+}
+
+// stringAttr returns the value of "tag" in "attrs", or "". Multiple values,
+// e.g., of an ImageDisplayFormat read as "STANDARD" and "2,3", are joined
+// back.
+func stringAttr(attrs []*dicom.Element, tag dicomtag.Tag) string {
+	for _, elem := range attrs {
+		if elem.Tag == tag {
+			values, _ := elem.GetStrings()
+			return strings.TrimSpace(strings.Join(values, "\\"))
+		}
+	}
+	return ""
+}
+
+// referencedUID returns the ReferencedSOPInstanceUID of the first item of
+// sequence "tag" in "attrs", or "".
+func referencedUID(attrs []*dicom.Element, tag dicomtag.Tag) string {
+	for _, elem := range attrs {
+		if elem.Tag != tag || len(elem.Value) == 0 {
+			continue
+		}
+		item, ok := elem.Value[0].(*dicom.Element)
+		if !ok {
+			return ""
+		}
+		for _, v := range item.Value {
+			if sub, ok := v.(*dicom.Element); ok && sub.Tag == dicomtag.ReferencedSOPInstanceUID {
+				s, _ := sub.GetString()
+				return strings.TrimSpace(s)
+			}
+		}
+	}
+	return ""
+}
+
+// imageBoxCount returns the number of image boxes an ImageDisplayFormat
+// lays out, e.g., 6 for "STANDARD\2,3". Other formats get one.
+func imageBoxCount(format string) int {
+	parts := strings.SplitN(format, "\\", 2)
+	if len(parts) != 2 || strings.ToUpper(parts[0]) != "STANDARD" {
+		return 1
+	}
+	dims := strings.SplitN(parts[1], ",", 2)
+	if len(dims) != 2 {
+		return 1
+	}
+	cols, err1 := strconv.Atoi(strings.TrimSpace(dims[0]))
+	rows, err2 := strconv.Atoi(strings.TrimSpace(dims[1]))
+	if err1 != nil || err2 != nil || cols < 1 || rows < 1 || cols*rows > 64 {
+		return 1
+	}
+	return cols * rows
+}
+
+// onPrintNCreate creates a film session or a film box. The film box is
+// answered with its image boxes, which the peer then fills in with N-SET.
+func (ss *server) onPrintNCreate(sopClassUID, sopInstanceUID string, attrs []*dicom.Element, sessionID string) (string, []*dicom.Element, dimse.Status) {
+	p := ss.printer
+	if sopInstanceUID == "" {
+		sopInstanceUID = p.newUID()
+	}
+	fields := map[string]interface{}{"SOPInstanceUID": sopInstanceUID}
+	switch sopClassUID {
+	case filmSessionSOPClassUID:
+		s := &filmSession{
+			created: time.Now(),
+			label:   stringAttr(attrs, dicomtag.FilmSessionLabel),
+			copies:  stringAttr(attrs, dicomtag.NumberOfCopies),
+		}
+		p.mu.Lock()
+		if len(p.sessions) >= maxFilmSessions {
+			p.forgetOldest()
+		}
+		_, dup := p.sessions[sopInstanceUID]
+		if !dup {
+			p.sessions[sopInstanceUID] = s
+		}
+		p.mu.Unlock()
+		if dup {
+			return sopInstanceUID, nil, dimse.Status{Status: dimse.StatusDuplicateSOPInstance}
+		}
+		fields["FilmSessionLabel"] = s.label
+		fields["NumberOfCopies"] = s.copies
+		fields["MediumType"] = stringAttr(attrs, dicomtag.MediumType)
+		ss.record(logrus.WarnLevel, dicompot.EventPrint, sessionID, "Film session created", fields)
+		return sopInstanceUID, nil, dimse.Success
+
+	case filmBoxSOPClassUID:
+		session := referencedUID(attrs, dicomtag.ReferencedFilmSessionSequence)
+		format := stringAttr(attrs, dicomtag.ImageDisplayFormat)
+		box := &filmBox{session: session, format: format}
+		var items []interface{}
+		for i := 0; i < imageBoxCount(format); i++ {
+			uid := p.newUID()
+			box.imageBoxes = append(box.imageBoxes, uid)
+			items = append(items, dicom.MustNewElement(dicomtag.Item,
+				dicom.MustNewElement(dicomtag.ReferencedSOPClassUID, grayscaleImageBoxSOPClassUID),
+				dicom.MustNewElement(dicomtag.ReferencedSOPInstanceUID, uid)))
+		}
+		p.mu.Lock()
+		s := p.sessions[session]
+		if s != nil {
+			s.boxes = append(s.boxes, sopInstanceUID)
+			p.boxes[sopInstanceUID] = box
+			for _, uid := range box.imageBoxes {
+				p.imageBoxes[uid] = sopInstanceUID
+			}
+		}
+		p.mu.Unlock()
+		if s == nil {
+			return sopInstanceUID, nil, dimse.Status{Status: dimse.StatusInvalidObjectInstance, ErrorComment: "Unknown film session"}
+		}
+		reply := []*dicom.Element{dicom.MustNewElement(dicomtag.ReferencedImageBoxSequence, items...)}
+		for _, elem := range attrs {
+			if elem.Tag != dicomtag.ReferencedImageBoxSequence {
+				reply = append(reply, elem)
+			}
+		}
+		sort.Slice(reply, func(i, j int) bool {
+			return reply[i].Tag.Compare(reply[j].Tag) < 0
+		})
+		fields["FilmSession"] = session
+		fields["ImageDisplayFormat"] = format
+		fields["FilmOrientation"] = stringAttr(attrs, dicomtag.FilmOrientation)
+		fields["FilmSizeID"] = stringAttr(attrs, dicomtag.FilmSizeID)
+		fields["ImageBoxes"] = len(box.imageBoxes)
+		ss.record(logrus.WarnLevel, dicompot.EventPrint, sessionID, "Film box created", fields)
+		return sopInstanceUID, reply, dimse.Success
+	}
+	return sopInstanceUID, nil, dimse.Status{Status: dimse.StatusSOPClassNotSupported}
+}
+
+// forgetOldest drops the oldest film session, with its boxes. p.mu must be
+// held.
+func (p *printer) forgetOldest() {
+	var oldest string
+	for uid, s := range p.sessions {
+		if oldest == "" || s.created.Before(p.sessions[oldest].created) {
+			oldest = uid
+		}
+	}
+	p.forget(oldest)
+}
+
+// forget drops film session "uid", with its boxes. p.mu must be held.
+func (p *printer) forget(uid string) {
+	s := p.sessions[uid]
+	if s == nil {
+		return
+	}
+	for _, box := range s.boxes {
+		p.forgetBox(box)
+	}
+	delete(p.sessions, uid)
+}
+
+// forgetBox drops film box "uid", with its image boxes. p.mu must be held.
+func (p *printer) forgetBox(uid string) {
+	if box := p.boxes[uid]; box != nil {
+		for _, imageBox := range box.imageBoxes {
+			delete(p.imageBoxes, imageBox)
+		}
+	}
+	delete(p.boxes, uid)
+}
+
+// onPrintNSet fills in an image box. The image itself is only described in
+// the log.
+func (ss *server) onPrintNSet(sopClassUID, sopInstanceUID string, attrs []*dicom.Element, sessionID string) dimse.Status {
+	p := ss.printer
+	if sopClassUID != grayscaleImageBoxSOPClassUID {
+		// Film sessions and boxes may be updated, but there is nothing
+		// to keep.
+		return dimse.Success
+	}
+	p.mu.Lock()
+	box, ok := p.imageBoxes[sopInstanceUID]
+	if ok {
+		if s := p.sessions[p.boxes[box].session]; s != nil {
+			s.images++
+		}
+	}
+	p.mu.Unlock()
+	if !ok {
+		return dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+	}
+	fields := map[string]interface{}{
+		"SOPInstanceUID": sopInstanceUID,
+		"FilmBox":        box,
+	}
+	for _, elem := range attrs {
+		if elem.Tag == dicomtag.ImageBoxPosition {
+			fields["ImageBoxPosition"], _ = elem.GetUInt16()
+		}
+		if elem.Tag != dicomtag.BasicGrayscaleImageSequence || len(elem.Value) == 0 {
+			continue
+		}
+		item, ok := elem.Value[0].(*dicom.Element)
+		if !ok {
+			continue
+		}
+		for _, v := range item.Value {
+			sub, ok := v.(*dicom.Element)
+			if !ok {
+				continue
+			}
+			switch sub.Tag {
+			case dicomtag.Rows:
+				fields["Rows"], _ = sub.GetUInt16()
+			case dicomtag.Columns:
+				fields["Columns"], _ = sub.GetUInt16()
+			case dicomtag.PixelData:
+				if info, ok := sub.Value[0].(dicom.PixelDataInfo); ok && len(info.Frames) > 0 {
+					fields["PixelDataSize"] = len(info.Frames[0])
+				}
+			}
+		}
+	}
+	ss.record(logrus.WarnLevel, dicompot.EventPrint, sessionID, "Image box set", fields)
+	return dimse.Success
+}
+
+// onPrintNAction accepts a print request for a film session or a film box.
+func (ss *server) onPrintNAction(sopClassUID, sopInstanceUID string, actionTypeID uint16, sessionID string) ([]*dicom.Element, dimse.Status) {
+	p := ss.printer
+	if actionTypeID != 1 || (sopClassUID != filmSessionSOPClassUID && sopClassUID != filmBoxSOPClassUID) {
+		return nil, dimse.Status{Status: dimse.StatusSOPClassNotSupported}
+	}
+	p.mu.Lock()
+	session := sopInstanceUID
+	if sopClassUID == filmBoxSOPClassUID {
+		session = ""
+		if box := p.boxes[sopInstanceUID]; box != nil {
+			session = box.session
+		}
+	}
+	s := p.sessions[session]
+	var fields map[string]interface{}
+	if s != nil {
+		fields = map[string]interface{}{
+			"SOPClassUID":      sopClassUID,
+			"SOPInstanceUID":   sopInstanceUID,
+			"FilmSession":      session,
+			"FilmSessionLabel": s.label,
+			"NumberOfCopies":   s.copies,
+			"FilmBoxes":        len(s.boxes),
+			"Images":           s.images,
+		}
+	}
+	p.mu.Unlock()
+	if s == nil {
+		return nil, dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+	}
+	ss.record(logrus.WarnLevel, dicompot.EventPrint, sessionID, "Print requested", fields)
+	return nil, dimse.Success
+}
+
+// onPrintNGet reports the printer as ready.
+func (ss *server) onPrintNGet(sopClassUID, sopInstanceUID string, tags []dicomtag.Tag, sessionID string) ([]*dicom.Element, dimse.Status) {
+	if sopClassUID != printerSOPClassUID {
+		return nil, dimse.Status{Status: dimse.StatusSOPClassNotSupported}
+	}
+	if sopInstanceUID != printerSOPInstanceUID {
+		return nil, dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+	}
+	attrs := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PrinterStatus, "NORMAL"),
+		dicom.MustNewElement(dicomtag.PrinterStatusInfo, "NORMAL"),
+		dicom.MustNewElement(dicomtag.PrinterName, ss.printer.name),
+	}
+	if len(tags) == 0 {
+		return attrs, dimse.Success
+	}
+	var reply []*dicom.Element
+	for _, elem := range attrs {
+		for _, tag := range tags {
+			if elem.Tag == tag {
+				reply = append(reply, elem)
+			}
+		}
+	}
+	return reply, dimse.Success
+}
+
+// onPrintNDelete deletes a film session or a film box.
+func (ss *server) onPrintNDelete(sopClassUID, sopInstanceUID string, sessionID string) dimse.Status {
+	p := ss.printer
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch sopClassUID {
+	case filmSessionSOPClassUID:
+		if p.sessions[sopInstanceUID] == nil {
+			return dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+		}
+		p.forget(sopInstanceUID)
+	case filmBoxSOPClassUID:
+		box := p.boxes[sopInstanceUID]
+		if box == nil {
+			return dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+		}
+		if s := p.sessions[box.session]; s != nil {
+			for i, uid := range s.boxes {
+				if uid == sopInstanceUID {
+					s.boxes = append(s.boxes[:i], s.boxes[i+1:]...)
+					break
+				}
+			}
+		}
+		p.forgetBox(sopInstanceUID)
+	default:
+		return dimse.Status{Status: dimse.StatusSOPClassNotSupported}
+	}
+	return dimse.Success
+}
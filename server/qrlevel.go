@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// qrLevel is one level of a Query/Retrieve information model. P3.4, C.6.
+type qrLevel struct {
+	name      string       // Value of QueryRetrieveLevel, e.g., "STUDY".
+	uniqueKey dicomtag.Tag // Identifies an entity at this level.
+	keys      []dicomtag.Tag
+}
+
+var patientKeys = []dicomtag.Tag{
+	dicomtag.PatientName,
+	dicomtag.IssuerOfPatientID,
+	dicomtag.OtherPatientIDs,
+	dicomtag.OtherPatientNames,
+	dicomtag.PatientBirthDate,
+	dicomtag.PatientBirthTime,
+	dicomtag.PatientSex,
+	dicomtag.EthnicGroup,
+	dicomtag.PatientComments,
+	dicomtag.NumberOfPatientRelatedStudies,
+	dicomtag.NumberOfPatientRelatedSeries,
+	dicomtag.NumberOfPatientRelatedInstances,
+}
+
+var studyKeys = []dicomtag.Tag{
+	dicomtag.StudyDate,
+	dicomtag.StudyTime,
+	dicomtag.AccessionNumber,
+	dicomtag.StudyID,
+	dicomtag.ReferringPhysicianName,
+	dicomtag.StudyDescription,
+	dicomtag.NameOfPhysiciansReadingStudy,
+	dicomtag.ModalitiesInStudy,
+	dicomtag.PatientAge,
+	dicomtag.PatientSize,
+	dicomtag.PatientWeight,
+	dicomtag.Occupation,
+	dicomtag.AdditionalPatientHistory,
+	dicomtag.NumberOfStudyRelatedSeries,
+	dicomtag.NumberOfStudyRelatedInstances,
+}
+
+var (
+	patientLevel = qrLevel{"PATIENT", dicomtag.PatientID, patientKeys}
+	studyLevel   = qrLevel{"STUDY", dicomtag.StudyInstanceUID, studyKeys}
+	seriesLevel  = qrLevel{"SERIES", dicomtag.SeriesInstanceUID, []dicomtag.Tag{
+		dicomtag.Modality,
+		dicomtag.SeriesNumber,
+		dicomtag.SeriesDescription,
+		dicomtag.SeriesDate,
+		dicomtag.SeriesTime,
+		dicomtag.BodyPartExamined,
+		dicomtag.ProtocolName,
+		dicomtag.PerformedProcedureStepStartDate,
+		dicomtag.PerformedProcedureStepStartTime,
+		dicomtag.NumberOfSeriesRelatedInstances,
+	}}
+	imageLevel = qrLevel{"IMAGE", dicomtag.SOPInstanceUID, []dicomtag.Tag{
+		dicomtag.SOPClassUID,
+		dicomtag.InstanceNumber,
+		dicomtag.ContentDate,
+		dicomtag.ContentTime,
+		dicomtag.Rows,
+		dicomtag.Columns,
+		dicomtag.NumberOfFrames,
+	}}
+
+	// In the Study Root model, patient attributes are study attributes.
+	// P3.4, C.6.2.1.
+	studyRootStudyLevel = qrLevel{"STUDY", dicomtag.StudyInstanceUID,
+		append(append([]dicomtag.Tag{dicomtag.PatientID}, patientKeys[:9]...), studyKeys...)}
+)
+
+// qrModels lists the levels of each information model, top first.
+var qrModels = map[string][]qrLevel{
+	dicomuid.PatientRootQRFind: {patientLevel, studyLevel, seriesLevel, imageLevel},
+	dicomuid.PatientRootQRMove: {patientLevel, studyLevel, seriesLevel, imageLevel},
+	dicomuid.PatientRootQRGet:  {patientLevel, studyLevel, seriesLevel, imageLevel},
+	dicomuid.StudyRootQRFind:   {studyRootStudyLevel, seriesLevel, imageLevel},
+	dicomuid.StudyRootQRMove:   {studyRootStudyLevel, seriesLevel, imageLevel},
+	dicomuid.StudyRootQRGet:    {studyRootStudyLevel, seriesLevel, imageLevel},
+	// Patient/Study Only. Retired, but old tools still use it.
+	"1.2.840.10008.5.1.4.1.2.3.1": {patientLevel, studyLevel},
+	"1.2.840.10008.5.1.4.1.2.3.2": {patientLevel, studyLevel},
+	"1.2.840.10008.5.1.4.1.2.3.3": {patientLevel, studyLevel},
+}
+
+// qrQuery is a C-{FIND,MOVE,GET} identifier validated against the
+// information model.
+type qrQuery struct {
+	level qrLevel
+	// The keys that apply at the level: the unique keys of the levels above,
+	// plus the keys of the level itself. Other keys in the identifier are
+	// ignored.
+	filters []*dicom.Element
+	// The identifier's SpecificCharacterSet, if any.
+	charset *dicom.Element
+}
+
+// parseQRQuery checks QueryRetrieveLevel and the unique keys of the
+// identifier. The checks follow the hierarchical search method, P3.4,
+// C.4.1.3.1, unless "relational" is set. A relational query may leave out the
+// unique keys above the query level, and match on any of their keys
+// instead. P3.4, C.4.1.3.2.
+func parseQRQuery(sopClassUID string, identifier []*dicom.Element, relational bool) (qrQuery, error) {
+	var q qrQuery
+	model, ok := qrModels[sopClassUID]
+	if !ok {
+		return q, fmt.Errorf("SOP class %s is not a Query/Retrieve information model", sopClassUID)
+	}
+	byTag := map[dicomtag.Tag]*dicom.Element{}
+	for _, elem := range identifier {
+		byTag[elem.Tag] = elem
+	}
+	q.charset = byTag[dicomtag.SpecificCharacterSet]
+	levelElem, ok := byTag[dicomtag.QueryRetrieveLevel]
+	if !ok {
+		return q, fmt.Errorf("QueryRetrieveLevel missing")
+	}
+	levelName, err := levelElem.GetString()
+	if err != nil {
+		return q, fmt.Errorf("Invalid QueryRetrieveLevel: %v", err)
+	}
+	levelName = strings.TrimSpace(levelName)
+	depth := -1
+	for i, level := range model {
+		if level.name == levelName {
+			depth = i
+		}
+	}
+	if depth < 0 {
+		return q, fmt.Errorf("Invalid QueryRetrieveLevel %q", levelName)
+	}
+	q.level = model[depth]
+
+	for _, level := range model[:depth] {
+		elem, ok := byTag[level.uniqueKey]
+		if relational {
+			if ok {
+				q.filters = append(q.filters, elem)
+			}
+			for _, tag := range level.keys {
+				if elem, ok := byTag[tag]; ok {
+					q.filters = append(q.filters, elem)
+				}
+			}
+			continue
+		}
+		if !ok || !isSingleValueKey(elem) {
+			return q, fmt.Errorf("Unique key %s required at level %s", dicomtag.DebugString(level.uniqueKey), levelName)
+		}
+		q.filters = append(q.filters, elem)
+	}
+	if elem, ok := byTag[q.level.uniqueKey]; ok {
+		q.filters = append(q.filters, elem)
+	} else {
+		// The unique key of the level is always returned, even if the
+		// requester forgot to ask for it.
+		q.filters = append(q.filters, dicom.MustNewElement(q.level.uniqueKey))
+	}
+	for _, tag := range q.level.keys {
+		if elem, ok := byTag[tag]; ok {
+			q.filters = append(q.filters, elem)
+		}
+	}
+	return q, nil
+}
+
+// isSingleValueKey reports whether "elem" names exactly one entity, as
+// required for the unique keys above the query level.
+func isSingleValueKey(elem *dicom.Element) bool {
+	if len(elem.Value) != 1 {
+		return false
+	}
+	s, ok := elem.Value[0].(string)
+	return ok && strings.TrimSpace(s) != "" && !strings.ContainsAny(s, "*?\\")
+}
+
+// group merges the matches of a C-FIND that belong to the same entity at the
+// query level, e.g., all the images of a study for a STUDY query. It fills in
+// QueryRetrieveLevel and the computed "Number of ... Related" attributes.
+func (q qrQuery) group(matches []filterMatch) []filterMatch {
+	type entity struct {
+		match                     filterMatch
+		studies, series, children map[string]bool
+	}
+	var order []string
+	entities := map[string]*entity{}
+	value := func(ds *dicom.DataSet, tag dicomtag.Tag) string {
+		elem, err := ds.FindElementByTag(tag)
+		if err != nil {
+			return ""
+		}
+		s, _ := elem.GetString()
+		return s
+	}
+	for _, m := range matches {
+		key := value(m.ds, q.level.uniqueKey)
+		e, ok := entities[key]
+		if !ok {
+			e = &entity{
+				match:    m,
+				studies:  map[string]bool{},
+				series:   map[string]bool{},
+				children: map[string]bool{},
+			}
+			entities[key] = e
+			order = append(order, key)
+		}
+		e.studies[value(m.ds, dicomtag.StudyInstanceUID)] = true
+		e.series[value(m.ds, dicomtag.SeriesInstanceUID)] = true
+		e.children[value(m.ds, dicomtag.SOPInstanceUID)] = true
+	}
+
+	var grouped []filterMatch
+	for _, key := range order {
+		e := entities[key]
+		elems := []*dicom.Element{dicom.MustNewElement(dicomtag.QueryRetrieveLevel, q.level.name)}
+		if q.charset != nil {
+			if elem, err := e.match.ds.FindElementByTag(dicomtag.SpecificCharacterSet); err == nil {
+				elems = append(elems, elem)
+			} else {
+				elems = append(elems, q.charset)
+			}
+		}
+		for _, elem := range e.match.elems {
+			var count int
+			switch elem.Tag {
+			case dicomtag.NumberOfPatientRelatedStudies:
+				count = len(e.studies)
+			case dicomtag.NumberOfPatientRelatedSeries, dicomtag.NumberOfStudyRelatedSeries:
+				count = len(e.series)
+			case dicomtag.NumberOfPatientRelatedInstances, dicomtag.NumberOfStudyRelatedInstances,
+				dicomtag.NumberOfSeriesRelatedInstances:
+				count = len(e.children)
+			default:
+				elems = append(elems, elem)
+				continue
+			}
+			elems = append(elems, dicom.MustNewElement(elem.Tag, strconv.Itoa(count)))
+		}
+		grouped = append(grouped, filterMatch{path: e.match.path, ds: e.match.ds, elems: elems})
+	}
+	return grouped
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+// errQuarantineFull is returned for a file past the size caps of the
+// quarantine.
+var errQuarantineFull = errors.New("quarantine full")
+
+// How long a session goes without storing anything before the quarantine
+// forgets how much it stored.
+const quarantineSessionTimeout = time.Hour
+
+// quarantine stores datasets received through C-STORE. Files are named after
+// the session, never after the UIDs chosen by the peer, so a hostile peer
+// can't pick the destination path. Files larger than maxFile, past maxSession
+// for their owner, the session of C-STORE or the peer of STOW-RS, or past
+// maxTotal for the directory, are refused, so a peer can't fill the disk; 0
+// is no limit.
+type quarantine struct {
+	dir string
+	seq int64 // Number of files written so far. Accessed atomically.
+
+	maxFile, maxSession, maxTotal int64
+
+	mu       sync.Mutex
+	total    int64
+	sessions map[string]*quarantineSession // By owner.
+	pruned   time.Time
+}
+
+// quarantineSession is what an owner stored.
+type quarantineSession struct {
+	size int64
+	last time.Time
+}
+
+// newQuarantine returns the quarantine in "dir", with the caps of
+// -quarantinemaxfile and friends, in MB.
+func newQuarantine(dir string, maxFile, maxSession, maxTotal int64) (*quarantine, error) {
+	if maxFile < 0 || maxSession < 0 || maxTotal < 0 {
+		return nil, errors.New("-quarantinemaxfile, -quarantinemaxsession and -quarantinemaxsize must not be negative")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &quarantine{
+		dir:        dir,
+		maxFile:    maxFile << 20,
+		maxSession: maxSession << 20,
+		maxTotal:   maxTotal << 20,
+		sessions:   map[string]*quarantineSession{},
+	}
+	// What earlier runs left counts towards maxTotal.
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			q.total += info.Size()
+		}
+		return err
+	})
+	return q, err
+}
+
+// reserve accounts for "size" bytes to be stored by "owner", or returns
+// errQuarantineFull if that is past a cap.
+func (q *quarantine) reserve(owner string, size int64) error {
+	if q.maxFile > 0 && size > q.maxFile {
+		return errQuarantineFull
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if now.Sub(q.pruned) > quarantineSessionTimeout {
+		for id, s := range q.sessions {
+			if now.Sub(s.last) > quarantineSessionTimeout {
+				delete(q.sessions, id)
+			}
+		}
+		q.pruned = now
+	}
+	s := q.sessions[owner]
+	if s == nil {
+		s = &quarantineSession{}
+	}
+	if (q.maxSession > 0 && s.size+size > q.maxSession) || (q.maxTotal > 0 && q.total+size > q.maxTotal) {
+		return errQuarantineFull
+	}
+	s.size += size
+	s.last = now
+	q.sessions[owner] = s
+	q.total += size
+	return nil
+}
+
+// release gives back "size" bytes reserved by "owner" and not stored.
+func (q *quarantine) release(owner string, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s := q.sessions[owner]; s != nil {
+		s.size -= size
+	}
+	q.total -= size
+}
+
+func (q *quarantine) create(sessionID string) (*os.File, string, error) {
+	path := filepath.Join(q.dir, fmt.Sprintf("%s-%d.dcm", sessionID, atomic.AddInt64(&q.seq, 1)))
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	return out, path, err
+}
+
+// write stores "data" as a DICOM Part 10 file and returns its path and
+// contents, the latter even if it isn't stored.
+func (q *quarantine) write(transferSyntaxUID, sopClassUID, sopInstanceUID, sessionID string, data []byte) (string, []byte, error) {
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dicom.WriteFileHeader(e, []*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, sopClassUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
+	})
+	e.WriteBytes(data)
+	if err := e.Error(); err != nil {
+		return "", nil, err
+	}
+	file := e.Bytes()
+	path, err := q.writeFile(sessionID, sessionID, file)
+	return path, file, err
+}
+
+// writeFile stores a Part 10 file received whole, e.g., through STOW-RS, in
+// the name of "sessionID", on the account of "owner".
+func (q *quarantine) writeFile(sessionID, owner string, data []byte) (string, error) {
+	size := int64(len(data))
+	if err := q.reserve(owner, size); err != nil {
+		return "", err
+	}
+	out, path, err := q.create(sessionID)
+	if err != nil {
+		q.release(owner, size)
+		return "", err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		os.Remove(path)
+		q.release(owner, size)
+		return "", err
+	}
+	return path, out.Close()
+}
+
+func (ss *server) onCStore(
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	sessionID string,
+	data []byte) dimse.Status {
+
+	path, file, err := ss.quarantine.write(transferSyntaxUID, sopClassUID, sopInstanceUID, sessionID, data)
+	if err != nil && err != errQuarantineFull {
+		log.Printf("Failed to quarantine C-STORE payload: %v", err)
+		return dimse.Status{Status: dimse.CStoreOutOfResources}
+	}
+	ds, _ := dicompot.ReadDataSet(bytes.NewReader(file), dicom.ReadOptions{DropPixelData: true})
+	fields := payloadFields(file, ds)
+	// The file meta information is ours, not the peer's.
+	delete(fields, "ImplementationVersionName")
+	delete(fields, "SourceApplicationEntityTitle")
+	fields["SOPInstanceUID"] = sopInstanceUID
+	if err == errQuarantineFull {
+		fields["QuarantineFull"] = true
+		ss.record(logrus.WarnLevel, dicompot.EventCStore, sessionID, "C-STORE refused, quarantine full", fields)
+		return dimse.Status{Status: dimse.CStoreOutOfResources}
+	}
+	fields["Path"] = path
+	ss.record(logrus.WarnLevel, dicompot.EventCStore, sessionID, "C-STORE quarantined", fields)
+	return dimse.Success
+}
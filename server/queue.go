@@ -0,0 +1,181 @@
+package main
+
+// This file decouples the sessions from the services events are shipped to:
+// events are queued, and sent in batches from a goroutine of their own, which
+// retries until the service takes them.
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// Events waiting to be sent, at most. Further ones are dropped.
+	queueSize = 10000
+	// Longest wait between two attempts to send a batch.
+	maxRetryInterval = time.Minute
+	// How long Close waits for the queue to drain.
+	drainTimeout = 10 * time.Second
+)
+
+// queuedSink is an EventSink that hands the events to "send", batches of at
+// most "maxBatch" at a time, and never blocks. While "send" fails, the batch
+// is retried, with a growing interval, and new events wait in the queue.
+type queuedSink struct {
+	name     string
+	send     func(events []dicompot.Event) error
+	maxBatch int
+	// How long to wait for a batch to fill.
+	linger time.Duration
+
+	queue   chan dicompot.Event
+	done    chan struct{}
+	closing chan struct{}
+	once    sync.Once
+	dropped int64 // Accessed atomically.
+	// Set once a failure has been logged, until a batch goes through.
+	failing bool
+	// When "send" started failing, in Unix nanoseconds, or 0. Accessed
+	// atomically.
+	failingSince int64
+}
+
+// The queuedSinks started, for the health endpoints.
+var queuedSinks struct {
+	mu    sync.Mutex
+	sinks []*queuedSink
+}
+
+// newQueuedSink starts the goroutine of a queuedSink. "name" is what the
+// console calls the service.
+func newQueuedSink(name string, maxBatch int, linger time.Duration, send func(events []dicompot.Event) error) *queuedSink {
+	q := &queuedSink{
+		name:     name,
+		send:     send,
+		maxBatch: maxBatch,
+		linger:   linger,
+		queue:    make(chan dicompot.Event, queueSize),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	queuedSinks.mu.Lock()
+	queuedSinks.sinks = append(queuedSinks.sinks, q)
+	queuedSinks.mu.Unlock()
+	go q.run()
+	return q
+}
+
+// Record queues the event, or drops it if the queue is full.
+func (q *queuedSink) Record(event dicompot.Event) error {
+	select {
+	case q.queue <- event:
+	default:
+		if atomic.AddInt64(&q.dropped, 1)%1000 == 1 {
+			log.Printf("%s: queue full, dropping events", q.name)
+		}
+	}
+	return nil
+}
+
+func (q *queuedSink) run() {
+	defer close(q.done)
+	for {
+		var batch []dicompot.Event
+		select {
+		case event := <-q.queue:
+			batch = append(batch, event)
+		case <-q.closing:
+			q.drain(nil)
+			return
+		}
+		timer := time.NewTimer(q.linger)
+	fill:
+		for len(batch) < q.maxBatch {
+			select {
+			case event := <-q.queue:
+				batch = append(batch, event)
+			case <-timer.C:
+				break fill
+			case <-q.closing:
+				break fill
+			}
+		}
+		timer.Stop()
+		if !q.deliver(batch) {
+			q.drain(batch)
+			return
+		}
+	}
+}
+
+// deliver sends "batch", retrying until it goes through or the sink is
+// closed. It returns false in the latter case.
+func (q *queuedSink) deliver(batch []dicompot.Event) bool {
+	interval := time.Second
+	for {
+		err := q.send(batch)
+		if err == nil {
+			if q.failing {
+				log.Printf("%s: sending again", q.name)
+				q.failing = false
+				atomic.StoreInt64(&q.failingSince, 0)
+			}
+			return true
+		}
+		if !q.failing {
+			log.Printf("%s: failed to send %d events, retrying: %v", q.name, len(batch), err)
+			q.failing = true
+			atomic.StoreInt64(&q.failingSince, time.Now().UnixNano())
+		}
+		select {
+		case <-time.After(interval):
+		case <-q.closing:
+			return false
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// drain makes one attempt at sending "batch", then what is left in the
+// queue.
+func (q *queuedSink) drain(batch []dicompot.Event) {
+	for {
+	fill:
+		for len(batch) < q.maxBatch {
+			select {
+			case event := <-q.queue:
+				batch = append(batch, event)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := q.send(batch); err != nil {
+			log.Printf("%s: failed to send %d events on exit: %v", q.name, len(batch)+len(q.queue), err)
+			return
+		}
+		batch = nil
+	}
+}
+
+// Close sends what is queued, waiting at most drainTimeout.
+func (q *queuedSink) Close() error {
+	q.once.Do(func() { close(q.closing) })
+	select {
+	case <-q.done:
+	case <-time.After(drainTimeout):
+		log.Printf("%s: gave up sending %d events on exit", q.name, len(q.queue))
+	}
+	if n := atomic.LoadInt64(&q.dropped); n > 0 {
+		log.Printf("%s: %d events were dropped", q.name, n)
+	}
+	return nil
+}
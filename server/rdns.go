@@ -0,0 +1,149 @@
+package main
+
+// This file adds the host name of the source of every event, from its PTR
+// record, as the field RemoteHostname. Lookups are made in the background,
+// by a few workers, and their results cached: the events recorded before
+// the name of their source is known go without it, the first ones of a
+// session usually, rather than waiting for DNS.
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// How long a name, or the lack of one, is kept.
+	rdnsTTL = time.Hour
+	// How long a lookup may take.
+	rdnsTimeout = 5 * time.Second
+	// Sources waiting to be looked up, at most; more are looked up later.
+	rdnsQueueSize = 256
+	// Names cached, at most, before the expired ones are dropped.
+	rdnsCacheSize = 10000
+)
+
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// reverseDNS is an EventSink that adds the name of the source to the events
+// it hands to "next".
+type reverseDNS struct {
+	next     dicompot.EventSink
+	resolver *net.Resolver
+	queue    chan string
+	// Closed by Close. The queue never is, for Record not to panic on
+	// events of sessions still open.
+	closing chan struct{}
+	once    sync.Once
+
+	mu sync.Mutex
+	// Names by IP. An empty name is a lookup that failed, or is pending.
+	cache map[string]rdnsEntry
+}
+
+// newReverseDNS returns the enricher for -rdns, with "workers" lookups at a
+// time, or nil if names aren't looked up.
+func newReverseDNS(enabled bool, workers int, next dicompot.EventSink) *reverseDNS {
+	if !enabled {
+		return nil
+	}
+	if workers <= 0 {
+		log.Fatalf("Invalid -rdnsworkers %d, want at least 1", workers)
+	}
+	r := &reverseDNS{
+		next:     next,
+		resolver: &net.Resolver{},
+		queue:    make(chan string, rdnsQueueSize),
+		closing:  make(chan struct{}),
+		cache:    map[string]rdnsEntry{},
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	log.Printf("-| Looking up the names of sources, %d at a time", workers)
+	return r
+}
+
+// Record adds the name of the source of "event", if known, or has it looked
+// up otherwise, and hands the event to "next".
+func (r *reverseDNS) Record(event dicompot.Event) error {
+	if ip := sourceIP(event); ip != nil {
+		if name := r.lookup(ip.String()); name != "" {
+			fields := map[string]interface{}{"RemoteHostname": name}
+			for k, v := range event.Fields {
+				fields[k] = v
+			}
+			event.Fields = fields
+		}
+	}
+	return r.next.Record(event)
+}
+
+// lookup returns the cached name of "ip". If there is none, a lookup is
+// queued, unless one is or the queue is full.
+func (r *reverseDNS) lookup(ip string) string {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cache[ip]; ok && now.Before(e.expires) {
+		return e.name
+	}
+	if len(r.cache) >= rdnsCacheSize {
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= rdnsCacheSize {
+			return ""
+		}
+	}
+	select {
+	case <-r.closing:
+		return ""
+	default:
+	}
+	select {
+	case r.queue <- ip:
+		// Pending until the worker is done.
+		r.cache[ip] = rdnsEntry{expires: now.Add(rdnsTimeout + time.Minute)}
+	default:
+	}
+	return ""
+}
+
+// work looks up the queued sources until the enricher is closed.
+func (r *reverseDNS) work() {
+	for {
+		var ip string
+		select {
+		case ip = <-r.queue:
+		case <-r.closing:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+		names, err := r.resolver.LookupAddr(ctx, ip)
+		cancel()
+		var name string
+		if err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+		r.mu.Lock()
+		r.cache[ip] = rdnsEntry{name: name, expires: time.Now().Add(rdnsTTL)}
+		r.mu.Unlock()
+	}
+}
+
+// Close stops the lookups and closes "next".
+func (r *reverseDNS) Close() error {
+	r.once.Do(func() { close(r.closing) })
+	return r.next.Close()
+}
@@ -0,0 +1,217 @@
+package main
+
+// This file publishes the events to Redis, for realtime dashboards and
+// enrichment workers to subscribe to rather than tail files: with PUBLISH to
+// a channel, and with XADD to a stream, for workers that must not miss
+// events while down.
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// The length the stream is trimmed to, roughly.
+const redisStreamLength = 100000
+
+// redis is a Redis publisher.
+type redis struct {
+	addr            string
+	tls             *tls.Config
+	user, password  string
+	db              int
+	channel, stream string
+
+	// Only used from the goroutine of the queuedSink.
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisSink returns the sink for -redis and friends, or nil if events
+// aren't published. "rawURL" is redis://[user:password@]host:port[/db], or
+// rediss:// for TLS.
+func newRedisSink(rawURL, channel, stream string) dicompot.EventSink {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		log.Fatalf("Invalid -redis %q, want redis://[user:password@]host:port[/db]", rawURL)
+	}
+	if channel == "" && stream == "" {
+		log.Fatalf("-redis needs -redischannel, -redisstream or both")
+	}
+	r := &redis{addr: u.Host, channel: channel, stream: stream}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		r.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+		r.password, _ = u.User.Password()
+		if r.password == "" {
+			// redis://password@host, as some clients take it.
+			r.user, r.password = "", r.user
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			log.Fatalf("Invalid database %q in -redis", db)
+		}
+	}
+	var to []string
+	if channel != "" {
+		to = append(to, "channel "+channel)
+	}
+	if stream != "" {
+		to = append(to, "stream "+stream)
+	}
+	log.Printf("-| Publishing events to Redis: %s, %s", r.addr, strings.Join(to, ", "))
+	return newQueuedSink("Redis", 500, 0, r.publish)
+}
+
+// redisCommand returns a command in RESP.
+func redisCommand(args ...string) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(sb.String())
+}
+
+// readReply reads a reply, and returns the error, if it is one.
+func (r *redis) readReply() error {
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return err
+		}
+		_, err = r.r.Discard(n + 2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			if err := r.readReply(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid reply %q", line)
+}
+
+// do sends the commands at once, then reads all the replies, returning the
+// first error.
+func (r *redis) do(commands [][]byte) error {
+	r.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var buf []byte
+	for _, c := range commands {
+		buf = append(buf, c...)
+	}
+	if _, err := r.conn.Write(buf); err != nil {
+		return err
+	}
+	var first error
+	for range commands {
+		if err := r.readReply(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// connect connects, authenticates and selects the database.
+func (r *redis) connect() error {
+	conn, err := net.DialTimeout("tcp", r.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if r.tls != nil {
+		conn = tls.Client(conn, r.tls)
+	}
+	r.conn, r.r = conn, bufio.NewReader(conn)
+	var commands [][]byte
+	switch {
+	case r.user != "":
+		commands = append(commands, redisCommand("AUTH", r.user, r.password))
+	case r.password != "":
+		commands = append(commands, redisCommand("AUTH", r.password))
+	}
+	if r.db != 0 {
+		commands = append(commands, redisCommand("SELECT", strconv.Itoa(r.db)))
+	}
+	if len(commands) > 0 {
+		if err := r.do(commands); err != nil {
+			r.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redis) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn, r.r = nil, nil
+	}
+}
+
+// publish publishes every event in JSON. Stream entries also have the type
+// and session of the event, for workers to filter on without decoding it.
+func (r *redis) publish(events []dicompot.Event) error {
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return err
+		}
+	}
+	var commands [][]byte
+	for _, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if r.channel != "" {
+			commands = append(commands, redisCommand("PUBLISH", r.channel, string(b)))
+		}
+		if r.stream != "" {
+			commands = append(commands, redisCommand("XADD", r.stream, "MAXLEN", "~", strconv.Itoa(redisStreamLength), "*",
+				"type", event.Type, "session", event.SessionID, "event", string(b)))
+		}
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	if err := r.do(commands); err != nil {
+		r.close()
+		return err
+	}
+	return nil
+}
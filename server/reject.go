@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/pdu"
+	"github.com/nsmfoo/dicompot/sopclass"
+)
+
+// The SOP classes the server answers. With -rjsopclass, an association that
+// proposes none of them is rejected.
+var supportedSOPClasses = concatStrings(
+	sopclass.VerificationClasses,
+	sopclass.StorageClasses,
+	sopclass.QRFindClasses,
+	sopclass.QRMoveClasses,
+	sopclass.QRGetClasses,
+	[]string{mppsSOPClassUID, "1.2.840.10008.1.20.1"}, // MPPS, Storage Commitment
+)
+
+func concatStrings(lists ...[]string) []string {
+	var all []string
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+// parseRejectRule parses "result,source,reason", e.g., "1,1,7" for
+// "rejected-permanent, service user, called AE title not recognized". See
+// P3.8, 9.3.4 for the codes. An empty value disables the rule.
+func parseRejectRule(name, value string) *pdu.AAssociateRj {
+	if value == "" {
+		return nil
+	}
+	parts := strings.Split(value, ",")
+	var codes [3]byte
+	if len(parts) != len(codes) {
+		log.Fatalf("Invalid -%s %q, want result,source,reason", name, value)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+		if err != nil {
+			log.Fatalf("Invalid -%s %q: %v", name, value, err)
+		}
+		codes[i] = byte(n)
+	}
+	return &pdu.AAssociateRj{
+		Result: pdu.RejectResultType(codes[0]),
+		Source: pdu.SourceType(codes[1]),
+		Reason: pdu.RejectReasonType(codes[2]),
+	}
+}
+
+func newRejectPolicy() dicompot.RejectPolicy {
+	policy := dicompot.RejectPolicy{
+		CalledAE:            parseRejectRule("rjcalledae", *rjCalledAEFlag),
+		UnsupportedSOPClass: parseRejectRule("rjsopclass", *rjSOPClassFlag),
+		SOPClasses:          supportedSOPClasses,
+		TooManyContexts:     parseRejectRule("rjcontexts", *rjContextsFlag),
+		MaxContexts:         *maxContextsFlag,
+	}
+	if *printFlag {
+		policy.SOPClasses = concatStrings(supportedSOPClasses, printSOPClasses)
+	}
+	if policy.MaxContexts > 0 && policy.TooManyContexts == nil {
+		// Local limit exceeded. P3.8, 9.3.4.
+		policy.TooManyContexts = &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedTransient,
+			Source: pdu.SourceULServiceProviderPresentation,
+			Reason: 2,
+		}
+	}
+	return policy
+}
@@ -0,0 +1,359 @@
+package main
+
+// This file implements the "replay" subcommand, which re-drives the
+// association of a transcript against a provider: the requests the peer sent
+// are sent again, in order, and what comes back is compared with what the
+// honeypot answered.
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+// The maximum PDU length proposed, which is what the provider's PDUs get.
+const replayMaxPDUSize = 1 << 20
+
+// outcome is how a request ended.
+type outcome struct {
+	pending int
+	status  *dimse.Status
+}
+
+func (o outcome) String() string {
+	if o.status == nil {
+		return "no response"
+	}
+	return fmt.Sprintf("%v after %d pending", o.status.Status, o.pending)
+}
+
+// add counts response "status" towards the outcome.
+func (o *outcome) add(status *dimse.Status) {
+	if status.Status == dimse.StatusPending || status.Status == 0xff01 {
+		o.pending++
+		return
+	}
+	o.status = status
+}
+
+// isFinal reports whether "status" ends its request.
+func isFinal(status *dimse.Status) bool {
+	return status != nil && status.Status != dimse.StatusPending && status.Status != 0xff01
+}
+
+func decodeCommand(b []byte) (dimse.Message, error) {
+	d := dicomio.NewBytesDecoder(b, nil, dicomio.UnknownVR)
+	msg := dimse.ReadMessage(d)
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readTranscript returns the association of the transcript at "path", its
+// messages, and the outcome of each request, by message ID, as recorded.
+func readTranscript(path string) (*dicompot.TranscriptEntry, []dicompot.TranscriptEntry, map[dimse.MessageID]*outcome, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+	var association *dicompot.TranscriptEntry
+	var received []dicompot.TranscriptEntry
+	recorded := map[dimse.MessageID]*outcome{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 256<<20)
+	for scanner.Scan() {
+		var entry dicompot.TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, nil, nil, err
+		}
+		switch entry.Type {
+		case dicompot.TranscriptAssociation:
+			association = &entry
+		case dicompot.TranscriptReceived:
+			received = append(received, entry)
+		case dicompot.TranscriptSent:
+			msg, err := decodeCommand(entry.CommandSet)
+			if err != nil || msg.GetStatus() == nil {
+				continue
+			}
+			o := recorded[msg.GetMessageID()]
+			if o == nil {
+				o = &outcome{}
+				recorded[msg.GetMessageID()] = o
+			}
+			o.add(msg.GetStatus())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	if association == nil {
+		return nil, nil, nil, fmt.Errorf("no association in the transcript")
+	}
+	return association, received, recorded, nil
+}
+
+// replayConn is the association of a replay.
+type replayConn struct {
+	conn       net.Conn
+	timeout    time.Duration
+	maxPDUSize int
+	asm        dimse.CommandAssembler
+}
+
+func (c *replayConn) send(p pdu.PDU) error {
+	b, err := pdu.EncodePDU(p)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(b)
+	return err
+}
+
+// sendValue sends a command set or a data set, split into PDUs that fit the
+// provider's maximum length.
+func (c *replayConn) sendValue(contextID byte, command bool, value []byte) error {
+	chunk := c.maxPDUSize - 6
+	for {
+		n := len(value)
+		if n > chunk {
+			n = chunk
+		}
+		err := c.send(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+			ContextID: contextID,
+			Command:   command,
+			Last:      n == len(value),
+			Value:     value[:n],
+		}}})
+		if err != nil || n == len(value) {
+			return err
+		}
+		value = value[n:]
+	}
+}
+
+func (c *replayConn) sendMessage(contextID byte, msg dimse.Message, data []byte) error {
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dimse.EncodeMessage(e, msg)
+	if err := c.sendValue(contextID, true, e.Bytes()); err != nil {
+		return err
+	}
+	if msg.HasData() {
+		return c.sendValue(contextID, false, data)
+	}
+	return nil
+}
+
+// receive returns the next message of the provider.
+func (c *replayConn) receive() (byte, dimse.Message, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		p, err := pdu.ReadPDU(c.conn, replayMaxPDUSize)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, ok := p.(*pdu.PDataTf)
+		if !ok {
+			return 0, nil, fmt.Errorf("unexpected %v", p)
+		}
+		contextID, msg, _, err := c.asm.AddDataPDU(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if msg != nil {
+			return contextID, msg, nil
+		}
+	}
+}
+
+// answer responds to the requests the provider makes of the peer during a
+// command, e.g., the C-STOREs of a C-GET or the N-EVENT-REPORT of a Storage
+// Commitment, the way a willing peer would.
+func (c *replayConn) answer(contextID byte, req dimse.Message) error {
+	var rsp dimse.Message
+	switch r := req.(type) {
+	case *dimse.CStoreRq:
+		rsp = &dimse.CStoreRsp{
+			AffectedSOPClassUID:       r.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: r.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    r.AffectedSOPInstanceUID,
+			Status:                    dimse.Success,
+		}
+	case *dimse.NEventReportRq:
+		rsp = &dimse.NEventReportRsp{
+			AffectedSOPClassUID:       r.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: r.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    r.AffectedSOPInstanceUID,
+			EventTypeID:               r.EventTypeID,
+			Status:                    dimse.Success,
+		}
+	default:
+		return nil
+	}
+	return c.sendMessage(contextID, rsp, nil)
+}
+
+// associate opens the association of "association" on "addr".
+func associate(addr string, association *dicompot.TranscriptEntry, calling, called string, timeout time.Duration) (*replayConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &replayConn{conn: conn, timeout: timeout, maxPDUSize: dicompot.DefaultMaxPDUSize}
+	items := []pdu.SubItem{&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName}}
+	for _, ctx := range association.Contexts {
+		items = append(items, &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: ctx.ID,
+			Items: []pdu.SubItem{
+				&pdu.AbstractSyntaxSubItem{Name: ctx.AbstractSyntax},
+				&pdu.TransferSyntaxSubItem{Name: ctx.TransferSyntax},
+			},
+		})
+	}
+	items = append(items, &pdu.UserInformationItem{Items: []pdu.SubItem{
+		&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: replayMaxPDUSize},
+	}})
+	err = c.send(&pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   called,
+		CallingAETitle:  calling,
+		Items:           items,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	p, err := pdu.ReadPDU(conn, replayMaxPDUSize)
+	if err == nil {
+		ac, ok := p.(*pdu.AAssociate)
+		if !ok {
+			err = fmt.Errorf("association refused: %v", p)
+		} else {
+			for _, item := range ac.Items {
+				ui, ok := item.(*pdu.UserInformationItem)
+				if !ok {
+					continue
+				}
+				for _, sub := range ui.Items {
+					if m, ok := sub.(*pdu.UserInformationMaximumLengthItem); ok && m.MaximumLengthReceived > 6 {
+						c.maxPDUSize = int(m.MaximumLengthReceived)
+					}
+				}
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// release ends the association.
+func (c *replayConn) release() {
+	if c.send(&pdu.AReleaseRq{}) == nil {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		pdu.ReadPDU(c.conn, replayMaxPDUSize)
+	}
+	c.conn.Close()
+}
+
+// runReplay implements the "replay" subcommand. "args" are the arguments
+// that follow it. It exits with 1 if a request ended differently than
+// recorded.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:11112", "Provider to replay the association against")
+	calling := fs.String("calling", "", "Calling AE title (default: the recorded one)")
+	called := fs.String("called", "", "Called AE title (default: the recorded one)")
+	timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for each response")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("Usage: dicompot replay [flags] <transcript>")
+	}
+
+	association, received, recorded, err := readTranscript(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read transcript %s: %v", fs.Arg(0), err)
+	}
+	if *calling == "" {
+		*calling = association.CallingAETitle
+	}
+	if *called == "" {
+		*called = association.CalledAETitle
+	}
+	c, err := associate(*addr, association, *calling, *called, *timeout)
+	if err != nil {
+		log.Fatalf("Failed to associate with %s: %v", *addr, err)
+	}
+	defer c.release()
+	log.Printf("-| Replaying %d messages of %s against %s", len(received), fs.Arg(0), *addr)
+
+	differ := 0
+	for _, entry := range received {
+		msg, err := decodeCommand(entry.CommandSet)
+		if err != nil {
+			log.Printf("Skipping an undecodable command: %v", err)
+			continue
+		}
+		// Responses answered the honeypot's own requests, which the
+		// provider makes anew, and are answered anew.
+		if msg.GetStatus() != nil {
+			continue
+		}
+		if err := c.sendMessage(entry.ContextID, msg, entry.DataSet); err != nil {
+			log.Fatalf("Failed to send %v: %v", msg, err)
+		}
+		if msg.CommandField() == dimse.CommandFieldCCancelRq {
+			continue
+		}
+		var replayed outcome
+		for !isFinal(replayed.status) {
+			contextID, rsp, err := c.receive()
+			if err != nil {
+				log.Printf("Failed to receive the response to %v: %v", msg, err)
+				break
+			}
+			if rsp.GetStatus() == nil {
+				if err := c.answer(contextID, rsp); err != nil {
+					log.Fatalf("Failed to answer %v: %v", rsp, err)
+				}
+				continue
+			}
+			if rsp.GetMessageID() == msg.GetMessageID() {
+				replayed.add(rsp.GetStatus())
+			}
+		}
+		want := outcome{}
+		if o := recorded[msg.GetMessageID()]; o != nil {
+			want = *o
+		}
+		verdict := "same"
+		if want.String() != replayed.String() {
+			verdict = "DIFFERS"
+			differ++
+		}
+		fmt.Printf("%s #%d: recorded %s, replayed %s: %s\n", entry.Command, msg.GetMessageID(), want, replayed, verdict)
+	}
+	if differ > 0 {
+		c.release()
+		os.Exit(1)
+	}
+}
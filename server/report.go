@@ -0,0 +1,408 @@
+package main
+
+// This file implements the "report" subcommand, which sums up what the
+// honeypot saw, offline, from its log (-log), its event logs (-eventlog, in
+// JSON) or its event store (-database): the sources, the calling AE titles,
+// the DIMSE commands per day, the query terms searched the most and the
+// instances retrieved. It prints a text report, or JSON or CSV for further
+// processing.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// The types of the lines of the log, which don't say, by message. Only those
+// the report looks at are listed.
+var logMessageTypes = map[string]string{
+	"Connection from":      dicompot.EventConnectionOpened,
+	"Association request":  dicompot.EventAssociationRequest,
+	"C-FIND Search":        dicompot.EventCFindQuery,
+	"C-STORE received":     dicompot.EventCStore,
+	"C-CANCEL received":    dicompot.EventCCancel,
+	"C-MOVE sub-operation": dicompot.EventCMove,
+	"C-GET sub-operation":  dicompot.EventCGet,
+	"HL7 connection from":  dicompot.EventHL7Connection,
+	"DICOMweb request":     dicompot.EventHTTPRequest,
+	"WADO-RS retrieve":     dicompot.EventWADO,
+	"WADO-URI retrieve":    dicompot.EventWADO,
+}
+
+// reportCount is a row of a breakdown.
+type reportCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// reportDay is what was received on a day.
+type reportDay struct {
+	Day      string        `json:"day"`
+	Commands []reportCount `json:"commands"`
+}
+
+// report is the summary.
+type report struct {
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Events   int       `json:"events"`
+	Sessions int       `json:"sessions"`
+	// By sessions.
+	Sources  []reportCount `json:"sources"`
+	AETitles []reportCount `json:"aeTitles"`
+	Days     []reportDay   `json:"days"`
+	// By searches, as Keyword=value.
+	QueryTerms []reportCount `json:"queryTerms"`
+	// Instances retrieved, by command, and by source.
+	Retrieved         []reportCount `json:"retrieved"`
+	RetrievedBySource []reportCount `json:"retrievedBySource"`
+}
+
+// reportBuilder sums up the events.
+type reportBuilder struct {
+	report
+	// The source and calling AE title of each session.
+	sessions map[string]*[2]string
+	days     map[string]map[string]int
+	terms    map[string]int
+	// Retrieved instances, by command and by source.
+	retrieved, retrievedBy map[string]int
+}
+
+func newReportBuilder() *reportBuilder {
+	return &reportBuilder{
+		sessions:    map[string]*[2]string{},
+		days:        map[string]map[string]int{},
+		terms:       map[string]int{},
+		retrieved:   map[string]int{},
+		retrievedBy: map[string]int{},
+	}
+}
+
+// add sums up "event".
+func (b *reportBuilder) add(event dicompot.Event) {
+	b.Events++
+	if b.First.IsZero() || event.Time.Before(b.First) {
+		b.First = event.Time
+	}
+	if event.Time.After(b.Last) {
+		b.Last = event.Time
+	}
+	s := b.sessions[event.SessionID]
+	if s == nil && event.SessionID != "" {
+		s = &[2]string{}
+		b.sessions[event.SessionID] = s
+	}
+	source := event.RemoteIP
+	if ip := stringField(event, "IP"); ip != "" {
+		source = ip
+	}
+	if s != nil {
+		if source != "" {
+			s[0] = source
+		}
+		if ae := event.CallingAETitle; ae != "" {
+			s[1] = ae
+		} else if ae := stringField(event, "CallingAETitle"); ae != "" {
+			s[1] = ae
+		}
+		if s[0] != "" {
+			source = s[0]
+		}
+	}
+
+	command := event.Command
+	if command == "" {
+		command = stringField(event, "Command")
+	}
+	if command != "" && isDIMSERequest(event) {
+		day := event.Time.Format("2006-01-02")
+		if b.days[day] == nil {
+			b.days[day] = map[string]int{}
+		}
+		b.days[day][command]++
+	}
+	if event.Type == dicompot.EventCFindQuery {
+		if name, term := stringField(event, "Type"), stringField(event, "Term"); term != "" {
+			b.terms[name+"="+term]++
+		}
+	}
+	if n := retrievedInstances(event); n > 0 {
+		b.retrieved[retrievalCommand(event)] += n
+		if source != "" {
+			b.retrievedBy[source] += n
+		}
+	}
+}
+
+// retrievedInstances returns how many instances "event" reports retrieved.
+func retrievedInstances(event dicompot.Event) int {
+	switch event.Type {
+	case dicompot.EventCMove, dicompot.EventCGet:
+		if stringField(event, "SOPInstanceUID") != "" && event.Fields["Error"] == nil {
+			return 1
+		}
+	case dicompot.EventWADO:
+		// An int as recorded, a float64 as read back from JSON.
+		switch n := event.Fields["Matches"].(type) {
+		case int:
+			return n
+		case float64:
+			return int(n)
+		}
+	}
+	return 0
+}
+
+func retrievalCommand(event dicompot.Event) string {
+	switch event.Type {
+	case dicompot.EventCMove:
+		return "C-MOVE"
+	case dicompot.EventCGet:
+		return "C-GET"
+	}
+	return strings.TrimSuffix(event.Message, " retrieve")
+}
+
+// sortedCounts returns "counts", the most first, at most "top" if not 0.
+func sortedCounts(counts map[string]int, top int) []reportCount {
+	list := []reportCount{}
+	for name, n := range counts {
+		list = append(list, reportCount{name, n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+	if top > 0 && len(list) > top {
+		list = list[:top]
+	}
+	return list
+}
+
+// build returns the report, the top "top" of each list.
+func (b *reportBuilder) build(top int) report {
+	r := b.report
+	r.Sessions = len(b.sessions)
+	sources, aeTitles := map[string]int{}, map[string]int{}
+	for _, s := range b.sessions {
+		if s[0] != "" {
+			sources[s[0]]++
+		}
+		if s[1] != "" {
+			aeTitles[s[1]]++
+		}
+	}
+	r.Sources = sortedCounts(sources, top)
+	r.AETitles = sortedCounts(aeTitles, top)
+	r.Days = []reportDay{}
+	for day, commands := range b.days {
+		r.Days = append(r.Days, reportDay{Day: day, Commands: sortedCounts(commands, 0)})
+	}
+	sort.Slice(r.Days, func(i, j int) bool {
+		return r.Days[i].Day < r.Days[j].Day
+	})
+	r.QueryTerms = sortedCounts(b.terms, top)
+	r.Retrieved = sortedCounts(b.retrieved, 0)
+	r.RetrievedBySource = sortedCounts(b.retrievedBy, top)
+	return r
+}
+
+// readReportEvents adds the events of "r" to "b": lines of the log, or of
+// an event log. Other lines are skipped.
+func readReportEvents(r io.Reader, b *reportBuilder) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		if _, ok := line["type"]; ok {
+			var event dicompot.Event
+			if json.Unmarshal(scanner.Bytes(), &event) == nil {
+				b.add(event)
+			}
+			continue
+		}
+		if event, ok := logLineEvent(line); ok {
+			b.add(event)
+		}
+	}
+	return scanner.Err()
+}
+
+// logLineEvent returns the event a line of the log records.
+func logLineEvent(line map[string]interface{}) (dicompot.Event, bool) {
+	message, _ := line["msg"].(string)
+	when, _ := line["time"].(string)
+	t, err := time.Parse(logTimeFormat, when)
+	if err != nil {
+		// Logs written before the timestamps had a time zone.
+		t, err = time.ParseInLocation("2006-01-02 15:04:05", when, time.Local)
+	}
+	if message == "" || err != nil {
+		return dicompot.Event{}, false
+	}
+	event := dicompot.Event{Time: t, Message: message, Type: logMessageTypes[message], Fields: map[string]interface{}{}}
+	if level, ok := line["level"].(string); ok {
+		event.Level, _ = logrus.ParseLevel(level)
+	}
+	event.SessionID, _ = line["ID"].(string)
+	for k, v := range line {
+		switch k {
+		case "msg", "time", "level", "ID":
+		default:
+			event.Fields[k] = v
+		}
+	}
+	event.Command = stringField(event, "Command")
+	return event, true
+}
+
+// writeReportText writes "r" for people to read.
+func writeReportText(w io.Writer, r report) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	if r.Events == 0 {
+		fmt.Fprintln(tw, "No events.")
+		return
+	}
+	fmt.Fprintf(tw, "Period:\t%s to %s\n", r.First.Format("2006-01-02 15:04:05"), r.Last.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(tw, "Events:\t%d\n", r.Events)
+	fmt.Fprintf(tw, "Sessions:\t%d\n", r.Sessions)
+	section := func(title string, counts []reportCount) {
+		fmt.Fprintf(tw, "\n%s\n", title)
+		if len(counts) == 0 {
+			fmt.Fprintln(tw, "  none")
+		}
+		for _, c := range counts {
+			fmt.Fprintf(tw, "  %s\t%d\n", c.Name, c.Count)
+		}
+	}
+	section("Sources, by sessions", r.Sources)
+	section("Calling AE titles, by sessions", r.AETitles)
+	fmt.Fprintf(tw, "\nCommands per day\n")
+	if len(r.Days) == 0 {
+		fmt.Fprintln(tw, "  none")
+	}
+	for _, d := range r.Days {
+		var commands []string
+		for _, c := range d.Commands {
+			commands = append(commands, fmt.Sprintf("%s %d", c.Name, c.Count))
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", d.Day, strings.Join(commands, ", "))
+	}
+	section("Query terms, by searches", r.QueryTerms)
+	section("Instances retrieved, by command", r.Retrieved)
+	section("Instances retrieved, by source", r.RetrievedBySource)
+}
+
+// writeReportCSV writes "r" as rows of section, name, day and count.
+func writeReportCSV(w io.Writer, r report) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"section", "name", "day", "count"})
+	row := func(section, name, day string, n int) {
+		cw.Write([]string{section, name, day, fmt.Sprint(n)})
+	}
+	row("events", "", "", r.Events)
+	row("sessions", "", "", r.Sessions)
+	for _, c := range r.Sources {
+		row("source", c.Name, "", c.Count)
+	}
+	for _, c := range r.AETitles {
+		row("ae-title", c.Name, "", c.Count)
+	}
+	for _, d := range r.Days {
+		for _, c := range d.Commands {
+			row("command", c.Name, d.Day, c.Count)
+		}
+	}
+	for _, c := range r.QueryTerms {
+		row("query-term", c.Name, "", c.Count)
+	}
+	for _, c := range r.Retrieved {
+		row("retrieved", c.Name, "", c.Count)
+	}
+	for _, c := range r.RetrievedBySource {
+		row("retrieved-by-source", c.Name, "", c.Count)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "text", "Output format: text, json or csv")
+	database := fs.String("database", "", "Read the events from this event store, as -database, rather than from files")
+	top := fs.Int("top", 20, "Rows of the lists of sources, AE titles and query terms (0: all)")
+	output := fs.String("o", "", "File to write the report to (default: the standard output)")
+	fs.Parse(args)
+	if (fs.NArg() == 0) == (*database == "") {
+		log.Fatalf("Usage: dicompot report [flags] <log or event log>... | -database <store>")
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		log.Fatalf("Invalid -format %q, want text, json or csv", *format)
+	}
+	b := newReportBuilder()
+	if *database != "" {
+		events, err := openDatabase(*database).events(eventQuery{since: time.Unix(0, 0), limit: math.MaxInt32})
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", *database, err)
+		}
+		for _, event := range events {
+			b.add(event)
+		}
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		err = readReportEvents(f, b)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", path, err)
+		}
+	}
+	r := b.build(*top)
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	var err error
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	case "csv":
+		err = writeReportCSV(w, r)
+	default:
+		writeReportText(w, r)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write the report: %v", err)
+	}
+}
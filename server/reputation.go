@@ -0,0 +1,295 @@
+package main
+
+// This file adds what AbuseIPDB and GreyNoise know of the source of every
+// event: AbuseConfidence, AbuseReports and AbuseUsageType from AbuseIPDB,
+// GreyNoiseClassification (benign, malicious or unknown), GreyNoiseName,
+// GreyNoiseNoise (whether it scans the internet) and GreyNoiseRIOT (whether
+// it is a common business service) from GreyNoise, so that mass scanners are
+// told apart without looking them up by hand. As with -rdns, sources are
+// looked up in the background and the first events of a new source go
+// without; lookups are spaced out to stay within the quota of each service.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// How long what a service says of a source is kept.
+	reputationTTL = 24 * time.Hour
+	// How long before a lookup that failed is tried again.
+	reputationRetry = 10 * time.Minute
+	// Sources waiting to be looked up, at most, by service.
+	reputationQueueSize = 256
+)
+
+// The networks that aren't worth a lookup.
+var privateNetworks = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isPublicIP reports whether "ip" is routed on the internet.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// reputationService is a source of reputation, looked up by one worker.
+type reputationService struct {
+	name string
+	// lookup returns the fields of "ip".
+	lookup func(ip string) (map[string]interface{}, error)
+	queue  chan string
+}
+
+type reputationEntry struct {
+	// nil while the lookup is pending, or after it failed.
+	fields  map[string]interface{}
+	expires time.Time
+}
+
+// reputation is an EventSink that adds the reputation of the source to the
+// events it hands to "next".
+type reputation struct {
+	next     dicompot.EventSink
+	services []*reputationService
+	client   *http.Client
+	// Closed by Close. The queues never are, for Record not to panic on
+	// events of sessions still open.
+	closing chan struct{}
+	once    sync.Once
+
+	mu sync.Mutex
+	// By service, then IP.
+	cache map[string]map[string]reputationEntry
+}
+
+// newReputation returns the enricher for -abuseipdbkey and -greynoisekey,
+// looking each source up at most "perDay" times a day per service, or nil if
+// neither is set.
+func newReputation(abuseIPDBKey, greyNoiseKey string, perDay int, next dicompot.EventSink) *reputation {
+	if abuseIPDBKey == "" && greyNoiseKey == "" {
+		return nil
+	}
+	if perDay <= 0 {
+		log.Fatalf("Invalid -reputationrate %d, want at least 1", perDay)
+	}
+	r := &reputation{
+		next:    next,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		closing: make(chan struct{}),
+		cache:   map[string]map[string]reputationEntry{},
+	}
+	if abuseIPDBKey != "" {
+		r.add("AbuseIPDB", func(ip string) (map[string]interface{}, error) {
+			return r.abuseIPDB(abuseIPDBKey, ip)
+		})
+	}
+	if greyNoiseKey != "" {
+		r.add("GreyNoise", func(ip string) (map[string]interface{}, error) {
+			return r.greyNoise(greyNoiseKey, ip)
+		})
+	}
+	interval := 24 * time.Hour / time.Duration(perDay)
+	for _, s := range r.services {
+		go r.work(s, interval)
+		log.Printf("-| Looking up the reputation of sources with %s, every %v at most", s.name, interval)
+	}
+	return r
+}
+
+func (r *reputation) add(name string, lookup func(ip string) (map[string]interface{}, error)) {
+	r.services = append(r.services, &reputationService{name: name, lookup: lookup, queue: make(chan string, reputationQueueSize)})
+	r.cache[name] = map[string]reputationEntry{}
+}
+
+// Record adds what is known of the source of "event", has it looked up
+// otherwise, and hands the event to "next".
+func (r *reputation) Record(event dicompot.Event) error {
+	ip := sourceIP(event)
+	if ip == nil || !isPublicIP(ip) {
+		return r.next.Record(event)
+	}
+	var fields map[string]interface{}
+	now := time.Now()
+	closed := false
+	select {
+	case <-r.closing:
+		closed = true
+	default:
+	}
+	r.mu.Lock()
+	for _, s := range r.services {
+		cache := r.cache[s.name]
+		e, ok := cache[ip.String()]
+		if ok && now.Before(e.expires) {
+			for name, value := range e.fields {
+				if fields == nil {
+					fields = map[string]interface{}{}
+				}
+				fields[name] = value
+			}
+			continue
+		}
+		if closed {
+			continue
+		}
+		select {
+		case s.queue <- ip.String():
+			cache[ip.String()] = reputationEntry{expires: now.Add(reputationTTL)}
+		default:
+		}
+	}
+	r.mu.Unlock()
+	if fields != nil {
+		for name, value := range event.Fields {
+			fields[name] = value
+		}
+		event.Fields = fields
+	}
+	return r.next.Record(event)
+}
+
+// work looks up the sources queued for "s", one every "interval" at most,
+// until the enricher is closed.
+func (r *reputation) work(s *reputationService, interval time.Duration) {
+	var last time.Time
+	for {
+		var ip string
+		select {
+		case ip = <-s.queue:
+		case <-r.closing:
+			return
+		}
+		select {
+		case <-time.After(time.Until(last.Add(interval))):
+		case <-r.closing:
+			return
+		}
+		last = time.Now()
+		fields, err := s.lookup(ip)
+		e := reputationEntry{fields: fields, expires: time.Now().Add(reputationTTL)}
+		if err != nil {
+			log.Printf("%s: %s: %v", s.name, ip, err)
+			e = reputationEntry{expires: time.Now().Add(reputationRetry)}
+		}
+		r.mu.Lock()
+		cache := r.cache[s.name]
+		for k, old := range cache {
+			if !time.Now().Before(old.expires) {
+				delete(cache, k)
+			}
+		}
+		cache[ip] = e
+		r.mu.Unlock()
+	}
+}
+
+// get requests "rawURL" and decodes the JSON response into "out". Statuses
+// in "ok", besides 200, have their body decoded as well.
+func (r *reputation) get(rawURL string, header http.Header, out interface{}, ok ...int) error {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	accepted := resp.StatusCode == http.StatusOK
+	for _, status := range ok {
+		accepted = accepted || resp.StatusCode == status
+	}
+	if !accepted {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// abuseIPDB checks "ip" against the reports of the last 90 days.
+func (r *reputation) abuseIPDB(key, ip string) (map[string]interface{}, error) {
+	var resp struct {
+		Data struct {
+			AbuseConfidenceScore int    `json:"abuseConfidenceScore"`
+			TotalReports         int    `json:"totalReports"`
+			UsageType            string `json:"usageType"`
+		} `json:"data"`
+	}
+	err := r.get("https://api.abuseipdb.com/api/v2/check?maxAgeInDays=90&ipAddress="+url.QueryEscape(ip),
+		http.Header{"Key": {key}}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{
+		"AbuseConfidence": resp.Data.AbuseConfidenceScore,
+		"AbuseReports":    resp.Data.TotalReports,
+	}
+	if resp.Data.UsageType != "" {
+		fields["AbuseUsageType"] = resp.Data.UsageType
+	}
+	return fields, nil
+}
+
+// greyNoise looks "ip" up with the Community API, which answers 404 for the
+// sources GreyNoise hasn't seen.
+func (r *reputation) greyNoise(key, ip string) (map[string]interface{}, error) {
+	var resp struct {
+		Noise          bool   `json:"noise"`
+		RIOT           bool   `json:"riot"`
+		Classification string `json:"classification"`
+		Name           string `json:"name"`
+	}
+	err := r.get("https://api.greynoise.io/v3/community/"+url.PathEscape(ip),
+		http.Header{"Key": {key}}, &resp, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{
+		"GreyNoiseNoise": resp.Noise,
+		"GreyNoiseRIOT":  resp.RIOT,
+	}
+	if resp.Classification != "" {
+		fields["GreyNoiseClassification"] = resp.Classification
+	}
+	if resp.Name != "" && resp.Name != "unknown" {
+		fields["GreyNoiseName"] = resp.Name
+	}
+	return fields, nil
+}
+
+// Close stops the lookups and closes "next".
+func (r *reputation) Close() error {
+	r.once.Do(func() { close(r.closing) })
+	return r.next.Close()
+}
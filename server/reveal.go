@@ -0,0 +1,227 @@
+package main
+
+// This file reveals the archive bit by bit. A source IP sees a few studies on
+// first contact, and more with every association it comes back for, so that
+// casual scrapers go away with little while persistent ones show themselves.
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// How many of the latest session IDs of a source are remembered, so that each
+// association counts once, however many requests it makes.
+const revealRecentSessions = 16
+
+// revealSource is the history of a source IP.
+type revealSource struct {
+	Sessions  int       `json:"sessions"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+
+	recent []string
+}
+
+// reveal decides how much of the archive each source IP sees.
+type reveal struct {
+	// Studies seen on first contact, and the factor by which that grows on
+	// every further session.
+	first  int
+	growth float64
+	// Where the histories are kept across restarts. "" if they aren't.
+	path string
+
+	mu sync.Mutex
+	// The StudyInstanceUIDs of the archive, in the order they are revealed.
+	studies []string
+	sources map[string]*revealSource
+}
+
+// newReveal returns the reveal for -reveal and friends, or nil if every
+// source sees the whole archive. The histories saved in "path", if any, are
+// loaded.
+func newReveal(first int, growth float64, path string, datasets map[string]*dicom.DataSet) *reveal {
+	if first <= 0 {
+		return nil
+	}
+	if growth < 1 {
+		log.Fatalf("Invalid -revealgrowth %v, want at least 1", growth)
+	}
+	r := &reveal{
+		first:   first,
+		growth:  growth,
+		studies: revealOrder(datasets),
+		path:    path,
+		sources: map[string]*revealSource{},
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &r.sources)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to load -revealstate %s: %v", path, err)
+		}
+	}
+	return r
+}
+
+// revealOrder returns the StudyInstanceUIDs of "datasets", shuffled by hash,
+// so that the order is the same on every restart but unrelated to the UIDs.
+func revealOrder(datasets map[string]*dicom.DataSet) []string {
+	seen := map[string]bool{}
+	var studies []string
+	for _, ds := range datasets {
+		uid := studyUID(ds)
+		if uid != "" && !seen[uid] {
+			seen[uid] = true
+			studies = append(studies, uid)
+		}
+	}
+	key := func(uid string) string {
+		sum := sha256.Sum256([]byte(uid))
+		return string(sum[:])
+	}
+	sort.Slice(studies, func(i, j int) bool {
+		return key(studies[i]) < key(studies[j])
+	})
+	return studies
+}
+
+func studyUID(ds *dicom.DataSet) string {
+	elem, err := ds.FindElementByTag(dicomtag.StudyInstanceUID)
+	if err != nil {
+		return ""
+	}
+	uid, _ := elem.GetString()
+	return strings.TrimSpace(uid)
+}
+
+// visit counts session "sessionID" of "ip", if it is new. It reports the
+// number of sessions of "ip" so far, and whether this one is new. An empty
+// "sessionID" is never counted.
+func (r *reveal) visit(ip, sessionID string) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	src := r.sources[ip]
+	if src == nil {
+		src = &revealSource{FirstSeen: time.Now()}
+		r.sources[ip] = src
+	}
+	if sessionID == "" {
+		return src.Sessions, false
+	}
+	for _, id := range src.recent {
+		if id == sessionID {
+			return src.Sessions, false
+		}
+	}
+	if len(src.recent) == revealRecentSessions {
+		src.recent = src.recent[1:]
+	}
+	src.recent = append(src.recent, sessionID)
+	src.Sessions++
+	src.LastSeen = time.Now()
+	if r.path != "" {
+		r.save()
+	}
+	return src.Sessions, true
+}
+
+// save writes the histories to r.path. r.mu must be held.
+func (r *reveal) save() {
+	data, err := json.Marshal(r.sources)
+	if err == nil {
+		tmp := r.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, r.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save -revealstate %s: %v", r.path, err)
+	}
+}
+
+// order returns the StudyInstanceUIDs of the archive, in the order they are
+// revealed.
+func (r *reveal) order() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.studies
+}
+
+// load reveals the studies of "datasets" from now on, the histories
+// unchanged.
+func (r *reveal) load(datasets map[string]*dicom.DataSet) {
+	studies := revealOrder(datasets)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.studies = studies
+}
+
+// limit returns how many of "studies" a source sees after "sessions"
+// sessions. Sources that never had one, e.g., DICOMweb clients, see as many
+// as on first contact.
+func (r *reveal) limit(sessions, studies int) int {
+	if sessions < 1 {
+		sessions = 1
+	}
+	n := float64(r.first) * math.Pow(r.growth, float64(sessions-1))
+	if n >= float64(studies) {
+		return studies
+	}
+	return int(n)
+}
+
+// visibleStudies returns the StudyInstanceUIDs "ip" sees in session
+// "sessionID", or nil if it sees them all. The session is counted as it goes,
+// and logged when new. DICOMweb requests, which are sessions of their own,
+// pass an empty "sessionID", so that they see what the source has earned
+// over DIMSE without earning more.
+func (ss *server) visibleStudies(ip, sessionID string) map[string]bool {
+	r := ss.reveal
+	if r == nil {
+		return nil
+	}
+	sessions, isNew := r.visit(ip, sessionID)
+	studies := r.order()
+	n := r.limit(sessions, len(studies))
+	if isNew {
+		ss.record(logrus.WarnLevel, dicompot.EventReveal, sessionID, "Source history", map[string]interface{}{
+			"IP":       ip,
+			"Sessions": sessions,
+			"Revealed": n,
+			"Studies":  len(studies),
+		})
+	}
+	if n == len(studies) {
+		return nil
+	}
+	visible := make(map[string]bool, n)
+	for _, uid := range studies[:n] {
+		visible[uid] = true
+	}
+	return visible
+}
+
+// remoteIP returns the IP of an http.Request.RemoteAddr.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
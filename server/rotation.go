@@ -0,0 +1,201 @@
+package main
+
+// This file rotates the archive, so that repeated scans don't find the same
+// one forever. Every period, a new subset of the studies loaded is served,
+// and their dates are moved to the last few weeks, as if they had just been
+// acquired. Matching and retrieval both see the moved dates.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// Layout of DA values.
+const dicomDateLayout = "20060102"
+
+// rotation schedules which studies are served, and with what dates.
+type rotation struct {
+	period time.Duration
+	// Part of the studies served at a time, between 0 and 1.
+	fraction float64
+	// The studies served are dated within this many days before the
+	// rotation.
+	recentDays int
+
+	mu sync.Mutex
+	// Everything loaded, keyed by path, as loaded.
+	archive map[string]*dicom.DataSet
+	// Days added to the dates of each study served, by StudyInstanceUID.
+	shifts map[string]int
+}
+
+// newRotation returns the rotation for -rotate and friends, or nil if the
+// archive doesn't rotate.
+func newRotation(period time.Duration, fraction float64, recentDays int, archive map[string]*dicom.DataSet) *rotation {
+	if period <= 0 {
+		return nil
+	}
+	if fraction <= 0 || fraction > 1 {
+		log.Fatalf("Invalid -rotatefraction %v, want a fraction between 0 and 1", fraction)
+	}
+	if recentDays < 1 {
+		log.Fatalf("Invalid -recentdays %d, want at least 1", recentDays)
+	}
+	return &rotation{period: period, fraction: fraction, recentDays: recentDays, archive: archive}
+}
+
+// draw returns a number in [0, 1) for "uid" in rotation "epoch", the same
+// every time, and different from epoch to epoch.
+func (r *rotation) draw(epoch int64, salt, uid string) float64 {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d/%s/%s", epoch, salt, uid)))
+	return float64(binary.BigEndian.Uint64(sum[:])>>11) / (1 << 53)
+}
+
+// rotate returns the datasets served in rotation "epoch", which starts at
+// "start", with their dates moved.
+func (r *rotation) rotate(epoch int64, start time.Time) map[string]*dicom.DataSet {
+	archive := r.loaded()
+	// The first dataset of each study stands for it.
+	studies := map[string]*dicom.DataSet{}
+	for _, ds := range archive {
+		if uid := studyUID(ds); uid != "" && studies[uid] == nil {
+			studies[uid] = ds
+		}
+	}
+	shifts := map[string]int{}
+	for uid, ds := range studies {
+		if r.draw(epoch, "serve", uid) >= r.fraction {
+			continue
+		}
+		shifts[uid] = 0
+		elem, err := ds.FindElementByTag(dicomtag.StudyDate)
+		if err != nil {
+			continue
+		}
+		value, _ := elem.GetString()
+		studyDate, err := time.Parse(dicomDateLayout, strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		daysAgo := int(r.draw(epoch, "date", uid) * float64(r.recentDays))
+		date := start.AddDate(0, 0, -daysAgo)
+		date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		shifts[uid] = int(date.Sub(studyDate).Hours() / 24)
+	}
+	if len(shifts) == 0 {
+		// Never serve an empty archive.
+		for uid := range studies {
+			shifts[uid] = 0
+			break
+		}
+	}
+
+	r.mu.Lock()
+	r.shifts = shifts
+	r.mu.Unlock()
+
+	served := map[string]*dicom.DataSet{}
+	for path, ds := range archive {
+		if shift, ok := shifts[studyUID(ds)]; ok {
+			served[path] = shiftedCopy(ds, shift)
+		}
+	}
+	return served
+}
+
+// loaded returns everything loaded.
+func (r *rotation) loaded() map[string]*dicom.DataSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.archive
+}
+
+// load replaces what is loaded, from the next rotation on.
+func (r *rotation) load(archive map[string]*dicom.DataSet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.archive = archive
+}
+
+// shiftedCopy returns "ds" with "days" added to its dates. The elements that
+// don't change are shared.
+func shiftedCopy(ds *dicom.DataSet, days int) *dicom.DataSet {
+	out := &dicom.DataSet{Elements: make([]*dicom.Element, len(ds.Elements))}
+	for i, elem := range ds.Elements {
+		out.Elements[i] = shiftedElement(elem, days)
+	}
+	return out
+}
+
+// shiftDates adds "days" to the DA and DT values of "ds", in place.
+func shiftDates(ds *dicom.DataSet, days int) {
+	for i, elem := range ds.Elements {
+		ds.Elements[i] = shiftedElement(elem, days)
+	}
+}
+
+// shiftedElement returns "elem" with "days" added to its value, or "elem"
+// itself if it isn't a date.
+func shiftedElement(elem *dicom.Element, days int) *dicom.Element {
+	if days == 0 || (elem.VR != "DA" && elem.VR != "DT") {
+		return elem
+	}
+	shifted := *elem
+	shifted.Value = make([]interface{}, len(elem.Value))
+	for i, v := range elem.Value {
+		shifted.Value[i] = v
+		s, ok := v.(string)
+		if !ok || len(strings.TrimSpace(s)) < 8 {
+			continue
+		}
+		s = strings.TrimSpace(s)
+		date, err := time.Parse(dicomDateLayout, s[:8])
+		if err != nil {
+			continue
+		}
+		shifted.Value[i] = date.AddDate(0, 0, days).Format(dicomDateLayout) + s[8:]
+	}
+	return &shifted
+}
+
+// shiftFor returns the days added to the dates of the study of "ds".
+func (r *rotation) shiftFor(ds *dicom.DataSet) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.shifts[studyUID(ds)]
+}
+
+// epoch returns the rotation "t" falls in, and when it started.
+func (r *rotation) epoch(t time.Time) (int64, time.Time) {
+	n := t.UnixNano() / int64(r.period)
+	return n, time.Unix(0, n*int64(r.period))
+}
+
+// rotate serves the rotation of the current period, and returns when the
+// next one starts.
+func (ss *server) rotate() time.Time {
+	epoch, start := ss.rotation.epoch(time.Now())
+	served := ss.rotation.rotate(epoch, start)
+	ss.mu.Lock()
+	ss.datasets = served
+	ss.mu.Unlock()
+	log.Printf("-| Rotated the archive: serving %d of %d images", len(served), len(ss.rotation.loaded()))
+	return start.Add(ss.rotation.period)
+}
+
+// runRotation rotates the archive at the start of every period, the first
+// being at "next".
+func (ss *server) runRotation(next time.Time) {
+	for {
+		time.Sleep(time.Until(next))
+		next = ss.rotate()
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+// This file recognizes the tools and crawlers that scan the Internet for
+// DICOM, and adds the name of the tool, as the field Scanner, to the events
+// of their sessions, so that the background noise is told from targeted
+// activity. Tools are known by what they send during association
+// negotiation (the AE titles, implementation class UID and version name of
+// their defaults, the contexts they propose), crawlers by their host names,
+// networks and user agents, and port scans by connections closed without a
+// byte or with no association request. An EventScanner records each session
+// recognized.
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// How long the sessions that don't say when they end, those of DICOMweb,
+// are remembered.
+const scannerSessionTimeout = 10 * time.Minute
+
+// The crawlers known by the domain of their host names.
+var crawlerDomains = map[string]string{
+	".shodan.io":                "shodan",
+	".censys-scanner.com":       "censys",
+	".binaryedge.ninja":         "binaryedge",
+	".shadowserver.org":         "shadowserver",
+	".internet-measurement.com": "driftnet",
+	".onyphe.net":               "onyphe",
+}
+
+// The tools known by their user agents.
+var scannerUserAgents = map[string]string{
+	"CensysInspect":         "censys",
+	"Expanse":               "expanse",
+	"InternetMeasurement":   "driftnet",
+	"l9explore":             "leakix",
+	"masscan":               "masscan",
+	"Nmap Scripting Engine": "nmap",
+	"zgrab":                 "zgrab",
+}
+
+// The default calling AE titles of the command line tools of DCMTK and
+// dcm4che, which are named after them.
+var scuAETitles = map[string]bool{"ECHOSCU": true, "FINDSCU": true, "MOVESCU": true, "GETSCU": true, "STORESCU": true}
+
+// scannerSession is what is known of a session.
+type scannerSession struct {
+	last time.Time
+	// The tool, once known.
+	scanner string
+
+	hostname, asOrganization, userAgent string
+	callingAETitle, calledAETitle       string
+	implUID, implVersion                string
+	// The transfer syntaxes proposed, comma-separated, and the number of
+	// presentation contexts.
+	transferSyntaxes string
+	contexts         int
+	// Whether the presentation contexts were negotiated, and the
+	// connection closed.
+	negotiated, closed bool
+	bytesReceived      int64
+}
+
+// scannerSignature recognizes a tool in what is known of a session.
+type scannerSignature struct {
+	description string
+	// The name of the tool, or "" if the session isn't of it.
+	match func(s *scannerSession) string
+}
+
+var scannerSignatures = []scannerSignature{
+	{
+		description: "Internet crawler, by its host name or network",
+		match: func(s *scannerSession) string {
+			for domain, name := range crawlerDomains {
+				if strings.HasSuffix(strings.TrimSuffix(s.hostname, "."), domain) {
+					return name
+				}
+			}
+			if strings.Contains(strings.ToUpper(s.asOrganization), "CENSYS") {
+				return "censys"
+			}
+			return ""
+		},
+	},
+	{
+		description: "Tool, by its user agent",
+		match: func(s *scannerSession) string {
+			for ua, name := range scannerUserAgents {
+				if strings.Contains(s.userAgent, ua) {
+					return name
+				}
+			}
+			return ""
+		},
+	},
+	{
+		// nmap's dicom library passes for DCMTK 3.6.2's echoscu, but
+		// proposes Verification in Implicit VR Little Endian only.
+		description: "nmap dicom-ping or dicom-brute",
+		match: func(s *scannerSession) string {
+			if s.negotiated && s.implVersion == "OFFIS_DCMTK_362" && s.callingAETitle == "ECHOSCU" &&
+				s.contexts == 1 && s.transferSyntaxes == "1.2.840.10008.1.2" {
+				return "nmap"
+			}
+			return ""
+		},
+	},
+	{
+		description: "Command line tool of DCMTK or dcm4che, with its defaults",
+		match: func(s *scannerSession) string {
+			ae := strings.ToUpper(s.callingAETitle)
+			if !scuAETitles[ae] {
+				return ""
+			}
+			switch {
+			case s.negotiated && strings.HasPrefix(s.implUID, "1.2.276.0.7230010.3."):
+				return "dcmtk-" + strings.ToLower(ae)
+			case s.negotiated && strings.HasPrefix(s.implUID, "1.2.40.0.13.1."):
+				return "dcm4che-" + strings.ToLower(ae)
+			case s.closed && !s.negotiated && s.calledAETitle == "ANY-SCP":
+				// Rejected before the implementation was told.
+				return "dcmtk-" + strings.ToLower(ae)
+			}
+			return ""
+		},
+	},
+	{
+		description: "pynetdicom, with its defaults",
+		match: func(s *scannerSession) string {
+			if strings.HasPrefix(s.implUID, "1.2.826.0.1.3680043.9.3811.") && s.callingAETitle == "PYNETDICOM" {
+				return "pynetdicom"
+			}
+			return ""
+		},
+	},
+	{
+		description: "Port scan, a connection closed without a byte",
+		match: func(s *scannerSession) string {
+			if s.closed && s.bytesReceived == 0 {
+				return "port-scan"
+			}
+			return ""
+		},
+	},
+	{
+		description: "Probe of another protocol, a connection closed without an association request",
+		match: func(s *scannerSession) string {
+			if s.closed && s.bytesReceived > 0 && s.callingAETitle == "" && s.calledAETitle == "" {
+				return "non-dicom-probe"
+			}
+			return ""
+		},
+	},
+}
+
+// scanners is an EventSink that adds the tool of their session to the
+// events it hands to "next".
+type scanners struct {
+	next dicompot.EventSink
+
+	mu       sync.Mutex
+	sessions map[string]*scannerSession
+	pruned   time.Time
+}
+
+// newScanners returns the enricher for -scanners, or nil if tools aren't
+// recognized.
+func newScanners(enabled bool, next dicompot.EventSink) *scanners {
+	if !enabled {
+		return nil
+	}
+	log.Printf("-| Recognizing scanners")
+	return &scanners{next: next, sessions: map[string]*scannerSession{}, pruned: time.Now()}
+}
+
+// Record adds the tool of the session of "event", if known, and hands the
+// event, with an EventScanner if it gave the tool away, to "next".
+func (ss *scanners) Record(event dicompot.Event) error {
+	if event.SessionID == "" {
+		return ss.next.Record(event)
+	}
+	scanner, description := ss.check(event)
+	if scanner != "" {
+		fields := map[string]interface{}{"Scanner": scanner}
+		for name, value := range event.Fields {
+			fields[name] = value
+		}
+		event.Fields = fields
+	}
+	err := ss.next.Record(event)
+	if description != "" {
+		e := dicompot.NewEvent(logrus.InfoLevel, dicompot.EventScanner, event.SessionID, "Scanner", map[string]interface{}{
+			"Scanner":     scanner,
+			"Description": description,
+			"Trigger":     event.Type,
+		})
+		if recordErr := ss.next.Record(e); err == nil {
+			err = recordErr
+		}
+	}
+	return err
+}
+
+// check returns the tool of the session of "event", if known, and the
+// description of the signature if "event" gave it away.
+func (ss *scanners) check(event dicompot.Event) (string, string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	now := time.Now()
+	if now.Sub(ss.pruned) > scannerSessionTimeout {
+		for id, s := range ss.sessions {
+			if now.Sub(s.last) > scannerSessionTimeout {
+				delete(ss.sessions, id)
+			}
+		}
+		ss.pruned = now
+	}
+	s := ss.sessions[event.SessionID]
+	if s == nil {
+		s = &scannerSession{}
+		ss.sessions[event.SessionID] = s
+	}
+	s.last = now
+	if event.Type == dicompot.EventConnectionClosed {
+		delete(ss.sessions, event.SessionID)
+	}
+	if s.scanner != "" {
+		return s.scanner, ""
+	}
+
+	if name := stringField(event, "RemoteHostname"); name != "" {
+		s.hostname = name
+	}
+	if org := stringField(event, "ASOrganization"); org != "" {
+		s.asOrganization = org
+	}
+	switch event.Type {
+	case dicompot.EventHTTPRequest:
+		s.userAgent = stringField(event, "UserAgent")
+	case dicompot.EventAssociationRequest:
+		s.callingAETitle = stringField(event, "CallingAETitle")
+		s.calledAETitle = stringField(event, "CalledAETitle")
+	case dicompot.EventAssociationClient:
+		if uid := stringField(event, "ImplementationClassUID"); uid != "" {
+			s.implUID = uid
+			s.implVersion = stringField(event, "Version")
+		}
+	case dicompot.EventContextNegotiation:
+		s.negotiated = true
+		s.transferSyntaxes = stringField(event, "TransferSyntaxes")
+		contexts, _ := event.Fields["Contexts"].([]string)
+		s.contexts = len(contexts)
+	case dicompot.EventConnectionClosed:
+		s.closed = true
+		s.bytesReceived, _ = event.Fields["BytesReceived"].(int64)
+	}
+	for _, sig := range scannerSignatures {
+		if name := sig.match(s); name != "" {
+			s.scanner = name
+			return name, sig.description
+		}
+	}
+	return "", ""
+}
+
+// Close closes "next".
+func (ss *scanners) Close() error {
+	return ss.next.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+// This file stamps the identity of the sensor on every event, for fleets of
+// honeypots that report to one backend to tell them apart: the node ID,
+// e.g., the machine or container, as NodeID, the name of the sensor, e.g.,
+// where it is deployed, as Sensor, and free tags, as SensorTags.
+
+import (
+	"log"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// sensorIdentity is an EventSink that adds the identity of the sensor to
+// the events it hands to "next".
+type sensorIdentity struct {
+	next   dicompot.EventSink
+	fields map[string]interface{}
+}
+
+// newSensorIdentity returns the enricher for -nodeid, -sensorname and
+// -sensortags, or nil if none is set. "tags" is comma-separated.
+func newSensorIdentity(nodeID, name, tags string, next dicompot.EventSink) *sensorIdentity {
+	fields := map[string]interface{}{}
+	if nodeID != "" {
+		fields["NodeID"] = nodeID
+	}
+	if name != "" {
+		fields["Sensor"] = name
+	}
+	var tagList []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tagList = append(tagList, tag)
+		}
+	}
+	if len(tagList) > 0 {
+		fields["SensorTags"] = tagList
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	log.Printf("-| Stamping the events with the identity of the sensor: %v", fields)
+	return &sensorIdentity{next: next, fields: fields}
+}
+
+// Record adds the identity of the sensor to "event", and hands it to "next".
+// The fields of the event win, e.g., those of events relayed from another
+// sensor.
+func (s *sensorIdentity) Record(event dicompot.Event) error {
+	fields := make(map[string]interface{}, len(s.fields)+len(event.Fields))
+	for name, value := range s.fields {
+		fields[name] = value
+	}
+	for name, value := range event.Fields {
+		fields[name] = value
+	}
+	event.Fields = fields
+	return s.next.Record(event)
+}
+
+// Close closes "next".
+func (s *sensorIdentity) Close() error {
+	return s.next.Close()
+}
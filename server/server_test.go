@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/nsmfoo/dicompot"
+)
+
+func TestOnCFindWorklistEmptyIdentifier(t *testing.T) {
+	ss := &server{worklist: newWorklist(3), sink: dicompot.MultiSink{}}
+	ch := make(chan dicompot.CFindResult, 16)
+	ss.onCFind(dicomuid.ImplicitVRLittleEndian, dicomuid.ModalityWorklistInformationFind, nil, "session", "192.0.2.1", false, ch)
+	var results []dicompot.CFindResult
+	for result := range ch {
+		results = append(results, result)
+	}
+	if len(results) != 1 || results[0].Err == nil {
+		t.Errorf("an empty identifier returned %v, want a failure", results)
+	}
+
+	ch = make(chan dicompot.CFindResult, 16)
+	filters := []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "")}
+	ss.onCFind(dicomuid.ImplicitVRLittleEndian, dicomuid.ModalityWorklistInformationFind, filters, "session", "192.0.2.1", false, ch)
+	n := 0
+	for result := range ch {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("a universal key matched %d items, want 3", n)
+	}
+}
+
+func TestMatchDataSetWithoutKeys(t *testing.T) {
+	ds := &dicom.DataSet{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "Doe^John")}}
+	if _, ok, err := matchDataSet("", ds, nil); ok || err == nil {
+		t.Errorf("matchDataSet without keys = %v, %v, want an error", ok, err)
+	}
+}
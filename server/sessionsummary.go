@@ -0,0 +1,175 @@
+package main
+
+// This file sums up every DICOM session, when its connection closes, in one
+// EventSessionSummary: how long it lasted, the bytes exchanged, the
+// commands, the query terms and what they matched, the objects stored and
+// retrieved, and the exploit attempts, with the fields the enrichers added
+// to the connection-closed event, e.g., the location of the source, its
+// scanner or campaign. Analysts triage a line per session rather than
+// piecing the session together from its events.
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// How long the sessions that don't say when they end, those of DICOMweb,
+// are remembered.
+const sessionSummaryTimeout = 10 * time.Minute
+
+// The distinct query terms listed in a summary, at most.
+const sessionSummaryTerms = 20
+
+// sessionTally is what a session did so far.
+type sessionTally struct {
+	last                         time.Time
+	calledAETitle                string
+	commands                     map[string]int
+	terms                        []string
+	matches, stored, retrieved   int
+	exploits, aborts, rejections int
+	malformedPDUs                int
+}
+
+// sessionSummaries is an EventSink that hands the events to "next", and
+// the summary of each DICOM session after its connection-closed event.
+type sessionSummaries struct {
+	next dicompot.EventSink
+
+	mu       sync.Mutex
+	sessions map[string]*sessionTally
+	pruned   time.Time
+}
+
+// newSessionSummaries returns the sink for -sessionsummary, or nil if the
+// sessions aren't summed up.
+func newSessionSummaries(enabled bool, next dicompot.EventSink) *sessionSummaries {
+	if !enabled {
+		return nil
+	}
+	log.Printf("-| Summing up every session when it closes")
+	return &sessionSummaries{next: next, sessions: map[string]*sessionTally{}, pruned: time.Now()}
+}
+
+// Record tallies "event", and hands it to "next", followed by the summary of
+// its session if it closed the connection.
+func (ss *sessionSummaries) Record(event dicompot.Event) error {
+	// The sensors sum up the sessions they forward.
+	if _, forwarded := event.Fields["ForwardedBy"]; forwarded || event.SessionID == "" {
+		return ss.next.Record(event)
+	}
+	t := ss.tally(event)
+	err := ss.next.Record(event)
+	if t != nil {
+		if recordErr := ss.next.Record(sessionSummary(event, t)); err == nil {
+			err = recordErr
+		}
+	}
+	return err
+}
+
+// tally adds "event" to what its session did, and returns the tally if it
+// closed the connection.
+func (ss *sessionSummaries) tally(event dicompot.Event) *sessionTally {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	now := time.Now()
+	if now.Sub(ss.pruned) > sessionSummaryTimeout {
+		for id, t := range ss.sessions {
+			if now.Sub(t.last) > sessionSummaryTimeout {
+				delete(ss.sessions, id)
+			}
+		}
+		ss.pruned = now
+	}
+	t := ss.sessions[event.SessionID]
+	if t == nil {
+		t = &sessionTally{commands: map[string]int{}}
+		ss.sessions[event.SessionID] = t
+	}
+	t.last = now
+
+	if event.Command != "" && isDIMSERequest(event) {
+		t.commands[event.Command]++
+	}
+	switch event.Type {
+	case dicompot.EventAssociationRequest:
+		t.calledAETitle = stringField(event, "CalledAETitle")
+	case dicompot.EventCFindQuery, dicompot.EventCMove, dicompot.EventCGet:
+		if terms := queryTerms(event); terms != "" && len(t.terms) < sessionSummaryTerms {
+			seen := false
+			for _, s := range t.terms {
+				seen = seen || s == terms
+			}
+			if !seen {
+				t.terms = append(t.terms, terms)
+			}
+		}
+	case dicompot.EventCFindResult:
+		if n, ok := event.Fields["Matches"].(int); ok {
+			t.matches += n
+		}
+	case dicompot.EventExploitAttempt:
+		t.exploits++
+	case dicompot.EventAbort:
+		t.aborts++
+	case dicompot.EventAssociationRejected:
+		t.rejections++
+	case dicompot.EventMalformedPDU:
+		t.malformedPDUs++
+	}
+	switch objectDirection(event) {
+	case "stored":
+		t.stored++
+	case "retrieved":
+		t.retrieved += retrievedInstances(event)
+	}
+	if event.Type != dicompot.EventConnectionClosed {
+		return nil
+	}
+	delete(ss.sessions, event.SessionID)
+	return t
+}
+
+// sessionSummary returns the summary of the session "closed" closed, what
+// "t" tallied over the fields of "closed".
+func sessionSummary(closed dicompot.Event, t *sessionTally) dicompot.Event {
+	fields := map[string]interface{}{}
+	for name, value := range closed.Fields {
+		fields[name] = value
+	}
+	for name, value := range map[string]interface{}{
+		"Commands":        t.commands,
+		"Matches":         t.matches,
+		"Stored":          t.stored,
+		"Retrieved":       t.retrieved,
+		"ExploitAttempts": t.exploits,
+		"Aborts":          t.aborts,
+		"Rejections":      t.rejections,
+		"MalformedPDUs":   t.malformedPDUs,
+	} {
+		fields[name] = value
+	}
+	if len(t.terms) > 0 {
+		fields["QueryTerms"] = t.terms
+	}
+	if t.calledAETitle != "" {
+		fields["CalledAETitle"] = t.calledAETitle
+	}
+	// The session, as the connection-closed event knew it: it may be over
+	// by now.
+	e := closed
+	e.Type = dicompot.EventSessionSummary
+	e.Message = "Session closed"
+	e.Command = ""
+	e.Fields = fields
+	return e
+}
+
+// Close closes "next".
+func (ss *sessionSummaries) Close() error {
+	return ss.next.Close()
+}
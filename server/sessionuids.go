@@ -0,0 +1,176 @@
+package main
+
+// This file gives every session UIDs of its own. Two attackers who compare the
+// UIDs they were served can't tell they hit the same honeypot, while the
+// operator keeps the mapping. A UID minted in one session still resolves in
+// another, so that a C-MOVE may follow the C-FIND of an earlier association.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// Most UIDs remembered for resolving. The mapping starts over beyond that.
+const maxSessionUIDs = 1 << 20
+
+// sessionUIDs mints the UIDs of each session.
+type sessionUIDs struct {
+	key []byte
+	// Where the mapping is appended, as tab-separated time, session,
+	// original and UID. nil if it is only logged on retrieval.
+	mapFile *os.File
+
+	mu sync.Mutex
+	// The originals of the UIDs minted.
+	originals map[string]string
+}
+
+// newSessionUIDs returns the sessionUIDs for -sessionuids, or nil if it isn't
+// set. UIDs are derived from "key", or from a random key if empty.
+func newSessionUIDs(enabled bool, key, mapPath string) *sessionUIDs {
+	if !enabled {
+		return nil
+	}
+	u := &sessionUIDs{key: []byte(key), originals: map[string]string{}}
+	if key == "" {
+		u.key = make([]byte, 32)
+		if _, err := rand.Read(u.key); err != nil {
+			log.Fatalf("Failed to generate a session UID key: %v", err)
+		}
+	}
+	if mapPath != "" {
+		f, err := os.OpenFile(mapPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open -uidmap %s: %v", mapPath, err)
+		}
+		u.mapFile = f
+	}
+	return u
+}
+
+// uid returns the UID that stands for "original" in session "sessionID", a
+// UUID-derived one under 2.25. P3.5, B.2.
+func (u *sessionUIDs) uid(sessionID, original string) string {
+	mac := hmac.New(sha256.New, u.key)
+	fmt.Fprintf(mac, "%s/%s", sessionID, original)
+	uid := "2.25." + new(big.Int).SetBytes(mac.Sum(nil)[:16]).String()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.originals[uid]; !ok {
+		if len(u.originals) >= maxSessionUIDs {
+			u.originals = map[string]string{}
+		}
+		u.originals[uid] = original
+		if u.mapFile != nil {
+			fmt.Fprintf(u.mapFile, "%s\t%s\t%s\t%s\n", time.Now().Format(time.RFC3339), sessionID, original, uid)
+		}
+	}
+	return uid
+}
+
+// original returns the UID "uid" stands for, or "uid" if it wasn't minted.
+func (u *sessionUIDs) original(uid string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if original, ok := u.originals[uid]; ok {
+		return original
+	}
+	return uid
+}
+
+// isMintedTag reports whether the UIDs of "elem" are minted per session.
+func isMintedTag(elem *dicom.Element) bool {
+	for _, t := range canaryTags {
+		if elem.Tag == t.tag {
+			return true
+		}
+	}
+	return false
+}
+
+// mapValues returns a copy of "elem", a UID attribute, with "f" applied to
+// its values.
+func mapValues(elem *dicom.Element, f func(string) string) *dicom.Element {
+	mapped := *elem
+	mapped.Value = make([]interface{}, len(elem.Value))
+	for i, v := range elem.Value {
+		mapped.Value[i] = v
+		if s, ok := v.(string); ok && strings.Trim(s, " \x00") != "" {
+			mapped.Value[i] = f(strings.Trim(s, " \x00"))
+		}
+	}
+	return &mapped
+}
+
+// resolve returns "filters", with the UIDs minted replaced by their
+// originals, so that they match the archive. A nil sessionUIDs returns
+// "filters" as is.
+func (u *sessionUIDs) resolve(filters []*dicom.Element) []*dicom.Element {
+	if u == nil {
+		return filters
+	}
+	resolved := make([]*dicom.Element, len(filters))
+	for i, elem := range filters {
+		resolved[i] = elem
+		if isMintedTag(elem) {
+			resolved[i] = mapValues(elem, u.original)
+		}
+	}
+	return resolved
+}
+
+// rewrite returns "elems", e.g., a C-FIND result, with the UIDs of session
+// "sessionID". The elements are copied, not changed. A nil sessionUIDs
+// returns "elems" as is.
+func (u *sessionUIDs) rewrite(elems []*dicom.Element, sessionID string) []*dicom.Element {
+	if u == nil {
+		return elems
+	}
+	rewritten := make([]*dicom.Element, len(elems))
+	for i, elem := range elems {
+		rewritten[i] = elem
+		if isMintedTag(elem) {
+			rewritten[i] = mapValues(elem, func(uid string) string {
+				return u.uid(sessionID, uid)
+			})
+		}
+	}
+	return rewritten
+}
+
+// markSessionUIDs gives "ds", read from "path", the UIDs of session
+// "sessionID" before it is served, and logs the mapping.
+func (ss *server) markSessionUIDs(ds *dicom.DataSet, path, sessionID string) {
+	if ss.sessionUIDs == nil {
+		return
+	}
+	fields := map[string]interface{}{"Path": path}
+	for i, elem := range ds.Elements {
+		if !isMintedTag(elem) {
+			continue
+		}
+		ds.Elements[i] = ss.sessionUIDs.rewrite([]*dicom.Element{elem}, sessionID)[0]
+		for _, t := range canaryTags {
+			if t.tag == elem.Tag && t.field != "" {
+				original, _ := elem.GetString()
+				uid, _ := ds.Elements[i].GetString()
+				fields[t.field] = original
+				fields["Session"+t.field] = uid
+			}
+		}
+	}
+	ss.record(logrus.WarnLevel, dicompot.EventSessionUID, sessionID, "Session UIDs served", fields)
+}
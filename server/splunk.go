@@ -0,0 +1,105 @@
+package main
+
+// This file sends the events to the HTTP Event Collector of Splunk, so that
+// a Splunk shop onboards dicompot with a token and a URL.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// splunk is an HEC client.
+type splunk struct {
+	url               string
+	token             string
+	index, sourceType string
+	host              string
+	client            *http.Client
+}
+
+// newSplunkSink returns the sink for -splunk and friends, or nil if events
+// aren't sent. "rawURL" is that of the collector, e.g.,
+// https://splunk:8088; the path of the event endpoint is added if missing.
+func newSplunkSink(rawURL, token, index, sourceType, caFile string) dicompot.EventSink {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid -splunk %q, want, e.g., https://splunk:8088", rawURL)
+	}
+	if token == "" {
+		log.Fatalf("-splunk needs -splunktoken")
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/services/collector/event"
+	}
+	s := &splunk{
+		url:        u.String(),
+		token:      token,
+		index:      index,
+		sourceType: sourceType,
+		client:     newHTTPClient("splunkcafile", caFile),
+	}
+	s.host, _ = os.Hostname()
+	log.Printf("-| Sending events to Splunk: %s", s.url)
+	return newQueuedSink("Splunk", 500, time.Second, s.send)
+}
+
+// send posts the events, in JSON, as one request. A request the collector
+// rejects as malformed is logged and dropped; other failures, including
+// that of the token, are retried.
+func (s *splunk) send(events []dicompot.Event) error {
+	var body bytes.Buffer
+	for _, event := range events {
+		doc := map[string]interface{}{
+			"time":       float64(event.Time.UnixNano()/1e6) / 1000,
+			"host":       s.host,
+			"source":     "dicompot",
+			"sourcetype": s.sourceType,
+			"event":      event,
+		}
+		if s.index != "" {
+			doc["index"] = s.index
+		}
+		b, err := json.Marshal(doc)
+		if err != nil {
+			continue
+		}
+		body.Write(b)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequest("POST", s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusBadRequest {
+		log.Printf("Splunk: rejected %d events: %v", len(events), err)
+		return nil
+	}
+	return err
+}
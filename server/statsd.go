@@ -0,0 +1,108 @@
+package main
+
+// This file emits the metrics of -metrics to StatsD, for the shops on
+// Datadog or Telegraf: the counters as counts, the durations as timings.
+// DogStatsD gets the labels as tags; plain StatsD, in the names.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// The longest UDP payload sent, which fits in an Ethernet frame.
+const statsdMaxPacket = 1432
+
+// What a name of plain StatsD can't have.
+var statsdUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// statsd is a StatsD client.
+type statsd struct {
+	conn   net.Conn
+	prefix string
+	dog    bool
+	labels map[string]string
+	// Only used from the goroutine of the queuedSink.
+	failing bool
+}
+
+// newStatsDSink returns the sink for -statsd, in "format", statsd or
+// dogstatsd, or nil if no metrics are emitted.
+func newStatsDSink(addr, prefix, format string) dicompot.EventSink {
+	if addr == "" {
+		return nil
+	}
+	if format != "statsd" && format != "dogstatsd" {
+		log.Fatalf("Invalid -statsdformat %q, want statsd or dogstatsd", format)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Fatalf("Invalid -statsd %q: %v", addr, err)
+	}
+	s := &statsd{conn: conn, prefix: prefix, dog: format == "dogstatsd", labels: map[string]string{}}
+	for _, def := range metricDefs {
+		s.labels[def.name] = def.label
+	}
+	log.Printf("-| Emitting metrics to %s: %s", format, addr)
+	return newQueuedSink("StatsD", 1000, time.Second, s.send)
+}
+
+// line returns the line of "sample".
+func (s *statsd) line(sample metricSample) string {
+	name := s.prefix + strings.TrimSuffix(sample.name, "_total")
+	label := s.labels[sample.name]
+	if label != "" && !s.dog {
+		name += "." + statsdUnsafe.ReplaceAllString(sample.labelValue, "_")
+	}
+	var line string
+	if sample.name == "session_duration_seconds" {
+		line = fmt.Sprintf("%s:%d|ms", strings.TrimSuffix(name, "_seconds"), int64(sample.n*1000))
+	} else {
+		line = fmt.Sprintf("%s:%s|c", name, formatFloat(sample.n))
+	}
+	if label != "" && s.dog {
+		line += "|#" + label + ":" + strings.NewReplacer(",", "_", "|", "_").Replace(sample.labelValue)
+	}
+	return line
+}
+
+// send emits the metrics of the events, in as few packets as fit them.
+// Datagrams aren't retried, lest the counts be off: a failure is logged,
+// once until they go through again.
+func (s *statsd) send(events []dicompot.Event) error {
+	var packet bytes.Buffer
+	var err error
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, e := s.conn.Write(packet.Bytes()); e != nil && err == nil {
+			err = e
+		}
+		packet.Reset()
+	}
+	for _, event := range events {
+		for _, sample := range metricSamples(event) {
+			line := s.line(sample)
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+				flush()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	flush()
+	if err != nil && !s.failing {
+		log.Printf("StatsD: failed to emit metrics: %v", err)
+	}
+	s.failing = err != nil
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+// This file implements the "stix" subcommand, which converts the sessions of
+// event logs (-eventlog, in JSON) into a STIX 2.1 bundle, for threat
+// intelligence platforms: an indicator per source IP, an observed-data per
+// session, with its network traffic, and a file per object stored, by its
+// hashes, or an artifact with -payloads. The IDs derive from what they
+// identify, so that a platform updates the objects of a bundle exported
+// again rather than adding copies.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+var (
+	// The namespace of the IDs of cyber-observable objects, from the
+	// specification.
+	stixSCONamespace = [16]byte{0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c, 0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7}
+	// The namespace of the IDs of the other objects.
+	stixNamespace = [16]byte{0x6f, 0x1d, 0x2b, 0x6e, 0x3c, 0x8a, 0x4e, 0x52, 0x9a, 0x0b, 0x93, 0x6d, 0x1e, 0x77, 0x40, 0x21}
+)
+
+// stixID returns the ID of an object of type "objectType": a version 5 UUID
+// of "name" in "namespace".
+func stixID(objectType string, namespace [16]byte, name []byte) string {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write(name)
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%s--%x-%x-%x-%x-%x", objectType, u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// stixSCOID returns the ID of a cyber-observable object, from its
+// ID contributing properties.
+func stixSCOID(objectType string, properties map[string]interface{}) string {
+	// Marshaling sorts the keys, and adds no spaces, as the canonical form
+	// wants.
+	b, _ := json.Marshal(properties)
+	return stixID(objectType, stixSCONamespace, b)
+}
+
+func stixTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// stixSession is what a session shows.
+type stixSession struct {
+	id               string
+	first, last      time.Time
+	ip               string
+	srcPort, dstPort int
+	protocol         string
+	called, calling  string
+	commands         map[string]bool
+	objects          []stixObject
+}
+
+// stixObject is an object stored.
+type stixObject struct {
+	sha256, md5, path, sopInstanceUID string
+}
+
+// readSessions reads the sessions of the event log "r" into "sessions".
+// Lines that aren't events in JSON are skipped.
+func readSessions(r io.Reader, sessions map[string]*stixSession) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var event dicompot.Event
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || event.SessionID == "" || event.Type == "" {
+			continue
+		}
+		s := sessions[event.SessionID]
+		if s == nil {
+			s = &stixSession{id: event.SessionID, first: event.Time, commands: map[string]bool{}}
+			sessions[event.SessionID] = s
+		}
+		if event.Time.Before(s.first) {
+			s.first = event.Time
+		}
+		if event.Time.After(s.last) {
+			s.last = event.Time
+		}
+		if ip := sourceIP(event); ip != nil {
+			s.ip = ip.String()
+		}
+		if event.RemotePort != 0 {
+			s.srcPort, s.dstPort = event.RemotePort, event.LocalPort
+		}
+		if s.protocol == "" || s.protocol == "dicom" {
+			s.protocol = ecsProtocol(event.Type)
+		}
+		if event.CallingAETitle != "" {
+			s.calling, s.called = event.CallingAETitle, event.CalledAETitle
+		}
+		if event.Command != "" {
+			s.commands[event.Command] = true
+		}
+		if sha256 := stringField(event, "SHA256"); sha256 != "" {
+			s.objects = append(s.objects, stixObject{
+				sha256:         sha256,
+				md5:            stringField(event, "MD5"),
+				path:           stringField(event, "Path"),
+				sopInstanceUID: stringField(event, "SOPInstanceUID"),
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+// stixBuilder adds the objects of a bundle.
+type stixBuilder struct {
+	now      string
+	identity string
+	objects  []interface{}
+}
+
+// sdo adds an object of type "objectType", its ID derived from "name".
+func (b *stixBuilder) sdo(objectType, name string, props map[string]interface{}) string {
+	props["type"] = objectType
+	props["spec_version"] = "2.1"
+	props["id"] = stixID(objectType, stixNamespace, []byte(name))
+	props["created"] = b.now
+	props["modified"] = b.now
+	if b.identity != "" {
+		props["created_by_ref"] = b.identity
+	}
+	b.objects = append(b.objects, props)
+	return props["id"].(string)
+}
+
+// sco adds a cyber-observable object of type "objectType", its ID derived
+// from the "contributing" properties.
+func (b *stixBuilder) sco(objectType string, props map[string]interface{}, contributing ...string) string {
+	idProps := map[string]interface{}{}
+	for _, name := range contributing {
+		if v, ok := props[name]; ok {
+			idProps[name] = v
+		}
+	}
+	props["type"] = objectType
+	props["spec_version"] = "2.1"
+	props["id"] = stixSCOID(objectType, idProps)
+	b.objects = append(b.objects, props)
+	return props["id"].(string)
+}
+
+// object adds the object "o" stored: an artifact with its content if
+// "payloads" and it is still at its path, a file known by its hashes
+// otherwise.
+func (b *stixBuilder) object(o stixObject, payloads bool) string {
+	if payloads && o.path != "" {
+		if content, err := ioutil.ReadFile(o.path); err == nil {
+			return b.sco("artifact", map[string]interface{}{
+				"mime_type":   "application/dicom",
+				"payload_bin": base64.StdEncoding.EncodeToString(content),
+				"hashes":      map[string]string{"SHA-256": o.sha256},
+			}, "hashes", "payload_bin")
+		}
+	}
+	file := map[string]interface{}{"hashes": map[string]string{"SHA-256": o.sha256}}
+	if o.sopInstanceUID != "" {
+		file["name"] = o.sopInstanceUID + ".dcm"
+	}
+	id := b.sco("file", file, "hashes", "name")
+	// Only SHA-256 contributes to the ID.
+	if o.md5 != "" {
+		file["hashes"] = map[string]string{"SHA-256": o.sha256, "MD5": o.md5}
+	}
+	return id
+}
+
+// session adds the observed-data of "s", from "addr", and returns its ID.
+func (b *stixBuilder) session(s *stixSession, addr string, payloads bool) string {
+	traffic := map[string]interface{}{
+		"src_ref":   addr,
+		"protocols": []string{"tcp", s.protocol},
+		"start":     stixTime(s.first),
+		"end":       stixTime(s.last),
+	}
+	if s.srcPort != 0 {
+		traffic["src_port"] = s.srcPort
+	}
+	if s.dstPort != 0 {
+		traffic["dst_port"] = s.dstPort
+	}
+	refs := []string{addr, b.sco("network-traffic", traffic, "start", "end", "src_ref", "src_port", "dst_port", "protocols")}
+	for _, o := range s.objects {
+		refs = append(refs, b.object(o, payloads))
+	}
+	data := map[string]interface{}{
+		"first_observed":  stixTime(s.first),
+		"last_observed":   stixTime(s.last),
+		"number_observed": 1,
+		"object_refs":     refs,
+		"external_references": []map[string]string{{
+			"source_name": "dicompot",
+			"external_id": s.id,
+			"description": fmt.Sprintf("Session, calling AE title %q, called AE title %q", s.calling, s.called),
+		}},
+	}
+	var commands []string
+	for c := range s.commands {
+		commands = append(commands, c)
+	}
+	if len(commands) > 0 {
+		sort.Strings(commands)
+		data["labels"] = commands
+	}
+	return b.sdo("observed-data", "observed-data|"+s.id, data)
+}
+
+// stixBundle returns the bundle of "sessions", those without a source left
+// out. With "payloads", the objects still at their path are included.
+func stixBundle(sessions map[string]*stixSession, payloads bool) map[string]interface{} {
+	b := &stixBuilder{now: stixTime(time.Now())}
+	b.identity = b.sdo("identity", "dicompot", map[string]interface{}{
+		"name":           "dicompot",
+		"description":    "DICOM honeypot",
+		"identity_class": "system",
+	})
+
+	// The sessions of each source, in order.
+	var all []*stixSession
+	for _, s := range sessions {
+		if s.ip != "" {
+			all = append(all, s)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].first.Before(all[j].first) })
+	bySource := map[string][]*stixSession{}
+	var sources []string
+	for _, s := range all {
+		if bySource[s.ip] == nil {
+			sources = append(sources, s.ip)
+		}
+		bySource[s.ip] = append(bySource[s.ip], s)
+	}
+
+	for _, ip := range sources {
+		ipType := "ipv4-addr"
+		if net.ParseIP(ip).To4() == nil {
+			ipType = "ipv6-addr"
+		}
+		addr := b.sco(ipType, map[string]interface{}{"value": ip}, "value")
+		var observed []string
+		for _, s := range bySource[ip] {
+			observed = append(observed, b.session(s, addr, payloads))
+		}
+		indicator := b.sdo("indicator", "indicator|"+ip, map[string]interface{}{
+			"name":            "DICOM honeypot source " + ip,
+			"description":     fmt.Sprintf("%s interacted with a DICOM honeypot in %d sessions.", ip, len(bySource[ip])),
+			"indicator_types": []string{"malicious-activity"},
+			"pattern":         fmt.Sprintf("[%s:value = '%s']", ipType, ip),
+			"pattern_type":    "stix",
+			"valid_from":      stixTime(bySource[ip][0].first),
+		})
+		for _, ref := range observed {
+			b.sdo("relationship", "based-on|"+indicator+"|"+ref, map[string]interface{}{
+				"relationship_type": "based-on",
+				"source_ref":        indicator,
+				"target_ref":        ref,
+			})
+		}
+	}
+	return map[string]interface{}{
+		"type":    "bundle",
+		"id":      stixID("bundle", stixNamespace, []byte(b.now)),
+		"objects": b.objects,
+	}
+}
+
+func runSTIX(args []string) {
+	fs := flag.NewFlagSet("stix", flag.ExitOnError)
+	output := fs.String("o", "", "File to write the bundle to (default: the standard output)")
+	payloads := fs.Bool("payloads", false, "Include the objects stored that are still in the quarantine, as artifacts")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatalf("Usage: dicompot stix [flags] <event log>...")
+	}
+	sessions := map[string]*stixSession{}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		err = readSessions(f, sessions)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", path, err)
+		}
+	}
+	b, err := json.MarshalIndent(stixBundle(sessions, *payloads), "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode the bundle: %v", err)
+	}
+	b = append(b, '\n')
+	if *output == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*output, b, 0644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+// This file writes a summary of the day, in Markdown or HTML, so that a
+// sensor left unattended still gives something to read without further
+// tooling: the sources, where they are (with -geoip), the calling AE
+// titles, the commands, the query terms, the instances retrieved and the
+// sessions of note, those that stored, retrieved or tried exploits. It is
+// written to a directory, emailed through -smtp, or both.
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// The sessions of note listed, at most.
+const summarySessions = 20
+
+// summarySession is what a session did.
+type summarySession struct {
+	id        string
+	start     time.Time
+	source    string
+	country   string
+	aeTitle   string
+	commands  int
+	stored    int
+	retrieved int
+	exploits  int
+}
+
+// summaryTable is a table of the summary.
+type summaryTable struct {
+	title  string
+	header []string
+	rows   [][]string
+}
+
+// summary is an EventSink that writes the summary of the day.
+type summary struct {
+	dir    string
+	format string
+	mailer *mailer
+	stop   chan struct{}
+
+	mu       sync.Mutex
+	since    time.Time
+	builder  *reportBuilder
+	sessions map[string]*summarySession
+}
+
+// newSummary returns the sink for -summarydir and -summaryemail, or nil if
+// no summary is written. It is written every day at "at", the local time
+// as HH:MM, as "format", markdown or html, into "dir" if not empty, and
+// emailed through "m" if "email".
+func newSummary(dir, format, at string, email bool, m *mailer) *summary {
+	if dir == "" && !email {
+		return nil
+	}
+	if format != "markdown" && format != "html" {
+		log.Fatalf("Invalid -summaryformat %q, want markdown or html", format)
+	}
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		log.Fatalf("Invalid -summaryat %q, want the time of the day, as HH:MM", at)
+	}
+	if email && m == nil {
+		log.Fatalf("-summaryemail needs -smtp")
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			log.Fatalf("Failed to create -summarydir %s: %v", dir, err)
+		}
+	}
+	s := &summary{dir: dir, format: format, stop: make(chan struct{})}
+	if email {
+		s.mailer = m
+	}
+	s.reset(time.Now())
+	go s.daily(t.Hour(), t.Minute())
+	if dir != "" {
+		log.Printf("-| Writing a summary into %s every day at %s", dir, at)
+	}
+	if email {
+		log.Printf("-| Emailing a summary every day at %s", at)
+	}
+	return s
+}
+
+func (s *summary) reset(since time.Time) {
+	s.since = since
+	s.builder = newReportBuilder()
+	s.sessions = map[string]*summarySession{}
+}
+
+// Record adds the event to the summary.
+func (s *summary) Record(event dicompot.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.builder.add(event)
+	if event.SessionID == "" {
+		return nil
+	}
+	ss := s.sessions[event.SessionID]
+	if ss == nil {
+		ss = &summarySession{id: event.SessionID, start: event.Time}
+		s.sessions[event.SessionID] = ss
+	}
+	if ip := sourceIP(event); ip != nil {
+		ss.source = ip.String()
+	}
+	if country := stringField(event, "GeoCountry"); country != "" {
+		ss.country = country
+	}
+	if event.CallingAETitle != "" {
+		ss.aeTitle = event.CallingAETitle
+	}
+	if event.Command != "" && isDIMSERequest(event) {
+		ss.commands++
+	}
+	switch objectDirection(event) {
+	case "stored":
+		ss.stored++
+	case "retrieved":
+		ss.retrieved += retrievedInstances(event)
+	}
+	if event.Type == dicompot.EventExploitAttempt {
+		ss.exploits++
+	}
+	return nil
+}
+
+// Close stops writing the summary. The one under way is not written.
+func (s *summary) Close() error {
+	close(s.stop)
+	return nil
+}
+
+// daily writes the summary every day at "hour":"minute", until Close.
+func (s *summary) daily(hour, minute int) {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		select {
+		case <-time.After(time.Until(next)):
+		case <-s.stop:
+			return
+		}
+		until := time.Now()
+		s.mu.Lock()
+		since, r, sessions := s.since, s.builder.build(emailDigestTop), s.sessions
+		s.reset(until)
+		s.mu.Unlock()
+
+		title := fmt.Sprintf("dicompot summary, %s to %s", since.Format("2006-01-02 15:04"), until.Format("2006-01-02 15:04"))
+		tables := summaryTables(r, sessions)
+		var body, ext, contentType string
+		if s.format == "html" {
+			body, ext, contentType = summaryHTML(title, r, tables), ".html", "text/html"
+		} else {
+			body, ext, contentType = summaryMarkdown(title, r, tables), ".md", "text/plain"
+		}
+		if s.dir != "" {
+			path := filepath.Join(s.dir, "summary-"+since.Format("2006-01-02")+ext)
+			if err := ioutil.WriteFile(path, []byte(body), 0640); err != nil {
+				log.Printf("Summary: failed to write %s: %v", path, err)
+			}
+		}
+		if s.mailer != nil {
+			subject := fmt.Sprintf("dicompot summary: %d sources, %d sessions", len(r.Sources), r.Sessions)
+			if err := s.mailer.sendAs(subject, contentType, body); err != nil {
+				log.Printf("Summary: failed to email: %v", err)
+			}
+		}
+	}
+}
+
+// summaryTables returns the tables of the summary of "r" and "sessions".
+func summaryTables(r report, sessions map[string]*summarySession) []summaryTable {
+	counts := func(title, name, unit string, list []reportCount) summaryTable {
+		t := summaryTable{title: title, header: []string{name, unit}}
+		for _, c := range list {
+			t.rows = append(t.rows, []string{c.Name, fmt.Sprint(c.Count)})
+		}
+		return t
+	}
+	countries := map[string]int{}
+	for _, ss := range sessions {
+		if ss.country != "" {
+			countries[ss.country]++
+		}
+	}
+	tables := []summaryTable{
+		counts("Sources", "Source", "Sessions", r.Sources),
+		counts("Countries", "Country", "Sessions", sortedCounts(countries, emailDigestTop)),
+		counts("Calling AE titles", "AE title", "Sessions", r.AETitles),
+	}
+	commands := summaryTable{title: "Commands", header: []string{"Day", "Command", "Requests"}}
+	for _, d := range r.Days {
+		for _, c := range d.Commands {
+			commands.rows = append(commands.rows, []string{d.Day, c.Name, fmt.Sprint(c.Count)})
+		}
+	}
+	tables = append(tables,
+		commands,
+		counts("Query terms", "Term", "Searches", r.QueryTerms),
+		counts("Instances retrieved", "Command", "Instances", r.Retrieved),
+		counts("Instances retrieved, by source", "Source", "Instances", r.RetrievedBySource),
+	)
+
+	// The sessions that tried exploits first, then those that moved the
+	// most objects.
+	var notable []*summarySession
+	for _, ss := range sessions {
+		if ss.exploits > 0 || ss.stored > 0 || ss.retrieved > 0 {
+			notable = append(notable, ss)
+		}
+	}
+	sort.Slice(notable, func(i, j int) bool {
+		a, b := notable[i], notable[j]
+		if a.exploits != b.exploits {
+			return a.exploits > b.exploits
+		}
+		if a.stored+a.retrieved != b.stored+b.retrieved {
+			return a.stored+a.retrieved > b.stored+b.retrieved
+		}
+		return a.start.Before(b.start)
+	})
+	if len(notable) > summarySessions {
+		notable = notable[:summarySessions]
+	}
+	t := summaryTable{title: "Sessions of note", header: []string{"Start", "Session", "Source", "Country", "AE title", "Commands", "Stored", "Retrieved", "Exploits"}}
+	for _, ss := range notable {
+		t.rows = append(t.rows, []string{ss.start.Format("2006-01-02 15:04:05"), ss.id, ss.source, ss.country, ss.aeTitle,
+			fmt.Sprint(ss.commands), fmt.Sprint(ss.stored), fmt.Sprint(ss.retrieved), fmt.Sprint(ss.exploits)})
+	}
+	return append(tables, t)
+}
+
+// summaryMarkdown returns the summary in Markdown.
+func summaryMarkdown(title string, r report, tables []summaryTable) string {
+	cell := func(s string) string {
+		return strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "|", "\\|", -1)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%d events, %d sessions, %d sources.\n", title, r.Events, r.Sessions, len(r.Sources))
+	for _, t := range tables {
+		fmt.Fprintf(&b, "\n## %s\n\n", t.title)
+		if len(t.rows) == 0 {
+			b.WriteString("None.\n")
+			continue
+		}
+		fmt.Fprintf(&b, "| %s |\n|%s\n", strings.Join(t.header, " | "), strings.Repeat(" --- |", len(t.header)))
+		for _, row := range t.rows {
+			for i := range row {
+				row[i] = cell(row[i])
+			}
+			fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+		}
+	}
+	return b.String()
+}
+
+// summaryHTML returns the summary as an HTML page.
+func summaryHTML(title string, r report, tables []summaryTable) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n", html.EscapeString(title))
+	b.WriteString("<style>body{font-family:sans-serif}table{border-collapse:collapse}th,td{border:1px solid #ccc;padding:2px 8px;text-align:left}</style>\n")
+	fmt.Fprintf(&b, "</head><body>\n<h1>%s</h1>\n<p>%d events, %d sessions, %d sources.</p>\n", html.EscapeString(title), r.Events, r.Sessions, len(r.Sources))
+	for _, t := range tables {
+		fmt.Fprintf(&b, "<h2>%s</h2>\n", html.EscapeString(t.title))
+		if len(t.rows) == 0 {
+			b.WriteString("<p>None.</p>\n")
+			continue
+		}
+		b.WriteString("<table>\n<tr>")
+		for _, h := range t.header {
+			fmt.Fprintf(&b, "<th>%s</th>", html.EscapeString(h))
+		}
+		b.WriteString("</tr>\n")
+		for _, row := range t.rows {
+			b.WriteString("<tr>")
+			for _, c := range row {
+				fmt.Fprintf(&b, "<td>%s</td>", html.EscapeString(c))
+			}
+			b.WriteString("</tr>\n")
+		}
+		b.WriteString("</table>\n")
+	}
+	b.WriteString("</body></html>\n")
+	return b.String()
+}
@@ -0,0 +1,184 @@
+package main
+
+// This file invents C-FIND matches for queries that match nothing stored,
+// so that whatever an attacker looks for seems to exist.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// synthesizer holds the traits of an invented entity, chosen once so that
+// its attributes agree with each other.
+type synthesizer struct {
+	g        *generator
+	modality generatedModality
+	sex      string
+	given    string
+	date     time.Time
+}
+
+// synthesizeMatch invents an entity that satisfies the keys of "q". The
+// same keys always yield the same entity, so that repeated queries get
+// consistent answers. It returns false if no value could be made up for
+// some key.
+func synthesizeMatch(q qrQuery) (filterMatch, bool) {
+	h := fnv.New64a()
+	for _, f := range q.filters {
+		fmt.Fprintf(h, "%v=%v;", f.Tag, f.Value)
+	}
+	g := &generator{rand: rand.New(rand.NewSource(int64(h.Sum64())))}
+	s := &synthesizer{
+		g:        g,
+		modality: generatedModalities[g.rand.Intn(len(generatedModalities))],
+		sex:      "M",
+		given:    g.pick(generatedMaleNames),
+		date:     time.Now().AddDate(0, 0, -g.rand.Intn(5*365)),
+	}
+	if g.rand.Intn(2) == 0 {
+		s.sex, s.given = "F", g.pick(generatedFemaleNames)
+	}
+	byTag := map[dicomtag.Tag]*dicom.Element{}
+	for _, f := range q.filters {
+		if f.Tag == dicomtag.Modality || f.Tag == dicomtag.ModalitiesInStudy {
+			if v, err := f.GetString(); err == nil {
+				for _, m := range generatedModalities {
+					if strings.EqualFold(strings.TrimSpace(v), m.modality) {
+						s.modality = m
+					}
+				}
+			}
+		}
+	}
+	// The unique keys of every level exist, so that grouping can count the
+	// entity's children.
+	for _, tag := range []dicomtag.Tag{dicomtag.StudyInstanceUID, dicomtag.SeriesInstanceUID, dicomtag.SOPInstanceUID} {
+		byTag[tag] = dicom.MustNewElement(tag, g.uid())
+	}
+	byTag[dicomtag.PatientID] = dicom.MustNewElement(dicomtag.PatientID, s.plausible(dicomtag.PatientID, "LO"))
+	for _, f := range q.filters {
+		if elem := s.satisfy(f); elem != nil {
+			byTag[f.Tag] = elem
+		}
+	}
+
+	ds := &dicom.DataSet{}
+	for _, elem := range byTag {
+		ds.Elements = append(ds.Elements, elem)
+	}
+	elems, ok, err := matchKeys(ds, q.filters)
+	if err != nil || !ok {
+		return filterMatch{}, false
+	}
+	return filterMatch{ds: ds, elems: elems}, true
+}
+
+// satisfy returns an element that matches key "f", or nil if the entity
+// doesn't need the attribute.
+func (s *synthesizer) satisfy(f *dicom.Element) *dicom.Element {
+	if f.VR == "SQ" || f.Tag == dicomtag.QueryRetrieveLevel || f.Tag == dicomtag.SpecificCharacterSet {
+		return nil
+	}
+	if isUniversalKey(f) {
+		if v := s.plausible(f.Tag, f.VR); v != nil {
+			return dicom.MustNewElement(f.Tag, v)
+		}
+		return nil
+	}
+	// A list of UIDs matches any of them.
+	key, ok := f.Value[0].(string)
+	if !ok {
+		return nil
+	}
+	key = strings.TrimSpace(key)
+	switch {
+	case (f.VR == "DA" || f.VR == "TM" || f.VR == "DT") && strings.Contains(key, "-"):
+		parts := strings.SplitN(key, "-", 2)
+		from, errFrom := time.Parse("20060102", normalizeDateTime("DA", parts[0]))
+		to, errTo := time.Parse("20060102", normalizeDateTime("DA", parts[1]))
+		if f.VR == "DA" && errFrom == nil && errTo == nil && to.After(from) {
+			// Somewhere in the range, rather than at an edge.
+			days := int(to.Sub(from).Hours() / 24)
+			return dicom.MustNewElement(f.Tag, from.AddDate(0, 0, s.g.rand.Intn(days+1)).Format("20060102"))
+		}
+		if parts[0] != "" {
+			key = parts[0]
+		} else {
+			key = parts[1]
+		}
+		key = normalizeDateTime(f.VR, key)
+	case isWildcardVR(f.VR) && strings.ContainsAny(key, "*?"):
+		key = s.fill(f.VR, key)
+	}
+	return dicom.MustNewElement(f.Tag, key)
+}
+
+// fill turns a wildcard pattern into a value it matches, e.g., "SMITH*"
+// into "SMITH^JOHN" for a person name.
+func (s *synthesizer) fill(vr, pattern string) string {
+	var sb strings.Builder
+	for i, r := range pattern {
+		switch r {
+		case '*':
+			if vr == "PN" && i == len(pattern)-1 && !strings.Contains(sb.String(), "^") {
+				sb.WriteString("^" + strings.ToUpper(s.given))
+			}
+		case '?':
+			sb.WriteByte(byte('A' + s.g.rand.Intn(26)))
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// plausible returns a made up value for attribute "tag", or nil if there is
+// nothing sensible to say.
+func (s *synthesizer) plausible(tag dicomtag.Tag, vr string) interface{} {
+	g := s.g
+	switch tag {
+	case dicomtag.PatientName:
+		return strings.ToUpper(g.pick(generatedFamilyNames) + "^" + s.given)
+	case dicomtag.PatientID:
+		return fmt.Sprintf("MRN%07d", g.rand.Intn(10000000))
+	case dicomtag.PatientBirthDate:
+		return time.Now().AddDate(-18-g.rand.Intn(70), 0, -g.rand.Intn(365)).Format("20060102")
+	case dicomtag.PatientSex:
+		return s.sex
+	case dicomtag.AccessionNumber:
+		return fmt.Sprintf("A%08d", g.rand.Intn(100000000))
+	case dicomtag.StudyID:
+		return fmt.Sprintf("%d", 1+g.rand.Intn(9999))
+	case dicomtag.StudyDescription:
+		return g.pick(s.modality.descriptions)
+	case dicomtag.SeriesDescription:
+		return g.pick(s.modality.series)
+	case dicomtag.ReferringPhysicianName, dicomtag.NameOfPhysiciansReadingStudy:
+		return strings.ToUpper(g.pick(generatedPhysicians))
+	case dicomtag.InstitutionName:
+		return g.pick(generatedInstitutions)
+	case dicomtag.Modality, dicomtag.ModalitiesInStudy:
+		return s.modality.modality
+	case dicomtag.SOPClassUID:
+		return s.modality.sopClassUID
+	case dicomtag.SeriesNumber, dicomtag.InstanceNumber:
+		return "1"
+	case dicomtag.Rows, dicomtag.Columns:
+		return uint16(generatedImageSize)
+	}
+	switch vr {
+	case "DA":
+		return s.date.Format("20060102")
+	case "TM":
+		return fmt.Sprintf("%02d%02d%02d", 8+g.rand.Intn(9), g.rand.Intn(60), g.rand.Intn(60))
+	case "UI":
+		return g.uid()
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+// This file sends the events to a syslog collector, as RFC 5424 messages, so
+// that they reach the syslog infrastructure of a hospital or SOC directly.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// The facilities of RFC 5424, by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity maps the level of an event to a severity of RFC 5424.
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0 // Emergency
+	case logrus.FatalLevel:
+		return 2 // Critical
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7 // Debug
+}
+
+// How long a connection to the collector or a write may take.
+const syslogTimeout = 10 * time.Second
+
+// syslogSink sends the events, through a queuedSink, as syslog messages,
+// the event in one of the eventFormats as their content.
+type syslogSink struct {
+	network, addr string
+	facility      int
+	hostname      string
+	format        func(event dicompot.Event) ([]byte, error)
+
+	conn net.Conn
+}
+
+// newSyslogSink returns the sink for -syslog, -syslogfacility and
+// -syslogformat, or nil if events aren't sent to syslog. "target" is
+// udp://host:port, tcp://host:port or unix:///path.
+func newSyslogSink(target, facility, format string) dicompot.EventSink {
+	if target == "" {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		log.Fatalf("Invalid -syslog %q: %v", target, err)
+	}
+	s := &syslogSink{network: u.Scheme, format: lookupEventFormat("syslogformat", format)}
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.addr = u.Host
+		if u.Port() == "" {
+			s.addr = net.JoinHostPort(u.Hostname(), "514")
+		}
+	case "unix":
+		s.addr = u.Path
+	default:
+		log.Fatalf("Invalid -syslog %q, want udp://host:port, tcp://host:port or unix:///path", target)
+	}
+	f, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		log.Fatalf("Invalid -syslogfacility %q, want, e.g., local0 or daemon", facility)
+	}
+	s.facility = f
+	if s.hostname, err = os.Hostname(); err != nil || s.hostname == "" {
+		s.hostname = "-"
+	}
+	if err := s.dial(); err != nil {
+		log.Fatalf("Failed to connect to -syslog %s: %v", target, err)
+	}
+	log.Printf("-| Sending events to syslog: %s", target)
+	return newQueuedSink("Syslog", 100, 0, s.send)
+}
+
+// dial connects to the collector. A unix socket is tried as a datagram one
+// first, as /dev/log usually is.
+func (s *syslogSink) dial() error {
+	var err error
+	if s.network == "unix" {
+		if s.conn, err = net.Dial("unixgram", s.addr); err == nil {
+			return nil
+		}
+	}
+	s.conn, err = net.DialTimeout(s.network, s.addr, syslogTimeout)
+	return err
+}
+
+// message returns "event" as an RFC 5424 message. The event type is the
+// MSGID, and the session ID the only structured data, for collectors to
+// index on without parsing the content.
+func (s *syslogSink) message(event dicompot.Event) ([]byte, error) {
+	content, err := s.format(event)
+	if err != nil {
+		return nil, err
+	}
+	sd := "-"
+	if event.SessionID != "" {
+		sd = fmt.Sprintf(`[dicompot@32473 sessionID="%s"]`, event.SessionID)
+	}
+	header := fmt.Sprintf("<%d>1 %s %s dicompot %d %s %s ",
+		s.facility*8+syslogSeverity(event.Level),
+		event.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		s.hostname, os.Getpid(), event.Type, sd)
+	return append([]byte(header), content...), nil
+}
+
+// send sends the events. Over TCP, messages are octet-counted (RFC 6587).
+// A connection that broke is made again on the next batch.
+func (s *syslogSink) send(events []dicompot.Event) error {
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		msg, err := s.message(event)
+		if err != nil {
+			continue
+		}
+		if s.network == "tcp" {
+			msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := s.conn.Write(msg); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
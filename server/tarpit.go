@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// ipMatcher matches source IPs against addresses and CIDR blocks.
+type ipMatcher struct {
+	nets []*net.IPNet
+}
+
+// newIPMatcher parses a comma-separated list of IPs and CIDR blocks, e.g.,
+// "192.0.2.7,198.51.100.0/24", found in flag "name".
+func newIPMatcher(name, value string) *ipMatcher {
+	m := &ipMatcher{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Fatalf("Invalid -%s entry %q, want an IP or a CIDR block", name, entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			m.nets = append(m.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("Invalid -%s entry %q, want an IP or a CIDR block", name, entry)
+		}
+		m.nets = append(m.nets, n)
+	}
+	return m
+}
+
+func (m *ipMatcher) match(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range m.nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// newProxies returns the networks of the proxies for -proxytrusted, which
+// -proxyprotocol requires, or nil without -proxyprotocol.
+func newProxies(proxyProtocol bool, trusted string) []*net.IPNet {
+	if !proxyProtocol {
+		return nil
+	}
+	m := newIPMatcher("proxytrusted", trusted)
+	if len(m.nets) == 0 {
+		log.Fatalf("-proxyprotocol requires -proxytrusted, the IPs or CIDR blocks of the proxies")
+	}
+	log.Printf("-| Expecting PROXY protocol headers from: %s", trusted)
+	return m.nets
+}
+
+// newTarpit returns the tarpit for -tarpitip and friends, or nil if no source
+// is to be tarpitted.
+func newTarpit(ips string, interval, hold time.Duration, maxConns int) *dicompot.Tarpit {
+	m := newIPMatcher("tarpitip", ips)
+	if len(m.nets) == 0 {
+		return nil
+	}
+	if hold <= 0 || maxConns <= 0 {
+		log.Fatalf("-tarpithold and -tarpitmax must be positive, so that the tarpit can't exhaust the server")
+	}
+	return &dicompot.Tarpit{
+		Match:    m.match,
+		Interval: interval,
+		Hold:     hold,
+		MaxConns: maxConns,
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+// This file raises TheHive 5 alerts for the sessions that do something
+// serious: store or retrieve objects, submit credentials, or attempt an
+// exploit. A session has one alert, created at its first such event, with
+// the artifacts of the session as observables: the source IP, the AE
+// titles, the user names, the patient names queried, the hashes of the
+// objects stored and the URLs requested. Those seen later are added to the
+// alert, for Cortex analyzers to run on from TheHive.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// How long the sessions without a connection-closed, those of DICOMweb, are
+// tracked after their last event.
+const theHiveSessionTTL = time.Hour
+
+// theHiveSeverities are the severities of the alerts, by event type: 2
+// (medium) or 3 (high).
+var theHiveSeverities = map[string]int{
+	dicompot.EventCStore:         3,
+	dicompot.EventSTOW:           3,
+	dicompot.EventExploitAttempt: 3,
+}
+
+// theHiveObservable is an observable of an alert.
+type theHiveObservable struct {
+	DataType string   `json:"dataType"`
+	Data     string   `json:"data"`
+	Message  string   `json:"message,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	IOC      bool     `json:"ioc"`
+}
+
+// theHiveSession is what is known of a session.
+type theHiveSession struct {
+	alertID string
+	// The observables the alert has, or is to be created with.
+	seen    map[string]bool
+	pending []theHiveObservable
+	last    time.Time
+}
+
+// theHive is a TheHive client.
+type theHive struct {
+	url    string
+	key    string
+	org    string
+	types  map[string]bool
+	source string
+	client *http.Client
+
+	// Only used from the goroutine of the queuedSink.
+	sessions map[string]*theHiveSession
+}
+
+// newTheHiveSink returns the sink for -thehive and friends, raising alerts
+// for the sessions with events of the comma-separated "types", or nil if no
+// alerts are raised.
+func newTheHiveSink(rawURL, key, org, types, caFile string) dicompot.EventSink {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid -thehive %q, want https://host:port", rawURL)
+	}
+	if key == "" {
+		log.Fatalf("-thehive needs -thehivekey")
+	}
+	h := &theHive{
+		url:      strings.TrimRight(rawURL, "/"),
+		key:      key,
+		org:      org,
+		types:    map[string]bool{},
+		source:   "dicompot",
+		client:   newHTTPClient("thehivecafile", caFile),
+		sessions: map[string]*theHiveSession{},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		h.source += "@" + hostname
+	}
+	for _, t := range strings.Split(types, ",") {
+		h.types[strings.TrimSpace(t)] = true
+	}
+	log.Printf("-| Raising TheHive alerts: %s, for %s and credentials", h.url, types)
+	return newQueuedSink("TheHive", 100, time.Second, h.process)
+}
+
+// severity returns the severity of the alert "event" raises, or 0 if it
+// raises none.
+func (h *theHive) severity(event dicompot.Event) int {
+	credentials := event.Fields["Password"] != nil || event.Fields["Passcode"] != nil
+	if !h.types[event.Type] && !credentials {
+		return 0
+	}
+	if s, ok := theHiveSeverities[event.Type]; ok {
+		return s
+	}
+	return 2
+}
+
+// theHiveObservables returns the artifacts of "event".
+func theHiveObservables(event dicompot.Event) []theHiveObservable {
+	var obs []theHiveObservable
+	add := func(dataType, data, message string, ioc bool, tags ...string) {
+		if data != "" {
+			obs = append(obs, theHiveObservable{DataType: dataType, Data: data, Message: message, Tags: tags, IOC: ioc})
+		}
+	}
+	if ip := sourceIP(event); ip != nil {
+		add("ip", ip.String(), "Source", true)
+	}
+	add("other", event.CallingAETitle, "Calling AE title", false, "dicom:calling-ae-title")
+	add("other", stringField(event, "Username"), "User name submitted", false, "username")
+	add("hash", stringField(event, "SHA256"), "Object stored", true, "sha256")
+	add("hash", stringField(event, "MD5"), "Object stored", true, "md5")
+	add("user-agent", stringField(event, "UserAgent"), "", false)
+	if uri := stringField(event, "URI"); uri != "" {
+		add("url", uri, "URL requested", false)
+	}
+	for _, qe := range event.Query {
+		if qe.Keyword != "PatientName" {
+			continue
+		}
+		for _, v := range qe.Values {
+			if strings.Trim(v, "*?^ ") != "" {
+				add("other", v, "Patient name queried", false, "dicom:patient-name")
+			}
+		}
+	}
+	return obs
+}
+
+// request sends a request to the API, and decodes the JSON response into
+// "out", if not nil.
+func (h *theHive) request(method, path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, h.url+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.key)
+	req.Header.Set("Content-Type", "application/json")
+	if h.org != "" {
+		req.Header.Set("X-Organisation", h.org)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// createAlert creates the alert of session "id", raised by "event", or finds
+// it if an earlier attempt did.
+func (h *theHive) createAlert(id string, s *theHiveSession, event dicompot.Event, severity int) error {
+	ip := sourceIP(event)
+	source := "an unknown source"
+	if ip != nil {
+		source = ip.String()
+	}
+	var desc strings.Builder
+	fmt.Fprintf(&desc, "dicompot recorded **%s** (%s) from %s at %s.\n\n", event.Message, event.Type, source, event.Time.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&desc, "- Session: `%s`\n", id)
+	if event.CallingAETitle != "" {
+		fmt.Fprintf(&desc, "- Calling AE title: `%s`, called AE title: `%s`\n", event.CallingAETitle, event.CalledAETitle)
+	}
+	if event.LocalPort != 0 {
+		fmt.Fprintf(&desc, "- Port: %d\n", event.LocalPort)
+	}
+	if terms := queryTerms(event); terms != "" {
+		fmt.Fprintf(&desc, "- Query: `%s`\n", terms)
+	}
+	alert := map[string]interface{}{
+		"type":        "dicompot",
+		"source":      h.source,
+		"sourceRef":   id,
+		"title":       fmt.Sprintf("DICOM honeypot: %s from %s", event.Message, source),
+		"description": desc.String(),
+		"severity":    severity,
+		"date":        event.Time.UnixNano() / 1e6,
+		"tags":        []string{"dicompot", event.Type},
+		"tlp":         2,
+		"pap":         2,
+		"observables": s.pending,
+	}
+	var created struct {
+		ID string `json:"_id"`
+	}
+	err := h.request("POST", "/api/v1/alert", alert, &created)
+	if err != nil && strings.Contains(err.Error(), "already exist") {
+		var found []struct {
+			ID string `json:"_id"`
+		}
+		query := map[string]interface{}{"query": []interface{}{
+			map[string]interface{}{"_name": "listAlert"},
+			map[string]interface{}{"_name": "filter", "_and": []interface{}{
+				map[string]interface{}{"_field": "sourceRef", "_value": id},
+				map[string]interface{}{"_field": "source", "_value": h.source},
+			}},
+		}}
+		if err = h.request("POST", "/api/v1/query", query, &found); err == nil && len(found) > 0 {
+			created.ID = found[0].ID
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if created.ID == "" {
+		return fmt.Errorf("no ID in the alert created")
+	}
+	s.alertID, s.pending = created.ID, nil
+	return nil
+}
+
+// process keeps the artifacts of every session, and raises or completes
+// the alerts of the serious ones.
+func (h *theHive) process(events []dicompot.Event) error {
+	now := time.Now()
+	for _, event := range events {
+		id := event.SessionID
+		if id == "" {
+			continue
+		}
+		s := h.sessions[id]
+		if s == nil {
+			s = &theHiveSession{seen: map[string]bool{}}
+			h.sessions[id] = s
+		}
+		s.last = now
+		for _, o := range theHiveObservables(event) {
+			key := o.DataType + "|" + o.Data
+			if !s.seen[key] {
+				s.seen[key] = true
+				s.pending = append(s.pending, o)
+			}
+		}
+		if s.alertID == "" {
+			if severity := h.severity(event); severity > 0 {
+				if err := h.createAlert(id, s, event, severity); err != nil {
+					return err
+				}
+			}
+		}
+		for len(s.pending) > 0 && s.alertID != "" {
+			err := h.request("POST", "/api/v1/alert/"+url.PathEscape(s.alertID)+"/observable", s.pending[0], nil)
+			if err != nil && !strings.Contains(err.Error(), "already exist") {
+				return err
+			}
+			s.pending = s.pending[1:]
+		}
+		if event.Type == dicompot.EventConnectionClosed {
+			delete(h.sessions, id)
+		}
+	}
+	for id, s := range h.sessions {
+		if now.Sub(s.last) > theHiveSessionTTL {
+			delete(h.sessions, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// The requests, by the name used in -delays and -failures.
+var requestNames = map[string]int{
+	"echo":    dimse.CommandFieldCEchoRq,
+	"find":    dimse.CommandFieldCFindRq,
+	"move":    dimse.CommandFieldCMoveRq,
+	"get":     dimse.CommandFieldCGetRq,
+	"store":   dimse.CommandFieldCStoreRq,
+	"naction": dimse.CommandFieldNActionRq,
+	"ncreate": dimse.CommandFieldNCreateRq,
+	"nset":    dimse.CommandFieldNSetRq,
+	"nget":    dimse.CommandFieldNGetRq,
+	"ndelete": dimse.CommandFieldNDeleteRq,
+}
+
+// parseDelays parses the value of -delays, e.g.,
+// "find=200-800ms,move=1s,image=50-300ms". "image" is the delay of each
+// C-MOVE or C-GET sub-operation; the other names are requests.
+func parseDelays(value string) (map[int]dicompot.Delay, dicompot.Delay) {
+	commands := map[int]dicompot.Delay{}
+	var image dicompot.Delay
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid -delays entry %q, want name=min[-max]", entry)
+		}
+		delay, ok := parseDelay(parts[1])
+		if !ok {
+			log.Fatalf("Invalid -delays entry %q, want a duration or range, e.g., 200-800ms", entry)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "image" {
+			image = delay
+			continue
+		}
+		command, ok := requestNames[name]
+		if !ok {
+			log.Fatalf("Invalid -delays entry %q, unknown name %q", entry, name)
+		}
+		commands[command] = delay
+	}
+	return commands, image
+}
+
+// parseDelay parses "1s", "200ms-1s" or "200-800ms", where the lower bound
+// takes the unit of the upper one.
+func parseDelay(s string) (dicompot.Delay, bool) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	max, err := time.ParseDuration(parts[len(parts)-1])
+	if err != nil {
+		return dicompot.Delay{}, false
+	}
+	min := max
+	if len(parts) == 2 {
+		if min, err = time.ParseDuration(parts[0]); err != nil {
+			unit := strings.TrimLeft(parts[1], "0123456789.")
+			if min, err = time.ParseDuration(parts[0] + unit); err != nil {
+				return dicompot.Delay{}, false
+			}
+		}
+	}
+	if min < 0 || max < min {
+		return dicompot.Delay{}, false
+	}
+	return dicompot.Delay{Min: min, Max: max}, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+// toolkitProfile is how a DICOM toolkit presents itself during association
+// negotiation, which is what scanners fingerprint.
+type toolkitProfile struct {
+	implementationClassUID    string
+	implementationVersionName string
+	// Whether a wrong called AE title is rejected, and with what.
+	enforceCalledAE bool
+	calledAEReject  *pdu.AAssociateRj
+}
+
+// Called AE title not recognized, as sent by the toolkits that check it.
+var calledAENotRecognized = &pdu.AAssociateRj{
+	Result: pdu.ResultRejectedPermanent,
+	Source: pdu.SourceULServiceUser,
+	Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+}
+
+// The toolkits -toolkit can pass for. The versions are recent releases
+// that are common in the field.
+var toolkitProfiles = map[string]toolkitProfile{
+	// storescp and dcmqrscp accept any called AE title by default.
+	"dcmtk": {
+		implementationClassUID:    "1.2.276.0.7230010.3.0.3.6.7",
+		implementationVersionName: "OFFIS_DCMTK_367",
+	},
+	"dcm4che": {
+		implementationClassUID:    "1.2.40.0.13.1.3",
+		implementationVersionName: "dcm4che-5.22.6",
+		enforceCalledAE:           true,
+		calledAEReject:            calledAENotRecognized,
+	},
+	"merge": {
+		implementationClassUID:    "2.16.840.1.113669.2.931128",
+		implementationVersionName: "MergeCOM3_440",
+		enforceCalledAE:           true,
+		calledAEReject:            calledAENotRecognized,
+	},
+	"pynetdicom": {
+		implementationClassUID:    "1.2.826.0.1.3680043.9.3811.2.0.2",
+		implementationVersionName: "PYNETDICOM_202",
+	},
+	"go-dicom": {
+		implementationClassUID:    dicom.GoDICOMImplementationClassUID,
+		implementationVersionName: dicom.GoDICOMImplementationVersionName,
+	},
+}
+
+// isFlagSet reports whether flag "name" was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// applyToolkit sets the identity of the provider from -toolkit, -impluid and
+// -implversion.
+func applyToolkit(params *dicompot.ServiceProviderParams, name, implUID, implVersion string) {
+	if name != "" {
+		profile, ok := toolkitProfiles[strings.ToLower(name)]
+		if !ok {
+			var names []string
+			for n := range toolkitProfiles {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			log.Fatalf("Unknown -toolkit %q, want one of %s", name, strings.Join(names, ", "))
+		}
+		applyToolkitProfile(params, profile)
+	}
+	if implUID != "" {
+		params.ImplementationClassUID = implUID
+	}
+	if implVersion != "" {
+		params.ImplementationVersionName = implVersion
+	}
+}
+
+// applyToolkitProfile makes the provider present itself as "profile". The
+// profile's called AE behavior applies unless -enforce or -rjcalledae say
+// otherwise.
+func applyToolkitProfile(params *dicompot.ServiceProviderParams, profile toolkitProfile) {
+	params.ImplementationClassUID = profile.implementationClassUID
+	params.ImplementationVersionName = profile.implementationVersionName
+	if !isFlagSet("enforce") {
+		params.Enforce = "no"
+		if profile.enforceCalledAE {
+			params.Enforce = "yes"
+		}
+	}
+	if !isFlagSet("rjcalledae") && profile.calledAEReject != nil {
+		params.Reject.CalledAE = profile.calledAEReject
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+// This file shows the activity live in the terminal, "top" style, for
+// operators who run the honeypot interactively, e.g., during an exercise:
+// the sessions in progress, the last DIMSE commands and counters over the
+// last minute, hour and since the start. The screen is redrawn every
+// second in place of the console log, which still goes to -log, and the
+// operational messages are shown at the bottom. They are also written
+// below the screen as they come, so that one that ends the process, e.g.,
+// on a port taken, stays in sight.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// The commands and messages kept for the screen.
+	topRecent   = 100
+	topMessages = 20
+	// The screen size without $COLUMNS and $LINES.
+	topWidth  = 120
+	topHeight = 40
+)
+
+// The counters shown, in that order.
+var topCounters = []string{"connections", "associations", "commands", "stored", "retrieved", "exploits"}
+
+// topCommand is a line of the recent commands.
+type topCommand struct {
+	time    time.Time
+	source  string
+	aeTitle string
+	command string
+	detail  string
+}
+
+// top is an EventSink that shows the activity in the terminal.
+type top struct {
+	out     io.Writer
+	started time.Time
+	done    chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	totals map[string]int64
+	// When each counter was incremented in the last hour, the oldest first.
+	times    map[string][]time.Time
+	commands []topCommand
+	messages []string
+}
+
+// newTop returns the sink for -top, or nil if the activity isn't shown.
+// The screen is redrawn on "out" until Close.
+func newTop(enabled bool, out io.Writer) *top {
+	if !enabled {
+		return nil
+	}
+	t := &top{
+		out:     out,
+		started: time.Now(),
+		done:    make(chan struct{}),
+		totals:  map[string]int64{},
+		times:   map[string][]time.Time{},
+	}
+	go t.run()
+	return t
+}
+
+func (t *top) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// count adds one to counter "name".
+func (t *top) count(name string, at time.Time) {
+	t.totals[name]++
+	t.times[name] = append(t.times[name], at)
+}
+
+// Record counts the event, and lists it if it is a command.
+func (t *top) Record(event dicompot.Event) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch event.Type {
+	case dicompot.EventConnectionOpened, dicompot.EventHL7Connection:
+		if stringField(event, "Status") == "" {
+			t.count("connections", event.Time)
+		}
+	case dicompot.EventHTTPRequest:
+		t.count("connections", event.Time)
+	case dicompot.EventAssociationRequest:
+		t.count("associations", event.Time)
+	case dicompot.EventExploitAttempt:
+		t.count("exploits", event.Time)
+	}
+	if direction := objectDirection(event); direction != "" {
+		t.count(direction, event.Time)
+	}
+	if event.Command == "" || !isDIMSERequest(event) {
+		return nil
+	}
+	t.count("commands", event.Time)
+	c := topCommand{time: event.Time, source: event.RemoteIP, aeTitle: event.CallingAETitle, command: event.Command}
+	for _, qe := range event.Query {
+		if term := strings.Join(qe.Values, "\\"); term != "" {
+			name := qe.Keyword
+			if name == "" {
+				name = qe.Tag
+			}
+			c.detail += name + "=" + term + " "
+		}
+	}
+	if c.detail == "" {
+		c.detail = stringField(event, "SOPClassUID")
+	}
+	if len(t.commands) == topRecent {
+		t.commands = t.commands[1:]
+	}
+	t.commands = append(t.commands, c)
+	return nil
+}
+
+// Write takes the operational messages, of the log package, for the
+// bottom of the screen.
+func (t *top) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		if len(t.messages) == topMessages {
+			t.messages = t.messages[1:]
+		}
+		t.messages = append(t.messages, line)
+	}
+	t.out.Write(b)
+	return len(b), nil
+}
+
+// Close stops redrawing the screen.
+func (t *top) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	return nil
+}
+
+// screenSize returns the size of the terminal, from $COLUMNS and $LINES.
+func screenSize() (int, int) {
+	width, height := topWidth, topHeight
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 40 {
+		width = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n > 15 {
+		height = n
+	}
+	return width, height
+}
+
+// draw redraws the screen.
+func (t *top) draw() {
+	width, height := screenSize()
+	now := time.Now()
+	sessions := dicompot.Sessions()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("\x1b[1mdicompot\x1b[0m  up %s  %s", now.Sub(t.started).Round(time.Second), now.Format("15:04:05"))
+	add("")
+	add("%-14s %10s %10s %10s", "", "last min", "last hour", "total")
+	for _, name := range topCounters {
+		var minute, hour int
+		times := t.times[name]
+		// Forget what is older than an hour.
+		for len(times) > 0 && now.Sub(times[0]) > time.Hour {
+			times = times[1:]
+		}
+		t.times[name] = times
+		hour = len(times)
+		for i := len(times) - 1; i >= 0 && now.Sub(times[i]) <= time.Minute; i-- {
+			minute++
+		}
+		add("%-14s %10d %10d %10d", name, minute, hour, t.totals[name])
+	}
+
+	// What is left is shared by the sessions, the commands and the
+	// messages.
+	rest := height - len(lines) - 7
+	sessionRows, messageRows := rest/4, rest/4
+	commandRows := rest - sessionRows - messageRows
+
+	add("")
+	add("\x1b[1mSessions in progress (%d)\x1b[0m", len(sessions))
+	add("%-9s %-39s %6s %-16s %-16s", "SINCE", "SOURCE", "PORT", "CALLING AE", "CALLED AE")
+	for i := len(sessions) - 1; i >= 0 && i >= len(sessions)-sessionRows; i-- {
+		s := sessions[i]
+		add("%-9s %-39s %6d %-16s %-16s", s.Opened.Format("15:04:05"), s.RemoteIP, s.LocalPort, s.CallingAETitle, s.CalledAETitle)
+	}
+
+	add("")
+	add("\x1b[1mRecent commands\x1b[0m")
+	add("%-9s %-39s %-16s %-10s %s", "TIME", "SOURCE", "CALLING AE", "COMMAND", "DETAIL")
+	for i := len(t.commands) - 1; i >= 0 && i >= len(t.commands)-commandRows; i-- {
+		c := t.commands[i]
+		add("%-9s %-39s %-16s %-10s %s", c.time.Format("15:04:05"), c.source, c.aeTitle, c.command, c.detail)
+	}
+
+	add("")
+	for i := len(t.messages) - messageRows; i < len(t.messages); i++ {
+		if i >= 0 {
+			add("%s", t.messages[i])
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i == height-1 {
+			break
+		}
+		b.WriteString(truncateTerminal(line, width))
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[J")
+	t.out.Write(b.Bytes())
+}
+
+// truncateTerminal cuts "line" to "width" characters, not counting the
+// escape sequences.
+func truncateTerminal(line string, width int) string {
+	var b strings.Builder
+	n := 0
+	escape := false
+	for _, r := range line {
+		switch {
+		case r == '\x1b':
+			escape = true
+		case escape:
+			escape = r < '@' || r > '~' || r == '['
+		case n == width:
+			continue
+		default:
+			n++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
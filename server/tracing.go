@@ -0,0 +1,413 @@
+package main
+
+// This file exports a trace per DICOM association, in the OTLP/HTTP JSON
+// encoding, to an OpenTelemetry collector or a tracing backend. The
+// association is the root span, from the connection to its close, and each
+// DIMSE request a child span, from its receipt to the last event about it,
+// e.g., the search result of a C-FIND, with the number of matches, or the
+// last image of a C-MOVE. The events of a span are span events, so that
+// the time each step took, e.g., the search through the files, shows.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+const (
+	// How long after its last event an association without a close is
+	// given up on.
+	traceSessionTTL = time.Hour
+	// Spans waiting to be exported, at most. Further ones are dropped.
+	maxPendingSpans = 10000
+	// The OTLP span kind of the spans: SERVER.
+	spanKindServer = 2
+)
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// attribute returns the attribute "key" of "value", a string, an integer
+// or a boolean, or anything else as a string.
+func attribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case int, int64, uint16, uint32:
+		s := fmt.Sprint(v)
+		a.Value.IntValue = &s
+	case bool:
+		a.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		if b, err := json.Marshal(v); err == nil {
+			s = string(b)
+		}
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+// setAttribute sets the attribute "key" of the span to "value".
+func (span *otlpSpan) setAttribute(key string, value interface{}) {
+	for i, a := range span.Attributes {
+		if a.Key == key {
+			span.Attributes[i] = attribute(key, value)
+			return
+		}
+	}
+	span.Attributes = append(span.Attributes, attribute(key, value))
+}
+
+// fieldAttributes returns the fields of "event" as attributes, in order.
+func fieldAttributes(prefix string, fields map[string]interface{}) []otlpAttribute {
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var attrs []otlpAttribute
+	for _, k := range keys {
+		attrs = append(attrs, attribute(prefix+k, fields[k]))
+	}
+	return attrs
+}
+
+// traceSession is an association being traced.
+type traceSession struct {
+	root *otlpSpan
+	// The span of the request under way, if one.
+	op *otlpSpan
+	// The time of the last event, which ends the spans.
+	last time.Time
+}
+
+// tracer is a trace exporter.
+type tracer struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	host    string
+
+	// Only used from the goroutine of the queuedSink.
+	sessions map[string]*traceSession
+	pending  []*otlpSpan
+	failing  bool
+}
+
+// newTracer returns the sink for -otlp and -otlpheaders, the
+// comma-separated key=value headers of the requests, or nil if no traces
+// are exported.
+func newTracer(endpoint, headers string) dicompot.EventSink {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid -otlp %q, want, e.g., http://collector:4318", endpoint)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+	t := &tracer{
+		url:      u.String(),
+		headers:  map[string]string{},
+		client:   &http.Client{Timeout: 30 * time.Second},
+		sessions: map[string]*traceSession{},
+	}
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		kv := strings.SplitN(h, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Fatalf("Invalid -otlpheaders entry %q, want key=value", h)
+		}
+		t.headers[kv[0]] = kv[1]
+	}
+	t.host, _ = os.Hostname()
+	log.Printf("-| Exporting traces to %s", t.url)
+	return newQueuedSink("OTLP", 1000, 5*time.Second, t.process)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func newSpanID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// traceID returns the trace ID of session "id", the UUID it is.
+func traceID(id string) string {
+	if b, err := hex.DecodeString(strings.Replace(id, "-", "", -1)); err == nil && len(b) == 16 {
+		return hex.EncodeToString(b)
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// spanEvent returns the span event of "event".
+func spanEvent(event dicompot.Event) otlpEvent {
+	e := otlpEvent{TimeUnixNano: unixNano(event.Time), Name: event.Message, Attributes: fieldAttributes("dicompot.", event.Fields)}
+	e.Attributes = append([]otlpAttribute{attribute("dicompot.type", event.Type)}, e.Attributes...)
+	if terms := queryTerms(event); terms != "" {
+		e.Attributes = append(e.Attributes, attribute("dicom.query", terms))
+	}
+	return e
+}
+
+// The fields of the events that are attributes of the span of their
+// request, and their names.
+var operationAttributes = map[string]string{
+	"SOPClassUID": "sop_class_uid",
+	"Matches":     "matches",
+	"Files":       "files",
+}
+
+// startsOperation returns whether "event" starts a request other than
+// that of "command" under way. The search result of a C-MOVE or C-GET says
+// C-FIND.
+func startsOperation(event dicompot.Event, command string) bool {
+	if isDIMSERequest(event) && !endsOperation(event) {
+		return true
+	}
+	return event.Command != command && event.Type != dicompot.EventCFindResult
+}
+
+// endsOperation returns whether "event" is the last of its request: C-FIND,
+// C-GET and C-STORE report their receipt once answered.
+func endsOperation(event dicompot.Event) bool {
+	switch event.Type {
+	case dicompot.EventCFind, dicompot.EventCGet:
+		return event.Message == "Received"
+	case dicompot.EventCStore:
+		return event.Message == "C-STORE received"
+	}
+	return false
+}
+
+// finish ends "span" at "end" and queues it.
+func (t *tracer) finish(span *otlpSpan, end time.Time) {
+	span.EndTimeUnixNano = unixNano(end)
+	if len(t.pending) < maxPendingSpans {
+		t.pending = append(t.pending, span)
+	}
+}
+
+// process adds the events to the spans of their associations, and exports
+// the spans finished.
+func (t *tracer) process(events []dicompot.Event) error {
+	for _, event := range events {
+		s := t.sessions[event.SessionID]
+		if s == nil {
+			if event.Type != dicompot.EventConnectionOpened || event.SessionID == "" {
+				continue
+			}
+			s = &traceSession{root: &otlpSpan{
+				TraceID:           traceID(event.SessionID),
+				SpanID:            newSpanID(),
+				Name:              "DICOM association",
+				Kind:              spanKindServer,
+				StartTimeUnixNano: unixNano(event.Time),
+			}}
+			s.root.Attributes = []otlpAttribute{
+				attribute("dicompot.session_id", event.SessionID),
+				attribute("client.address", event.RemoteIP),
+				attribute("client.port", event.RemotePort),
+				attribute("server.port", event.LocalPort),
+			}
+			t.sessions[event.SessionID] = s
+		}
+		if event.CallingAETitle != "" && event.Type == dicompot.EventAssociationRequest {
+			s.root.Attributes = append(s.root.Attributes,
+				attribute("dicom.calling_ae_title", event.CallingAETitle),
+				attribute("dicom.called_ae_title", event.CalledAETitle))
+		}
+		if country := stringField(event, "GeoCountry"); country != "" && event.Type == dicompot.EventConnectionOpened {
+			s.root.Attributes = append(s.root.Attributes, attribute("client.geo.country_iso_code", country))
+		}
+		if event.Command != "" {
+			if s.op != nil && startsOperation(event, s.op.Name) {
+				// The previous request ends with its last event.
+				t.finish(s.op, s.last)
+				s.op = nil
+			}
+			if s.op == nil {
+				s.op = &otlpSpan{
+					TraceID:           s.root.TraceID,
+					SpanID:            newSpanID(),
+					ParentSpanID:      s.root.SpanID,
+					Name:              event.Command,
+					Kind:              spanKindServer,
+					StartTimeUnixNano: unixNano(event.Time),
+					Attributes:        []otlpAttribute{attribute("dicom.command", event.Command)},
+				}
+			}
+		}
+		s.last = event.Time
+		switch event.Type {
+		case dicompot.EventConnectionClosed:
+			if s.op != nil {
+				t.finish(s.op, event.Time)
+			}
+			s.root.Events = append(s.root.Events, spanEvent(event))
+			for _, k := range []string{"BytesReceived", "BytesSent"} {
+				if v, ok := event.Fields[k]; ok {
+					s.root.Attributes = append(s.root.Attributes, attribute("dicompot."+k, v))
+				}
+			}
+			t.finish(s.root, event.Time)
+			delete(t.sessions, event.SessionID)
+			continue
+		case dicompot.EventAssociationRejected:
+			s.root.Status.Code, s.root.Status.Message = 2, "Association rejected"
+		}
+		if s.op == nil {
+			s.root.Events = append(s.root.Events, spanEvent(event))
+			continue
+		}
+		s.op.Events = append(s.op.Events, spanEvent(event))
+		for k, name := range operationAttributes {
+			if v, ok := event.Fields[k]; ok {
+				s.op.setAttribute("dicom."+name, v)
+			}
+		}
+		if _, ok := event.Fields["Error"]; ok && s.op.Status.Code == 0 {
+			s.op.Status.Code, s.op.Status.Message = 2, stringField(event, "Error")
+		}
+		if endsOperation(event) {
+			t.finish(s.op, event.Time)
+			s.op = nil
+		}
+	}
+	now := time.Now()
+	for id, s := range t.sessions {
+		if now.Sub(s.last) > traceSessionTTL {
+			if s.op != nil {
+				t.finish(s.op, s.last)
+			}
+			t.finish(s.root, s.last)
+			delete(t.sessions, id)
+		}
+	}
+	t.export()
+	return nil
+}
+
+// export sends the spans finished. They are kept for the next batch if the
+// backend fails, and dropped if it rejects them.
+func (t *tracer) export() {
+	if len(t.pending) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{attribute("service.name", "dicompot"), attribute("host.name", t.host)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "dicompot", "version": siemVersion},
+				"spans": t.pending,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Printf("OTLP: failed to encode %d spans: %v", len(t.pending), err)
+		t.pending = nil
+		return
+	}
+	err = t.post(body)
+	if err == nil || err == errRejected {
+		if t.failing {
+			log.Printf("OTLP: exporting again")
+			t.failing = false
+		}
+		t.pending = nil
+		return
+	}
+	if !t.failing {
+		log.Printf("OTLP: failed to export %d spans, retrying with the next batch: %v", len(t.pending), err)
+		t.failing = true
+	}
+}
+
+// errRejected is the error of a request the backend rejected, which is not
+// retried.
+var errRejected = errors.New("rejected")
+
+func (t *tracer) post(body []byte) error {
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusBadRequest {
+		log.Printf("OTLP: rejected %d spans: %v", len(t.pending), err)
+		return errRejected
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// newTranscripts returns the transcripts for -transcriptdir, or nil if
+// associations aren't recorded.
+func newTranscripts(dir string) *dicompot.Transcripts {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatalf("Failed to create -transcriptdir %s: %v", dir, err)
+	}
+	log.Printf("-| Recording transcripts to: %s", dir)
+	return &dicompot.Transcripts{Dir: dir}
+}
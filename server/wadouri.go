@@ -0,0 +1,166 @@
+package main
+
+// This file emulates WADO-URI, P3.18 chapter 9 in the 2017 and earlier
+// editions: GET ?requestType=WADO&studyUID=...&seriesUID=...&objectUID=...
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// isWADOURI reports whether "r" is a WADO-URI request. Scanners use all
+// sorts of paths, e.g., /wado, /wado.php, /dcm4chee-arc/wado, so only the
+// query is checked.
+func isWADOURI(r *http.Request) bool {
+	for key, values := range r.URL.Query() {
+		if strings.EqualFold(key, "requestType") && len(values) > 0 && strings.EqualFold(values[0], "WADO") {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *dicomweb) wadoURI(rw http.ResponseWriter, r *http.Request, sessionID string) {
+	query := r.URL.Query()
+	contentType := query.Get("contentType")
+	if contentType == "" {
+		// The default. P3.18, 9.2.2.
+		contentType = "image/jpeg"
+	}
+	fields := map[string]interface{}{
+		"StudyInstanceUID":  query.Get("studyUID"),
+		"SeriesInstanceUID": query.Get("seriesUID"),
+		"SOPInstanceUID":    query.Get("objectUID"),
+		"ContentType":       contentType,
+	}
+	for _, key := range []string{"anonymize", "frameNumber", "transferSyntax", "rows", "columns", "region"} {
+		if v := query.Get(key); v != "" {
+			fields[key] = v
+		}
+	}
+	var keys []*dicom.Element
+	for tag, param := range map[dicomtag.Tag]string{
+		dicomtag.StudyInstanceUID:  "studyUID",
+		dicomtag.SeriesInstanceUID: "seriesUID",
+		dicomtag.SOPInstanceUID:    "objectUID",
+	} {
+		if uid := query.Get(param); uid != "" {
+			keys = append(keys, dicom.MustNewElement(tag, uid))
+		}
+	}
+	var matches []filterMatch
+	var err error
+	// All three UIDs are required, but a partial request is still worth
+	// answering with something.
+	if len(keys) > 0 {
+		matches, err = w.ss.findMatchingFiles(w.ss.sessionUIDs.resolve(keys), w.ss.visibleStudies(remoteIP(r.RemoteAddr), ""))
+	}
+	fields["Matches"] = len(matches)
+	if err != nil {
+		fields["Error"] = err.Error()
+	}
+	w.ss.record(logrus.WarnLevel, dicompot.EventWADO, sessionID, "WADO-URI retrieve", fields)
+	if len(matches) == 0 {
+		http.NotFound(rw, r)
+		return
+	}
+
+	path := matches[0].path
+	if strings.Contains(contentType, "application/dicom") {
+		data, err := w.ss.readFile(path, sessionID)
+		if err != nil {
+			http.NotFound(rw, r)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/dicom")
+		rw.Write(data)
+		return
+	}
+	ds, err := dicompot.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, renderImage(ds), nil); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "image/jpeg")
+	rw.Write(buf.Bytes())
+}
+
+func intAttribute(ds *dicom.DataSet, tag dicomtag.Tag) int {
+	elem, err := ds.FindElementByTag(tag)
+	if err != nil || len(elem.Value) == 0 {
+		return 0
+	}
+	switch v := elem.Value[0].(type) {
+	case uint16:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(strings.TrimSpace(v))
+		return n
+	}
+	return 0
+}
+
+// renderImage converts the first frame of native grayscale pixel data to an
+// image, with the full range of the values stretched to 8 bits. Anything it
+// can't render, including datasets without pixel data, comes out as a plain
+// gray image, so the response still looks like a real one.
+func renderImage(ds *dicom.DataSet) image.Image {
+	rows, columns := intAttribute(ds, dicomtag.Rows), intAttribute(ds, dicomtag.Columns)
+	if rows <= 0 || columns <= 0 {
+		rows, columns = 512, 512
+	}
+	img := image.NewGray(image.Rect(0, 0, columns, rows))
+	for i := range img.Pix {
+		img.Pix[i] = 0x40
+	}
+	bits := intAttribute(ds, dicomtag.BitsAllocated)
+	elem, err := ds.FindElementByTag(dicomtag.PixelData)
+	if err != nil || intAttribute(ds, dicomtag.SamplesPerPixel) > 1 || (bits != 8 && bits != 16) {
+		return img
+	}
+	info, ok := elem.Value[0].(dicom.PixelDataInfo)
+	if !ok || len(info.Frames) == 0 || len(info.Frames[0]) < rows*columns*bits/8 {
+		return img
+	}
+	frame := info.Frames[0]
+	values := make([]int, rows*columns)
+	lo, hi := int(^uint(0)>>1), 0
+	for i := range values {
+		if bits == 8 {
+			values[i] = int(frame[i])
+		} else {
+			values[i] = int(binary.LittleEndian.Uint16(frame[2*i:]))
+		}
+		if values[i] < lo {
+			lo = values[i]
+		}
+		if values[i] > hi {
+			hi = values[i]
+		}
+	}
+	for i, v := range values {
+		if hi > lo {
+			v = (v - lo) * 255 / (hi - lo)
+		} else {
+			v = 0x40
+		}
+		img.Set(i%columns, i/columns, color.Gray{Y: uint8(v)})
+	}
+	return img
+}
@@ -0,0 +1,144 @@
+package main
+
+// This file hides a watermark in the pixel data of the images retrieved with
+// C-MOVE and C-GET: the session ID and time, written into the least
+// significant bit of the samples, over and over. A change of one in the
+// lowest bit is invisible, and "server watermark FILE" reads it back.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// Starts every copy of the watermark, followed by the length of the payload.
+const watermarkMagic = "DPWM"
+
+// pixelSamples returns the native pixel data of "ds", the size of a sample
+// in bytes, and the offset of its least significant byte. Compressed pixel
+// data is not supported, as changing it would take a codec.
+func pixelSamples(ds *dicom.DataSet) (samples []byte, step int, lsb int, err error) {
+	elem, err := ds.FindElementByTag(dicomtag.PixelData)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("No pixel data")
+	}
+	info, ok := elem.Value[0].(dicom.PixelDataInfo)
+	if !ok || len(info.Frames) != 1 || elem.UndefinedLength {
+		return nil, 0, 0, fmt.Errorf("Compressed pixel data")
+	}
+	bits := intAttribute(ds, dicomtag.BitsAllocated)
+	if bits != 8 && bits != 16 {
+		return nil, 0, 0, fmt.Errorf("Unsupported BitsAllocated %d", bits)
+	}
+	step = bits / 8
+	if ts, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID); err == nil && step == 2 {
+		if uid, _ := ts.GetString(); uid == dicomuid.ExplicitVRBigEndian {
+			lsb = 1
+		}
+	}
+	return info.Frames[0], step, lsb, nil
+}
+
+// embedWatermark writes "payload" into the pixel data of "ds".
+func embedWatermark(ds *dicom.DataSet, payload string) error {
+	samples, step, lsb, err := pixelSamples(ds)
+	if err != nil {
+		return err
+	}
+	if len(payload) > 255 {
+		payload = payload[:255]
+	}
+	msg := append([]byte(watermarkMagic), byte(len(payload)))
+	msg = append(msg, payload...)
+	n := len(samples) / step
+	if n < 8*len(msg) {
+		return fmt.Errorf("Image too small for a watermark")
+	}
+	for i := 0; i < n; i++ {
+		b := i % (8 * len(msg))
+		bit := msg[b/8] >> uint(7-b%8) & 1
+		samples[i*step+lsb] = samples[i*step+lsb]&^1 | bit
+	}
+	return nil
+}
+
+// readWatermark returns the payload embedded by embedWatermark.
+func readWatermark(ds *dicom.DataSet) (string, error) {
+	samples, step, lsb, err := pixelSamples(ds)
+	if err != nil {
+		return "", err
+	}
+	readByte := func(i int) byte {
+		var b byte
+		for bit := 0; bit < 8; bit++ {
+			if j := (8*i+bit)*step + lsb; j < len(samples) {
+				b = b<<1 | samples[j]&1
+			}
+		}
+		return b
+	}
+	for i := range watermarkMagic {
+		if readByte(i) != watermarkMagic[i] {
+			return "", fmt.Errorf("No watermark")
+		}
+	}
+	length := int(readByte(len(watermarkMagic)))
+	payload := make([]byte, length)
+	for i := range payload {
+		payload[i] = readByte(len(watermarkMagic) + 1 + i)
+	}
+	return string(payload), nil
+}
+
+// watermarkPayload identifies a retrieval, e.g.,
+// "4f0c2a9e-8d1b-4c3e-9a47-1f6b2d8e5c70 1792001317".
+func watermarkPayload(sessionID string, t time.Time) string {
+	return sessionID + " " + strconv.FormatInt(t.Unix(), 10)
+}
+
+// watermark marks "ds", read from "path", as retrieved in session
+// "sessionID", and logs the outcome.
+func (ss *server) watermark(ds *dicom.DataSet, path, sessionID string) {
+	payload := watermarkPayload(sessionID, time.Now())
+	fields := map[string]interface{}{
+		"Path":      path,
+		"Watermark": payload,
+	}
+	if err := embedWatermark(ds, payload); err != nil {
+		fields["Error"] = err.Error()
+	}
+	ss.record(logrus.WarnLevel, dicompot.EventWatermark, sessionID, "Watermark embedded", fields)
+}
+
+// runWatermark implements the "watermark" subcommand, which prints the
+// watermarks of the files named in "args".
+func runWatermark(args []string) {
+	fs := flag.NewFlagSet("watermark", flag.ExitOnError)
+	fs.Parse(args)
+	for _, path := range fs.Args() {
+		ds, err := dicompot.ReadDataSetFromFile(path, dicom.ReadOptions{})
+		if err == nil {
+			var payload string
+			if payload, err = readWatermark(ds); err == nil {
+				fields := strings.SplitN(payload, " ", 2)
+				if len(fields) == 2 {
+					if unix, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+						payload = fmt.Sprintf("session %s at %s", fields[0], time.Unix(unix, 0).UTC().Format(time.RFC3339))
+					}
+				}
+				fmt.Printf("%s: %s\n", path, payload)
+				continue
+			}
+		}
+		log.Printf("%s: %v", path, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+// This file posts the events to webhooks, for whatever automation is behind
+// them: each event that passes the filters is posted to every URL, as a
+// JSON object of its own, retried while the receiver fails. With a secret,
+// requests are signed, so that a receiver can tell them from forgeries:
+// X-Dicompot-Signature is sha256=<hex HMAC-SHA256 of
+// "<X-Dicompot-Timestamp>.<body>">.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// webhook posts the events to a URL.
+type webhook struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// webhookFilter is an EventSink that hands "sink" the events of the types
+// it is given, if any, and of "level" or more severe.
+type webhookFilter struct {
+	types map[string]bool
+	level logrus.Level
+	sink  dicompot.EventSink
+}
+
+// newWebhookSink returns the sink for -webhook and friends, posting the
+// events to the comma-separated "urls", or nil if there are none. "types"
+// are the comma-separated event types posted (default: all), "level" the
+// least severe level.
+func newWebhookSink(urls, types, level, secret, caFile string) dicompot.EventSink {
+	if urls == "" {
+		return nil
+	}
+	f := &webhookFilter{types: map[string]bool{}}
+	if types != "" {
+		for _, t := range strings.Split(types, ",") {
+			f.types[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+	}
+	var err error
+	if f.level, err = logrus.ParseLevel(level); err != nil {
+		log.Fatalf("Invalid -webhooklevel %q, want debug, info, warning or error", level)
+	}
+	client := newHTTPClient("webhookcafile", caFile)
+	var sinks dicompot.MultiSink
+	for _, rawURL := range strings.Split(urls, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid -webhook %q, want, e.g., https://hooks.example.org/dicompot", rawURL)
+		}
+		w := &webhook{url: rawURL, secret: secret, client: client}
+		// One event a request, so that a retry doesn't post others again.
+		sinks = append(sinks, newQueuedSink("Webhook "+rawURL, 1, 0, w.post))
+		log.Printf("-| Posting events to the webhook %s", rawURL)
+	}
+	f.sink = sinks
+	return f
+}
+
+// Record hands the event on if it passes the filters.
+func (f *webhookFilter) Record(event dicompot.Event) error {
+	if event.Level > f.level || (len(f.types) > 0 && !f.types[event.Type]) {
+		return nil
+	}
+	return f.sink.Record(event)
+}
+
+func (f *webhookFilter) Close() error {
+	return f.sink.Close()
+}
+
+// post posts the events, one request each. A request the receiver rejects,
+// save for throttling, is logged and dropped.
+func (w *webhook) post(events []dicompot.Event) error {
+	for _, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "dicompot/"+siemVersion)
+		req.Header.Set("X-Dicompot-Event", event.Type)
+		if w.secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte(w.secret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(body)
+			req.Header.Set("X-Dicompot-Timestamp", timestamp)
+			req.Header.Set("X-Dicompot-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := w.client.Do(req)
+		if err != nil {
+			return err
+		}
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			continue
+		}
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+			log.Printf("Webhook %s: rejected a %s event: %v", w.url, event.Type, err)
+			continue
+		}
+		return err
+	}
+	return nil
+}
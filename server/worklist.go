@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// Synthetic scheduled procedure steps served to Modality Worklist
+// (1.2.840.10008.5.1.4.31) C-FIND queries. P3.4, K.6.1.
+type worklistItem struct {
+	patientName      string
+	patientID        string
+	birthDate        string
+	sex              string
+	accessionNumber  string
+	referringDoctor  string
+	studyUID         string
+	procedureID      string
+	procedure        string
+	modality         string
+	stationAETitle   string
+	stationName      string
+	startDate        string
+	startTime        string
+	performingDoctor string
+}
+
+// The modalities that take scheduled procedures, and their stations.
+var worklistStations = map[string][2]string{
+	"CT": {"CT01", "CTSCANNER1"},
+	"MR": {"MR01", "MRSCANNER1"},
+	"US": {"US02", "ULTRASOUND2"},
+	"CR": {"CR01", "XRAYROOM1"},
+}
+
+// worklist is the schedule served to Modality Worklist queries. It is made
+// up anew every day, so the dates are always current.
+type worklist struct {
+	// Number of procedures scheduled each day.
+	size int
+
+	mu    sync.Mutex
+	day   string           // guarded by mu
+	items []*dicom.DataSet // guarded by mu
+}
+
+func newWorklist(size int) *worklist {
+	return &worklist{size: size}
+}
+
+// today returns the procedures scheduled for today.
+func (w *worklist) today() []*dicom.DataSet {
+	day := time.Now().Format("20060102")
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if day != w.day {
+		w.day = day
+		w.items = worklistDataSets(scheduleWorklist(day, w.size))
+	}
+	return w.items
+}
+
+// scheduleWorklist makes up "n" procedures for "day", spread over the
+// working hours. The same day always gets the same schedule, so that it
+// doesn't change when the honeypot restarts.
+func scheduleWorklist(day string, n int) []worklistItem {
+	h := fnv.New64a()
+	h.Write([]byte(day))
+	g := &generator{rand: rand.New(rand.NewSource(int64(h.Sum64())))}
+	var modalities []generatedModality
+	for _, m := range generatedModalities {
+		if _, ok := worklistStations[m.modality]; ok {
+			modalities = append(modalities, m)
+		}
+	}
+	birthYear, _ := strconv.Atoi(day[:4])
+	start := 7*60 + 30
+	var items []worklistItem
+	for i := 1; i <= n; i++ {
+		m := modalities[g.rand.Intn(len(modalities))]
+		station := worklistStations[m.modality]
+		sex, given := "M", g.pick(generatedMaleNames)
+		if g.rand.Intn(2) == 0 {
+			sex, given = "F", g.pick(generatedFemaleNames)
+		}
+		procedure := g.pick(m.descriptions)
+		items = append(items, worklistItem{
+			patientName:      strings.ToUpper(g.pick(generatedFamilyNames) + "^" + given),
+			patientID:        fmt.Sprintf("PAT%07d", g.rand.Intn(10000000)),
+			birthDate:        fmt.Sprintf("%04d%02d%02d", birthYear-18-g.rand.Intn(70), 1+g.rand.Intn(12), 1+g.rand.Intn(28)),
+			sex:              sex,
+			accessionNumber:  fmt.Sprintf("ACC%s%03d", day, i),
+			referringDoctor:  strings.ToUpper(g.pick(generatedPhysicians)),
+			studyUID:         g.uid(),
+			procedureID:      fmt.Sprintf("RP%s%03d", day[2:], i),
+			procedure:        procedure,
+			modality:         m.modality,
+			stationAETitle:   station[0],
+			stationName:      station[1],
+			startDate:        day,
+			startTime:        fmt.Sprintf("%02d%02d00", start/60, start%60),
+			performingDoctor: strings.ToUpper(g.pick(generatedPhysicians)),
+		})
+		// Slots are 15 to 45 minutes, rounded to five. A long schedule
+		// starts over, as if in another room.
+		start += 15 + 5*g.rand.Intn(7)
+		if start > 17*60 {
+			start = 7*60 + 30 + 5*g.rand.Intn(6)
+		}
+	}
+	return items
+}
+
+// worklistDataSets converts "items" into datasets that can be matched like
+// any DICOM file.
+func worklistDataSets(items []worklistItem) []*dicom.DataSet {
+	var datasets []*dicom.DataSet
+	for _, w := range items {
+		step := dicom.MustNewElement(dicomtag.Item,
+			dicom.MustNewElement(dicomtag.Modality, w.modality),
+			dicom.MustNewElement(dicomtag.ScheduledStationAETitle, w.stationAETitle),
+			dicom.MustNewElement(dicomtag.ScheduledStationName, w.stationName),
+			dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, w.startDate),
+			dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartTime, w.startTime),
+			dicom.MustNewElement(dicomtag.ScheduledPerformingPhysicianName, w.performingDoctor),
+			dicom.MustNewElement(dicomtag.ScheduledProcedureStepDescription, w.procedure),
+			dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "SPS"+w.procedureID[2:]))
+		datasets = append(datasets, &dicom.DataSet{Elements: []*dicom.Element{
+			dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 100"),
+			dicom.MustNewElement(dicomtag.AccessionNumber, w.accessionNumber),
+			dicom.MustNewElement(dicomtag.ReferringPhysicianName, w.referringDoctor),
+			dicom.MustNewElement(dicomtag.PatientName, w.patientName),
+			dicom.MustNewElement(dicomtag.PatientID, w.patientID),
+			dicom.MustNewElement(dicomtag.PatientBirthDate, w.birthDate),
+			dicom.MustNewElement(dicomtag.PatientSex, w.sex),
+			dicom.MustNewElement(dicomtag.StudyInstanceUID, w.studyUID),
+			dicom.MustNewElement(dicomtag.RequestedProcedureDescription, w.procedure),
+			dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, step),
+			dicom.MustNewElement(dicomtag.RequestedProcedureID, w.procedureID),
+		}})
+	}
+	return datasets
+}
@@ -3,14 +3,31 @@ package dicompot
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
 )
 
 // serviceDispatcher multiplexes statemachine upcall events to DIMSE commands.
 type serviceDispatcher struct {
 	label      string          // for logging.
 	downcallCh chan stateEvent // for sending PDUs to the statemachine.
+	events     *eventEmitter   // nil on the service user side.
+
+	// How long to wait before sending each message, and before handling each
+	// kind of request. Set on the provider side only.
+	responseDelay time.Duration
+	commandDelays map[int]Delay
+
+	// The failures each kind of request meets. Set on the provider side
+	// only.
+	fakeStatuses map[int][]FakeStatus
+
+	// Where the association is recorded, once accepted. Set on the
+	// provider side only.
+	transcripts *Transcripts
+	transcript  *transcript
 
 	mu sync.Mutex
 
@@ -38,13 +55,21 @@ type serviceCommandState struct {
 
 	// upcallCh streams command+data for this messageID.
 	upcallCh chan upcallEvent
+
+	// If set, the command fails with this status, whatever the callback
+	// says.
+	fakeStatus *dimse.Status
 }
 
 // Send a command+data combo to the remote peer. data may be nil.
 func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
+	if cs.disp.responseDelay > 0 {
+		time.Sleep(cs.disp.responseDelay)
+	}
 	if s := cmd.GetStatus(); s != nil && s.Status != dimse.StatusSuccess && s.Status != dimse.StatusPending {
 	} else {
 	}
+	cs.disp.transcript.record(TranscriptSent, cs.context.contextID, cmd, data)
 	payload := &stateEventDIMSEPayload{
 		abstractSyntaxName: cs.context.abstractSyntaxUID,
 		command:            cmd,
@@ -126,6 +151,7 @@ func (disp *serviceDispatcher) unregisterCallback(commandField int) {
 
 func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	if event.eventType == upcallEventHandshakeCompleted {
+		disp.transcript = disp.transcripts.open(event.cm, disp.events, disp.label)
 		return
 	}
 	doassert(event.eventType == upcallEventData)
@@ -135,6 +161,7 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
 		return
 	}
+	disp.transcript.record(TranscriptReceived, event.contextID, event.command, event.data)
 	messageID := event.command.GetMessageID()
 	dc, found := disp.findOrCreateCommand(messageID, event.cm, context)
 	if found {
@@ -144,7 +171,23 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	disp.mu.Lock()
 	cb := disp.callbacks[event.command.CommandField()]
 	disp.mu.Unlock()
+	if cb == nil {
+		// A response to a command we never sent, or a request we don't
+		// implement. Drop it rather than crash the connection.
+		disp.events.emit(logrus.WarnLevel, EventUnhandledCommand, disp.label, "Unhandled DIMSE message", map[string]interface{}{
+			"Command": event.command.String(),
+		})
+		disp.deleteCommand(dc)
+		return
+	}
 	go func() {
+		time.Sleep(disp.commandDelays[event.command.CommandField()].duration())
+		if dc.fakeStatus = drawFakeStatus(disp.fakeStatuses[event.command.CommandField()]); dc.fakeStatus != nil {
+			disp.events.emit(logrus.InfoLevel, EventFakeStatus, disp.label, "Fake status", map[string]interface{}{
+				"CommandField": fmt.Sprintf("0x%04x", event.command.CommandField()),
+				"Status":       fmt.Sprintf("0x%04x", uint16(dc.fakeStatus.Status)),
+			})
+		}
 		cb(event.command, event.data, dc)
 		disp.deleteCommand(dc)
 	}()
@@ -152,6 +195,7 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 
 // Must be called exactly once to shut down the dispatcher.
 func (disp *serviceDispatcher) close() {
+	disp.transcript.close()
 	disp.mu.Lock()
 	for _, cs := range disp.activeCommands {
 		close(cs.upcallCh)
@@ -159,9 +203,10 @@ func (disp *serviceDispatcher) close() {
 	disp.mu.Unlock()
 }
 
-func newServiceDispatcher(label string) *serviceDispatcher {
+func newServiceDispatcher(label string, events *eventEmitter) *serviceDispatcher {
 	return &serviceDispatcher{
 		label:          label,
+		events:         events,
 		downcallCh:     make(chan stateEvent, 128),
 		activeCommands: make(map[dimse.MessageID]*serviceCommandState),
 		callbacks:      make(map[int]serviceCallback),
@@ -3,13 +3,19 @@
 package dicompot
 
 import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
 	"net"
-	"regexp"
 	"strings"
+	"time"
 
 	dicom "github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/pdu"
+	"github.com/nsmfoo/dicompot/sopclass"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,10 +29,14 @@ type CMoveResult struct {
 
 func handleCStore(
 	cb CStoreCallback,
+	refusedStatus dimse.StatusCode,
 	connState ConnectionState,
 	c *dimse.CStoreRq, data []byte,
 	cs *serviceCommandState) {
-	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
+	if refusedStatus == 0 {
+		refusedStatus = dimse.StatusUnrecognizedOperation
+	}
+	status := dimse.Status{Status: refusedStatus}
 
 	if cb != nil {
 		status = cb(
@@ -34,8 +44,12 @@ func handleCStore(
 			cs.context.transferSyntaxUID,
 			c.AffectedSOPClassUID,
 			c.AffectedSOPInstanceUID,
+			cs.cm.label,
 			data)
 	}
+	if cs.fakeStatus != nil {
+		status = *cs.fakeStatus
+	}
 	resp := &dimse.CStoreRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo: c.MessageID,
@@ -45,10 +59,17 @@ func handleCStore(
 	}
 	cs.sendMessage(resp, nil)
 
-	logrus.WithFields(logrus.Fields{
-		"Type": "We don't like that",
-		"ID":   cs.disp.label,
-	}).Error("C-STORE received")
+	fields := map[string]interface{}{
+		"SOPClassUID":    c.AffectedSOPClassUID,
+		"SOPInstanceUID": c.AffectedSOPInstanceUID,
+		"TransferSyntax": cs.context.transferSyntaxUID,
+		"Size":           len(data),
+		"Status":         status.Status.String(),
+	}
+	if cb == nil {
+		fields["Type"] = "We don't like that"
+	}
+	cs.disp.events.emit(logrus.ErrorLevel, EventCStore, cs.disp.label, "C-STORE received", fields)
 }
 
 func handleCFind(
@@ -76,6 +97,19 @@ func handleCFind(
 		}, nil)
 		return
 	}
+	query := emitQuery(cs, "C-FIND", elems)
+	if cs.fakeStatus != nil {
+		emitWithQuery(cs, logrus.InfoLevel, EventCFind, "Received", query, map[string]interface{}{
+			"Command": "C-FIND",
+		})
+		cs.sendMessage(&dimse.CFindRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    *cs.fakeStatus,
+		}, nil)
+		return
+	}
 
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	responseCh := make(chan CFindResult, 128)
@@ -85,7 +119,12 @@ func handleCFind(
 	go func() {
 		params.CFind(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, sessionID, responseCh)
 	}()
+	var numSent int
 	for resp := range responseCh {
+		if cancelRequested(cs, "C-FIND", numSent) {
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -93,7 +132,7 @@ func handleCFind(
 			}
 			break
 		}
-		payload, err := writeElementsToBytes(resp.Elements, cs.context.transferSyntaxUID)
+		payload, err := writeElementsToBytes(withUTF8CharacterSet(resp.Elements), cs.context.transferSyntaxUID)
 
 		if err != nil {
 			status = dimse.Status{
@@ -109,12 +148,12 @@ func handleCFind(
 			CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
 			Status:                    dimse.Status{Status: dimse.StatusPending},
 		}, payload)
+		numSent++
 	}
 
-	logrus.WithFields(logrus.Fields{
+	emitWithQuery(cs, logrus.InfoLevel, EventCFind, "Received", query, map[string]interface{}{
 		"Command": "C-FIND",
-		"ID":      cs.cm.label,
-	}).Info("Received")
+	})
 
 	cs.sendMessage(&dimse.CFindRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -132,10 +171,10 @@ func handleCMove(
 	c *dimse.CMoveRq, data []byte,
 	cs *serviceCommandState) {
 
-	logrus.WithFields(logrus.Fields{
-		"Command": "C-MOVE",
-		"ID":      cs.cm.label,
-	}).Info("Received")
+	cs.disp.events.emit(logrus.InfoLevel, EventCMove, cs.cm.label, "Received", map[string]interface{}{
+		"Command":         "C-MOVE",
+		"MoveDestination": c.MoveDestination,
+	})
 
 	sendError := func(err error) {
 		cs.sendMessage(&dimse.CMoveRsp{
@@ -159,6 +198,27 @@ func handleCMove(
 		sendError(err)
 		return
 	}
+	emitQuery(cs, "C-MOVE", elems)
+	if cs.fakeStatus != nil {
+		cs.sendMessage(&dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    *cs.fakeStatus,
+		}, nil)
+		return
+	}
+	dest, err := openMoveDestination(params, c.MoveDestination, cs)
+	if err != nil {
+		cs.sendMessage(&dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Status{Status: dimse.CMoveMoveDestinationUnknown, ErrorComment: err.Error()},
+		}, nil)
+		return
+	}
+	defer dest.release()
 	var sessionID string
 	sessionID = cs.cm.label
 	responseCh := make(chan CMoveResult, 128)
@@ -168,6 +228,10 @@ func handleCMove(
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	var numSuccesses, numFailures uint16
 	for resp := range responseCh {
+		if cancelRequested(cs, "C-MOVE", int(numSuccesses+numFailures)) {
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -175,7 +239,12 @@ func handleCMove(
 			}
 			break
 		}
-
+		time.Sleep(params.SubOperationDelay.duration())
+		if dest.store(resp.DataSet) {
+			numSuccesses++
+		} else {
+			numFailures++
+		}
 		cs.sendMessage(&dimse.CMoveRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
@@ -198,6 +267,105 @@ func handleCMove(
 	}
 }
 
+// How long to wait for the C-MOVE destination to accept the connection.
+const moveDialTimeout = 10 * time.Second
+
+// moveDestination is the storage SCP a C-MOVE sends its sub-operations to.
+// If the destination is not listed in RemoteAEs and SimulateCMove is set, no
+// association is opened and every sub-operation pretends to succeed.
+type moveDestination struct {
+	aeTitle   string
+	simulated bool
+	addr      string       // Resolved address of the destination.
+	su        *ServiceUser // Nil if the association failed.
+	cs        *serviceCommandState
+}
+
+func openMoveDestination(params ServiceProviderParams, aeTitle string, cs *serviceCommandState) (*moveDestination, error) {
+	// AE titles are padded with spaces on the wire.
+	aeTitle = strings.TrimSpace(aeTitle)
+	dest := &moveDestination{aeTitle: aeTitle, cs: cs}
+	fields := map[string]interface{}{"MoveDestination": aeTitle}
+	hostPort, ok := params.RemoteAEs[aeTitle]
+	if !ok {
+		if !params.SimulateCMove {
+			fields["Error"] = "Unknown destination"
+			cs.disp.events.emit(logrus.WarnLevel, EventCMove, cs.cm.label, "C-MOVE destination", fields)
+			return nil, fmt.Errorf("C-MOVE destination '%v' not registered in the server", aeTitle)
+		}
+		dest.simulated = true
+		fields["Simulated"] = true
+		cs.disp.events.emit(logrus.WarnLevel, EventCMove, cs.cm.label, "C-MOVE destination", fields)
+		return dest, nil
+	}
+	fields["Address"] = hostPort
+	err := dest.connect(params.AETitle, hostPort)
+	if err != nil {
+		fields["Error"] = err.Error()
+	} else {
+		fields["Resolved"] = dest.addr
+	}
+	cs.disp.events.emit(logrus.WarnLevel, EventCMove, cs.cm.label, "C-MOVE destination", fields)
+	// A destination that can't be reached is reported as failed
+	// sub-operations, as a real SCP would.
+	return dest, nil
+}
+
+func (d *moveDestination) connect(callingAETitle, hostPort string) error {
+	conn, err := net.DialTimeout("tcp", hostPort, moveDialTimeout)
+	if err != nil {
+		return err
+	}
+	d.addr = conn.RemoteAddr().String()
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  d.aeTitle,
+		CallingAETitle: callingAETitle,
+		SOPClasses:     sopclass.StorageClasses,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	su.SetConn(conn)
+	if err := su.waitUntilReady(); err != nil {
+		su.Release()
+		return err
+	}
+	d.su = su
+	return nil
+}
+
+// store runs one C-STORE sub-operation and reports whether it succeeded.
+func (d *moveDestination) store(ds *dicom.DataSet) bool {
+	fields := map[string]interface{}{"MoveDestination": d.aeTitle}
+	if elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID); err == nil {
+		fields["SOPInstanceUID"], _ = elem.GetString()
+	}
+	var err error
+	switch {
+	case d.simulated:
+		fields["Simulated"] = true
+	case d.su == nil:
+		err = fmt.Errorf("No association with %s", d.aeTitle)
+	default:
+		fields["Address"] = d.addr
+		err = d.su.CStore(ds)
+	}
+	level := logrus.InfoLevel
+	if err != nil {
+		level = logrus.WarnLevel
+		fields["Error"] = err.Error()
+	}
+	d.cs.disp.events.emit(level, EventCMove, d.cs.cm.label, "C-MOVE sub-operation", fields)
+	return err == nil
+}
+
+func (d *moveDestination) release() {
+	if d.su != nil {
+		d.su.Release()
+	}
+}
+
 func handleCGet(
 	params ServiceProviderParams,
 	connState ConnectionState,
@@ -226,6 +394,20 @@ func handleCGet(
 		sendError(err)
 		return
 	}
+	query := emitQuery(cs, "C-GET", elems)
+	if cs.fakeStatus != nil {
+		cs.sendMessage(&dimse.CGetRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    *cs.fakeStatus,
+		}, nil)
+		emitWithQuery(cs, logrus.InfoLevel, EventCGet, "Received", query, map[string]interface{}{
+			"Command": "C-GET",
+			"Files":   0,
+		})
+		return
+	}
 
 	var sessionID string
 	sessionID = cs.cm.label
@@ -236,6 +418,10 @@ func handleCGet(
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	var numSuccesses, numFailures uint16
 	for resp := range responseCh {
+		if cancelRequested(cs, "C-GET", int(numSuccesses+numFailures)) {
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -243,6 +429,7 @@ func handleCGet(
 			}
 			break
 		}
+		time.Sleep(params.SubOperationDelay.duration())
 		subCs, err := cs.disp.newCommand(cs.cm, cs.context /*not used*/)
 		if err != nil {
 			status = dimse.Status{
@@ -253,11 +440,19 @@ func handleCGet(
 		}
 
 		err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		fields := map[string]interface{}{}
+		if elem, err := resp.DataSet.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID); err == nil {
+			fields["SOPInstanceUID"], _ = elem.GetString()
+		}
+		level := logrus.InfoLevel
 		if err != nil {
 			numFailures++
+			level = logrus.WarnLevel
+			fields["Error"] = err.Error()
 		} else {
 			numSuccesses++
 		}
+		cs.disp.events.emit(level, EventCGet, cs.cm.label, "C-GET sub-operation", fields)
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
@@ -277,11 +472,10 @@ func handleCGet(
 		NumberOfFailedSuboperations:    numFailures,
 		Status:                         status}, nil)
 
-	logrus.WithFields(logrus.Fields{
+	emitWithQuery(cs, logrus.InfoLevel, EventCGet, "Received", query, map[string]interface{}{
 		"Command": "C-GET",
 		"Files":   numSuccesses,
-		"ID":      cs.cm.label,
-	}).Info("Received")
+	})
 
 	// Drain the responses in case of errors
 	for range responseCh {
@@ -298,20 +492,228 @@ func handleCEcho(
 	if params.CEcho != nil {
 		status = params.CEcho(connState)
 	}
+	if cs.fakeStatus != nil {
+		status = *cs.fakeStatus
+	}
 	resp := &dimse.CEchoRsp{
 		MessageIDBeingRespondedTo: c.MessageID,
 		CommandDataSetType:        dimse.CommandDataSetTypeNull,
 		Status:                    status,
 	}
 
-	logrus.WithFields(logrus.Fields{
+	cs.disp.events.emit(logrus.InfoLevel, EventCEcho, cs.cm.label, "Received", map[string]interface{}{
 		"Command": "C-ECHO",
-		"ID":      cs.cm.label,
-	}).Info("Received")
+	})
 
 	cs.sendMessage(resp, nil)
 }
 
+func handleNCreate(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NCreateRq, data []byte,
+	cs *serviceCommandState) {
+	sendStatus := func(sopInstanceUID string, status dimse.Status) {
+		cs.sendMessage(&dimse.NCreateRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}, nil)
+	}
+	if params.NCreate == nil {
+		sendStatus(c.AffectedSOPInstanceUID, dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for N-CREATE"})
+		return
+	}
+	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	if err != nil {
+		sendStatus(c.AffectedSOPInstanceUID, dimse.Status{Status: dimse.StatusInvalidArgumentValue, ErrorComment: err.Error()})
+		return
+	}
+	sopInstanceUID, status := c.AffectedSOPInstanceUID, dimse.Status{}
+	var reply []*dicom.Element
+	if cs.fakeStatus != nil {
+		status = *cs.fakeStatus
+	} else {
+		sopInstanceUID, reply, status = params.NCreate(connState, c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, elems, cs.cm.label)
+	}
+	sendReply(cs, &dimse.NCreateRsp{
+		AffectedSOPClassUID:       c.AffectedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    sopInstanceUID,
+		Status:                    status,
+	}, reply)
+
+	cs.disp.events.emit(logrus.WarnLevel, EventNCreate, cs.cm.label, "Received", map[string]interface{}{
+		"Command":        "N-CREATE",
+		"SOPClassUID":    c.AffectedSOPClassUID,
+		"SOPInstanceUID": sopInstanceUID,
+		"Attributes":     attributeFields(elems),
+		"Status":         status.Status.String(),
+	})
+}
+
+func handleNSet(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NSetRq, data []byte,
+	cs *serviceCommandState) {
+	sendStatus := func(status dimse.Status) {
+		cs.sendMessage(&dimse.NSetRsp{
+			AffectedSOPClassUID:       c.RequestedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+			Status:                    status,
+		}, nil)
+	}
+	if params.NSet == nil {
+		sendStatus(dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for N-SET"})
+		return
+	}
+	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	if err != nil {
+		sendStatus(dimse.Status{Status: dimse.StatusInvalidArgumentValue, ErrorComment: err.Error()})
+		return
+	}
+	var status dimse.Status
+	if cs.fakeStatus != nil {
+		status = *cs.fakeStatus
+	} else {
+		status = params.NSet(connState, c.RequestedSOPClassUID, c.RequestedSOPInstanceUID, elems, cs.cm.label)
+	}
+	sendStatus(status)
+
+	cs.disp.events.emit(logrus.WarnLevel, EventNSet, cs.cm.label, "Received", map[string]interface{}{
+		"Command":        "N-SET",
+		"SOPClassUID":    c.RequestedSOPClassUID,
+		"SOPInstanceUID": c.RequestedSOPInstanceUID,
+		"Attributes":     attributeFields(elems),
+		"Status":         status.Status.String(),
+	})
+}
+
+// sendReply sends "resp", an N-* response, with "reply" as its data set, if
+// any. If "reply" can't be encoded, it is left out.
+func sendReply(cs *serviceCommandState, resp dimse.Message, reply []*dicom.Element) {
+	var data []byte
+	if len(reply) > 0 {
+		var err error
+		if data, err = writeElementsToBytes(reply, cs.context.transferSyntaxUID); err != nil {
+			data = nil
+		}
+	}
+	if data != nil {
+		switch r := resp.(type) {
+		case *dimse.NCreateRsp:
+			r.CommandDataSetType = dimse.CommandDataSetTypeNonNull
+		case *dimse.NActionRsp:
+			r.CommandDataSetType = dimse.CommandDataSetTypeNonNull
+		case *dimse.NGetRsp:
+			r.CommandDataSetType = dimse.CommandDataSetTypeNonNull
+		}
+	}
+	cs.sendMessage(resp, data)
+}
+
+func handleNGet(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NGetRq, data []byte,
+	cs *serviceCommandState) {
+	var tags []dicomtag.Tag
+	for _, elem := range c.Extra {
+		if elem.Tag != dicomtag.AttributeIdentifierList {
+			continue
+		}
+		for _, v := range elem.Value {
+			if tag, ok := v.(dicomtag.Tag); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for N-GET"}
+	var reply []*dicom.Element
+	switch {
+	case cs.fakeStatus != nil:
+		status = *cs.fakeStatus
+	case params.NGet != nil:
+		reply, status = params.NGet(connState, c.RequestedSOPClassUID, c.RequestedSOPInstanceUID, tags, cs.cm.label)
+	}
+	sendReply(cs, &dimse.NGetRsp{
+		AffectedSOPClassUID:       c.RequestedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+		Status:                    status,
+	}, reply)
+
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.String())
+	}
+	cs.disp.events.emit(logrus.WarnLevel, EventNGet, cs.cm.label, "Received", map[string]interface{}{
+		"Command":        "N-GET",
+		"SOPClassUID":    c.RequestedSOPClassUID,
+		"SOPInstanceUID": c.RequestedSOPInstanceUID,
+		"Attributes":     names,
+		"Status":         status.Status.String(),
+	})
+}
+
+func handleNDelete(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NDeleteRq, data []byte,
+	cs *serviceCommandState) {
+	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for N-DELETE"}
+	switch {
+	case cs.fakeStatus != nil:
+		status = *cs.fakeStatus
+	case params.NDelete != nil:
+		status = params.NDelete(connState, c.RequestedSOPClassUID, c.RequestedSOPInstanceUID, cs.cm.label)
+	}
+	cs.sendMessage(&dimse.NDeleteRsp{
+		AffectedSOPClassUID:       c.RequestedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+		Status:                    status,
+	}, nil)
+
+	cs.disp.events.emit(logrus.WarnLevel, EventNDelete, cs.cm.label, "Received", map[string]interface{}{
+		"Command":        "N-DELETE",
+		"SOPClassUID":    c.RequestedSOPClassUID,
+		"SOPInstanceUID": c.RequestedSOPInstanceUID,
+		"Status":         status.Status.String(),
+	})
+}
+
+// cancelRequested checks, without blocking, whether the peer sent C-CANCEL
+// for the command. C-CANCEL carries the ID of the message it cancels, so the
+// dispatcher routes it to cs.upcallCh. "sent" is the number of responses or
+// sub-operations completed so far, for the log.
+func cancelRequested(cs *serviceCommandState, command string, sent int) bool {
+	select {
+	case event, ok := <-cs.upcallCh:
+		if !ok {
+			return false
+		}
+		if _, ok := event.command.(*dimse.CCancelRq); !ok {
+			return false
+		}
+		cs.disp.events.emit(logrus.WarnLevel, EventCCancel, cs.cm.label, "C-CANCEL received", map[string]interface{}{
+			"Command": command,
+			"Sent":    sent,
+		})
+		return true
+	default:
+		return false
+	}
+}
+
 // ServiceProviderParams defines parameters for ServiceProvider.
 type ServiceProviderParams struct {
 	// The application-entity title of the server. Must be nonempty
@@ -320,10 +722,21 @@ type ServiceProviderParams struct {
 	// Enforce AETitle, default accept any
 	Enforce string
 
+	// CallingAE decides, based on the calling AE title, whether to accept an
+	// association request. If nil, every calling AE is accepted.
+	CallingAE CallingAECallback
+
+	// Reject configures when association requests are rejected outright.
+	Reject RejectPolicy
+
 	// Names of remote AEs and their host:ports. Used only by C-MOVE. This
 	// map should be nonempty iff the server supports CMove.
 	RemoteAEs map[string]string
 
+	// If set, a C-MOVE to an AE missing from RemoteAEs pretends to succeed
+	// instead of failing with "Move Destination Unknown".
+	SimulateCMove bool
+
 	// Called on C_ECHO request. If nil, a C-ECHO call will produce an error response.
 	CEcho CEchoCallback
 
@@ -342,18 +755,144 @@ type ServiceProviderParams struct {
 
 	// If CStoreCallback=nil, a C-STORE call will produce an error response.
 	CStore CStoreCallback
-	
+
+	// StorageCommitment is called on Storage Commitment Push Model N-ACTION
+	// requests. If nil, N-ACTION produces an error response.
+	StorageCommitment StorageCommitmentCallback
+
+	// NCreate, NSet, NGet and NDelete are called on N-CREATE, N-SET,
+	// N-GET and N-DELETE requests, e.g., Modality Performed Procedure Step
+	// or Print Management, and NAction on N-ACTION requests other than
+	// Storage Commitment. If nil, the request produces an error response.
+	NCreate NCreateCallback
+	NSet    NSetCallback
+	NGet    NGetCallback
+	NDelete NDeleteCallback
+	NAction NActionCallback
+
+	// TransferSyntaxes lists, for each SOP class UID, the transfer syntaxes
+	// accepted, most preferred first. The "" entry applies to the SOP
+	// classes not listed. A presentation context proposing none of them is
+	// rejected. If nil, the first transfer syntax proposed is accepted.
+	TransferSyntaxes map[string][]string
+
+	// MaxPDUSize is the maximum PDU length advertised. If 0,
+	// DefaultMaxPDUSize.
+	MaxPDUSize int
+
+	// AsyncOperationsWindow is sent back to a peer that proposes an
+	// asynchronous operations window. If nil, none is sent, which means the
+	// default of one operation at a time. Operations are still handled one
+	// at a time whatever the window says.
+	AsyncOperationsWindow *pdu.AsynchronousOperationsWindowSubItem
+
+	// ImplementationClassUID and ImplementationVersionName identify the
+	// provider in the A-ASSOCIATE-AC, e.g., to pass for another toolkit.
+	// If ImplementationClassUID is empty, go-dicom's values are sent.
+	ImplementationClassUID    string
+	ImplementationVersionName string
+
+	// RefusedCStoreStatus is the status of C-STORE responses when CStore is
+	// nil. If 0, StatusUnrecognizedOperation.
+	RefusedCStoreStatus dimse.StatusCode
+
+	// ResponseDelay is how long the provider waits before sending each DIMSE
+	// response, to mimic the timing of a real archive.
+	ResponseDelay time.Duration
+
+	// CommandDelays is how long the provider takes to start on each kind of
+	// request, by command field, e.g., dimse.CommandFieldCFindRq.
+	CommandDelays map[int]Delay
+
+	// SubOperationDelay is how long each image of a C-MOVE or C-GET takes.
+	SubOperationDelay Delay
+
+	// FakeStatuses are the failures each kind of request meets, by command
+	// field, e.g., dimse.CommandFieldCStoreRq. The callbacks of a failed
+	// C-FIND, C-MOVE, C-GET, N-ACTION, N-CREATE or N-SET are not called; a
+	// failed C-STORE is still passed to CStore, and so kept.
+	FakeStatuses map[int][]FakeStatus
+
+	// If set, connections from the sources it matches are slowed down and
+	// held open. It may be shared by several providers, which then share
+	// its MaxConns.
+	Tarpit *Tarpit
+
+	// If set, connections from the sources it returns true for are closed
+	// as soon as they are logged.
+	Banned func(ip string) bool
+
+	// If set, the TCP payloads of every connection are recorded in a pcap
+	// file named after its session ID. TLS connections are recorded as
+	// they go over the wire, encrypted.
+	Capture *Capture
+
+	// If set, the DIMSE messages of every association are recorded in a
+	// transcript named after its session ID, which can be replayed.
+	Transcripts *Transcripts
+
+	// If set, connections are TLS: the handshake runs right after the TCP
+	// connection is accepted, and the ClientHello and client certificates
+	// are logged. Set ClientAuth to tls.RequestClientCert to receive the
+	// client certificates without verifying them.
 	TLSConfig *tls.Config
+
+	// If set, connections accepted by Run start with a PROXY protocol
+	// header, and are logged with the client address it carries. Only
+	// connections from ProxyTrusted, the networks of the proxies, are
+	// accepted.
+	ProxyProtocol bool
+	ProxyTrusted  []*net.IPNet
+
+	// Sink receives the events observed on every connection. If nil, events
+	// are written to the logrus standard logger.
+	Sink EventSink
+}
+
+// Delay is a wait of random length, between Min and Max, so that the timing
+// of responses varies like a loaded server's would.
+type Delay struct {
+	Min, Max time.Duration
+}
+
+func (d Delay) duration() time.Duration {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + time.Duration(rand.Int63n(int64(d.Max-d.Min)+1))
+}
+
+// FakeStatus is a failure a request meets, now and then, as it would on a
+// flaky archive.
+type FakeStatus struct {
+	Status dimse.Status
+	// Between 0 and 1.
+	Probability float64
+}
+
+// drawFakeStatus returns the status a request fails with, or nil if it
+// doesn't. The first of "statuses" drawn wins.
+func drawFakeStatus(statuses []FakeStatus) *dimse.Status {
+	for _, f := range statuses {
+		if rand.Float64() < f.Probability {
+			status := f.Status
+			return &status
+		}
+	}
+	return nil
 }
 
 // DefaultMaxPDUSize is the the PDU size advertized.
 const DefaultMaxPDUSize = 4 << 20
 
+// CStoreCallback implements a C-STORE handler. "data" is the dataset encoded
+// in transferSyntaxUID, without the file meta header.
 type CStoreCallback func(
 	conn ConnectionState,
 	transferSyntaxUID string,
 	sopClassUID string,
 	sopInstanceUID string,
+	sessionID string,
 	data []byte) dimse.Status
 
 // CFindCallback implements a C-FIND handler
@@ -374,11 +913,123 @@ type CMoveCallback func(
 	sessionID string,
 	ch chan CMoveResult)
 
+// NCreateCallback implements an N-CREATE handler. sopInstanceUID is empty if
+// the requester left it to the provider to assign one. It returns the UID of
+// the created instance, and the attributes sent back with the response, if
+// any, e.g., the Referenced Image Box Sequence of a Basic Film Box.
+type NCreateCallback func(
+	conn ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string,
+	attrs []*dicom.Element,
+	sessionID string) (string, []*dicom.Element, dimse.Status)
+
+// NSetCallback implements an N-SET handler.
+type NSetCallback func(
+	conn ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string,
+	attrs []*dicom.Element,
+	sessionID string) dimse.Status
+
+// NActionCallback implements an N-ACTION handler for the SOP classes other
+// than Storage Commitment, e.g., printing a Basic Film Session. It returns
+// the reply attributes, if any.
+type NActionCallback func(
+	conn ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string,
+	actionTypeID uint16,
+	attrs []*dicom.Element,
+	sessionID string) ([]*dicom.Element, dimse.Status)
+
+// NGetCallback implements an N-GET handler. "tags" lists the attributes
+// asked for. If empty, all of them are.
+type NGetCallback func(
+	conn ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string,
+	tags []dicomtag.Tag,
+	sessionID string) ([]*dicom.Element, dimse.Status)
+
+// NDeleteCallback implements an N-DELETE handler.
+type NDeleteCallback func(
+	conn ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string,
+	sessionID string) dimse.Status
+
 // ConnectionState informs session state to callbacks.
 type ConnectionState struct {
+	// IP address of the peer, as logged with the connection.
+	IP string
+
 	TLS tls.ConnectionState
+
+	// SOP Class Extended Negotiation accepted for the association, keyed
+	// by SOP class UID.
+	ExtendedNegotiation map[string][]byte
+}
+
+// Relational reports whether relational queries (C-FIND) or retrievals
+// (C-MOVE, C-GET) were negotiated for the SOP class. P3.4, C.5.
+func (c ConnectionState) Relational(sopClassUID string) bool {
+	info := c.ExtendedNegotiation[sopClassUID]
+	return len(info) > 0 && info[0] == 1
+}
+
+// RejectPolicy lists the conditions under which an association request is
+// answered with A-ASSOCIATE-RJ, and the result, source and reason sent for
+// each. A nil rule disables the condition. The proposed association is logged
+// in full before it is rejected.
+type RejectPolicy struct {
+	// Sent when Enforce is set and the called AE title isn't AETitle. If
+	// nil, "rejected-permanent, ACSE, protocol version not supported" is
+	// sent.
+	CalledAE *pdu.AAssociateRj
+
+	// Sent when none of the proposed abstract syntaxes is in SOPClasses.
+	UnsupportedSOPClass *pdu.AAssociateRj
+	SOPClasses          []string
+
+	// Sent when more than MaxContexts presentation contexts are proposed.
+	TooManyContexts *pdu.AAssociateRj
+	MaxContexts     int
 }
 
+// AEDecision is the fate of an association request.
+type AEDecision int
+
+const (
+	// AEAccept processes the request as usual.
+	AEAccept AEDecision = iota
+	// AEReject answers with A-ASSOCIATE-RJ, "calling AE title not
+	// recognized".
+	AEReject
+	// AETarpit never answers, and holds the connection open until the peer
+	// gives up.
+	AETarpit
+)
+
+func (d AEDecision) String() string {
+	switch d {
+	case AEAccept:
+		return "accept"
+	case AEReject:
+		return "reject"
+	case AETarpit:
+		return "tarpit"
+	}
+	return fmt.Sprintf("AEDecision(%d)", int(d))
+}
+
+// CallingAECallback decides the fate of an association request from
+// "callingAETitle". The title has its padding removed.
+type CallingAECallback func(callingAETitle string) AEDecision
+
+// How long a tarpitted connection is held open.
+const tarpitTimeout = 5 * time.Minute
+
 // CEchoCallback implements C-ECHO callback.
 type CEchoCallback func(conn ConnectionState) dimse.Status
 
@@ -403,35 +1054,113 @@ func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]b
 
 func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
 	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID)
-	var elems []*dicom.Element
-	for !decoder.EOF() {
-		elem := dicom.ReadElement(decoder, dicom.ReadOptions{})
-		if decoder.Error() != nil {
-			break
+	elems := readElements(decoder, dicom.ReadOptions{})
+	if decoder.Error() != nil {
+		return nil, decoder.Error()
+	}
+	return elems, nil
+}
+
+// queryElements converts a C-{FIND,MOVE,GET} identifier into the elements
+// of Event.Query.
+func queryElements(elems []*dicom.Element) []QueryElement {
+	var query []QueryElement
+	for _, elem := range elems {
+		qe := QueryElement{Tag: elem.Tag.String(), VR: elem.VR}
+		if info, err := dicomtag.Find(elem.Tag); err == nil {
+			qe.Keyword = info.Name
+		}
+		for _, v := range elem.Value {
+			switch v := v.(type) {
+			case *dicom.Element:
+				var sub []*dicom.Element
+				for _, iv := range v.Value {
+					if e, ok := iv.(*dicom.Element); ok {
+						sub = append(sub, e)
+					}
+				}
+				qe.Items = append(qe.Items, queryElements(sub))
+			case []byte:
+				qe.Values = append(qe.Values, fmt.Sprintf("<%d bytes>", len(v)))
+			default:
+				qe.Values = append(qe.Values, fmt.Sprint(v))
+			}
 		}
+		query = append(query, qe)
+	}
+	return query
+}
 
-		re := regexp.MustCompile(`\[([^\[\]]*)\]`)
-		searchTerm := re.FindAllString(elem.String(), -1)
+// emitQuery reports the non-trivial search terms of the identifier of a
+// "command", and returns the whole identifier, for the events that follow.
+func emitQuery(cs *serviceCommandState, command string, elems []*dicom.Element) []QueryElement {
+	query := queryElements(elems)
+	for _, qe := range query {
+		term := strings.Join(qe.Values, "\\")
+		if term == "" || term == "ISO_IR 100" || term == "STUDY" {
+			continue
+		}
+		name := qe.Keyword
+		if name == "" {
+			name = qe.Tag
+		}
+		event := NewEvent(logrus.InfoLevel, EventCFindQuery, cs.cm.label, "C-FIND Search", map[string]interface{}{
+			"Type": name,
+			"Term": term,
+		})
+		event.Command = command
+		event.Query = []QueryElement{qe}
+		cs.disp.events.record(event)
+	}
+	return query
+}
 
-		searchTerm[0] = strings.Trim(searchTerm[0], "[")
-		searchTerm[0] = strings.Trim(searchTerm[0], "]")
-		searchTerm[1] = strings.Trim(searchTerm[1], "[")
-		searchTerm[1] = strings.Trim(searchTerm[1], "]")
+// emitWithQuery emits an event about a command, with its identifier.
+func emitWithQuery(cs *serviceCommandState, level logrus.Level, eventType string, message string, query []QueryElement, fields map[string]interface{}) {
+	event := NewEvent(level, eventType, cs.cm.label, message, fields)
+	event.Query = query
+	cs.disp.events.record(event)
+}
 
-		if searchTerm[1] != "" && searchTerm[1] != "ISO_IR 100" && searchTerm[1] != "STUDY" {
-			logrus.WithFields(logrus.Fields{
-				"Type": searchTerm[0],
-				"Term": searchTerm[1],
-				"ID":   attackID,
-			}).Info("C-FIND Search")
+// attributeFields converts a dataset into event fields keyed by attribute
+// name. Multiple values are joined with a backslash, as on the wire, and
+// sequences become lists of nested field maps.
+func attributeFields(elems []*dicom.Element) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for _, elem := range elems {
+		name := elem.Tag.String()
+		if info, err := dicomtag.Find(elem.Tag); err == nil {
+			name = info.Name
 		}
-
-		elems = append(elems, elem)
-	}
-	if decoder.Error() != nil {
-		return nil, decoder.Error()
+		if elem.VR == "SQ" {
+			var items []map[string]interface{}
+			for _, v := range elem.Value {
+				item, ok := v.(*dicom.Element)
+				if !ok {
+					continue
+				}
+				var sub []*dicom.Element
+				for _, iv := range item.Value {
+					if e, ok := iv.(*dicom.Element); ok {
+						sub = append(sub, e)
+					}
+				}
+				items = append(items, attributeFields(sub))
+			}
+			fields[name] = items
+			continue
+		}
+		var values []string
+		for _, v := range elem.Value {
+			if b, ok := v.([]byte); ok {
+				values = append(values, fmt.Sprintf("<%d bytes>", len(b)))
+				continue
+			}
+			values = append(values, fmt.Sprint(v))
+		}
+		fields[name] = strings.Join(values, "\\")
 	}
-	return elems, nil
+	return fields
 }
 
 func elementsString(elems []*dicom.Element) string {
@@ -449,7 +1178,7 @@ func elementsString(elems []*dicom.Element) string {
 func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProvider, error) {
 	sp := &ServiceProvider{
 		params: params,
-		label:  newUID(),
+		label:  NewSessionID(),
 	}
 
 	var err error
@@ -458,15 +1187,21 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	if err != nil {
 		return nil, err
 	}
+	if params.ProxyProtocol {
+		sp.listener = NewProxyProtocolListener(sp.listener, params.ProxyTrusted)
+	}
 	return sp, nil
 }
 
-func getConnState(conn net.Conn) (cs ConnectionState) {
+func getConnState(conn net.Conn, cm *contextManager) (cs ConnectionState) {
+	cs.IP, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		cs.TLS = tlsConn.ConnectionState()
+	}
+	cs.ExtendedNegotiation = cm.extendedNegotiation
 	return
 }
 
-var attackID string
-
 // RunProviderForConn starts threads for running a DICOM server on "conn".
 func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
 
@@ -475,50 +1210,110 @@ func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
 
 	upcallCh := make(chan upcallEvent, 128)
 
-	label := newUID()
-	disp := newServiceDispatcher(label)
-
-	attackID = label
-
-	RemoteAddress := conn.RemoteAddr()
-	IPPort := strings.Split(RemoteAddress.String(), ":")
-	logrus.WithFields(logrus.Fields{
-		"IP":   IPPort[0],
-		"Port": IPPort[1],
-		"ID":   label,
-	}).Warn("Connection from")
+	label := NewSessionID()
+	events := newEventEmitter(params.Sink)
+	disp := newServiceDispatcher(label, events)
+	disp.responseDelay = params.ResponseDelay
+	disp.commandDelays = params.CommandDelays
+	disp.fakeStatuses = params.FakeStatuses
+	disp.transcripts = params.Transcripts
+
+	OpenSession(label, conn.RemoteAddr(), conn.LocalAddr())
+	defer CloseSession(label)
+	IP, Port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	fields := map[string]interface{}{
+		"IP":   IP,
+		"Port": Port,
+		// Which of the listeners was hit.
+		"LocalAETitle": params.AETitle,
+	}
+	if _, localPort, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		fields["LocalPort"] = localPort
+	}
+	if proxy := proxyAddr(conn); proxy != nil {
+		fields["ProxyIP"] = proxy.String()
+	}
+	if err := proxyError(conn); err != nil {
+		fields["Error"] = err.Error()
+	}
+	banned := params.Banned != nil && params.Banned(IP)
+	if banned {
+		fields["Banned"] = true
+	}
+	events.emit(logrus.WarnLevel, EventConnectionOpened, label, "Connection from", fields)
+	counter := newCountingConn(conn)
+	if banned {
+		conn.Close()
+		events.emit(logrus.WarnLevel, EventConnectionClosed, label, "Connection", counter.closedFields())
+		return
+	}
+	conn = params.Capture.wrap(counter, events, label)
+	conn = params.Tarpit.wrap(conn, IP, events, label)
+	if params.TLSConfig != nil {
+		tlsConn, err := tlsServerHandshake(conn, params.TLSConfig, events, label)
+		if err != nil {
+			conn.Close()
+			events.emit(logrus.WarnLevel, EventConnectionClosed, label, "Connection", counter.closedFields())
+			return
+		}
+		conn = tlsConn
+	}
 
 	disp.registerCallback(dimse.CommandFieldCStoreRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCStore(params.CStore, getConnState(conn), msg.(*dimse.CStoreRq), data, cs)
+			handleCStore(params.CStore, params.RefusedCStoreStatus, getConnState(conn, cs.cm), msg.(*dimse.CStoreRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCFindRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCFind(params, getConnState(conn), msg.(*dimse.CFindRq), data, cs)
+			handleCFind(params, getConnState(conn, cs.cm), msg.(*dimse.CFindRq), data, cs)
 		})
 
 	disp.registerCallback(dimse.CommandFieldCMoveRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCMove(params, getConnState(conn), msg.(*dimse.CMoveRq), data, cs)
+			handleCMove(params, getConnState(conn, cs.cm), msg.(*dimse.CMoveRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCGetRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCGet(params, getConnState(conn), msg.(*dimse.CGetRq), data, cs)
+			handleCGet(params, getConnState(conn, cs.cm), msg.(*dimse.CGetRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCEchoRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCEcho(params, getConnState(conn), msg.(*dimse.CEchoRq), data, cs)
+			handleCEcho(params, getConnState(conn, cs.cm), msg.(*dimse.CEchoRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNActionRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNAction(params, getConnState(conn, cs.cm), msg.(*dimse.NActionRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNCreateRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNCreate(params, getConnState(conn, cs.cm), msg.(*dimse.NCreateRq), data, cs)
 		})
-	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label, clientAETitle, enforce)
+	disp.registerCallback(dimse.CommandFieldNSetRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNSet(params, getConnState(conn, cs.cm), msg.(*dimse.NSetRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNGetRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNGet(params, getConnState(conn, cs.cm), msg.(*dimse.NGetRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNDeleteRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNDelete(params, getConnState(conn, cs.cm), msg.(*dimse.NDeleteRq), data, cs)
+		})
+	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label, clientAETitle, enforce, params.CallingAE, params.Reject, negotiationParams{
+		transferSyntaxes: params.TransferSyntaxes,
+		maxPDUSize:       params.MaxPDUSize,
+		asyncWindow:      params.AsyncOperationsWindow,
+
+		implementationClassUID:    params.ImplementationClassUID,
+		implementationVersionName: params.ImplementationVersionName,
+	}, events)
 
 	for event := range upcallCh {
 		disp.handleEvent(event)
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"Status": "Finished",
-		"ID":     label,
-	}).Warn("Connection")
+	events.emit(logrus.WarnLevel, EventConnectionClosed, label, "Connection", counter.closedFields())
 	disp.close()
 }
 
@@ -94,11 +94,11 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 		return nil, err
 	}
 	mu := &sync.Mutex{}
-	label := newUID()
+	label := NewSessionID()
 	su := &ServiceUser{
 		label:    label,
 		upcallCh: make(chan upcallEvent, 128),
-		disp:     newServiceDispatcher(label),
+		disp:     newServiceDispatcher(label, nil),
 		mu:       mu,
 		cond:     sync.NewCond(mu),
 		status:   serviceUserInitial,
@@ -163,6 +163,36 @@ func (su *ServiceUser) SetConn(conn net.Conn) {
 	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
 }
 
+// CStore issues a C-STORE request to transfer "ds" to the remote peer. It
+// blocks until the operation finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
+	err := su.waitUntilReady()
+	if err != nil {
+		return err
+	}
+	doassert(su.cm != nil)
+	elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPClassUID)
+	if err != nil {
+		return err
+	}
+	sopClassUID, err := elem.GetString()
+	if err != nil {
+		return err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		return err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return err
+	}
+	defer su.disp.deleteCommand(cs)
+	return runCStoreOnAssociation(cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, ds)
+}
+
 // CEcho send a C-ECHO request to the remote AE and waits for a
 // response. Returns nil iff the remote AE responds ok.
 func (su *ServiceUser) CEcho() error {
@@ -0,0 +1,120 @@
+package dicompot
+
+// This file keeps track of the sessions in progress, so that every event
+// recorded about one, by the provider or by its callbacks, tells who the peer
+// is without having to repeat it in its fields.
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session is what is known of the peer of a session when an event is
+// recorded. The AE titles are known once the association is requested.
+type Session struct {
+	RemoteIP       string `json:"remoteIP,omitempty"`
+	RemotePort     int    `json:"remotePort,omitempty"`
+	LocalPort      int    `json:"localPort,omitempty"`
+	CallingAETitle string `json:"callingAETitle,omitempty"`
+	CalledAETitle  string `json:"calledAETitle,omitempty"`
+
+	opened time.Time
+}
+
+// SessionInfo is a session in progress, as listed by Sessions.
+type SessionInfo struct {
+	ID string
+	Session
+	Opened time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	// The sessions in progress, by ID.
+	sessions = map[string]*Session{}
+)
+
+// NewSessionID returns a random UUID (RFC 4122, version 4), which identifies
+// a session in every event about it.
+func NewSessionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func addrPort(addr net.Addr) (string, int) {
+	if addr == nil {
+		return "", 0
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", 0
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// OpenSession starts session "id" with the peer at "remote", connected to
+// "local". Until CloseSession, LookupSession returns what is known of it.
+// The provider does this for its associations; other services do it for
+// theirs.
+func OpenSession(id string, remote, local net.Addr) {
+	s := &Session{opened: time.Now()}
+	s.RemoteIP, s.RemotePort = addrPort(remote)
+	_, s.LocalPort = addrPort(local)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessions[id] = s
+}
+
+// setSessionAETitles records the AE titles of the association of session
+// "id".
+func setSessionAETitles(id, calling, called string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if s := sessions[id]; s != nil {
+		s.CallingAETitle = calling
+		s.CalledAETitle = called
+	}
+}
+
+// LookupSession returns what is known of session "id", or the zero Session
+// if it isn't in progress.
+func LookupSession(id string) Session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if s := sessions[id]; s != nil {
+		return *s
+	}
+	return Session{}
+}
+
+// CloseSession forgets session "id".
+func CloseSession(id string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, id)
+}
+
+// Sessions returns the sessions in progress, the oldest first.
+func Sessions() []SessionInfo {
+	sessionsMu.Lock()
+	list := make([]SessionInfo, 0, len(sessions))
+	for id, s := range sessions {
+		list = append(list, SessionInfo{ID: id, Session: *s, Opened: s.opened})
+	}
+	sessionsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Opened.Before(list[j].Opened)
+	})
+	return list
+}
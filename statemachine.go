@@ -4,6 +4,7 @@ package dicompot
 // http://dicom.nema.org/medical/dicom/current/output/pdf/part08.pdf
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
@@ -204,8 +205,13 @@ var actionAe5 = &stateAction{"AE-5", "Issue Transport connection response primit
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		startTimer(sm)
+		// Peers that ignore a smaller advertised limit are still heard.
+		maxPDUSize := DefaultMaxPDUSize
+		if n := sm.contextManager.negotiation.maxPDUSize; n > maxPDUSize {
+			maxPDUSize = n
+		}
 		go func(ch chan stateEvent, conn net.Conn) {
-			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.label)
+			networkReaderThread(ch, conn, maxPDUSize, sm.label)
 		}(sm.netCh, event.conn)
 		return sta02
 	}}
@@ -228,51 +234,102 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		stopTimer(sm)
 		v := event.pdu.(*pdu.AAssociate)
 
+		decision := AEAccept
+		if sm.callingAEPolicy != nil {
+			decision = sm.callingAEPolicy(strings.TrimSpace(v.CallingAETitle))
+		}
+		setSessionAETitles(sm.label, strings.TrimSpace(v.CallingAETitle), strings.TrimSpace(v.CalledAETitle))
+		fingerprint, fingerprintString := associationFingerprint(v)
+		sm.events.emit(logrus.InfoLevel, EventAssociationRequest, sm.label, "Association request", map[string]interface{}{
+			"CallingAETitle":    strings.TrimSpace(v.CallingAETitle),
+			"CalledAETitle":     strings.TrimSpace(v.CalledAETitle),
+			"Decision":          decision.String(),
+			"Fingerprint":       fingerprint,
+			"FingerprintString": fingerprintString,
+		})
+		switch decision {
+		case AEReject:
+			return rejectAssociation(sm, v, "calling-ae", &pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceUser,
+				Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+			})
+		case AETarpit:
+			// Say nothing, and keep the connection open until the peer
+			// gives up or the tarpit timer expires.
+			startTimerWithDuration(sm, tarpitTimeout)
+			return sta13
+		}
+
 		if sm.enforceStatus != "no" {
 			if strings.TrimSpace(v.CalledAETitle) != strings.TrimSpace(sm.clientAETitleStatus) {
-
-				logrus.WithFields(logrus.Fields{
-					"AETitle": strings.TrimSpace(v.CalledAETitle),
-					"ID":      sm.label,
-				}).Error("Connection")
 				// Sleep to prevent overload in case of an extended brutefoce attempt
 				time.Sleep(5 * time.Second)
 
-				rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
-				sendPDU(sm, &rj)
-				startTimer(sm)
-				return sta13
+				rj := sm.rejectPolicy.CalledAE
+				if rj == nil {
+					rj = &pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
+				}
+				return rejectAssociation(sm, v, "called-ae", rj)
 			} else {
 
-				logrus.WithFields(logrus.Fields{
+				sm.events.emit(logrus.InfoLevel, EventAssociationClient, sm.label, "Client", map[string]interface{}{
 					"AETitle": strings.TrimSpace(v.CalledAETitle),
-					"ID":      sm.label,
-				}).Info("Client")
-				logrus.WithFields(logrus.Fields{
+				})
+				sm.events.emit(logrus.InfoLevel, EventAssociationClient, sm.label, "Client", map[string]interface{}{
 					"Identifier": strings.TrimSpace(v.CallingAETitle),
-					"ID":         sm.label,
-				}).Info("Client")
+				})
 			}
 		}
 
-		if v.ProtocolVersion != 0x0001 {
-			rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
-
-			sendPDU(sm, &rj)
-			startTimer(sm)
+		contexts := extractPresentationContextItems(v.Items)
+		if rj := sm.rejectPolicy.TooManyContexts; rj != nil && sm.rejectPolicy.MaxContexts > 0 &&
+			len(contexts) > sm.rejectPolicy.MaxContexts {
+			return rejectAssociation(sm, v, "too-many-contexts", rj)
+		}
+		if rj := sm.rejectPolicy.UnsupportedSOPClass; rj != nil && !proposesSOPClass(contexts, sm.rejectPolicy.SOPClasses) {
+			return rejectAssociation(sm, v, "unsupported-sop-class", rj)
+		}
 
-			return sta13
+		if v.ProtocolVersion != 0x0001 {
+			return rejectAssociation(sm, v, "protocol-version", &pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2})
 		}
+		sm.contextManager.peerCallingAETitle = strings.TrimSpace(v.CallingAETitle)
+		sm.contextManager.peerCalledAETitle = strings.TrimSpace(v.CalledAETitle)
 		responses, err := sm.contextManager.onAssociateRequest(v.Items)
+		clientFields := map[string]interface{}{
+			"Version":                sm.contextManager.peerImplementationVersionName,
+			"ImplementationClassUID": sm.contextManager.peerImplementationClassUID,
+		}
+		if n := sm.contextManager.peerProposedMaxPDUSize; n != nil {
+			clientFields["MaxPDULength"] = *n
+		}
+		if w := sm.contextManager.peerAsyncWindow; w != nil {
+			clientFields["MaxOpsInvoked"] = w.MaxOpsInvoked
+			clientFields["MaxOpsPerformed"] = w.MaxOpsPerformed
+		}
+		sm.events.emit(logrus.InfoLevel, EventAssociationClient, sm.label, "Client", clientFields)
+		if id := sm.contextManager.peerUserIdentity; id != nil {
+			sm.events.emit(logrus.WarnLevel, EventUserIdentity, sm.label, "User identity", userIdentityFields(id))
+		}
+		if err == nil {
+			sm.events.emit(logrus.InfoLevel, EventContextNegotiation, sm.label, "Presentation contexts", contextNegotiationFields(v, responses))
+		}
+		for sopClassUID, info := range sm.contextManager.peerExtendedNegotiation {
+			sm.events.emit(logrus.InfoLevel, EventExtendedNegotiation, sm.label, "Extended negotiation", map[string]interface{}{
+				"SOPClassUID": sopClassUID,
+				"Proposed":    fmt.Sprintf("%x", info),
+				"Accepted":    fmt.Sprintf("%x", sm.contextManager.extendedNegotiation[sopClassUID]),
+			})
+		}
 		if err != nil {
-			sm.downcallCh <- stateEvent{
-				event: evt08,
-				pdu: &pdu.AAssociateRj{
-					Result: pdu.ResultRejectedPermanent,
-					Source: pdu.SourceULServiceProviderACSE,
-					Reason: 1,
-				},
+			rj := &pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceProviderACSE,
+				Reason: 1,
 			}
+			logRejection(sm, v, "presentation-contexts", rj)
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
 		} else {
 			doassert(len(responses) > 0)
 			doassert(v.CalledAETitle != "")
@@ -290,6 +347,199 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		}
 		return sta03
 	}}
+
+// proposesSOPClass reports whether any of the presentation contexts proposes
+// one of "sopClasses".
+func proposesSOPClass(contexts []*pdu.PresentationContextItem, sopClasses []string) bool {
+	for _, c := range contexts {
+		for _, item := range c.Items {
+			if as, ok := item.(*pdu.AbstractSyntaxSubItem); ok {
+				for _, uid := range sopClasses {
+					if as.Name == uid {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// proposedAssociationFields describes an A-ASSOCIATE-RQ for the log: the AE
+// titles, the presentation contexts, the peer's implementation, and the type
+// of the credentials it carries, logged as EventUserIdentity.
+func proposedAssociationFields(v *pdu.AAssociate) map[string]interface{} {
+	fields := map[string]interface{}{
+		"AETitle":        strings.TrimSpace(v.CalledAETitle),
+		"CallingAETitle": strings.TrimSpace(v.CallingAETitle),
+	}
+	var contexts []string
+	for _, item := range v.Items {
+		switch ri := item.(type) {
+		case *pdu.PresentationContextItem:
+			var abstractSyntax string
+			var transferSyntaxes []string
+			for _, subItem := range ri.Items {
+				switch c := subItem.(type) {
+				case *pdu.AbstractSyntaxSubItem:
+					abstractSyntax = c.Name
+				case *pdu.TransferSyntaxSubItem:
+					transferSyntaxes = append(transferSyntaxes, c.Name)
+				}
+			}
+			contexts = append(contexts, fmt.Sprintf("%d:%s[%s]", ri.ContextID, abstractSyntax, strings.Join(transferSyntaxes, ",")))
+		case *pdu.UserInformationItem:
+			for _, subItem := range ri.Items {
+				switch c := subItem.(type) {
+				case *pdu.UserInformationMaximumLengthItem:
+					fields["MaxPDULength"] = c.MaximumLengthReceived
+				case *pdu.ImplementationClassUIDSubItem:
+					fields["ImplementationClassUID"] = c.Name
+				case *pdu.ImplementationVersionNameSubItem:
+					fields["Version"] = c.Name
+				case *pdu.UserIdentitySubItem:
+					fields["UserIdentity"] = userIdentityFields(c)["Type"]
+				}
+			}
+		}
+	}
+	fields["Contexts"] = contexts
+	return fields
+}
+
+// contextNegotiationFields describes the outcome of the presentation context
+// negotiation: what was proposed, what was accepted, and the distinct
+// transfer syntaxes the peer proposed in order, which tell a lot about the
+// toolkit it runs.
+func contextNegotiationFields(v *pdu.AAssociate, responses []pdu.SubItem) map[string]interface{} {
+	var transferSyntaxes []string
+	seen := map[string]bool{}
+	for _, c := range extractPresentationContextItems(v.Items) {
+		for _, item := range c.Items {
+			if ts, ok := item.(*pdu.TransferSyntaxSubItem); ok && !seen[ts.Name] {
+				seen[ts.Name] = true
+				transferSyntaxes = append(transferSyntaxes, ts.Name)
+			}
+		}
+	}
+	var accepted, rejected []string
+	for _, c := range extractPresentationContextItems(responses) {
+		var ts string
+		if len(c.Items) > 0 {
+			ts = c.Items[0].(*pdu.TransferSyntaxSubItem).Name
+		}
+		if c.Result == pdu.PresentationContextAccepted {
+			accepted = append(accepted, fmt.Sprintf("%d:%s", c.ContextID, ts))
+		} else {
+			rejected = append(rejected, fmt.Sprintf("%d:%d", c.ContextID, c.Result))
+		}
+	}
+	return map[string]interface{}{
+		"Contexts":         proposedAssociationFields(v)["Contexts"],
+		"TransferSyntaxes": strings.Join(transferSyntaxes, ","),
+		"Accepted":         accepted,
+		"Rejected":         rejected,
+	}
+}
+
+// userIdentityFields describes the credentials in a User Identity sub-item.
+// Kerberos tickets are binary, so they are logged in base64.
+func userIdentityFields(id *pdu.UserIdentitySubItem) map[string]interface{} {
+	fields := map[string]interface{}{
+		"PositiveResponseRequested": id.PositiveResponseRequested,
+	}
+	switch id.Type {
+	case pdu.UserIdentityUsername:
+		fields["Type"] = "username"
+		fields["Username"] = string(id.PrimaryField)
+	case pdu.UserIdentityUsernamePasscode:
+		fields["Type"] = "username-passcode"
+		fields["Username"] = string(id.PrimaryField)
+		fields["Passcode"] = string(id.SecondaryField)
+	case pdu.UserIdentityKerberos:
+		fields["Type"] = "kerberos"
+		fields["Ticket"] = base64.StdEncoding.EncodeToString(id.PrimaryField)
+	case pdu.UserIdentitySAML:
+		fields["Type"] = "saml"
+		fields["Assertion"] = string(id.PrimaryField)
+	case pdu.UserIdentityJWT:
+		fields["Type"] = "jwt"
+		fields["Token"] = string(id.PrimaryField)
+	default:
+		fields["Type"] = fmt.Sprintf("unknown(%d)", id.Type)
+		fields["Primary"] = base64.StdEncoding.EncodeToString(id.PrimaryField)
+		fields["Secondary"] = base64.StdEncoding.EncodeToString(id.SecondaryField)
+	}
+	return fields
+}
+
+// rejectionFields describes A-ASSOCIATE-RJ "rj", "sent" or "received": the
+// codes, their names, and what they mean together.
+func rejectionFields(rj *pdu.AAssociateRj, direction string) map[string]interface{} {
+	return map[string]interface{}{
+		"Direction":   direction,
+		"Result":      rj.Result.String(),
+		"Source":      rj.Source.String(),
+		"Reason":      rj.Reason.String(),
+		"ResultCode":  int(rj.Result),
+		"SourceCode":  int(rj.Source),
+		"ReasonCode":  int(rj.Reason),
+		"Explanation": rj.Explanation(),
+	}
+}
+
+// abortFields describes A-ABORT "v", "sent" or "received", as
+// rejectionFields does A-ASSOCIATE-RJ.
+func abortFields(v *pdu.AAbort, direction string) map[string]interface{} {
+	return map[string]interface{}{
+		"Direction":   direction,
+		"Source":      v.SourceName(),
+		"Reason":      v.Reason.String(),
+		"SourceCode":  int(v.Source),
+		"ReasonCode":  int(v.Reason),
+		"Explanation": v.Explanation(),
+	}
+}
+
+// proposedUserIdentity returns the User Identity sub-item of an
+// A-ASSOCIATE-RQ, or nil.
+func proposedUserIdentity(v *pdu.AAssociate) *pdu.UserIdentitySubItem {
+	for _, item := range v.Items {
+		if ui, ok := item.(*pdu.UserInformationItem); ok {
+			for _, subItem := range ui.Items {
+				if id, ok := subItem.(*pdu.UserIdentitySubItem); ok {
+					return id
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// logRejection logs the proposed association in full, the credentials it
+// carries, unless already logged, and its rejection with "rj". "rule" names
+// the condition that triggered the rejection.
+func logRejection(sm *stateMachine, v *pdu.AAssociate, rule string, rj *pdu.AAssociateRj) {
+	if id := proposedUserIdentity(v); id != nil && sm.contextManager.peerUserIdentity == nil {
+		sm.events.emit(logrus.WarnLevel, EventUserIdentity, sm.label, "User identity", userIdentityFields(id))
+	}
+	fields := proposedAssociationFields(v)
+	for name, value := range rejectionFields(rj, "sent") {
+		fields[name] = value
+	}
+	fields["Rule"] = rule
+	sm.events.emit(logrus.ErrorLevel, EventAssociationRejected, sm.label, "Connection", fields)
+}
+
+// rejectAssociation logs the proposed association in full, then rejects it
+// with "rj". "rule" names the condition that triggered the rejection.
+func rejectAssociation(sm *stateMachine, v *pdu.AAssociate, rule string, rj *pdu.AAssociateRj) stateType {
+	logRejection(sm, v, rule, rj)
+	sendPDU(sm, rj)
+	startTimer(sm)
+	return sta13
+}
+
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 
@@ -473,7 +723,7 @@ var actionAa1 = &stateAction{"AA-1", "Send A-ABORT PDU (service-user source) and
 		if sm.currentState == sta02 {
 			diagnostic = pdu.AbortReasonUnexpectedPDU
 		}
-		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: diagnostic})
+		sendAbort(sm, &pdu.AAbort{Source: 0, Reason: diagnostic})
 		restartTimer(sm)
 		return sta13
 	}}
@@ -509,13 +759,13 @@ var actionAa6 = &stateAction{"AA-6", "Ignore PDU",
 
 var actionAa7 = &stateAction{"AA-7", "Send A-ABORT PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
-		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: 0})
+		sendAbort(sm, &pdu.AAbort{Source: 0, Reason: 0})
 		return sta13
 	}}
 
 var actionAa8 = &stateAction{"AA-8", "Send A-ABORT PDU (service-dul source), issue an A-P-ABORT indication and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
-		sendPDU(sm, &pdu.AAbort{Source: 2, Reason: 0})
+		sendAbort(sm, &pdu.AAbort{Source: 2, Reason: 0})
 		startTimer(sm)
 		return sta13
 	}}
@@ -748,6 +998,11 @@ type stateMachine struct {
 
 	clientAETitleStatus string
 	enforceStatus       string
+	callingAEPolicy     CallingAECallback
+	rejectPolicy        RejectPolicy
+
+	// events is set only for a provider-side statemachine.
+	events *eventEmitter
 
 	// userParams is set only for a client-side statemachine
 	userParams ServiceUserParams
@@ -807,11 +1062,21 @@ func sendPDU(sm *stateMachine, v pdu.PDU) {
 	}
 }
 
+// sendAbort logs A-ABORT "v", then sends it.
+func sendAbort(sm *stateMachine, v *pdu.AAbort) {
+	sm.events.emit(logrus.WarnLevel, EventAbort, sm.label, "Abort", abortFields(v, "sent"))
+	sendPDU(sm, v)
+}
+
 func startTimer(sm *stateMachine) {
+	startTimerWithDuration(sm, time.Duration(10)*time.Second)
+}
+
+func startTimerWithDuration(sm *stateMachine, d time.Duration) {
 	ch := make(chan stateEvent, 1)
 	sm.timerCh = ch
 	currentState := sm.currentState
-	time.AfterFunc(time.Duration(10)*time.Second,
+	time.AfterFunc(d,
 		func() {
 			ch <- stateEvent{event: evt18, debug: &stateEventDebugInfo{currentState}}
 			close(ch)
@@ -826,10 +1091,22 @@ func stopTimer(sm *stateMachine) {
 	sm.timerCh = make(chan stateEvent, 1)
 }
 
+// How long the bytes that come after the header of a PDU that can't be read
+// are waited for, to be logged with it.
+const malformedPDUReadTimeout = time.Second
+
 func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smName string) {
 	doassert(maxPDUSize > 16*1024)
 	for {
 		v, err := pdu.ReadPDU(conn, maxPDUSize)
+		if rerr, ok := err.(*pdu.ReadError); ok && len(rerr.Data) == 6 {
+			// Only the header was read: keep whatever came with it, e.g.,
+			// the rest of an HTTP request.
+			rest := make([]byte, pdu.MaxReadErrorData-len(rerr.Data))
+			conn.SetReadDeadline(time.Now().Add(malformedPDUReadTimeout))
+			n, _ := conn.Read(rest)
+			rerr.Data = append(rerr.Data, rest[:n]...)
+		}
 		if err != nil {
 			if err == io.EOF {
 				ch <- stateEvent{event: evt17, pdu: nil, err: nil}
@@ -914,8 +1191,43 @@ func findAction(currentState stateType, event *stateEvent, smName string) *state
 	return nil
 }
 
+// printableText returns "data" with the bytes that aren't printable ASCII as
+// dots, as hexdump -C shows them.
+func printableText(data []byte) string {
+	text := make([]byte, len(data))
+	for i, c := range data {
+		if c < 0x20 || c > 0x7e {
+			c = '.'
+		}
+		text[i] = c
+	}
+	return string(text)
+}
+
 func runOneStep(sm *stateMachine) {
 	event := getNextEvent(sm)
+	if rerr, ok := event.err.(*pdu.ReadError); ok && event.event == evt19 {
+		// Another protocol is mere noise, a length trick an attack.
+		level := logrus.ErrorLevel
+		if rerr.Reason == pdu.ReadErrorUnknownType || rerr.Reason == pdu.ReadErrorShortHeader {
+			level = logrus.WarnLevel
+		}
+		sm.events.emit(level, EventMalformedPDU, sm.label, "Malformed PDU", map[string]interface{}{
+			"PDUType": int(rerr.Type),
+			"Length":  int(rerr.Length),
+			"Reason":  rerr.Reason,
+			"Error":   rerr.Error(),
+			// Base64, as binary, and as text for a glance.
+			"Data":     base64.StdEncoding.EncodeToString(rerr.Data),
+			"DataText": printableText(rerr.Data),
+		})
+	}
+	switch event.event {
+	case evt16:
+		sm.events.emit(logrus.WarnLevel, EventAbort, sm.label, "Abort", abortFields(event.pdu.(*pdu.AAbort), "received"))
+	case evt04:
+		sm.events.emit(logrus.ErrorLevel, EventAssociationRejected, sm.label, "Connection", rejectionFields(event.pdu.(*pdu.AAssociateRj), "received"))
+	}
 	action := findAction(sm.currentState, &event, sm.label)
 
 	if action == nil {
@@ -959,10 +1271,17 @@ func runStateMachineForServiceProvider(
 	label string,
 	clientAETitle string,
 	enforce string,
+	callingAEPolicy CallingAECallback,
+	rejectPolicy RejectPolicy,
+	negotiation negotiationParams,
+	events *eventEmitter,
 ) {
 	sm := &stateMachine{
 		clientAETitleStatus: clientAETitle,
 		enforceStatus:       enforce,
+		callingAEPolicy:     callingAEPolicy,
+		rejectPolicy:        rejectPolicy,
+		events:              events,
 		label:               label,
 		isUser:              false,
 		contextManager:      newContextManager(label),
@@ -972,6 +1291,7 @@ func runStateMachineForServiceProvider(
 		downcallCh:          downcallCh,
 		upcallCh:            upcallCh,
 	}
+	sm.contextManager.negotiation = negotiation
 
 	event := stateEvent{event: evt05, conn: conn}
 	action := findAction(sta01, &event, sm.label)
@@ -980,4 +1300,6 @@ func runStateMachineForServiceProvider(
 	for sm.currentState != sta01 {
 		runOneStep(sm)
 	}
+	// If the peer hung up first, nothing closed our end.
+	conn.Close()
 }
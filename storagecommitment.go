@@ -0,0 +1,276 @@
+package dicompot
+
+// This file implements the SCP side of the Storage Commitment Push Model
+// (P3.4, Annex J): N-ACTION requests are acknowledged, and the result is
+// reported back with N-EVENT-REPORT over the same association.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	storageCommitmentSOPClassUID    = "1.2.840.10008.1.20.1"
+	storageCommitmentSOPInstanceUID = "1.2.840.10008.1.20.1.1"
+
+	// N-ACTION Action Type ID "Request Storage Commitment".
+	storageCommitmentActionRequest = 1
+	// N-EVENT-REPORT Event Type IDs. P3.4, J.3.3.
+	storageCommitmentEventSuccess  = 1
+	storageCommitmentEventFailures = 2
+
+	// How long to wait for the peer to answer N-EVENT-REPORT.
+	storageCommitmentReportTimeout = 30 * time.Second
+)
+
+// Failure reasons reported in FailedSOPSequence. P3.4, C.14.1.1.
+const (
+	CommitmentProcessingFailure       uint16 = 0x0110
+	CommitmentNoSuchObjectInstance    uint16 = 0x0112
+	CommitmentClassInstanceConflict   uint16 = 0x0119
+	CommitmentSOPClassNotSupported    uint16 = 0x0122
+	CommitmentDuplicateTransactionUID uint16 = 0x0131
+)
+
+// SOPReference identifies one SOP instance listed in a Storage Commitment
+// request.
+type SOPReference struct {
+	SOPClassUID    string
+	SOPInstanceUID string
+	// FailureReason is set by StorageCommitmentCallback for instances that
+	// could not be committed.
+	FailureReason uint16
+}
+
+// StorageCommitmentCallback implements a Storage Commitment Push Model
+// handler. It returns the references that could not be committed, with
+// FailureReason set; all other references are reported as committed.
+type StorageCommitmentCallback func(
+	conn ConnectionState,
+	transactionUID string,
+	refs []SOPReference,
+	sessionID string) []SOPReference
+
+func handleNAction(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NActionRq, data []byte,
+	cs *serviceCommandState) {
+	sendStatus := func(status dimse.Status) {
+		cs.sendMessage(&dimse.NActionRsp{
+			AffectedSOPClassUID:       c.RequestedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+			ActionTypeID:              c.ActionTypeID,
+			Status:                    status,
+		}, nil)
+	}
+
+	cs.disp.events.emit(logrus.InfoLevel, EventNAction, cs.cm.label, "Received", map[string]interface{}{
+		"Command":     "N-ACTION",
+		"SOPClassUID": c.RequestedSOPClassUID,
+	})
+	if c.RequestedSOPClassUID != storageCommitmentSOPClassUID {
+		handleOtherNAction(params.NAction, connState, c, data, cs)
+		return
+	}
+	cb := params.StorageCommitment
+	if cb == nil || c.ActionTypeID != storageCommitmentActionRequest {
+		sendStatus(dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for N-ACTION"})
+		return
+	}
+	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	if err != nil {
+		sendStatus(dimse.Status{Status: dimse.StatusInvalidArgumentValue, ErrorComment: err.Error()})
+		return
+	}
+	transactionUID, refs := parseStorageCommitmentRequest(elems)
+	if transactionUID == "" {
+		sendStatus(dimse.Status{Status: dimse.StatusInvalidArgumentValue, ErrorComment: "TransactionUID missing"})
+		return
+	}
+	if cs.fakeStatus != nil {
+		sendStatus(*cs.fakeStatus)
+		return
+	}
+	sendStatus(dimse.Success)
+
+	var instances []string
+	for _, ref := range refs {
+		instances = append(instances, ref.SOPInstanceUID)
+	}
+	cs.disp.events.emit(logrus.WarnLevel, EventStorageCommitment, cs.cm.label, "Storage Commitment request", map[string]interface{}{
+		"TransactionUID":  transactionUID,
+		"SOPInstanceUIDs": instances,
+		"Count":           len(refs),
+	})
+
+	failed := cb(connState, transactionUID, refs, cs.cm.label)
+	status, err := sendStorageCommitmentReport(cs, transactionUID, refs, failed)
+	fields := map[string]interface{}{
+		"TransactionUID": transactionUID,
+		"Committed":      len(refs) - len(failed),
+		"Failed":         len(failed),
+	}
+	if err != nil {
+		fields["Error"] = err.Error()
+	} else {
+		fields["Status"] = status.Status.String()
+	}
+	cs.disp.events.emit(logrus.InfoLevel, EventStorageCommitment, cs.cm.label, "N-EVENT-REPORT sent", fields)
+}
+
+// parseStorageCommitmentRequest extracts the TransactionUID and the
+// ReferencedSOPSequence from an N-ACTION dataset. Malformed items are
+// skipped.
+func parseStorageCommitmentRequest(elems []*dicom.Element) (string, []SOPReference) {
+	var transactionUID string
+	var refs []SOPReference
+	for _, elem := range elems {
+		switch elem.Tag {
+		case dicomtag.TransactionUID:
+			transactionUID, _ = elem.GetString()
+		case dicomtag.ReferencedSOPSequence:
+			for _, v := range elem.Value {
+				item, ok := v.(*dicom.Element)
+				if !ok {
+					continue
+				}
+				var ref SOPReference
+				for _, iv := range item.Value {
+					sub, ok := iv.(*dicom.Element)
+					if !ok {
+						continue
+					}
+					switch sub.Tag {
+					case dicomtag.ReferencedSOPClassUID:
+						ref.SOPClassUID, _ = sub.GetString()
+					case dicomtag.ReferencedSOPInstanceUID:
+						ref.SOPInstanceUID, _ = sub.GetString()
+					}
+				}
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return transactionUID, refs
+}
+
+// sendStorageCommitmentReport sends the N-EVENT-REPORT for a transaction and
+// waits for the peer's response.
+func sendStorageCommitmentReport(
+	cs *serviceCommandState,
+	transactionUID string,
+	refs []SOPReference,
+	failed []SOPReference) (dimse.Status, error) {
+	isFailed := map[string]bool{}
+	for _, ref := range failed {
+		isFailed[ref.SOPInstanceUID] = true
+	}
+	newItem := func(ref SOPReference) *dicom.Element {
+		values := []interface{}{
+			dicom.MustNewElement(dicomtag.ReferencedSOPClassUID, ref.SOPClassUID),
+			dicom.MustNewElement(dicomtag.ReferencedSOPInstanceUID, ref.SOPInstanceUID),
+		}
+		if ref.FailureReason != 0 {
+			values = append(values, dicom.MustNewElement(dicomtag.FailureReason, ref.FailureReason))
+		}
+		return dicom.MustNewElement(dicomtag.Item, values...)
+	}
+	var committedItems, failedItems []interface{}
+	for _, ref := range refs {
+		if !isFailed[ref.SOPInstanceUID] {
+			committedItems = append(committedItems, newItem(ref))
+		}
+	}
+	for _, ref := range failed {
+		if ref.FailureReason == 0 {
+			ref.FailureReason = CommitmentProcessingFailure
+		}
+		failedItems = append(failedItems, newItem(ref))
+	}
+	elems := []*dicom.Element{dicom.MustNewElement(dicomtag.TransactionUID, transactionUID)}
+	if len(committedItems) > 0 {
+		elems = append(elems, dicom.MustNewElement(dicomtag.ReferencedSOPSequence, committedItems...))
+	}
+	eventTypeID := uint16(storageCommitmentEventSuccess)
+	if len(failedItems) > 0 {
+		eventTypeID = storageCommitmentEventFailures
+		elems = append(elems, dicom.MustNewElement(dicomtag.FailedSOPSequence, failedItems...))
+	}
+	payload, err := writeElementsToBytes(elems, cs.context.transferSyntaxUID)
+	if err != nil {
+		return dimse.Status{}, err
+	}
+
+	subCs, err := cs.disp.newCommand(cs.cm, cs.context)
+	if err != nil {
+		return dimse.Status{}, err
+	}
+	defer cs.disp.deleteCommand(subCs)
+	subCs.sendMessage(&dimse.NEventReportRq{
+		AffectedSOPClassUID:    storageCommitmentSOPClassUID,
+		MessageID:              subCs.messageID,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: storageCommitmentSOPInstanceUID,
+		EventTypeID:            eventTypeID,
+	}, payload)
+
+	select {
+	case event, ok := <-subCs.upcallCh:
+		if !ok {
+			return dimse.Status{}, fmt.Errorf("dicom.storagecommitment(%s): Connection closed while waiting for N-EVENT-REPORT response", cs.cm.label)
+		}
+		resp, ok := event.command.(*dimse.NEventReportRsp)
+		if !ok {
+			return dimse.Status{}, fmt.Errorf("dicom.storagecommitment(%s): Unexpected response %v", cs.cm.label, event.command)
+		}
+		return resp.Status, nil
+	case <-time.After(storageCommitmentReportTimeout):
+		return dimse.Status{}, fmt.Errorf("dicom.storagecommitment(%s): Timed out waiting for N-EVENT-REPORT response", cs.cm.label)
+	}
+}
+
+// handleOtherNAction answers the N-ACTION requests of SOP classes other than
+// Storage Commitment.
+func handleOtherNAction(
+	cb NActionCallback,
+	connState ConnectionState,
+	c *dimse.NActionRq, data []byte,
+	cs *serviceCommandState) {
+	status := dimse.Status{Status: dimse.StatusSOPClassNotSupported}
+	var elems, reply []*dicom.Element
+	var err error
+	if len(data) > 0 {
+		elems, err = readElementsInBytes(data, cs.context.transferSyntaxUID)
+	}
+	switch {
+	case err != nil:
+		status = dimse.Status{Status: dimse.StatusInvalidArgumentValue, ErrorComment: err.Error()}
+	case cs.fakeStatus != nil:
+		status = *cs.fakeStatus
+	case cb != nil:
+		reply, status = cb(connState, c.RequestedSOPClassUID, c.RequestedSOPInstanceUID, c.ActionTypeID, elems, cs.cm.label)
+	}
+	sendReply(cs, &dimse.NActionRsp{
+		AffectedSOPClassUID:       c.RequestedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+		ActionTypeID:              c.ActionTypeID,
+		Status:                    status,
+	}, reply)
+	cs.disp.events.emit(logrus.WarnLevel, EventNAction, cs.cm.label, "N-ACTION request", map[string]interface{}{
+		"SOPClassUID":    c.RequestedSOPClassUID,
+		"SOPInstanceUID": c.RequestedSOPInstanceUID,
+		"ActionTypeID":   c.ActionTypeID,
+		"Attributes":     attributeFields(elems),
+		"Status":         status.Status.String(),
+	})
+}
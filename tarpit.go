@@ -0,0 +1,142 @@
+package dicompot
+
+// This file implements the tarpit for abusive sources. Their connections are
+// served as usual, so everything they do is still logged, but every PDU
+// trickles out a few bytes at a time, and the connection is held open after
+// the association ends, until the peer hangs up.
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tarpit slows down the connections of the sources it matches.
+type Tarpit struct {
+	// Match reports whether connections from "ip" are tarpitted.
+	Match func(ip string) bool
+
+	// Interval is how long to wait after writing each chunk of ChunkSize
+	// bytes. If ChunkSize is 0, a byte is written at a time.
+	Interval  time.Duration
+	ChunkSize int
+
+	// Hold is how long a tarpitted connection lasts, at most. After that,
+	// reads and writes fail, and the connection is closed. If 0, it lasts
+	// until the peer hangs up.
+	Hold time.Duration
+
+	// MaxConns is the most connections tarpitted at once. Matching
+	// connections beyond that are served at full speed. If 0, there is no
+	// limit.
+	MaxConns int
+
+	mu     sync.Mutex
+	active int
+}
+
+// acquire reserves a slot for a tarpitted connection.
+func (t *Tarpit) acquire() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.MaxConns > 0 && t.active >= t.MaxConns {
+		return false
+	}
+	t.active++
+	return true
+}
+
+func (t *Tarpit) release() {
+	t.mu.Lock()
+	t.active--
+	t.mu.Unlock()
+}
+
+// wrap returns "conn", from "ip", tarpitted if "t" matches it, and logs the
+// decision. A nil *Tarpit matches nothing.
+func (t *Tarpit) wrap(conn net.Conn, ip string, events *eventEmitter, label string) net.Conn {
+	if t == nil || t.Match == nil || !t.Match(ip) {
+		return conn
+	}
+	if !t.acquire() {
+		events.emit(logrus.WarnLevel, EventTarpit, label, "Tarpit full", map[string]interface{}{
+			"Status":   "Full",
+			"MaxConns": t.MaxConns,
+		})
+		return conn
+	}
+	events.emit(logrus.WarnLevel, EventTarpit, label, "Connection tarpitted", map[string]interface{}{
+		"Status":   "Tarpitted",
+		"Interval": t.Interval.String(),
+		"Hold":     t.Hold.String(),
+	})
+	c := &tarpitConn{
+		Conn:   conn,
+		tarpit: t,
+		events: events,
+		label:  label,
+		start:  time.Now(),
+	}
+	if t.Hold > 0 {
+		c.deadline = c.start.Add(t.Hold)
+		conn.SetDeadline(c.deadline)
+	}
+	return c
+}
+
+// tarpitConn is a connection in the tarpit.
+type tarpitConn struct {
+	net.Conn
+	tarpit *Tarpit
+	events *eventEmitter
+	label  string
+
+	start    time.Time
+	deadline time.Time
+	written  int64
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *tarpitConn) Write(b []byte) (int, error) {
+	chunk := c.tarpit.ChunkSize
+	if chunk <= 0 {
+		chunk = 1
+	}
+	n := 0
+	for n < len(b) {
+		end := n + chunk
+		if end > len(b) {
+			end = len(b)
+		}
+		m, err := c.Conn.Write(b[n:end])
+		n += m
+		c.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		time.Sleep(c.tarpit.Interval)
+	}
+	return n, nil
+}
+
+// Close holds the connection open until the peer hangs up or the hold
+// expires, whatever is sent in the meantime being discarded.
+func (c *tarpitConn) Close() error {
+	c.closeOnce.Do(func() {
+		io.Copy(ioutil.Discard, c.Conn)
+		c.closeErr = c.Conn.Close()
+		c.tarpit.release()
+		c.events.emit(logrus.WarnLevel, EventTarpit, c.label, "Tarpit released", map[string]interface{}{
+			"Status":       "Released",
+			"Duration":     time.Since(c.start).Round(time.Millisecond).String(),
+			"BytesWritten": c.written,
+		})
+	})
+	return c.closeErr
+}
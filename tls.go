@@ -0,0 +1,122 @@
+package dicompot
+
+// This file implements the TLS side of the provider: the handshake, and
+// what it tells about the peer.
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How long the peer has to complete the TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsServerHandshake runs the server side of the TLS handshake on "conn",
+// and logs the ClientHello, with its JA3 fingerprint and the JA3S of the
+// ServerHello, and any certificate the client presents. The ClientHello is
+// logged even if the handshake fails, since scanners often give up halfway.
+func tlsServerHandshake(conn net.Conn, config *tls.Config, events *eventEmitter, label string) (*tls.Conn, error) {
+	config = config.Clone()
+	var hello *tls.ClientHelloInfo
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		hello = info
+		if getConfigForClient != nil {
+			return getConfigForClient(info)
+		}
+		return nil, nil
+	}
+	recorder := &helloRecorder{Conn: conn}
+	tlsConn := tls.Server(recorder, config)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	in, out := recorder.stop()
+
+	fields := map[string]interface{}{}
+	if hello != nil {
+		fields["ServerName"] = hello.ServerName
+		fields["CipherSuites"] = cipherSuiteNames(hello.CipherSuites)
+		fields["SupportedVersions"] = tlsVersionNames(hello.SupportedVersions)
+		if len(hello.SupportedProtos) > 0 {
+			fields["ALPN"] = hello.SupportedProtos
+		}
+	}
+	if msg := handshakeMessage(in, 1); msg != nil {
+		if hash, s := ja3(msg); hash != "" {
+			fields["JA3"] = hash
+			fields["JA3String"] = s
+		}
+	}
+	if msg := handshakeMessage(out, 2); msg != nil {
+		if hash, s := ja3s(msg); hash != "" {
+			fields["JA3S"] = hash
+			fields["JA3SString"] = s
+		}
+	}
+	level := logrus.WarnLevel
+	if err != nil {
+		level = logrus.ErrorLevel
+		fields["Error"] = err.Error()
+	} else {
+		state := tlsConn.ConnectionState()
+		fields["Version"] = tlsVersionName(state.Version)
+		fields["CipherSuite"] = tls.CipherSuiteName(state.CipherSuite)
+		var certs []map[string]interface{}
+		for _, cert := range state.PeerCertificates {
+			certs = append(certs, map[string]interface{}{
+				"Subject":   cert.Subject.String(),
+				"Issuer":    cert.Issuer.String(),
+				"Serial":    cert.SerialNumber.String(),
+				"NotBefore": cert.NotBefore.UTC().Format(time.RFC3339),
+				"NotAfter":  cert.NotAfter.UTC().Format(time.RFC3339),
+				"SHA256":    fmt.Sprintf("%x", sha256.Sum256(cert.Raw)),
+			})
+		}
+		if len(certs) > 0 {
+			fields["ClientCertificates"] = certs
+		}
+	}
+	events.emit(level, EventTLSHandshake, label, "TLS handshake", fields)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func cipherSuiteNames(ids []uint16) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	return names
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionSSL30:
+		return "SSL 3.0"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func tlsVersionNames(versions []uint16) []string {
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = tlsVersionName(v)
+	}
+	return names
+}
@@ -0,0 +1,163 @@
+package dicompot
+
+// This file records the DIMSE messages of each association, as exchanged,
+// into a transcript named after the session ID. A transcript holds enough of
+// the association to be replayed against another provider.
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/pdu"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of TranscriptEntry.
+const (
+	TranscriptAssociation = "association"
+	TranscriptReceived    = "received"
+	TranscriptSent        = "sent"
+)
+
+// TranscriptEntry is a line of a transcript, in JSON. The first one
+// describes the association, and each of the others is a message.
+type TranscriptEntry struct {
+	Time time.Time `json:"time"`
+	// One of the Transcript* constants.
+	Type string `json:"type"`
+
+	// The association, as accepted.
+	CallingAETitle string              `json:"callingAETitle,omitempty"`
+	CalledAETitle  string              `json:"calledAETitle,omitempty"`
+	Contexts       []TranscriptContext `json:"contexts,omitempty"`
+
+	// The message. Command is for reading only; CommandSet and DataSet
+	// are what went over the wire, the data set in the transfer syntax
+	// of the context.
+	ContextID  byte   `json:"contextID,omitempty"`
+	Command    string `json:"command,omitempty"`
+	CommandSet []byte `json:"commandSet,omitempty"`
+	DataSet    []byte `json:"dataSet,omitempty"`
+}
+
+// TranscriptContext is a presentation context accepted for the association.
+type TranscriptContext struct {
+	ID             byte   `json:"id"`
+	AbstractSyntax string `json:"abstractSyntax"`
+	TransferSyntax string `json:"transferSyntax"`
+}
+
+// Transcripts records the associations of a provider.
+type Transcripts struct {
+	// Dir is where transcripts are written, as "<session ID>.ndjson".
+	Dir string
+}
+
+// open starts the transcript of session "label", whose association "cm"
+// describes. A nil *Transcripts records nothing. If the file can't be
+// created, the error is logged, and nil is returned.
+func (t *Transcripts) open(cm *contextManager, events *eventEmitter, label string) *transcript {
+	if t == nil {
+		return nil
+	}
+	path := filepath.Join(t.Dir, label+".ndjson")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		events.emit(logrus.ErrorLevel, EventTranscript, label, "Transcript failed", map[string]interface{}{
+			"Error": err.Error(),
+		})
+		return nil
+	}
+	tr := &transcript{events: events, label: label, path: path, file: f, w: bufio.NewWriter(f)}
+	tr.enc = json.NewEncoder(tr.w)
+	entry := TranscriptEntry{
+		Time:           time.Now(),
+		Type:           TranscriptAssociation,
+		CallingAETitle: cm.peerCallingAETitle,
+		CalledAETitle:  cm.peerCalledAETitle,
+	}
+	for id, e := range cm.contextIDToAbstractSyntaxNameMap {
+		if e.result != pdu.PresentationContextAccepted {
+			continue
+		}
+		entry.Contexts = append(entry.Contexts, TranscriptContext{
+			ID:             id,
+			AbstractSyntax: e.abstractSyntaxUID,
+			TransferSyntax: e.transferSyntaxUID,
+		})
+	}
+	sort.Slice(entry.Contexts, func(i, j int) bool {
+		return entry.Contexts[i].ID < entry.Contexts[j].ID
+	})
+	tr.enc.Encode(entry)
+	return tr
+}
+
+// transcript is the transcript of one association. Its methods may be called
+// concurrently, and on a nil *transcript, which records nothing.
+type transcript struct {
+	events *eventEmitter
+	label  string
+	path   string
+
+	mu       sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	enc      *json.Encoder
+	messages int
+	closed   bool
+}
+
+// record adds a message, of type TranscriptReceived or TranscriptSent.
+func (tr *transcript) record(entryType string, contextID byte, cmd dimse.Message, data []byte) {
+	if tr == nil {
+		return
+	}
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dimse.EncodeMessage(e, cmd)
+	commandSet := e.Bytes()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.closed {
+		return
+	}
+	tr.messages++
+	tr.enc.Encode(TranscriptEntry{
+		Time:       time.Now(),
+		Type:       entryType,
+		ContextID:  contextID,
+		Command:    cmd.String(),
+		CommandSet: commandSet,
+		DataSet:    data,
+	})
+}
+
+// close ends the transcript, and logs where it is. Messages sent later, by
+// commands still running, are dropped.
+func (tr *transcript) close() {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.closed {
+		return
+	}
+	tr.closed = true
+	fields := map[string]interface{}{
+		"Path":     tr.path,
+		"Messages": tr.messages,
+	}
+	if err := tr.w.Flush(); err != nil {
+		fields["Error"] = err.Error()
+	}
+	tr.file.Close()
+	tr.events.emit(logrus.InfoLevel, EventTranscript, tr.label, "Transcript saved", fields)
+}
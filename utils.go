@@ -2,18 +2,8 @@ package dicompot
 
 import (
 	"fmt"
-	"sync/atomic"
-	"time"
 )
 
-var idSeq int64
-
-func newUID() string {
-	now := time.Now()
-	idSeq = now.UnixNano()
-	return fmt.Sprintf("%d", atomic.AddInt64(&idSeq, 1))
-}
-
 func doassert(cond bool, values ...interface{}) {
 	if !cond {
 		var s string